@@ -0,0 +1,123 @@
+package tiff
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// DecodeAlpha reads a LogLuv, LogL or RGB image from r and returns its alpha, the associated or
+// unassociated alpha ExtraSample following the color of each pixel (e.g. a confidence channel).
+// The floating point alpha samples are clamped to [0, 1] and the integer ones scaled to 16 bits.
+// The hdr images have no alpha channel, Decode skips it.
+func DecodeAlpha(r io.Reader) (*image.Alpha16, error) {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	if d.mode != mLogLuv && d.mode != mLogL && (d.mode != mRGB || d.compression == cJPEGOld) {
+		return nil, UnsupportedError("alpha of an image other than LogLuv, LogL or RGB")
+	}
+	if err = d.checkBitsPerSample(); err != nil {
+		return nil, err
+	}
+	offset, ok := d.alphaOffset()
+	if !ok {
+		return nil, FormatError("alpha ExtraSample not found")
+	}
+
+	l, err := d.layout()
+	if err != nil {
+		return nil, err
+	}
+	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+	if err = d.checkLimits(bounds, l); err != nil {
+		return nil, err
+	}
+	m := image.NewAlpha16(bounds)
+	d.decode = func(dst image.Image, xmin, ymin, xmax, ymax int) error {
+		return d.decodeAlpha(dst, offset, xmin, ymin, xmax, ymax)
+	}
+	for k := 0; k < l.across*l.down; k++ {
+		if err = d.readBlock(m, l, k); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// alphaOffset returns the offset, in the bytes of a pixel, of the alpha ExtraSample.
+func (d *decoder) alphaOffset() (int, bool) {
+	extras := d.features[tExtraSamples].val
+	size := d.extraSampleSize()
+	offset := d.bytesPerPixel - size*len(extras) // The color samples come first
+	for i, es := range extras {
+		if es == esAssociatedAlpha || es == esUnassociatedAlpha {
+			return offset + size*i, true
+		}
+	}
+	return 0, false
+}
+
+// extraSampleSize returns the number of bytes of each ExtraSample in the pixels of a block,
+// the packed samples being expanded to 16 bits by decompress.
+func (d *decoder) extraSampleSize() int {
+	if d.packed() {
+		return 2
+	}
+	return int(d.bpp / 8)
+}
+
+// alphaValue returns the 16-bit alpha of the sample p, of the sample index c in the pixel.
+func (d *decoder) alphaValue(p []byte, byteOrder binary.ByteOrder, c int) uint16 {
+	switch {
+	case d.mode != mRGB:
+		return byteOrder.Uint16(p)
+	case d.sampleFormat == sfSignedInteger && d.bpp == 16:
+		// Like the color samples, the signed range is mapped to the unsigned one.
+		return byteOrder.Uint16(p) ^ 0x8000
+	case d.sampleFormat == sfSignedInteger:
+		return uint16((byteOrder.Uint32(p) ^ 0x80000000) >> 16)
+	case d.bpp == 32 && d.sampleFormat == sfUnsignedInteger:
+		return uint16(byteOrder.Uint32(p) >> 16)
+	case d.bpp == 32:
+		// Like the color samples, the 32-bit samples are floating point by default.
+		a := math.Float32frombits(byteOrder.Uint32(p))
+		return uint16(math.Max(0, math.Min(1, float64(a)))*0xffff + 0.5)
+	case d.packed():
+		maxValue := uint32(1)<<d.sampleDepth(c) - 1
+		return uint16((uint32(byteOrder.Uint16(p))*0xffff + maxValue/2) / maxValue)
+	default:
+		return byteOrder.Uint16(p)
+	}
+}
+
+// decodeAlpha decodes the 16-bit alpha samples located at offset in the pixels of the block.
+func (d *decoder) decodeAlpha(dst image.Image, offset, xmin, ymin, xmax, ymax int) error {
+	rMaxX := minInt(xmax, dst.Bounds().Max.X)
+	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
+	rowStride := (xmax - xmin) * d.bytesPerPixel // Stored width, clipped pixels included
+	c := offset / d.extraSampleSize()            // Index of the alpha sample in the pixel
+
+	// unRLE interleaves the bytestreams most significant byte first whereas
+	// uncompressed samples are stored in the file's byte order.
+	var byteOrder binary.ByteOrder = binary.BigEndian
+	if d.compression != cSGILogRLE {
+		byteOrder = d.byteOrder
+	}
+
+	m, ok := dst.(*image.Alpha16)
+	if !ok {
+		return errDestinationType
+	}
+	for y := ymin; y < rMaxY; y++ {
+		o := (y-ymin)*rowStride + offset
+		for x := xmin; x < rMaxX; x++ {
+			m.SetAlpha16(x, y, color.Alpha16{A: d.alphaValue(d.buf[o:], byteOrder, c)})
+			o += d.bytesPerPixel
+		}
+	}
+	return nil
+}
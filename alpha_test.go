@@ -0,0 +1,118 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/format"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeAlpha(t *testing.T) {
+	const width, height = 3, 2
+
+	alpha := func(x, y int) uint16 { return uint16(0x1000*x + 0x80*y + 1) }
+
+	var pixels []byte
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := alpha(x, y)
+			pixels = append(append(pixels, logluvPixel(x, y)...), byte(a>>8), byte(a))
+		}
+	}
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16, 16, 16, 16).
+		add(tCompression, dtShort, cSGILogRLE).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 4).
+		add(tExtraSamples, dtShort, esUnassociatedAlpha).
+		strips(rle(pixels, 6, width, height))
+
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	a, err := DecodeAlpha(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, m.Bounds(), a.Bounds())
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := logluvPixel(x, y)
+			X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+			x2, y2, z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.Equal(t, f32(X, Y, Z), []float64{x2, y2, z2}, "pixel (%d,%d)", x, y)
+			assert.Equal(t, color.Alpha16{A: alpha(x, y)}, a.Alpha16At(x, y), "pixel (%d,%d)", x, y)
+		}
+	}
+
+	// Unspecified ExtraSample
+	_, err = DecodeAlpha(bytes.NewReader(b.add(tExtraSamples, dtShort, esUnspecified).bytes()))
+	assert.Error(t, err)
+}
+
+func TestDecodeAlphaTiledRGBAFloat(t *testing.T) {
+	const width, height, tileWidth, tileHeight = 5, 3, 4, 2
+
+	pixel := func(x, y int) []float32 {
+		return []float32{float32(x) + 0.25, float32(y) * 2, float32(x*y) / 8, float32(x+y) / 8} // RGBA
+	}
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var tiles [][]byte
+		for ty := 0; ty < height; ty += tileHeight {
+			for tx := 0; tx < width; tx += tileWidth {
+				var tile []byte
+				for y := ty; y < ty+tileHeight; y++ {
+					for x := tx; x < tx+tileWidth; x++ {
+						for _, v := range pixel(x, y) {
+							if x >= width || y >= height {
+								v = -1 // Padding
+							}
+							tile = append(tile, make([]byte, 4)...)
+							byteOrder.PutUint32(tile[len(tile)-4:], math.Float32bits(v))
+						}
+					}
+				}
+				tiles = append(tiles, tile)
+			}
+		}
+
+		b := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 32, 32, 32, 32).
+			add(tCompression, dtShort, cNone).
+			add(tPhotometricInterpretation, dtShort, pRGB).
+			add(tSamplesPerPixel, dtShort, 4).
+			add(tExtraSamples, dtShort, esAssociatedAlpha).
+			add(tSampleFormat, dtShort, sfIEEEFP, sfIEEEFP, sfIEEEFP, sfIEEEFP).
+			add(tTileWidth, dtShort, tileWidth).
+			add(tTileLength, dtShort, tileHeight).
+			tiles(tiles...)
+
+		m, err := Decode(bytes.NewReader(b.bytes()))
+		if !assert.NoError(t, err, "%v", byteOrder) {
+			continue
+		}
+		a, err := DecodeAlpha(bytes.NewReader(b.bytes()))
+		if !assert.NoError(t, err, "%v", byteOrder) {
+			continue
+		}
+		assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+		assert.Equal(t, m.Bounds(), a.Bounds())
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				p := pixel(x, y)
+				r, g, bl, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+				assert.Equal(t, []float64{float64(p[0]), float64(p[1]), float64(p[2])}, []float64{r, g, bl}, "%v pixel (%d,%d)", byteOrder, x, y)
+				assert.Equal(t, color.Alpha16{A: uint16(float64(p[3])*0xffff + 0.5)}, a.Alpha16At(x, y), "%v pixel (%d,%d)", byteOrder, x, y)
+			}
+		}
+	}
+}
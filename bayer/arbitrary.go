@@ -0,0 +1,90 @@
+package bayer
+
+import "fmt"
+
+type arbitrary struct {
+	base
+	radius int // Largest distance at which all the colors are found
+}
+
+// NewArbitrary instanciates an interpolation algorithm for the arbitrary CFA described by
+// opts.Colors, opts.RepeatRows and opts.RepeatCols (e.g. 2x4 or 6x6 X-Trans like patterns).
+// Each missing color of a pixel is the average of the nearest samples of this color.
+func NewArbitrary(buf []byte, opts *Options) (Bayer, error) {
+	if opts.RepeatRows <= 0 || opts.RepeatCols <= 0 || len(opts.Colors) != opts.RepeatRows*opts.RepeatCols {
+		return nil, fmt.Errorf("bayer: Colors do not match the %dx%d CFA", opts.RepeatRows, opts.RepeatCols)
+	}
+	var found [3]bool
+	for _, c := range opts.Colors {
+		if c > 2 {
+			return nil, fmt.Errorf("bayer: unsupported CFA color %d", c)
+		}
+		found[c] = true
+	}
+	if !found[0] || !found[1] || !found[2] {
+		return nil, fmt.Errorf("bayer: CFA without red, green and blue samples %v", opts.Colors)
+	}
+
+	radius := opts.RepeatRows
+	if opts.RepeatCols > radius {
+		radius = opts.RepeatCols
+	}
+	return &arbitrary{
+		base: base{
+			buf:            buf,
+			bytesPerPixels: opts.Depth / 8,
+			Options:        opts,
+		},
+		radius: radius,
+	}, nil
+}
+
+func (byr *arbitrary) At(x, y int) (r, g, b float64) {
+	return byr.interpolate(x, y, 0), byr.interpolate(x, y, 1), byr.interpolate(x, y, 2)
+}
+
+// color returns the color of the CFA at (x, y).
+func (byr *arbitrary) color(x, y int) int {
+	return int(byr.Colors[(y%byr.RepeatRows)*byr.RepeatCols+x%byr.RepeatCols])
+}
+
+// interpolate returns the value of color c at (x, y): the sample itself or the average of the samples
+// of color c in the smallest surrounding square containing some, the pixels outside the image being ignored.
+func (byr *arbitrary) interpolate(x, y, c int) float64 {
+	for r := 0; r <= byr.radius; r++ {
+		var sum float64
+		var n int
+		for Y := maxInt(y-r, 0); Y <= minInt(y+r, byr.Height-1); Y++ {
+			for X := maxInt(x-r, 0); X <= minInt(x+r, byr.Width-1); X++ {
+				if byr.color(X, Y) == c {
+					sum += byr.sample(X, Y, c)
+					n++
+				}
+			}
+		}
+		if n > 0 {
+			return sum / float64(n)
+		}
+	}
+	return 0 // Color not sampled in a too small image
+}
+
+// sample returns the white balanced sample at (x, y) whose color is c.
+func (byr *arbitrary) sample(x, y, c int) float64 {
+	n := (y*byr.Width + x) * byr.bytesPerPixels
+	return byr.clip(byr.read(n, c) * byr.WhiteBalance[c])
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -3,6 +3,7 @@ package bayer
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 // Based and adapted/corrected from https://github.com/BryceCicada/demosaic (MIT License)
@@ -14,6 +15,13 @@ type (
 		At(x, y int) (r, g, b float64)
 	}
 
+	// A RowBayer interpolates the pixels of a whole row at once, faster than calling At for each of them.
+	RowBayer interface {
+		Bayer
+		// Row writes the R, G and B values of the pixels of the row y into rgb, which holds 3 x Width values.
+		Row(y int, rgb []float64)
+	}
+
 	// Options contains information for bayer interpolation.
 	Options struct {
 		// ByteOrder defines the endianness of the CFA.
@@ -26,18 +34,31 @@ type (
 		Height int
 		// Pattern defines the CFAPattern (e.g. RGGB, GRBG, etc.).
 		Pattern Pattern
+		// Colors defines, for NewArbitrary, the colors (0 = red, 1 = green, 2 = blue) of a CFA of
+		// RepeatRows x RepeatCols pixels, row by row, which is tiled over the image.
+		Colors []uint
+		// RepeatRows and RepeatCols define the dimensions of Colors.
+		RepeatRows, RepeatCols int
 		// BlackLevel defines the zero light level.
 		BlackLevel float64
+		// BlackLevels defines the zero light level of each CFA color (R, G and B), overriding BlackLevel when set.
+		BlackLevels []float64
 		// WhiteLevel defines the saturation light level.
 		WhiteLevel float64
 		// WhiteBalance defines the AsShotNeutral with inverted values and then rescaled them all so that the green multiplier is 1.
+		// It contains the R, G and B multipliers and optionally a fourth one applied to the greens of the blue rows.
 		WhiteBalance []float64
+		// ClipHighlights clips the samples above WhiteLevel and then the white balanced values to the
+		// level where the first color saturates, so that the highlights are neutral instead of magenta.
+		ClipHighlights bool
 	}
 
 	base struct {
 		*Options
 		buf            []byte
 		bytesPerPixels int
+		// plane holds the linearized and white balanced samples, row by row, when precomputed.
+		plane []float64
 	}
 
 	// A Pattern desribes the orientation of the 4 pixels in the top left corner of the Bayer CFA.
@@ -94,42 +115,141 @@ func GetPattern(cfaPattern []uint) (Pattern, error) {
 	}
 }
 
-func (b base) reflect(x, p1, p2 int) (r int) {
-	if x >= p1 && x <= p2 {
-		r = x
-	} else if x < p1 {
-		r = p1 + abs(p1-x)
-	} else {
-		r = p2 - abs(p2-x)
+// reflect mirrors x into [p1, p2] without repeating the edge (e.g. -1 -> 1), so that the
+// parity of the coordinate, and thus the color of the CFA sample, is preserved at the boundaries.
+// It falls back to clamping when the range is too small to be mirrored.
+func (b base) reflect(x, p1, p2 int) int {
+	if p2 <= p1 {
+		return p1
+	}
+
+	period := 2 * (p2 - p1)
+	r := (x - p1) % period
+	if r < 0 {
+		r += period
+	}
+	if r > p2-p1 {
+		r = period - r
 	}
-	return
+	return p1 + r
 }
 
-func (b base) read(n int) (c float64) {
+func (b base) read(n, color int) (c float64) {
 	switch b.Depth {
 	case 16:
 		c = float64(b.ByteOrder.Uint16(b.buf[n : n+2]))
 	default:
 		c = float64(b.buf[n]) // default: 8 bits depth
 	}
-	return (c - b.BlackLevel) / (b.WhiteLevel - b.BlackLevel) // Rescale/Linearize value to range [0,1]
+	if b.ClipHighlights && c > b.WhiteLevel {
+		c = b.WhiteLevel
+	}
+
+	black := b.BlackLevel
+	if color < len(b.BlackLevels) {
+		black = b.BlackLevels[color]
+	}
+	return (c - black) / (b.WhiteLevel - black) // Rescale/Linearize value to range [0,1]
 }
 
-func (b base) pixel(x, y int) float64 {
-	X := b.reflect(x, 0, b.Width-1)
-	Y := b.reflect(y, 0, b.Height-1)
+// precompute linearizes and white balances all the samples once, the interpolations reading
+// each sample for several neighbouring pixels.
+func (b *base) precompute() {
+	b.plane = make([]float64, b.Width*b.Height)
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			b.plane[y*b.Width+x] = b.sample(x, y)
+		}
+	}
+}
+
+// Sites of a 2x2 Bayer CFA.
+const (
+	siteRed = iota
+	siteGreenR
+	siteGreenB
+	siteBlue
+)
+
+// site returns the site of the 2x2 Bayer CFA at (x, y).
+func (b base) site(x, y int) int {
+	switch {
+	case b.isRed(x, y):
+		return siteRed
+	case b.isGreenR(x, y):
+		return siteGreenR
+	case b.isGreenB(x, y):
+		return siteGreenB
+	default:
+		return siteBlue
+	}
+}
+
+// window fills rows with the precomputed samples of the rows centered on y, mirrored at the edges
+// like pixel, so that a row kernel reads the neighbouring rows without bounds checks.
+func (b *base) window(y int, rows [][]float64) {
+	n := len(rows) / 2
+	for i := range rows {
+		Y := y - n + i
+		if Y < 0 || Y >= b.Height {
+			Y = b.reflect(Y, 0, b.Height-1)
+		}
+		rows[i] = b.plane[Y*b.Width : (Y+1)*b.Width]
+	}
+}
+
+// column returns the column x mirrored at the edges like pixel.
+func (b *base) column(x int) int {
+	if x < 0 || x >= b.Width {
+		return b.reflect(x, 0, b.Width-1)
+	}
+	return x
+}
+
+func (b *base) pixel(x, y int) float64 {
+	if x < 0 || x >= b.Width {
+		x = b.reflect(x, 0, b.Width-1)
+	}
+	if y < 0 || y >= b.Height {
+		y = b.reflect(y, 0, b.Height-1)
+	}
+	if b.plane != nil {
+		return b.plane[y*b.Width+x]
+	}
+	return b.sample(x, y)
+}
+
+// sample returns the linearized and white balanced sample at (X, Y), inside the CFA.
+func (b *base) sample(X, Y int) float64 {
+	n := X*b.bytesPerPixels + Y*b.Width*b.bytesPerPixels
 	switch {
 	case b.isRed(X, Y):
-		return b.read(X*b.bytesPerPixels+Y*b.Width*b.bytesPerPixels) * b.WhiteBalance[0]
+		return b.clip(b.read(n, 0) * b.WhiteBalance[0])
+	case b.isGreenB(X, Y) && len(b.WhiteBalance) > 3:
+		return b.clip(b.read(n, 1) * b.WhiteBalance[3])
 	case b.isGreenR(X, Y) || b.isGreenB(X, Y):
-		return b.read(X*b.bytesPerPixels+Y*b.Width*b.bytesPerPixels) * b.WhiteBalance[1]
+		return b.clip(b.read(n, 1) * b.WhiteBalance[1])
 	case b.isBlue(X, Y):
-		return b.read(X*b.bytesPerPixels+Y*b.Width*b.bytesPerPixels) * b.WhiteBalance[2]
+		return b.clip(b.read(n, 2) * b.WhiteBalance[2])
 	default:
 		panic("Something went wrong")
 	}
 }
 
+// clip returns the white balanced value v clipped, when ClipHighlights is set, to the lowest
+// white balance multiplier which is the white balanced saturation level of the first color to saturate.
+// Above it the colors are not in their actual ratios anymore.
+func (b base) clip(v float64) float64 {
+	if !b.ClipHighlights {
+		return v
+	}
+	level := b.WhiteBalance[0]
+	for _, m := range b.WhiteBalance[1:] {
+		level = math.Min(level, m)
+	}
+	return math.Min(v, level)
+}
+
 func (b base) isRed(x, y int) bool {
 	switch b.Pattern {
 	case RGGB:
@@ -189,10 +309,3 @@ func (b base) isBlue(x, y int) bool {
 
 	return false
 }
-
-func abs(n int) int {
-	if n < 0 {
-		return -n
-	}
-	return n
-}
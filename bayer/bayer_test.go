@@ -0,0 +1,263 @@
+package bayer
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mosaic returns an 8-bit CFA of the given pattern where each color plane is given by fn.
+func mosaic(p Pattern, width, height int, fn func(c, x, y int) byte) ([]byte, *Options) {
+	opts := &Options{
+		ByteOrder:    binary.LittleEndian,
+		Depth:        8,
+		Width:        width,
+		Height:       height,
+		Pattern:      p,
+		WhiteLevel:   255,
+		WhiteBalance: []float64{1, 1, 1},
+	}
+	b := base{Options: opts, bytesPerPixels: 1}
+
+	buf := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := 1 // Green
+			switch {
+			case b.isRed(x, y):
+				c = 0
+			case b.isBlue(x, y):
+				c = 2
+			}
+			buf[y*width+x] = fn(c, x, y)
+		}
+	}
+	return buf, opts
+}
+
+func TestReflect(t *testing.T) {
+	b := base{}
+	for x, expected := range map[int]int{-3: 3, -2: 2, -1: 1, 0: 0, 3: 3, 4: 4, 5: 3, 6: 2, 9: 1, 10: 2} {
+		assert.Equal(t, expected, b.reflect(x, 0, 4), "x=%d", x)
+	}
+	assert.Equal(t, 0, b.reflect(-1, 0, 0))
+	assert.Equal(t, 0, b.reflect(1, 0, 0))
+}
+
+func TestDemosaicUniformEdges(t *testing.T) {
+	const r, g, b = 200, 100, 50
+	fn := func(c, x, y int) byte { return [3]byte{r, g, b}[c] }
+
+	for _, p := range []Pattern{RGGB, GRBG, GBRG, BGGR} {
+		for _, dim := range [][2]int{{5, 4}, {4, 5}, {1, 1}, {1, 4}, {3, 1}} {
+			buf, opts := mosaic(p, dim[0], dim[1], fn)
+			for name, byr := range map[string]Bayer{
+				"bilinear":          NewBilinear(buf, opts),
+				"malvar":            NewMalvar(buf, opts),
+				"nearest neighbour": NewNearestNeighbour(buf, opts),
+			} {
+				if dim[0] == 1 || dim[1] == 1 {
+					// Not all the colors are sampled, it just must not panic.
+					assert.NotPanics(t, func() { byr.At(0, 0) })
+					continue
+				}
+
+				for y := 0; y < dim[1]; y++ {
+					for x := 0; x < dim[0]; x++ {
+						R, G, B := byr.At(x, y)
+						assert.InDelta(t, r/255.0, R, 1e-9, "%s %v %v (%d,%d)", name, p, dim, x, y)
+						assert.InDelta(t, g/255.0, G, 1e-9, "%s %v %v (%d,%d)", name, p, dim, x, y)
+						assert.InDelta(t, b/255.0, B, 1e-9, "%s %v %v (%d,%d)", name, p, dim, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestBilinearGradients(t *testing.T) {
+	const width, height = 6, 7
+
+	// A linear gradient is exactly interpolated, including along the edges parallel to it
+	// where the mirrored neighbours have the same value.
+	gradients := map[string]func(c, x, y int) byte{
+		"vertical":   func(c, x, y int) byte { return byte(10*y + 60*c) },
+		"horizontal": func(c, x, y int) byte { return byte(10*x + 60*c) },
+	}
+	for name, fn := range gradients {
+		for _, p := range []Pattern{RGGB, GRBG, GBRG, BGGR} {
+			buf, opts := mosaic(p, width, height, fn)
+			byr := NewBilinear(buf, opts)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if name == "vertical" && (y == 0 || y == height-1) ||
+						name == "horizontal" && (x == 0 || x == width-1) {
+						continue
+					}
+
+					R, G, B := byr.At(x, y)
+					for c, v := range []float64{R, G, B} {
+						assert.InDelta(t, float64(fn(c, x, y))/255, v, 1e-9, "%s %v (%d,%d) c=%d", name, p, x, y, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestMalvarQuality demosaics a gray render of slanted stripes, whose colors differing from one another
+// are zippering artifacts: the gradient-corrected interpolation must be much closer to the render
+// than the bilinear one.
+func TestMalvarQuality(t *testing.T) {
+	const width, height = 32, 32
+	render := func(x, y int) float64 {
+		return 128 + 96*math.Sin(2*math.Pi*(float64(x)+0.6*float64(y))/9)
+	}
+
+	for _, p := range []Pattern{RGGB, GRBG, GBRG, BGGR} {
+		buf, opts := mosaic(p, width, height, func(_, x, y int) byte { return byte(math.Round(render(x, y))) })
+
+		errs := map[string]float64{}
+		for name, byr := range map[string]Bayer{"bilinear": NewBilinear(buf, opts), "malvar": NewMalvar(buf, opts)} {
+			// The edges of the image, mirrored, are excluded.
+			for y := 2; y < height-2; y++ {
+				for x := 2; x < width-2; x++ {
+					expected := math.Round(render(x, y)) / 255
+					r, g, b := byr.At(x, y)
+					errs[name] += (r-expected)*(r-expected) + (g-expected)*(g-expected) + (b-expected)*(b-expected)
+				}
+			}
+		}
+		assert.True(t, errs["malvar"] < errs["bilinear"]/3, "%v: malvar %g, bilinear %g", p, errs["malvar"], errs["bilinear"])
+	}
+}
+
+func TestRow(t *testing.T) {
+	for _, p := range []Pattern{RGGB, GRBG, GBRG, BGGR} {
+		for _, size := range [][2]int{{7, 5}, {1, 1}, {2, 3}, {3, 2}} {
+			width, height := size[0], size[1]
+			buf, opts := mosaic(p, width, height, func(c, x, y int) byte { return byte(31*c + 7*x + 13*y) })
+
+			rgb := make([]float64, 3*width)
+			for name, byr := range map[string]RowBayer{
+				"bilinear": NewBilinear(buf, opts).(RowBayer),
+				"malvar":   NewMalvar(buf, opts).(RowBayer),
+			} {
+				for y := 0; y < height; y++ {
+					byr.Row(y, rgb)
+					for x := 0; x < width; x++ {
+						r, g, b := byr.At(x, y)
+						assert.Equal(t, []float64{r, g, b}, rgb[3*x:3*x+3], "%s %v %dx%d (%d,%d)", name, p, width, height, x, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkRow(b *testing.B) {
+	const width, height = 1024, 64
+	buf, opts := mosaic(RGGB, width, height, func(c, x, y int) byte { return byte(31*c + 7*x + 13*y) })
+
+	rgb := make([]float64, 3*width)
+	for name, byr := range map[string]RowBayer{
+		"bilinear": NewBilinear(buf, opts).(RowBayer),
+		"malvar":   NewMalvar(buf, opts).(RowBayer),
+	} {
+		b.Run(name+"/row", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				byr.Row(i%height, rgb)
+			}
+		})
+		b.Run(name+"/at", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				y := i % height
+				for x := 0; x < width; x++ {
+					rgb[3*x], rgb[3*x+1], rgb[3*x+2] = byr.At(x, y)
+				}
+			}
+		})
+	}
+}
+
+func TestClipHighlights(t *testing.T) {
+	buf, opts := mosaic(RGGB, 4, 4, func(c, x, y int) byte { return 250 })
+	opts.WhiteLevel = 200
+	opts.WhiteBalance = []float64{2, 1, 1.6}
+
+	R, G, B := NewBilinear(buf, opts).At(1, 1)
+	assert.InDeltaSlice(t, []float64{2.5, 1.25, 2}, []float64{R, G, B}, 1e-9) // Magenta
+
+	opts.ClipHighlights = true
+	for _, byr := range []Bayer{NewBilinear(buf, opts), NewNearestNeighbour(buf, opts)} {
+		R, G, B = byr.At(1, 1)
+		assert.Equal(t, []float64{1, 1, 1}, []float64{R, G, B})
+	}
+
+	// The values below the saturation of the first color are kept.
+	buf, _ = mosaic(RGGB, 4, 4, func(c, x, y int) byte { return [3]byte{60, 100, 50}[c] })
+	R, G, B = NewBilinear(buf, opts).At(1, 1)
+	assert.InDeltaSlice(t, []float64{0.6, 0.5, 0.4}, []float64{R, G, B}, 1e-9)
+}
+
+func TestArbitrary(t *testing.T) {
+	const width, height = 8, 6
+	colors := []uint{
+		0, 1, 2, 1,
+		1, 2, 1, 0,
+	}
+	opts := &Options{
+		ByteOrder:    binary.LittleEndian,
+		Depth:        8,
+		Width:        width,
+		Height:       height,
+		WhiteLevel:   255,
+		WhiteBalance: []float64{1, 1, 1},
+		Colors:       colors,
+		RepeatRows:   2,
+		RepeatCols:   4,
+	}
+	const r, g, b = 200, 100, 50
+	buf := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			buf[y*width+x] = [3]byte{r, g, b}[colors[(y%2)*4+x%4]]
+		}
+	}
+
+	byr, err := NewArbitrary(buf, opts)
+	assert.NoError(t, err)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			R, G, B := byr.At(x, y)
+			assert.InDeltaSlice(t, []float64{r / 255.0, g / 255.0, b / 255.0}, []float64{R, G, B}, 1e-9, "(%d,%d)", x, y)
+		}
+	}
+
+	// A 2x2 Bayer pattern is interpolated like the bilinear algorithm away from the edges.
+	buf, opts = mosaic(GRBG, 6, 6, func(c, x, y int) byte { return byte(10*x + 7*y + 60*c) })
+	opts.Colors, opts.RepeatRows, opts.RepeatCols = []uint{1, 0, 2, 1}, 2, 2
+	byr, err = NewArbitrary(buf, opts)
+	assert.NoError(t, err)
+	bilinear := NewBilinear(buf, opts)
+	for y := 1; y < 5; y++ {
+		for x := 1; x < 5; x++ {
+			R, G, B := byr.At(x, y)
+			R2, G2, B2 := bilinear.At(x, y)
+			assert.InDeltaSlice(t, []float64{R2, G2, B2}, []float64{R, G, B}, 1e-9, "(%d,%d)", x, y)
+		}
+	}
+
+	// Invalid patterns
+	for _, invalid := range []Options{
+		{Colors: []uint{0, 1, 2}, RepeatRows: 2, RepeatCols: 2},
+		{Colors: []uint{0, 1, 1, 1}, RepeatRows: 2, RepeatCols: 2},
+		{Colors: []uint{0, 1, 3, 2}, RepeatRows: 2, RepeatCols: 2},
+	} {
+		invalid := invalid
+		_, err = NewArbitrary(buf, &invalid)
+		assert.Error(t, err, "%v", invalid.Colors)
+	}
+}
@@ -6,13 +6,48 @@ type bilinear struct {
 
 // NewBilinear instanciates a bilinear interpolation algorithm to parse the CFA provided as buf.
 func NewBilinear(buf []byte, opts *Options) Bayer {
-	return &bilinear{
+	byr := &bilinear{
 		base: base{
 			buf:            buf,
 			bytesPerPixels: opts.Depth / 8,
 			Options:        opts,
 		},
 	}
+	byr.precompute()
+	return byr
+}
+
+// Row implements RowBayer. The rows y-1 to y+1 are read from a window of the precomputed samples and
+// the sites of the row alternate with the parity of x, instead of resolving them for each pixel.
+func (byr *bilinear) Row(y int, rgb []float64) {
+	var w [3][]float64
+	byr.window(y, w[:])
+	up, row, down := w[0], w[1], w[2]
+	sites := [2]int{byr.site(0, y), byr.site(1, y)}
+
+	for x := 0; x < byr.Width; x++ {
+		l, r := byr.column(x-1), byr.column(x+1)
+		c := row[x]
+		p := rgb[3*x : 3*x+3]
+		switch sites[x&1] {
+		case siteRed:
+			p[0] = c
+			p[1] = (up[x] + down[x] + row[l] + row[r]) / 4
+			p[2] = (up[l] + down[l] + up[r] + down[r]) / 4
+		case siteBlue:
+			p[0] = (up[l] + down[l] + up[r] + down[r]) / 4
+			p[1] = (up[x] + down[x] + row[l] + row[r]) / 4
+			p[2] = c
+		case siteGreenR:
+			p[0] = (row[l] + row[r]) / 2
+			p[1] = c
+			p[2] = (up[x] + down[x]) / 2
+		default: // Green of the blue rows
+			p[0] = (up[x] + down[x]) / 2
+			p[1] = c
+			p[2] = (row[l] + row[r]) / 2
+		}
+	}
 }
 
 func (byr *bilinear) At(x, y int) (r, g, b float64) {
@@ -27,7 +62,7 @@ func (byr *bilinear) red(x, y int) float64 {
 		return (byr.pixel(x-1, y) + byr.pixel(x+1, y)) / 2
 	}
 	if byr.isGreenB(x, y) {
-		return (byr.pixel(x, y+1) + byr.pixel(x, y+1)) / 2
+		return (byr.pixel(x, y-1) + byr.pixel(x, y+1)) / 2
 	}
 	if byr.isBlue(x, y) {
 		return (byr.pixel(x-1, y-1) + byr.pixel(x-1, y+1) + byr.pixel(x+1, y-1) + byr.pixel(x+1, y+1)) / 4
@@ -0,0 +1,131 @@
+package bayer
+
+// Malvar, He and Cutler, High-quality linear interpolation for demosaicing of Bayer-patterned color images,
+// ICASSP 2004. The bilinear estimate of a color is corrected by the Laplacian of the color sampled
+// at the pixel, through 5x5 kernels whose weights are divided by 8.
+
+type malvar struct {
+	base
+}
+
+// NewMalvar instanciates a gradient-corrected linear interpolation algorithm to parse the CFA provided as buf.
+// It is sharper than the bilinear interpolation, with less zippering along the edges.
+func NewMalvar(buf []byte, opts *Options) Bayer {
+	byr := &malvar{
+		base: base{
+			buf:            buf,
+			bytesPerPixels: opts.Depth / 8,
+			Options:        opts,
+		},
+	}
+	byr.precompute()
+	return byr
+}
+
+// Row implements RowBayer. The rows y-2 to y+2 are read from a window of the precomputed samples and
+// the sites of the row alternate with the parity of x, instead of resolving them for each pixel.
+func (byr *malvar) Row(y int, rgb []float64) {
+	var w [5][]float64
+	byr.window(y, w[:])
+	up2, up, row, down, down2 := w[0], w[1], w[2], w[3], w[4]
+	sites := [2]int{byr.site(0, y), byr.site(1, y)}
+
+	for x := 0; x < byr.Width; x++ {
+		l, r := byr.column(x-1), byr.column(x+1)
+		l2, r2 := byr.column(x-2), byr.column(x+2)
+		c := row[x]
+		p := rgb[3*x : 3*x+3]
+
+		// The kernels of cross, diagonal, horizontal and vertical.
+		switch sites[x&1] {
+		case siteRed, siteBlue:
+			cross := 4*c +
+				2*(up[x]+down[x]+row[l]+row[r]) -
+				(up2[x] + down2[x] + row[l2] + row[r2])
+			diagonal := 6*c +
+				2*(up[l]+up[r]+down[l]+down[r]) -
+				1.5*(up2[x]+down2[x]+row[l2]+row[r2])
+			p[1] = positive(cross / 8)
+			if sites[x&1] == siteRed {
+				p[0], p[2] = c, positive(diagonal/8)
+			} else {
+				p[0], p[2] = positive(diagonal/8), c
+			}
+		default:
+			horizontal := 5*c +
+				4*(row[l]+row[r]) -
+				(up[l] + up[r] + down[l] + down[r]) -
+				(row[l2] + row[r2]) +
+				0.5*(up2[x]+down2[x])
+			vertical := 5*c +
+				4*(up[x]+down[x]) -
+				(up[l] + up[r] + down[l] + down[r]) -
+				(up2[x] + down2[x]) +
+				0.5*(row[l2]+row[r2])
+			p[1] = c
+			if sites[x&1] == siteGreenR {
+				p[0], p[2] = positive(horizontal/8), positive(vertical/8)
+			} else {
+				p[0], p[2] = positive(vertical/8), positive(horizontal/8)
+			}
+		}
+	}
+}
+
+func (byr *malvar) At(x, y int) (r, g, b float64) {
+	c := byr.pixel(x, y)
+	switch {
+	case byr.isRed(x, y):
+		return c, byr.cross(x, y, c), byr.diagonal(x, y, c)
+	case byr.isBlue(x, y):
+		return byr.diagonal(x, y, c), byr.cross(x, y, c), c
+	case byr.isGreenR(x, y):
+		return byr.horizontal(x, y, c), c, byr.vertical(x, y, c)
+	default: // Green of the blue rows
+		return byr.vertical(x, y, c), c, byr.horizontal(x, y, c)
+	}
+}
+
+// cross returns the green at the red or blue pixel (x, y) of value c.
+func (byr *malvar) cross(x, y int, c float64) float64 {
+	v := 4*c +
+		2*(byr.pixel(x, y-1)+byr.pixel(x, y+1)+byr.pixel(x-1, y)+byr.pixel(x+1, y)) -
+		(byr.pixel(x, y-2) + byr.pixel(x, y+2) + byr.pixel(x-2, y) + byr.pixel(x+2, y))
+	return positive(v / 8)
+}
+
+// diagonal returns the blue at the red pixel (x, y) of value c, or the red at the blue one.
+func (byr *malvar) diagonal(x, y int, c float64) float64 {
+	v := 6*c +
+		2*(byr.pixel(x-1, y-1)+byr.pixel(x+1, y-1)+byr.pixel(x-1, y+1)+byr.pixel(x+1, y+1)) -
+		1.5*(byr.pixel(x, y-2)+byr.pixel(x, y+2)+byr.pixel(x-2, y)+byr.pixel(x+2, y))
+	return positive(v / 8)
+}
+
+// horizontal returns the color sampled at the left and right of the green pixel (x, y) of value c.
+func (byr *malvar) horizontal(x, y int, c float64) float64 {
+	v := 5*c +
+		4*(byr.pixel(x-1, y)+byr.pixel(x+1, y)) -
+		(byr.pixel(x-1, y-1) + byr.pixel(x+1, y-1) + byr.pixel(x-1, y+1) + byr.pixel(x+1, y+1)) -
+		(byr.pixel(x-2, y) + byr.pixel(x+2, y)) +
+		0.5*(byr.pixel(x, y-2)+byr.pixel(x, y+2))
+	return positive(v / 8)
+}
+
+// vertical returns the color sampled above and below the green pixel (x, y) of value c.
+func (byr *malvar) vertical(x, y int, c float64) float64 {
+	v := 5*c +
+		4*(byr.pixel(x, y-1)+byr.pixel(x, y+1)) -
+		(byr.pixel(x-1, y-1) + byr.pixel(x+1, y-1) + byr.pixel(x-1, y+1) + byr.pixel(x+1, y+1)) -
+		(byr.pixel(x, y-2) + byr.pixel(x, y+2)) +
+		0.5*(byr.pixel(x-2, y)+byr.pixel(x+2, y))
+	return positive(v / 8)
+}
+
+// positive clamps to zero the undershoot of the gradient correction along the sharp edges.
+func positive(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
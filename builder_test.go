@@ -0,0 +1,273 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// tiffBuilder assembles small in-memory TIFF files for tests.
+type tiffBuilder struct {
+	byteOrder binary.ByteOrder
+	entries   []testEntry
+	blocks    [][]byte // Strips or tiles
+	tiled     bool
+	omitted   []uint16
+	subs      []*tiffBuilder // SubIFDs
+	exif      *tiffBuilder   // EXIF IFD
+	bigTIFF   bool
+}
+
+type testEntry struct {
+	id       uint16
+	datatype uint16
+	val      []uint64 // Rationals are stored as num,denom pairs.
+}
+
+func newTIFFBuilder(byteOrder binary.ByteOrder) *tiffBuilder {
+	return &tiffBuilder{byteOrder: byteOrder}
+}
+
+// add sets the tag id with the given datatype and values.
+func (b *tiffBuilder) add(id, datatype uint16, val ...uint64) *tiffBuilder {
+	for i, e := range b.entries {
+		if e.id == id {
+			b.entries[i] = testEntry{id: id, datatype: datatype, val: val}
+			return b
+		}
+	}
+	b.entries = append(b.entries, testEntry{id: id, datatype: datatype, val: val})
+	return b
+}
+
+// omit removes the given tags from the IFD, including the generated offsets and byte counts.
+func (b *tiffBuilder) omit(ids ...uint16) *tiffBuilder {
+	b.omitted = append(b.omitted, ids...)
+	return b
+}
+
+// strips sets the raw strips of the image.
+func (b *tiffBuilder) strips(blocks ...[]byte) *tiffBuilder {
+	b.blocks = blocks
+	b.tiled = false
+	return b
+}
+
+// tiles sets the raw tiles of the image.
+func (b *tiffBuilder) tiles(blocks ...[]byte) *tiffBuilder {
+	b.blocks = blocks
+	b.tiled = true
+	return b
+}
+
+// subIFDs sets the IFDs referenced by the SubIFDs tag.
+func (b *tiffBuilder) subIFDs(subs ...*tiffBuilder) *tiffBuilder {
+	for _, sub := range subs {
+		sub.byteOrder = b.byteOrder
+	}
+	b.subs = subs
+	return b
+}
+
+// exifIFD sets the IFD referenced by the ExifIFD tag.
+func (b *tiffBuilder) exifIFD(exif *tiffBuilder) *tiffBuilder {
+	exif.byteOrder = b.byteOrder
+	b.exif = exif
+	return b
+}
+
+// big makes b a BigTIFF file, with 8-byte offsets and counts.
+func (b *tiffBuilder) big() *tiffBuilder {
+	b.bigTIFF = true
+	return b
+}
+
+func (b *tiffBuilder) bytes() []byte {
+	buf := new(bytes.Buffer)
+	switch {
+	case b.bigTIFF && b.byteOrder == binary.LittleEndian:
+		buf.WriteString(leBigHeader + "\x08\x00\x00\x00")
+	case b.bigTIFF:
+		buf.WriteString(beBigHeader + "\x00\x08\x00\x00")
+	case b.byteOrder == binary.LittleEndian:
+		buf.WriteString(leHeader)
+	default:
+		buf.WriteString(beHeader)
+	}
+	headerLen := buf.Len()
+	buf.Write(make([]byte, b.offsetLen())) // IFD offset, patched below.
+
+	var entries []testEntry
+	if len(b.subs) > 0 {
+		subOffsets := make([]uint64, len(b.subs))
+		for i, sub := range b.subs {
+			sub.bigTIFF = b.bigTIFF
+			subOffsets[i] = uint64(sub.writeIFD(buf))
+		}
+		entries = append(entries, testEntry{id: tSubIFDs, datatype: dtLong, val: subOffsets})
+	}
+
+	if b.exif != nil {
+		b.exif.bigTIFF = b.bigTIFF
+		entries = append(entries, testEntry{id: tExifIFD, datatype: dtLong, val: []uint64{uint64(b.exif.writeIFD(buf))}})
+	}
+
+	ifdOffset := b.writeIFD(buf, entries...)
+	b.putOffset(buf.Bytes()[headerLen:], ifdOffset)
+
+	return buf.Bytes()
+}
+
+// offsetLen returns the size of the offsets and counts of the IFDs.
+func (b *tiffBuilder) offsetLen() int {
+	if b.bigTIFF {
+		return 8
+	}
+	return 4
+}
+
+func (b *tiffBuilder) putOffset(p []byte, v int) {
+	if b.bigTIFF {
+		b.byteOrder.PutUint64(p, uint64(v))
+	} else {
+		b.byteOrder.PutUint32(p, uint32(v))
+	}
+}
+
+// writeIFD writes the blocks and the IFD of b, with the additional entries, to buf and
+// returns the offset of the IFD.
+func (b *tiffBuilder) writeIFD(buf *bytes.Buffer, additional ...testEntry) int {
+	offsets := make([]uint64, len(b.blocks))
+	counts := make([]uint64, len(b.blocks))
+	for i, block := range b.blocks {
+		offsets[i] = uint64(buf.Len())
+		counts[i] = uint64(len(block))
+		buf.Write(block)
+	}
+
+	entries := append([]testEntry(nil), b.entries...)
+	for _, e := range additional {
+		entries = appendMissing(entries, e)
+	}
+	if len(b.blocks) > 0 {
+		offsetTag, countTag := uint16(tStripOffsets), uint16(tStripByteCounts)
+		if b.tiled {
+			offsetTag, countTag = tTileOffsets, tTileByteCounts
+		}
+		datatype := uint16(dtLong)
+		if b.bigTIFF {
+			datatype = dtLong8
+		}
+		entries = appendMissing(entries, testEntry{id: offsetTag, datatype: datatype, val: offsets})
+		entries = appendMissing(entries, testEntry{id: countTag, datatype: datatype, val: counts})
+	}
+	for _, id := range b.omitted {
+		for i := range entries {
+			if entries[i].id == id {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	if buf.Len()%2 != 0 {
+		buf.WriteByte(0) // Word alignment
+	}
+	ifdOffset := buf.Len()
+
+	// Entries: tag, datatype, count and value (or offset), the two latter being 4 bytes
+	// wide or 8 bytes wide in BigTIFF.
+	n := b.offsetLen()
+	countLen, entryLen := 2, ifdLen
+	if b.bigTIFF {
+		countLen, entryLen = 8, bigIFDLen
+	}
+
+	// Out-of-line values are written right after the IFD.
+	extra := new(bytes.Buffer)
+	extraOffset := ifdOffset + countLen + entryLen*len(entries) + n
+
+	p := make([]byte, entryLen)
+	if b.bigTIFF {
+		b.byteOrder.PutUint64(p, uint64(len(entries)))
+	} else {
+		b.byteOrder.PutUint16(p, uint16(len(entries)))
+	}
+	buf.Write(p[0:countLen])
+	for _, e := range entries {
+		raw := b.encode(e)
+		count := len(e.val)
+		if e.datatype == dtRational || e.datatype == dtSRational {
+			count /= 2
+		}
+
+		for i := range p {
+			p[i] = 0
+		}
+		b.byteOrder.PutUint16(p[0:2], e.id)
+		b.byteOrder.PutUint16(p[2:4], e.datatype)
+		b.putOffset(p[4:], count)
+		if len(raw) > n {
+			b.putOffset(p[4+n:], extraOffset+extra.Len())
+			extra.Write(raw)
+		} else {
+			copy(p[4+n:], raw)
+		}
+		buf.Write(p)
+	}
+	buf.Write(make([]byte, n)) // No next IFD
+	buf.Write(extra.Bytes())
+
+	return ifdOffset
+}
+
+func (b *tiffBuilder) encode(e testEntry) []byte {
+	var raw []byte
+	p := make([]byte, 8)
+	for _, v := range e.val {
+		switch e.datatype {
+		case dtByte, dtASCII, dtSByte, dtUndefined:
+			raw = append(raw, byte(v))
+		case dtShort, dtSShort:
+			b.byteOrder.PutUint16(p, uint16(v))
+			raw = append(raw, p[:2]...)
+		case dtLong, dtSLong, dtRational, dtSRational, dtFloat:
+			b.byteOrder.PutUint32(p, uint32(v))
+			raw = append(raw, p[:4]...)
+		case dtDouble, dtLong8, dtSLong8, dtIFD8:
+			b.byteOrder.PutUint64(p, v)
+			raw = append(raw, p...)
+		}
+	}
+	return raw
+}
+
+func appendMissing(entries []testEntry, e testEntry) []testEntry {
+	for _, entry := range entries {
+		if entry.id == e.id {
+			return entries
+		}
+	}
+	return append(entries, e)
+}
+
+// rle encodes each of the bytesPerPixel bytestreams of each row as literal runs,
+// as expected by the SGILog RLE decoder.
+func rle(data []byte, bytesPerPixel, width, height int) []byte {
+	var dst []byte
+	for row := 0; row < height; row++ {
+		line := data[row*width*bytesPerPixel : (row+1)*width*bytesPerPixel]
+		for channel := 0; channel < bytesPerPixel; channel++ {
+			for x := 0; x < width; {
+				n := minInt(width-x, 127)
+				dst = append(dst, byte(n))
+				for i := 0; i < n; i++ {
+					dst = append(dst, line[(x+i)*bytesPerPixel+channel])
+				}
+				x += n
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,128 @@
+package tiff
+
+import "sync"
+
+// A CameraProfile describes the color calibration of a camera.
+type CameraProfile struct {
+	// ColorMatrix converts XYZ values to reference camera native values, like the DNG ColorMatrix tags.
+	// It is stored in row-major order.
+	ColorMatrix [9]float64
+	// Illuminant is the white point for which the ColorMatrix is calibrated.
+	Illuminant WhitePoint
+	// Override makes the CFA decoding use the profile even when the file has its own ColorMatrix tags
+	// enabled by DecodeOptions.UseColorMatrix. Otherwise the profile is only used for the files
+	// without ColorMatrix or when UseColorMatrix is not set.
+	Override bool
+}
+
+var (
+	cameraProfilesMu sync.RWMutex
+	cameraProfiles   = map[string]CameraProfile{}
+)
+
+// RegisterCameraProfile registers the color profile of the camera identified by its DNG UniqueCameraModel.
+func RegisterCameraProfile(uniqueCameraModel string, profile CameraProfile) {
+	cameraProfilesMu.Lock()
+	defer cameraProfilesMu.Unlock()
+	cameraProfiles[uniqueCameraModel] = profile
+}
+
+// cameraProfile returns the registered profile of the camera identified by uniqueCameraModel.
+func cameraProfile(uniqueCameraModel string) (CameraProfile, bool) {
+	cameraProfilesMu.RLock()
+	defer cameraProfilesMu.RUnlock()
+	p, ok := cameraProfiles[uniqueCameraModel]
+	return p, ok
+}
+
+// EXIF LightSource values of the CalibrationIlluminant tags.
+const (
+	lsD65 = 21
+	lsD50 = 23
+)
+
+// colorMatrix returns the XYZ to camera matrix of the CFA and the white point of its calibration.
+// A registered CameraProfile is used if the file has no ColorMatrix or if the profile overrides it.
+func (d *decoder) colorMatrix() (mat3, WhitePoint, bool) {
+	profile, registered := cameraProfile(d.features[tUniqueCameraModel].ascii())
+	if registered && profile.Override {
+		return profile.ColorMatrix, profile.Illuminant, true
+	}
+
+	// The matrix calibrated for D65, or D50, is preferred. Otherwise the white point is approximated by D65.
+	var cm tag
+	white := D65
+	rank := -1
+	for _, c := range []struct{ matrix, illuminant uint16 }{
+		{tColorMatrix1, tCalibrationIlluminant1},
+		{tColorMatrix2, tCalibrationIlluminant2},
+	} {
+		t, ok := d.features[c.matrix]
+		if !ok || len(t.val) != 9 {
+			continue
+		}
+
+		r, wp := 0, D65
+		switch d.firstVal(c.illuminant) {
+		case lsD65:
+			r = 2
+		case lsD50:
+			r, wp = 1, D50
+		}
+		if r >= rank {
+			cm, white, rank = t, wp, r
+		}
+	}
+
+	if len(cm.val) == 0 {
+		if registered {
+			return profile.ColorMatrix, profile.Illuminant, true
+		}
+		return mat3{}, D65, false
+	}
+
+	var m mat3
+	for i := range m {
+		m[i] = cm.asFloat(i)
+	}
+	return m, white, true
+}
+
+// correctionMatrix returns the XYZ to camera matrix applied by the color space correction of the CFA.
+// The ColorMatrix tags are only used along with the UseColorMatrix option, a registered CameraProfile
+// being used otherwise, if any.
+func (d *decoder) correctionMatrix() (mat3, WhitePoint, bool) {
+	if d.opts.UseColorMatrix {
+		return d.colorMatrix()
+	}
+	if profile, ok := cameraProfile(d.features[tUniqueCameraModel].ascii()); ok {
+		return profile.ColorMatrix, profile.Illuminant, true
+	}
+	return mat3{}, D65, false
+}
+
+// cameraToXYZ returns the matrix converting the white balanced camera values to XYZ values
+// from the XYZ to camera colorMatrix and the R, G, B white balance multipliers.
+// The camera white is mapped to a luminance of 1.
+func cameraToXYZ(colorMatrix mat3, wb []float64) (mat3, bool) {
+	m, ok := colorMatrix.inverse()
+	if !ok {
+		return mat3{}, false
+	}
+
+	// Undo the white balance to get the camera native values.
+	m = m.mul(mat3{
+		1 / wb[0], 0, 0,
+		0, 1 / wb[1], 0,
+		0, 0, 1 / wb[2],
+	})
+
+	_, Y, _ := m.apply(1, 1, 1)
+	if Y == 0 {
+		return mat3{}, false
+	}
+	for i := range m {
+		m[i] /= Y
+	}
+	return m, true
+}
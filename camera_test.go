@@ -0,0 +1,109 @@
+package tiff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCameraToXYZ(t *testing.T) {
+	xyzToSRGB, _ := sRGBToXYZ.inverse()
+	m, ok := cameraToXYZ(xyzToSRGB, []float64{1, 1, 1})
+	assert.True(t, ok)
+	for i := range m {
+		assert.InDelta(t, sRGBToXYZ[i], m[i], 1e-6)
+	}
+
+	// The white balanced camera white is mapped to the calibration white.
+	m, ok = cameraToXYZ(xyzToSRGB, []float64{2, 1, 0.5})
+	assert.True(t, ok)
+	X, Y, Z := m.apply(1, 1, 1)
+	X2, Y2, Z2 := sRGBToXYZ.apply(0.5, 1, 2)
+	assert.InDelta(t, X2/Y2, X, 1e-6)
+	assert.InDelta(t, 1, Y, 1e-6)
+	assert.InDelta(t, Z2/Y2, Z, 1e-6)
+
+	_, ok = cameraToXYZ(mat3{}, []float64{1, 1, 1})
+	assert.False(t, ok)
+}
+
+func TestDecodeCFACameraProfile(t *testing.T) {
+	const model = "Test Camera"
+	colorMatrix := [9]float64{2, 0, 0, 0, 1, 0, 0, 0, 0.5}
+	defer delete(cameraProfiles, model)
+
+	// XYZ to camera matrix as signed rationals.
+	withMatrix := cfaImage(4, 4).
+		add(tColorMatrix1, dtSRational, 2, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 2).
+		add(tCalibrationIlluminant1, dtShort, lsD65)
+	opts := &DecodeOptions{UseColorMatrix: true}
+	expected, err := DecodeWithOptions(bytes.NewReader(withMatrix.bytes()), opts)
+	assert.NoError(t, err)
+
+	// Without the option, the ColorMatrix is ignored.
+	srgb, err := Decode(bytes.NewReader(cfaImage(4, 4).bytes()))
+	assert.NoError(t, err)
+	m, err := Decode(bytes.NewReader(withMatrix.bytes()))
+	assert.NoError(t, err)
+	assertEqualImages(t, srgb.(hdr.Image), m.(hdr.Image))
+
+	// Profile used when the file has no ColorMatrix, with or without the option.
+	RegisterCameraProfile(model, CameraProfile{ColorMatrix: colorMatrix, Illuminant: D65})
+	b := cfaImage(4, 4).add(tUniqueCameraModel, dtASCII, ascii(model)...)
+	m, err = DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+	assert.NoError(t, err)
+	assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+	m, err = Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+
+	// The file's ColorMatrix takes precedence, along with the option, unless the profile overrides it.
+	b.add(tColorMatrix1, dtSRational, 1, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 1)
+	m, err = DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+	assert.NoError(t, err)
+	assert.NotEqual(t, expected.(hdr.Image).HDRAt(1, 1), m.(hdr.Image).HDRAt(1, 1))
+	m, err = Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+
+	RegisterCameraProfile(model, CameraProfile{ColorMatrix: colorMatrix, Illuminant: D65, Override: true})
+	m, err = DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+	assert.NoError(t, err)
+	assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+}
+
+func TestDecodeCFAColorMatrixZeroDenominator(t *testing.T) {
+	identity := cfaImage(4, 4).
+		add(tColorMatrix1, dtSRational, 1, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 1).
+		add(tCalibrationIlluminant1, dtShort, lsD65)
+	opts := &DecodeOptions{UseColorMatrix: true}
+	expected, err := DecodeWithOptions(bytes.NewReader(identity.bytes()), opts)
+	assert.NoError(t, err)
+
+	// An entry with a zero denominator reads as 0.
+	b := cfaImage(4, 4).
+		add(tColorMatrix1, dtSRational, 1, 1, 5, 0, 0, 1, 0, 1, 1, 1, 7, 0, 0, 0, 0, 1, 1, 1).
+		add(tCalibrationIlluminant1, dtShort, lsD65)
+	m, err := DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+	assert.NoError(t, err)
+	assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+
+	assert.Equal(t, "0/1", tag{datatype: dtRational, val: []uint64{5}}.rational(0).String())
+	assert.Equal(t, "0/1", tag{datatype: dtSRational}.sRational(0).String())
+}
+
+func assertEqualImages(t *testing.T, expected, actual hdr.Image) {
+	assert.Equal(t, expected.Bounds(), actual.Bounds())
+	b := expected.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			X, Y, Z, _ := expected.HDRAt(x, y).HDRXYZA()
+			X2, Y2, Z2, _ := actual.HDRAt(x, y).HDRXYZA()
+			assert.InDelta(t, X, X2, 1e-9, "pixel (%d,%d)", x, y)
+			assert.InDelta(t, Y, Y2, 1e-9, "pixel (%d,%d)", x, y)
+			assert.InDelta(t, Z, Z2, 1e-9, "pixel (%d,%d)", x, y)
+		}
+	}
+}
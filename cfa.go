@@ -0,0 +1,476 @@
+package tiff
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+)
+
+// A CFA is the raw Color Filter Array mosaic of a DNG along with the metadata needed to develop it.
+// It is decoded by DecodeCFA and encoded by EncodeCFA without demosaicing, so that the metadata
+// of a raw image can be edited without altering its samples.
+type CFA struct {
+	// Width and Height are the dimensions of the mosaic.
+	Width, Height int
+	// BitsPerSample is the depth of the samples: 8, 12, 14 or 16, the 12 and 14 bits samples being bit-packed.
+	BitsPerSample int
+	// Pix holds one sample per pixel, row by row.
+	Pix []uint16
+	// Pattern is the 2x2 CFAPattern, row by row (0 = red, 1 = green, 2 = blue).
+	Pattern [4]uint
+	// BlackLevelRepeatDim is the rows and columns of the BlackLevel pattern, 1x1 when zero.
+	BlackLevelRepeatDim [2]uint
+	// BlackLevel holds the zero light levels of the BlackLevelRepeatDim pattern, row by row, if any.
+	BlackLevel []uint
+	// WhiteLevel is the saturation level, 2^BitsPerSample-1 when zero.
+	WhiteLevel uint
+	// AsShotNeutral is the camera neutral of the white balance, if any.
+	AsShotNeutral []float64
+	// ColorMatrix1 is the XYZ to camera matrix, row by row.
+	ColorMatrix1 []float64
+	// CalibrationIlluminant1 is the EXIF LightSource of ColorMatrix1 (e.g. 21 for D65).
+	CalibrationIlluminant1 uint
+	// ColorMatrix2 is the XYZ to camera matrix of a second illuminant, if any.
+	ColorMatrix2 []float64
+	// CalibrationIlluminant2 is the EXIF LightSource of ColorMatrix2.
+	CalibrationIlluminant2 uint
+	// DefaultCropOrigin and DefaultCropSize are the x, y origin and the width, height of the default crop, if any.
+	DefaultCropOrigin, DefaultCropSize []float64
+	// DefaultUserCrop is the top, left, bottom, right of the user crop as fractions of the default crop, if any.
+	DefaultUserCrop []float64
+	// UniqueCameraModel is the name of the camera model.
+	UniqueCameraModel string
+}
+
+// DecodeCFA reads a DNG image from r and returns its raw Color Filter Array mosaic.
+// Packed 12 and 14 bits samples are expanded, the predictor, if any, is reversed.
+func DecodeCFA(r io.Reader) (*CFA, error) {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	if d.mode != mColorFilterArray {
+		return nil, FormatError("not a Color Filter Array image")
+	}
+	if d.spp != 1 || (d.bpp != 8 && d.bpp != 16 && !d.packed()) {
+		return nil, FormatError("Invalid BitsPerSample for ColorFilterArray format")
+	}
+	if dim := d.features[tCFARepeatPatternDim].val; len(dim) != 2 || dim[0] != 2 || dim[1] != 2 {
+		return nil, UnsupportedError("CFARepeatPatternDim other than 2x2")
+	}
+	l, err := d.layout()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkLimits(image.Rect(0, 0, d.config.Width, d.config.Height), l); err != nil {
+		return nil, err
+	}
+
+	c := &CFA{
+		Width:                  d.config.Width,
+		Height:                 d.config.Height,
+		BitsPerSample:          int(d.bpp),
+		Pix:                    make([]uint16, d.config.Width*d.config.Height),
+		WhiteLevel:             uint(math.Round(d.features[tWhiteLevel].asFloat(0))),
+		CalibrationIlluminant1: d.firstVal(tCalibrationIlluminant1),
+		CalibrationIlluminant2: d.firstVal(tCalibrationIlluminant2),
+		UniqueCameraModel:      d.features[tUniqueCameraModel].ascii(),
+	}
+	if dim := d.features[tBlackLevelRepeatDim].val; len(dim) == 2 {
+		copy(c.BlackLevelRepeatDim[:], uints(dim))
+	}
+	if t, exists := d.features[tBlackLevel]; exists {
+		c.BlackLevel = make([]uint, len(t.val))
+		for i := range t.val {
+			c.BlackLevel[i] = uint(math.Round(t.asFloat(i)))
+		}
+	}
+	if pattern := d.features[tCFAPattern].val; len(pattern) == 4 {
+		copy(c.Pattern[:], uints(pattern))
+	} else {
+		return nil, FormatError("CFAPattern does not match CFARepeatPatternDim")
+	}
+	if t, exists := d.features[tAsShotNeutral]; exists {
+		c.AsShotNeutral = make([]float64, len(t.val))
+		for i := range t.val {
+			c.AsShotNeutral[i] = t.asFloat(i)
+		}
+	}
+	for _, f := range []struct {
+		tag uint16
+		dst *[]float64
+	}{
+		{tColorMatrix1, &c.ColorMatrix1},
+		{tColorMatrix2, &c.ColorMatrix2},
+		{tDefaultCropOrigin, &c.DefaultCropOrigin},
+		{tDefaultCropSize, &c.DefaultCropSize},
+		{tDefaultUserCrop, &c.DefaultUserCrop},
+	} {
+		if t, exists := d.features[f.tag]; exists {
+			*f.dst = make([]float64, len(t.val))
+			for i := range t.val {
+				(*f.dst)[i] = t.asFloat(i)
+			}
+		}
+	}
+
+	for k := 0; k < l.across*l.down; k++ {
+		err = d.readSamples(l, k, func(x, y int, v uint16) {
+			c.Pix[y*c.Width+x] = v
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// DecodeCFAGreen reads a DNG image from r and returns the green samples of its Color Filter Array,
+// without demosaicing nor color conversion, e.g. as a luminance proxy for a focus or sharpness analysis.
+// Each pixel is the average of the green samples of a repeat of the CFAPattern, so the image is
+// CFARepeatPatternDim times smaller, rounded down. The samples are scaled from [BlackLevel, WhiteLevel]
+// to the 16-bit range.
+func DecodeCFAGreen(r io.Reader) (*image.Gray16, error) {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	if d.mode != mColorFilterArray {
+		return nil, FormatError("not a Color Filter Array image")
+	}
+	if err = d.checkBitsPerSample(); err != nil {
+		return nil, err
+	}
+	rows, cols, colors, err := d.cfaPattern()
+	if err != nil {
+		return nil, err
+	}
+	var greens float64
+	for _, c := range colors {
+		if c == 1 {
+			greens++
+		}
+	}
+	if greens == 0 {
+		return nil, FormatError("CFAPattern without green")
+	}
+
+	black := d.features[tBlackLevel].asFloat(0)
+	white := math.Exp2(float64(d.bpp)) - 1
+	if t, exists := d.features[tWhiteLevel]; exists {
+		white = t.asFloat(0)
+	}
+	if white <= black {
+		return nil, FormatError("WhiteLevel not above BlackLevel")
+	}
+
+	bounds := image.Rect(0, 0, d.config.Width/cols, d.config.Height/rows)
+	l, err := d.layout()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkLimits(bounds, l); err != nil {
+		return nil, err
+	}
+	m := image.NewGray16(bounds)
+	width, height := m.Rect.Dx(), m.Rect.Dy()
+	sums := make([]float64, width*height)
+
+	for k := 0; k < l.across*l.down; k++ {
+		err = d.readSamples(l, k, func(x, y int, v uint16) {
+			if colors[(y%rows)*cols+x%cols] != 1 || x/cols >= width || y/rows >= height {
+				return
+			}
+			sums[(y/rows)*width+x/cols] += float64(v)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, sum := range sums {
+		g := (sum/greens - black) / (white - black)
+		v := uint16(math.Round(math.Max(0, math.Min(g, 1)) * 0xffff))
+		m.Pix[2*i], m.Pix[2*i+1] = byte(v>>8), byte(v)
+	}
+	return m, nil
+}
+
+// readSamples decompresses the k-th strip or tile of the CFA and calls visit for each of its in-bounds samples.
+func (d *decoder) readSamples(l *blockLayout, k int, visit func(x, y int, v uint16)) error {
+	b := l.bounds(k)
+	if err := d.decompressBlock(l, k); err != nil {
+		return err
+	}
+
+	rMaxX := minInt(b.Max.X, d.config.Width)
+	rMaxY := minInt(b.Max.Y, d.config.Height)
+	if rMaxX > b.Min.X && rMaxY > b.Min.Y {
+		if needed := ((rMaxY-b.Min.Y-1)*b.Dx() + rMaxX - b.Min.X) * d.bytesPerPixel; len(d.buf) < needed {
+			return FormatError("not enough pixel data")
+		}
+	}
+
+	for y := b.Min.Y; y < rMaxY; y++ {
+		off := (y - b.Min.Y) * b.Dx() * d.bytesPerPixel
+		for x := b.Min.X; x < rMaxX; x++ {
+			if d.bytesPerPixel == 1 {
+				visit(x, y, uint16(d.buf[off]))
+			} else {
+				visit(x, y, d.byteOrder.Uint16(d.buf[off:off+2]))
+			}
+			off += d.bytesPerPixel
+		}
+	}
+	return nil
+}
+
+// maskedAreasBlackLevels returns the R, G and B black levels averaged over the MaskedAreas,
+// the static BlackLevel being used for the colors without masked pixel.
+func (d *decoder) maskedAreasBlackLevels(l *blockLayout) ([]float64, error) {
+	areas := d.features[tMaskedAreas].val
+	if len(areas)%4 != 0 {
+		return nil, FormatError("MaskedAreas must contain rectangles")
+	}
+	rows, cols, pattern, err := d.cfaPattern()
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+	var rects []image.Rectangle
+	for i := 0; i < len(areas); i += 4 {
+		// Top, left, bottom, right
+		r := image.Rect(int(areas[i+1]), int(areas[i]), int(areas[i+3]), int(areas[i+2])).Intersect(bounds)
+		if !r.Empty() {
+			rects = append(rects, r)
+		}
+	}
+
+	var sums, counts [3]float64
+	for k := 0; k < l.across*l.down; k++ {
+		overlaps := false
+		for _, r := range rects {
+			overlaps = overlaps || r.Overlaps(l.bounds(k))
+		}
+		if !overlaps {
+			continue
+		}
+
+		err := d.readSamples(l, k, func(x, y int, v uint16) {
+			p := image.Pt(x, y)
+			for _, r := range rects {
+				if p.In(r) {
+					c := pattern[(y%rows)*cols+x%cols]
+					if c < 3 {
+						sums[c] += float64(v)
+						counts[c]++
+					}
+					return
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	levels := make([]float64, 3)
+	for c := range levels {
+		levels[c] = d.features[tBlackLevel].asFloat(0)
+		if counts[c] > 0 {
+			levels[c] = sums[c] / counts[c]
+		}
+	}
+	return levels, nil
+}
+
+// EncodeCFA writes the raw mosaic c to w as a DNG.
+// The samples are written as is, 12 and 14 bits samples being bit-packed.
+// The floating point predictor is not supported, nor any predictor for the bit-packed samples.
+func EncodeCFA(w io.Writer, c *CFA, opt *Options) error {
+	e, err := newCFAEncoder(c, opt)
+	if err != nil {
+		return err
+	}
+	return e.encode(w)
+}
+
+func newCFAEncoder(c *CFA, opt *Options) (*encoder, error) {
+	blackLevels := maxInt(int(c.BlackLevelRepeatDim[0]), 1) * maxInt(int(c.BlackLevelRepeatDim[1]), 1)
+	switch {
+	case c.Width <= 0 || c.Height <= 0 || len(c.Pix) != c.Width*c.Height:
+		return nil, FormatError("CFA dimensions do not match its samples")
+	case c.BitsPerSample != 8 && c.BitsPerSample != 12 && c.BitsPerSample != 14 && c.BitsPerSample != 16:
+		return nil, UnsupportedError("CFA BitsPerSample")
+	case len(c.ColorMatrix1) != 9:
+		return nil, FormatError("DNG requires a 3x3 ColorMatrix1")
+	case len(c.ColorMatrix2) != 0 && len(c.ColorMatrix2) != 9:
+		return nil, FormatError("ColorMatrix2 must be a 3x3 matrix")
+	case len(c.BlackLevel) != 0 && len(c.BlackLevel) != blackLevels:
+		return nil, FormatError("BlackLevel does not match BlackLevelRepeatDim")
+	case len(c.DefaultCropOrigin) != 0 && len(c.DefaultCropOrigin) != 2,
+		len(c.DefaultCropSize) != 0 && len(c.DefaultCropSize) != 2,
+		len(c.DefaultUserCrop) != 0 && len(c.DefaultUserCrop) != 4:
+		return nil, FormatError("invalid crop")
+	case c.UniqueCameraModel == "":
+		return nil, FormatError("DNG requires a UniqueCameraModel")
+	case opt != nil && opt.Predictor != PredictorNone && opt.Predictor != PredictorHorizontal:
+		return nil, UnsupportedError("predictor for CFA")
+	case opt != nil && opt.Predictor != PredictorNone && (c.BitsPerSample == 12 || c.BitsPerSample == 14):
+		return nil, UnsupportedError("predictor with bit-packed samples")
+	}
+	for _, v := range c.Pix {
+		if v>>c.BitsPerSample != 0 {
+			return nil, FormatError("CFA sample beyond BitsPerSample")
+		}
+	}
+
+	e := &encoder{
+		byteOrder:       binary.LittleEndian,
+		bounds:          image.Rect(0, 0, c.Width, c.Height),
+		samplesPerPixel: 1,
+	}
+	if opt != nil {
+		e.opt = *opt
+	}
+
+	if c.BitsPerSample == 8 {
+		e.bytesPerPixel = 1
+		e.writePixel = func(p []byte, x, y int) {
+			p[0] = byte(c.Pix[y*c.Width+x])
+		}
+	} else {
+		e.bytesPerPixel = 2
+		e.writePixel = func(p []byte, x, y int) {
+			e.byteOrder.PutUint16(p, c.Pix[y*c.Width+x])
+		}
+	}
+	if c.BitsPerSample == 12 || c.BitsPerSample == 14 {
+		e.packedDepth = c.BitsPerSample
+	}
+
+	model := make([]uint64, 0, len(c.UniqueCameraModel)+1)
+	for i := 0; i < len(c.UniqueCameraModel); i++ {
+		model = append(model, uint64(c.UniqueCameraModel[i]))
+	}
+	model = append(model, 0) // NUL terminated
+
+	rationals := func(sl []float64, signed bool) []uint64 {
+		vals := make([]uint64, len(sl))
+		for i, v := range sl {
+			vals[i] = rationalValue(v, signed)
+		}
+		return vals
+	}
+
+	e.tags = []ifdEntry{
+		{tNewSubFileType, dtLong, []uint64{sftPrimaryImage}},
+		{tBitsPerSample, dtShort, []uint64{uint64(c.BitsPerSample)}},
+		{tPhotometricInterpretation, dtShort, []uint64{pColorFilterArray}},
+		{tSamplesPerPixel, dtShort, []uint64{1}},
+		{tCFARepeatPatternDim, dtShort, []uint64{2, 2}},
+		{tCFAPattern, dtByte, uint64s(c.Pattern[:])},
+		{tDNGVersion, dtByte, []uint64{1, 4, 0, 0}},
+		{tDNGBackwardVersion, dtByte, []uint64{1, 1, 0, 0}},
+		{tUniqueCameraModel, dtASCII, model},
+		{tColorMatrix1, dtSRational, rationals(c.ColorMatrix1, true)},
+	}
+	if c.BlackLevelRepeatDim != [2]uint{} {
+		e.tags = append(e.tags, ifdEntry{tBlackLevelRepeatDim, dtShort, uint64s(c.BlackLevelRepeatDim[:])})
+	}
+	if len(c.BlackLevel) > 0 {
+		e.tags = append(e.tags, ifdEntry{tBlackLevel, dtLong, uint64s(c.BlackLevel)})
+	}
+	if c.WhiteLevel != 0 {
+		e.tags = append(e.tags, ifdEntry{tWhiteLevel, dtLong, []uint64{uint64(c.WhiteLevel)}})
+	}
+	if c.CalibrationIlluminant1 != 0 {
+		e.tags = append(e.tags, ifdEntry{tCalibrationIlluminant1, dtShort, []uint64{uint64(c.CalibrationIlluminant1)}})
+	}
+	if len(c.ColorMatrix2) > 0 {
+		e.tags = append(e.tags, ifdEntry{tColorMatrix2, dtSRational, rationals(c.ColorMatrix2, true)})
+	}
+	if c.CalibrationIlluminant2 != 0 {
+		e.tags = append(e.tags, ifdEntry{tCalibrationIlluminant2, dtShort, []uint64{uint64(c.CalibrationIlluminant2)}})
+	}
+	for _, t := range []struct {
+		tag uint16
+		val []float64
+	}{
+		{tAsShotNeutral, c.AsShotNeutral},
+		{tDefaultCropOrigin, c.DefaultCropOrigin},
+		{tDefaultCropSize, c.DefaultCropSize},
+		{tDefaultUserCrop, c.DefaultUserCrop},
+	} {
+		if len(t.val) > 0 {
+			e.tags = append(e.tags, ifdEntry{t.tag, dtRational, rationals(t.val, false)})
+		}
+	}
+
+	if err := e.layout(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// packSamples packs the 16-bit samples of p, rowLen samples per row, on depth bits MSB first,
+// the rows beginning on byte boundaries.
+func packSamples(p []byte, byteOrder binary.ByteOrder, rowLen, depth int) []byte {
+	rows := len(p) / (2 * rowLen)
+	dst := make([]byte, 0, rows*((rowLen*depth+7)/8))
+	for y := 0; y < rows; y++ {
+		var v uint32
+		var nbits int
+		for i := 0; i < rowLen; i++ {
+			v = v<<depth | uint32(byteOrder.Uint16(p[2*(y*rowLen+i):]))
+			nbits += depth
+			for nbits >= 8 {
+				nbits -= 8
+				dst = append(dst, byte(v>>nbits))
+			}
+		}
+		if nbits > 0 {
+			dst = append(dst, byte(v<<(8-nbits)))
+		}
+	}
+	return dst
+}
+
+// rationalValue returns the (signed) rational closest to f, with 32-bit terms, in the layout of tag.val.
+// The fraction is the last convergent of the continued fraction expansion of f that fits in 32 bits,
+// so that the rationals decoded from a file are encoded back unchanged.
+func rationalValue(f float64, signed bool) uint64 {
+	maxTerm := float64(math.MaxUint32)
+	if signed {
+		maxTerm = math.MaxInt32
+	}
+
+	sign := 1.0
+	if f < 0 {
+		sign, f = -1, -f
+	}
+
+	h0, h1 := 0.0, 1.0 // Numerators
+	k0, k1 := 1.0, 0.0 // Denominators
+	x := f
+	for i := 0; i < 64; i++ {
+		a := math.Floor(x)
+		h2, k2 := a*h1+h0, a*k1+k0
+		if h2 > maxTerm || k2 > maxTerm {
+			break
+		}
+		h0, h1, k0, k1 = h1, h2, k1, k2
+		if h1/k1 == f || x == a {
+			break
+		}
+		x = 1 / (x - a)
+	}
+	if k1 == 0 { // f does not fit in 32 bits
+		h1, k1 = maxTerm, 1
+	}
+
+	num := int64(sign * h1)
+	return uint64(uint32(k1))<<32 | uint64(uint32(num)) // Numerator first in little-endian
+}
@@ -0,0 +1,204 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCFA(width, height, depth int) *CFA {
+	c := &CFA{
+		Width:                  width,
+		Height:                 height,
+		BitsPerSample:          depth,
+		Pix:                    make([]uint16, width*height),
+		Pattern:                [4]uint{0, 1, 1, 2},
+		BlackLevel:             []uint{16},
+		AsShotNeutral:          []float64{0.5, 1, 0.625},
+		ColorMatrix1:           []float64{0.6722, -0.0635, -0.0963, -0.4287, 1.246, 0.2046, -0.0779, 0.1449, 0.6433},
+		CalibrationIlluminant1: lsD65,
+		UniqueCameraModel:      "Test Camera",
+	}
+	for i := range c.Pix {
+		c.Pix[i] = uint16((i*997 + 16) % (1 << depth))
+	}
+	return c
+}
+
+func TestEncodeCFA(t *testing.T) {
+	for name, opt := range map[string]*Options{
+		"default":   nil,
+		"strips":    {RowsPerStrip: 3},
+		"tiles":     {Deflate: true, TileWidth: 16, TileLength: 16},
+		"predictor": {Deflate: true, Predictor: PredictorHorizontal},
+	} {
+		for _, depth := range []int{8, 12, 14, 16} {
+			c := testCFA(21, 19, depth)
+
+			var buf bytes.Buffer
+			if name == "predictor" && (depth == 12 || depth == 14) {
+				assert.Error(t, EncodeCFA(&buf, c, opt), "%s %d bits", name, depth)
+				continue
+			}
+			assert.NoError(t, EncodeCFA(&buf, c, opt), name)
+
+			decoded, err := DecodeCFA(bytes.NewReader(buf.Bytes()))
+			assert.NoError(t, err, name)
+			assert.Equal(t, c, decoded, "%s %d bits", name, depth)
+		}
+	}
+}
+
+func TestEncodeCFAPacked(t *testing.T) {
+	c := testCFA(21, 19, 14)
+	var buf bytes.Buffer
+	assert.NoError(t, EncodeCFA(&buf, c, nil))
+
+	// 294 bits per row
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint(14), d.firstVal(tBitsPerSample))
+	assert.Equal(t, uint(19*37), d.firstVal(tStripByteCounts))
+
+	c.Pix[3] = 1 << 14
+	assert.Error(t, EncodeCFA(new(bytes.Buffer), c, nil))
+}
+
+func TestEncodeCFAMetadata(t *testing.T) {
+	c := testCFA(8, 6, 16)
+	c.BlackLevelRepeatDim = [2]uint{2, 2}
+	c.BlackLevel = []uint{16, 17, 18, 19}
+	c.ColorMatrix2 = []float64{0.7, -0.1, -0.1, -0.4, 1.2, 0.2, -0.1, 0.2, 0.6}
+	c.CalibrationIlluminant2 = 17 // Standard light A
+	c.DefaultCropOrigin = []float64{1, 1.5}
+	c.DefaultCropSize = []float64{6, 4}
+	c.DefaultUserCrop = []float64{0, 0.25, 1, 0.75}
+
+	var buf bytes.Buffer
+	assert.NoError(t, EncodeCFA(&buf, c, nil))
+	decoded, err := DecodeCFA(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, c, decoded)
+
+	c.BlackLevel = c.BlackLevel[:3]
+	assert.Error(t, EncodeCFA(new(bytes.Buffer), c, nil))
+	c.BlackLevel = nil
+	c.ColorMatrix2 = c.ColorMatrix2[:4]
+	assert.Error(t, EncodeCFA(new(bytes.Buffer), c, nil))
+	c.ColorMatrix2 = nil
+	c.DefaultCropSize = c.DefaultCropSize[:1]
+	assert.Error(t, EncodeCFA(new(bytes.Buffer), c, nil))
+}
+
+func TestEncodeCFADeveloped(t *testing.T) {
+	const width, height = 4, 2
+
+	c := testCFA(width, height, 16)
+	c.WhiteLevel = 60000
+	c.ColorMatrix1 = []float64{2, 0, 0, 0, 1, 0, 0, 0.25, 0.5}
+	var buf bytes.Buffer
+	assert.NoError(t, EncodeCFA(&buf, c, nil))
+
+	strip := make([]byte, 2*len(c.Pix))
+	for i, v := range c.Pix {
+		binary.LittleEndian.PutUint16(strip[2*i:], v)
+	}
+	expected, err := Decode(bytes.NewReader(newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		add(tBlackLevel, dtShort, 16).
+		add(tWhiteLevel, dtShort, 60000).
+		add(tAsShotNeutral, dtRational, 1, 2, 1, 1, 5, 8).
+		add(tColorMatrix1, dtSRational, 2, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 1, 4, 1, 2).
+		add(tCalibrationIlluminant1, dtShort, lsD65).
+		strips(strip).
+		bytes()))
+	assert.NoError(t, err)
+
+	m, err := Decode(&buf)
+	assert.NoError(t, err)
+	assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+}
+
+func TestDecodeCFAPacked(t *testing.T) {
+	const width, height = 4, 2
+
+	samples := make([]uint16, width*height)
+	for i := range samples {
+		samples[i] = uint16(500*i + 3)
+	}
+
+	c, err := DecodeCFA(bytes.NewReader(newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 12).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 1, 0, 2, 1).
+		strips(pack(samples, width, 12)).
+		bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, samples, c.Pix)
+	assert.Equal(t, 12, c.BitsPerSample)
+	assert.Equal(t, [4]uint{1, 0, 2, 1}, c.Pattern)
+
+	// The DNG requirements are enforced.
+	assert.Error(t, EncodeCFA(new(bytes.Buffer), c, nil))
+	c.UniqueCameraModel = "Test Camera"
+	c.ColorMatrix1 = []float64{1, 0, 0, 0, 1, 0, 0, 0, 1}
+	assert.NoError(t, EncodeCFA(new(bytes.Buffer), c, nil))
+	assert.Error(t, EncodeCFA(new(bytes.Buffer), c, &Options{Predictor: PredictorFloatingPoint}))
+}
+
+func TestRationalValue(t *testing.T) {
+	for _, f := range []float64{0, 1, 0.5, 0.6722, -0.0635, 1.246, 1.0 / 3, -2.0 / 7, 65535.5} {
+		v := rationalValue(f, true)
+		r, _ := tag{datatype: dtSRational, val: []uint64{v}}.sRational(0).Float64()
+		assert.Equal(t, f, r)
+	}
+
+	v := rationalValue(3000000000.5, false)
+	assert.Equal(t, 3000000000.0, tag{datatype: dtRational, val: []uint64{v}}.asFloat(0))
+}
+
+func TestDecodeCFAGreen(t *testing.T) {
+	const width, height = 5, 4
+	b := cfaImage(width, height).
+		add(tBlackLevel, dtShort, 16).
+		add(tWhiteLevel, dtShort, 100)
+
+	m, err := DecodeCFAGreen(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 2, 2), m.Bounds())
+
+	sample := func(x, y int) float64 { return float64(16 * ((y*width+x)%7 + 1)) }
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			// The greens of the RGGB pattern, clipped to the WhiteLevel
+			g := (sample(2*x+1, 2*y)+sample(2*x, 2*y+1))/2 - 16
+			expected := uint16(math.Round(math.Min(g/84, 1) * 0xffff))
+			assert.Equal(t, expected, m.Gray16At(x, y).Y, "pixel (%d,%d)", x, y)
+		}
+	}
+
+	_, err = DecodeCFAGreen(bytes.NewReader(b.add(tCFAPattern, dtByte, 0, 2, 2, 0).bytes()))
+	assert.EqualError(t, err, "tiff: invalid format: CFAPattern without green")
+
+	var rgb bytes.Buffer
+	assert.NoError(t, Encode(&rgb, testRGBImage(4, 4), nil))
+	_, err = DecodeCFAGreen(&rgb)
+	assert.EqualError(t, err, "tiff: invalid format: not a Color Filter Array image")
+}
@@ -0,0 +1,53 @@
+package tiff
+
+import (
+	"io"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// XYZToxyY converts c to the CIE xyY color space: the x and y chromaticity coordinates and
+// the Y luminance. The chromaticity of black, which is undefined, is the one of D65.
+func XYZToxyY(c hdrcolor.XYZ) (x, y, Y float64) {
+	sum := c.X + c.Y + c.Z
+	if sum == 0 {
+		w := whitePoints[D65]
+		sum = w[0] + w[1] + w[2]
+		return w[0] / sum, w[1] / sum, 0
+	}
+	return c.X / sum, c.Y / sum, c.Y
+}
+
+// AverageChromaticity reads a TIFF image decoded as XYZ (e.g. LogLuv or LogL) from r and returns
+// the x and y chromaticity coordinates of its mean color and its mean Y luminance.
+// The chromaticity is the one of the mean XYZ color, not the mean of the pixel chromaticities which
+// would give the same weight to the dark pixels as to the bright ones.
+func AverageChromaticity(r io.Reader) (x, y, Y float64, err error) {
+	m, err := Decode(r)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	xyz, ok := m.(*hdr.XYZ)
+	if !ok {
+		return 0, 0, 0, UnsupportedError("chromaticity of an image not decoded as XYZ")
+	}
+
+	var mean hdrcolor.XYZ
+	b := xyz.Bounds()
+	for py := b.Min.Y; py < b.Max.Y; py++ {
+		for px := b.Min.X; px < b.Max.X; px++ {
+			c := xyz.XYZAt(px, py)
+			mean.X += c.X
+			mean.Y += c.Y
+			mean.Z += c.Z
+		}
+	}
+	if n := float64(b.Dx() * b.Dy()); n > 0 {
+		mean.X /= n
+		mean.Y /= n
+		mean.Z /= n
+	}
+	x, y, Y = XYZToxyY(mean)
+	return x, y, Y, nil
+}
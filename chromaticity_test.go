@@ -0,0 +1,71 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/mdouchement/hdr/format"
+	"github.com/mdouchement/hdr/hdrcolor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXYZToxyY(t *testing.T) {
+	x, y, Y := XYZToxyY(hdrcolor.XYZ{X: 0.95047, Y: 1, Z: 1.08883})
+	assert.InDeltaSlice(t, []float64{0.3127, 0.3290, 1}, []float64{x, y, Y}, 1e-4)
+
+	x, y, Y = XYZToxyY(hdrcolor.XYZ{X: 1, Y: 2, Z: 1})
+	assert.Equal(t, []float64{0.25, 0.5, 2}, []float64{x, y, Y})
+
+	// Black
+	x, y, Y = XYZToxyY(hdrcolor.XYZ{})
+	assert.InDeltaSlice(t, []float64{0.3127, 0.3290, 0}, []float64{x, y, Y}, 1e-4)
+}
+
+func TestAverageChromaticity(t *testing.T) {
+	const width, height = 2, 2
+
+	var strip []byte
+	var mean [3]float64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := logluvPixel(x, y)
+			strip = append(strip, p...)
+			X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+			for c, v := range f32(X, Y, Z) {
+				mean[c] += v / (width * height)
+			}
+		}
+	}
+
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips(strip).
+		bytes()
+
+	x, y, Y, err := AverageChromaticity(bytes.NewReader(data))
+	assert.NoError(t, err)
+	sum := mean[0] + mean[1] + mean[2]
+	assert.InDeltaSlice(t, []float64{mean[0] / sum, mean[1] / sum, mean[1]}, []float64{x, y, Y}, 1e-9)
+
+	// RGB images are not decoded as XYZ.
+	rgb := make([]byte, 12)
+	binary.LittleEndian.PutUint32(rgb, math.Float32bits(1))
+	data = newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, 3, 3, 3).
+		strips(rgb).
+		bytes()
+	_, _, _, err = AverageChromaticity(bytes.NewReader(data))
+	assert.Error(t, err)
+}
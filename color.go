@@ -0,0 +1,105 @@
+package tiff
+
+import "math"
+
+// mat3 is a row-major 3x3 matrix.
+type mat3 [9]float64
+
+var (
+	// sRGBToXYZ converts linear sRGB to XYZ (D65).
+	sRGBToXYZ = mat3{
+		0.4124564, 0.3575761, 0.1804375,
+		0.2126729, 0.7151522, 0.0721750,
+		0.0193339, 0.1191920, 0.9503041,
+	}
+
+	// identity is the identity matrix.
+	identity = mat3{
+		1, 0, 0,
+		0, 1, 0,
+		0, 0, 1,
+	}
+
+	// bradford is the cone response matrix of the Bradford chromatic adaptation.
+	bradford = mat3{
+		0.8951, 0.2664, -0.1614,
+		-0.7502, 1.7135, 0.0367,
+		0.0389, -0.0685, 1.0296,
+	}
+
+	// whitePoints contains the XYZ coordinates of the reference whites.
+	whitePoints = map[WhitePoint][3]float64{
+		D65: {0.95047, 1, 1.08883},
+		D50: {0.96422, 1, 0.82521},
+	}
+)
+
+// sRGBToLinear returns the linear value of the gamma encoded sRGB value v in the range [0, 1].
+func sRGBToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB returns the gamma encoded sRGB value of the linear value v in the range [0, 1].
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// mul returns the product m×n.
+func (m mat3) mul(n mat3) (r mat3) {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			r[3*i+j] = m[3*i]*n[j] + m[3*i+1]*n[3+j] + m[3*i+2]*n[6+j]
+		}
+	}
+	return
+}
+
+// apply returns the product of m with the column vector (a, b, c).
+func (m mat3) apply(a, b, c float64) (float64, float64, float64) {
+	return m[0]*a + m[1]*b + m[2]*c,
+		m[3]*a + m[4]*b + m[5]*c,
+		m[6]*a + m[7]*b + m[8]*c
+}
+
+// inverse returns the inverse of m and false if m is singular.
+func (m mat3) inverse() (mat3, bool) {
+	det := m[0]*(m[4]*m[8]-m[5]*m[7]) -
+		m[1]*(m[3]*m[8]-m[5]*m[6]) +
+		m[2]*(m[3]*m[7]-m[4]*m[6])
+	if det == 0 {
+		return mat3{}, false
+	}
+
+	return mat3{
+		(m[4]*m[8] - m[5]*m[7]) / det,
+		(m[2]*m[7] - m[1]*m[8]) / det,
+		(m[1]*m[5] - m[2]*m[4]) / det,
+		(m[5]*m[6] - m[3]*m[8]) / det,
+		(m[0]*m[8] - m[2]*m[6]) / det,
+		(m[2]*m[3] - m[0]*m[5]) / det,
+		(m[3]*m[7] - m[4]*m[6]) / det,
+		(m[1]*m[6] - m[0]*m[7]) / det,
+		(m[0]*m[4] - m[1]*m[3]) / det,
+	}, true
+}
+
+// chromaticAdaptation returns the Bradford matrix converting XYZ values relative to src into XYZ values relative to dst.
+func chromaticAdaptation(src, dst WhitePoint) mat3 {
+	ws, wd := whitePoints[src], whitePoints[dst]
+	s0, s1, s2 := bradford.apply(ws[0], ws[1], ws[2])
+	d0, d1, d2 := bradford.apply(wd[0], wd[1], wd[2])
+
+	scale := mat3{
+		d0 / s0, 0, 0,
+		0, d1 / s1, 0,
+		0, 0, d2 / s2,
+	}
+	inv, _ := bradford.inverse()
+	return inv.mul(scale).mul(bradford)
+}
@@ -0,0 +1,92 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChromaticAdaptation(t *testing.T) {
+	// http://www.brucelindbloom.com/index.html?Eqn_ChromAdapt.html
+	expected := mat3{
+		1.0478112, 0.0228866, -0.0501270,
+		0.0295424, 0.9904844, -0.0170491,
+		-0.0092345, 0.0150436, 0.7521316,
+	}
+	m := chromaticAdaptation(D65, D50)
+	for i := range expected {
+		assert.InDelta(t, expected[i], m[i], 1e-6)
+	}
+
+	w := whitePoints[D65]
+	X, Y, Z := m.apply(w[0], w[1], w[2])
+	w = whitePoints[D50]
+	assert.InDelta(t, w[0], X, 1e-6)
+	assert.InDelta(t, w[1], Y, 1e-6)
+	assert.InDelta(t, w[2], Z, 1e-6)
+}
+
+func TestMat3Inverse(t *testing.T) {
+	inv, ok := sRGBToXYZ.inverse()
+	assert.True(t, ok)
+
+	identity := inv.mul(sRGBToXYZ)
+	for i := range identity {
+		expected := 0.0
+		if i%4 == 0 {
+			expected = 1
+		}
+		assert.InDelta(t, expected, identity[i], 1e-9)
+	}
+
+	_, ok = mat3{}.inverse()
+	assert.False(t, ok)
+}
+
+// cfaImage returns an 8-bit RGGB CFA image of the given dimensions.
+func cfaImage(width, height int) *tiffBuilder {
+	strip := make([]byte, width*height)
+	for i := range strip {
+		strip[i] = byte(16 * (i%7 + 1))
+	}
+
+	return newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, uint64(width)).
+		add(tImageLength, dtShort, uint64(height)).
+		add(tBitsPerSample, dtShort, 8).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		strips(strip)
+}
+
+func TestDecodeCFAOutputWhitePoint(t *testing.T) {
+	data := cfaImage(4, 4).bytes()
+
+	d65, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	d50, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{OutputWhitePoint: D50})
+	assert.NoError(t, err)
+
+	adaptation := chromaticAdaptation(D65, D50)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			X, Y, Z, _ := d65.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			X, Y, Z = adaptation.apply(X, Y, Z)
+			X2, Y2, Z2, _ := d50.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.InDelta(t, X, X2, 1e-6)
+			assert.InDelta(t, Y, Y2, 1e-6)
+			assert.InDelta(t, Z, Z2, 1e-6)
+		}
+	}
+
+	for _, w := range []WhitePoint{-1, D50 + 1} {
+		_, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{OutputWhitePoint: w})
+		assert.Equal(t, FormatError("unknown OutputWhitePoint"), err)
+	}
+}
@@ -57,18 +57,14 @@ func unpackBits(r io.Reader) ([]byte, error) {
 // unRLE decodes the Run-Length Encoded data in src and returns the
 // uncompressed data. For LogLuv, each of four bytestreams is encoded separately per row.
 // This compression is used for LogLuv anf LogL (mode: mLogLuv or LogL).
+// bytesPerPixel is the number of bytestreams per row (4 for LogLuv, 2 for LogL).
 // blockWidth and blockHeight are the dimmension of the Strip or Tiles.
-func unRLE(r io.Reader, mode imageMode, blockWidth, blockHeight int) (dst []byte, err error) {
+func unRLE(r io.Reader, bytesPerPixel, blockWidth, blockHeight int) (dst []byte, err error) {
 	br, ok := r.(byteReader)
 	if !ok {
 		br = bufio.NewReader(r)
 	}
 
-	bytesPerPixel := 4 // mLogLuv
-	if mode == mLogL {
-		bytesPerPixel = 2 // Luminance without chromatic u, v parts
-	}
-
 	var b byte
 	dst = make([]byte, blockWidth*blockHeight*bytesPerPixel)
 
@@ -119,3 +115,46 @@ func unRLE(r io.Reader, mode imageMode, blockWidth, blockHeight int) (dst []byte
 
 	return
 }
+
+// encodeRLE is the inverse of unRLE, it Run-Length Encodes separately each of the bytesPerPixel
+// bytestreams of each row of src, whose blockWidth x blockHeight pixels are interleaved.
+// Runs of at least 3 bytes are encoded as runs, the other bytes as non-runs.
+func encodeRLE(src []byte, bytesPerPixel, blockWidth, blockHeight int) []byte {
+	var dst []byte
+	stream := make([]byte, blockWidth)
+
+	for row := 0; row < blockHeight; row++ {
+		rowOffset := row * blockWidth * bytesPerPixel
+
+		for channel := 0; channel < bytesPerPixel; channel++ {
+			for x := range stream {
+				stream[x] = src[rowOffset+x*bytesPerPixel+channel]
+			}
+
+			for x := 0; x < len(stream); {
+				runLength := 1
+				for x+runLength < len(stream) && runLength < 129 && stream[x+runLength] == stream[x] {
+					runLength++
+				}
+				if runLength >= 3 {
+					dst = append(dst, byte(runLength+128-2), stream[x])
+					x += runLength
+					continue
+				}
+
+				// A non-run, up to the next run
+				start := x
+				for x < len(stream) && x-start < 127 {
+					if x+2 < len(stream) && stream[x] == stream[x+1] && stream[x] == stream[x+2] {
+						break
+					}
+					x++
+				}
+				dst = append(dst, byte(x-start))
+				dst = append(dst, stream[start:x]...)
+			}
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,72 @@
+package tiff
+
+import "fmt"
+
+// A Compression is the compression scheme of the strips or tiles of a TIFF image.
+type Compression uint
+
+// Compression schemes.
+const (
+	CompressionNone           Compression = cNone
+	CompressionCCITT          Compression = cCCITT
+	CompressionG3             Compression = cG3
+	CompressionG4             Compression = cG4
+	CompressionLZW            Compression = cLZW
+	CompressionJPEGOld        Compression = cJPEGOld
+	CompressionJPEG           Compression = cJPEG
+	CompressionDeflate        Compression = cDeflate
+	CompressionPackBits       Compression = cPackBits
+	CompressionDeflateOld     Compression = cDeflateOld
+	CompressionSGILogRLE      Compression = cSGILogRLE
+	CompressionSGILog24Packed Compression = cSGILog24Packed
+	CompressionLossyJPEG      Compression = cLossyJPEG
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone:           "None",
+	CompressionCCITT:          "CCITT",
+	CompressionG3:             "Group 3 Fax",
+	CompressionG4:             "Group 4 Fax",
+	CompressionLZW:            "LZW",
+	CompressionJPEGOld:        "Old JPEG",
+	CompressionJPEG:           "JPEG",
+	CompressionDeflate:        "Deflate (zlib compression)",
+	CompressionPackBits:       "PackBits",
+	CompressionDeflateOld:     "Old Deflate",
+	CompressionSGILogRLE:      "SGI Log Luminance RLE",
+	CompressionSGILog24Packed: "SGI Log 24-bits packed",
+	CompressionLossyJPEG:      "Lossy JPEG",
+}
+
+// supportedCompressions lists the compression schemes handled by decoder#decompress.
+var supportedCompressions = []Compression{
+	CompressionNone,
+	CompressionLZW,
+	CompressionDeflate,
+	CompressionPackBits,
+	CompressionDeflateOld,
+	CompressionSGILogRLE,
+	CompressionSGILog24Packed,
+}
+
+// SupportedCompressions returns the compression schemes that can be decoded.
+func SupportedCompressions() []Compression {
+	return append([]Compression(nil), supportedCompressions...)
+}
+
+// IsSupported reports whether the strips or tiles compressed with c can be decoded.
+func (c Compression) IsSupported() bool {
+	for _, s := range supportedCompressions {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", uint(c))
+}
@@ -0,0 +1,34 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionIsSupported(t *testing.T) {
+	for c := range compressionNames {
+		d := &decoder{
+			idf: &idf{
+				r:         bytes.NewReader(nil),
+				byteOrder: binary.LittleEndian,
+				features: map[uint16]tag{
+					tCompression: {id: tCompression, datatype: dtShort, val: []uint64{uint64(c)}},
+				},
+			},
+			bytesPerPixel: 4,
+			compression:   uint(c),
+		}
+
+		err := d.decompress(0, 0, 1, 1)
+		assert.Equal(t, !errors.Is(err, ErrUnsupportedCompression), c.IsSupported(), "%v", c)
+	}
+
+	assert.Equal(t, "JPEG", CompressionJPEG.String())
+	assert.Equal(t, "Compression(42)", Compression(42).String())
+	assert.False(t, Compression(42).IsSupported())
+	assert.Contains(t, SupportedCompressions(), CompressionDeflate)
+}
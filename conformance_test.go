@@ -0,0 +1,342 @@
+package tiff
+
+import (
+	"bytes"
+	"compress/lzw"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+// A conformanceKind is a kind of image of the conformance matrix, whose samples are synthesized.
+type conformanceKind struct {
+	name         string
+	tags         func(b *tiffBuilder) *tiffBuilder
+	compressions []uint
+	// pixel returns the raw pixel at (x, y), most significant byte first for the SGILog RLE.
+	pixel func(byteOrder binary.ByteOrder, compression uint, x, y int) []byte
+	// check checks the decoded pixel at (x, y).
+	check func(t *testing.T, m hdr.Image, x, y int)
+}
+
+var conformanceKinds = []conformanceKind{
+	{
+		name: "RGB32",
+		tags: func(b *tiffBuilder) *tiffBuilder {
+			return b.add(tBitsPerSample, dtShort, 32, 32, 32).
+				add(tPhotometricInterpretation, dtShort, pRGB).
+				add(tSamplesPerPixel, dtShort, 3).
+				add(tSampleFormat, dtShort, sfIEEEFP, sfIEEEFP, sfIEEEFP)
+		},
+		compressions: []uint{cNone, cLZW, cDeflate, cPackBits},
+		pixel: func(byteOrder binary.ByteOrder, _ uint, x, y int) []byte {
+			p := make([]byte, 12)
+			byteOrder.PutUint32(p[0:], math.Float32bits(float32(x)+0.5))
+			byteOrder.PutUint32(p[4:], math.Float32bits(float32(y)*2))
+			byteOrder.PutUint32(p[8:], math.Float32bits(float32(x*y)/4))
+			return p
+		},
+		check: func(t *testing.T, m hdr.Image, x, y int) {
+			r, g, b, _ := m.HDRAt(x, y).HDRRGBA()
+			assert.Equal(t, []float64{float64(x) + 0.5, float64(y) * 2, float64(x*y) / 4}, []float64{r, g, b})
+		},
+	},
+	{
+		name: "LogLuv",
+		tags: func(b *tiffBuilder) *tiffBuilder {
+			return b.add(tBitsPerSample, dtShort, 16).
+				add(tPhotometricInterpretation, dtShort, pLogLuv).
+				add(tSamplesPerPixel, dtShort, 3)
+		},
+		compressions: []uint{cSGILogRLE, cNone},
+		pixel: func(byteOrder binary.ByteOrder, compression uint, x, y int) []byte {
+			p := logluvPixel(x, y)
+			if compression != cSGILogRLE {
+				byteOrder.PutUint32(p, binary.BigEndian.Uint32(p))
+			}
+			return p
+		},
+		check: func(t *testing.T, m hdr.Image, x, y int) {
+			X, Y, Z, _ := m.HDRAt(x, y).HDRXYZA()
+			eX, eY, eZ := logLuv32ToXYZ(binary.BigEndian.Uint32(logluvPixel(x, y)))
+			assert.InDeltaSlice(t, []float64{eX, eY, eZ}, []float64{X, Y, Z}, 1e-4*eY)
+		},
+	},
+	{
+		name: "LogL",
+		tags: func(b *tiffBuilder) *tiffBuilder {
+			return b.add(tBitsPerSample, dtShort, 16).
+				add(tPhotometricInterpretation, dtShort, pLogL).
+				add(tSamplesPerPixel, dtShort, 1)
+		},
+		compressions: []uint{cSGILogRLE, cNone},
+		pixel: func(byteOrder binary.ByteOrder, compression uint, x, y int) []byte {
+			p := make([]byte, 2)
+			if compression != cSGILogRLE {
+				byteOrder.PutUint16(p, uint16(0x3f00+16*x+y))
+			} else {
+				binary.BigEndian.PutUint16(p, uint16(0x3f00+16*x+y))
+			}
+			return p
+		},
+		check: func(t *testing.T, m hdr.Image, x, y int) {
+			_, Y, _, _ := m.HDRAt(x, y).HDRXYZA()
+			assert.InDelta(t, sleToY(uint16(0x3f00+16*x+y)), Y, 1e-6)
+		},
+	},
+	{
+		name: "CFA",
+		tags: func(b *tiffBuilder) *tiffBuilder {
+			return b.add(tBitsPerSample, dtShort, 16).
+				add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+				add(tSamplesPerPixel, dtShort, 1).
+				add(tCFARepeatPatternDim, dtShort, 2, 2).
+				add(tCFAPattern, dtByte, 0, 1, 1, 2)
+		},
+		compressions: []uint{cNone, cLZW, cDeflate, cPackBits},
+		pixel: func(byteOrder binary.ByteOrder, _ uint, x, y int) []byte {
+			p := make([]byte, 2)
+			byteOrder.PutUint16(p, []uint16{30000, 20000, 20000, 10000}[(y%2)*2+x%2]) // Uniform color
+			return p
+		},
+		check: func(t *testing.T, m hdr.Image, x, y int) {
+			// The pattern is anchored to the image, whatever the dimensions of the blocks.
+			X, Y, Z, _ := m.HDRAt(x, y).HDRXYZA()
+			eX, eY, eZ, _ := m.HDRAt(0, 0).HDRXYZA()
+			assert.InDeltaSlice(t, []float64{eX, eY, eZ}, []float64{X, Y, Z}, 1e-6, "pixel (%d,%d)", x, y)
+		},
+	},
+}
+
+// conformanceImage synthesizes the width x height image of kind, stored in strips of 3 rows
+// or in 16x16 tiles, so that the blocks do not begin on the even rows and columns only.
+func conformanceImage(kind conformanceKind, byteOrder binary.ByteOrder, compression uint, tiled bool, width, height int) ([]byte, error) {
+	blockWidth, blockHeight := width, 3
+	if tiled {
+		blockWidth, blockHeight = 16, 16
+	}
+
+	b := kind.tags(newTIFFBuilder(byteOrder)).
+		add(tImageWidth, dtShort, uint64(width)).
+		add(tImageLength, dtShort, uint64(height)).
+		add(tCompression, dtShort, uint64(compression))
+
+	var blocks [][]byte
+	for by := 0; by < height; by += blockHeight {
+		for bx := 0; bx < width; bx += blockWidth {
+			rows := blockHeight
+			if !tiled {
+				rows = minInt(blockHeight, height-by) // The last strip is truncated.
+			}
+
+			var block []byte
+			bytesPerPixel := len(kind.pixel(byteOrder, compression, 0, 0))
+			for y := by; y < by+rows; y++ {
+				for x := bx; x < bx+blockWidth; x++ {
+					if x < width && y < height {
+						block = append(block, kind.pixel(byteOrder, compression, x, y)...)
+					} else {
+						block = append(block, make([]byte, bytesPerPixel)...) // Padding
+					}
+				}
+			}
+
+			block, err := compressConformanceBlock(block, compression, bytesPerPixel, blockWidth, rows)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		}
+	}
+
+	if tiled {
+		b.add(tTileWidth, dtShort, uint64(blockWidth)).
+			add(tTileLength, dtShort, uint64(blockHeight)).
+			tiles(blocks...)
+	} else {
+		b.add(tRowsPerStrip, dtShort, uint64(blockHeight)).
+			strips(blocks...)
+	}
+	return b.bytes(), nil
+}
+
+// lzwCompress compresses data with the LZW of TIFF, whose codes widen one code earlier than
+// the ones of compress/lzw ("early change").
+func lzwCompress(data []byte, order lzw.Order) []byte {
+	const clear, eoi = 256, 257
+	var (
+		dst   []byte
+		bits  uint32
+		nBits uint
+		width uint = 9
+		next       = eoi + 1
+		table      = map[int]int{} // prefix<<8 | byte to code
+	)
+	emit := func(code int) {
+		if order == lzw.LSB {
+			bits |= uint32(code) << nBits
+			nBits += width
+			for ; nBits >= 8; nBits -= 8 {
+				dst = append(dst, byte(bits))
+				bits >>= 8
+			}
+			return
+		}
+		bits |= uint32(code) << (32 - width - nBits)
+		nBits += width
+		for ; nBits >= 8; nBits -= 8 {
+			dst = append(dst, byte(bits>>24))
+			bits <<= 8
+		}
+	}
+
+	emit(clear)
+	if len(data) > 0 {
+		w := int(data[0])
+		for _, c := range data[1:] {
+			if code, ok := table[w<<8|int(c)]; ok {
+				w = code
+				continue
+			}
+			emit(w)
+			table[w<<8|int(c)] = next
+			w = int(c)
+			if next++; next >= 1<<width {
+				if width == 12 {
+					emit(clear)
+					width, next, table = 9, eoi+1, map[int]int{}
+				} else {
+					width++
+				}
+			}
+		}
+		emit(w)
+		if next++; next >= 1<<width && width < 12 {
+			width++
+		}
+	}
+	emit(eoi)
+	if nBits > 0 {
+		if order == lzw.LSB {
+			dst = append(dst, byte(bits))
+		} else {
+			dst = append(dst, byte(bits>>24))
+		}
+	}
+	return dst
+}
+
+func compressConformanceBlock(block []byte, compression uint, bytesPerPixel, width, height int) ([]byte, error) {
+	var buf bytes.Buffer
+	switch compression {
+	case cNone:
+		return block, nil
+	case cLZW:
+		return lzwCompress(block, lzw.MSB), nil
+	case cDeflate:
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write(block); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case cPackBits:
+		// Literal runs only
+		for i := 0; i < len(block); i += 128 {
+			n := minInt(128, len(block)-i)
+			buf.WriteByte(byte(n - 1))
+			buf.Write(block[i : i+n])
+		}
+	case cSGILogRLE:
+		return encodeRLE(block, bytesPerPixel, width, height), nil
+	default:
+		return nil, fmt.Errorf("compression %d", compression)
+	}
+	return buf.Bytes(), nil
+}
+
+// TestConformance decodes each supported combination of image kind, compression, strips or tiles
+// and byte order. The variants of a kind and a layout must decode to the same image.
+func TestConformance(t *testing.T) {
+	const width, height = 20, 8
+
+	for _, kind := range conformanceKinds {
+		for _, tiled := range []bool{false, true} {
+			var reference image.Image
+			for _, compression := range kind.compressions {
+				for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+					name := fmt.Sprintf("%s %v tiled:%v %v", kind.name, Compression(compression), tiled, byteOrder)
+
+					data, err := conformanceImage(kind, byteOrder, compression, tiled, width, height)
+					assert.NoError(t, err, name)
+					m, err := Decode(bytes.NewReader(data))
+					if !assert.NoError(t, err, name) {
+						continue
+					}
+					assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds(), name)
+
+					if reference == nil {
+						reference = m
+						if kind.check != nil {
+							for y := 0; y < height; y++ {
+								for x := 0; x < width; x++ {
+									kind.check(t, m.(hdr.Image), x, y)
+								}
+							}
+						}
+						continue
+					}
+					assert.Equal(t, reference, m, name)
+				}
+			}
+		}
+	}
+}
+
+// TestConformanceEncoder decodes the output of each layout and compression of the encoder.
+func TestConformanceEncoder(t *testing.T) {
+	const width, height = 20, 8
+	rgb := testRGBImage(width, height)
+
+	logluv, err := conformanceImage(conformanceKinds[1], binary.LittleEndian, cSGILogRLE, false, width, height)
+	assert.NoError(t, err)
+	xyz, err := Decode(bytes.NewReader(logluv))
+	assert.NoError(t, err)
+
+	for _, opt := range []Options{
+		{},
+		{Deflate: true},
+		{Deflate: true, Predictor: PredictorFloatingPoint},
+		{Deflate: true, Predictor: PredictorHorizontal},
+		{TileWidth: 16, TileLength: 16},
+		{Deflate: true, Predictor: PredictorFloatingPoint, TileWidth: 16, TileLength: 16},
+		{Predictor: PredictorHorizontal, TileWidth: 16, TileLength: 16},
+		{RowsPerStrip: 1},
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, Encode(&buf, rgb, &opt), "%+v", opt)
+		m, err := Decode(&buf)
+		assert.NoError(t, err, "%+v", opt)
+		assert.Equal(t, rgb, m, "%+v", opt)
+	}
+
+	// The LogLuv pixels are encoded back unchanged.
+	for _, opt := range []Options{
+		{LogLuv: true},
+		{LogLuv: true, RowsPerStrip: 2},
+		{LogLuv: true, TileWidth: 16, TileLength: 16},
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, Encode(&buf, xyz.(hdr.Image), &opt), "%+v", opt)
+		m, err := Decode(&buf)
+		assert.NoError(t, err, "%+v", opt)
+		assert.Equal(t, xyz, m, "%+v", opt)
+	}
+}
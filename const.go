@@ -15,7 +15,12 @@ const (
 	leHeader = "II\x2A\x00" // Header for little-endian files.
 	beHeader = "MM\x00\x2A" // Header for big-endian files.
 
-	ifdLen = 12 // Length of an IFD entry in bytes.
+	// BigTIFF headers, followed by the bytesize of the offsets (8), 0 and the 8-byte offset of the first IFD.
+	leBigHeader = "II\x2B\x00"
+	beBigHeader = "MM\x00\x2B"
+
+	ifdLen    = 12 // Length of an IFD entry in bytes.
+	bigIFDLen = 20 // Length of a BigTIFF IFD entry in bytes.
 
 	// TIFF variantes
 	fTIFF = 0
@@ -36,10 +41,16 @@ const (
 	dtSRational = 10
 	dtFloat     = 11
 	dtDouble    = 12
+	dtIFD       = 13 // Offset of an IFD, same layout as dtLong
+
+	// BigTIFF
+	dtLong8  = 16
+	dtSLong8 = 17
+	dtIFD8   = 18 // Offset of an IFD, same layout as dtLong8
 )
 
 // The length of one instance of each data type in bytes.
-var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4, 0, 0, 8, 8, 8}
 
 // Tags (see p. 28-41 of the spec).
 const (
@@ -54,12 +65,24 @@ const (
 	tSamplesPerPixel = 277
 	tRowsPerStrip    = 278
 	tStripByteCounts = 279
+	tMinSampleValue  = 280
+	tMaxSampleValue  = 281
 
 	tTileWidth      = 322
 	tTileLength     = 323
 	tTileOffsets    = 324
 	tTileByteCounts = 325
 
+	tFillOrder = 266
+
+	// Obsolete JPEG (cJPEGOld)
+	tJPEGProc                    = 512
+	tJPEGInterchangeFormat       = 513
+	tJPEGInterchangeFormatLength = 514
+
+	// JPEG (cJPEG)
+	tJPEGTables = 347
+
 	tXResolution         = 282
 	tYResolution         = 283
 	tPlanarConfiguration = 284
@@ -73,6 +96,14 @@ const (
 
 	tStonits = 37439
 
+	tSoftware     = 305
+	tDateTime     = 306
+	tHostComputer = 316
+
+	// EXIF
+	tExifIFD          = 34665
+	tDateTimeOriginal = 36867
+
 	// TIFF/EP
 	tCFARepeatPatternDim = 33421
 	tCFAPattern          = 33422
@@ -80,12 +111,16 @@ const (
 	// DNG
 	tDNGVersion         = 50706
 	tDNGBackwardVersion = 50707
+	tUniqueCameraModel  = 50708
 
 	tCFAPlaneColor          = 50710
 	tCFALayout              = 50711
 	tLinearizationTable     = 50712
+	tBlackLevelRepeatDim    = 50713
 	tBlackLevel             = 50714
 	tWhiteLevel             = 50717
+	tDefaultCropOrigin      = 50719
+	tDefaultCropSize        = 50720
 	tColorMatrix1           = 50721
 	tColorMatrix2           = 50722
 	tCameraCalibration1     = 50723
@@ -93,13 +128,32 @@ const (
 	tReductionMatrix1       = 50725
 	tReductionMatrix2       = 50726
 	tAsShotNeutral          = 50728
+	tAsShotWhiteXY          = 50729
 	tBaselineExposure       = 50730
 	tCalibrationIlluminant1 = 50778
 	tCalibrationIlluminant2 = 50779
+	tMaskedAreas            = 51009
+	tPreviewColorSpace      = 50970
+	tRawImageDigest         = 50972
+	tDefaultUserCrop        = 51125
+
+	// DNG 1.5
+	tDefaultBlackRender = 51110
+	tNewRawImageDigest  = 51111
+	tRawToPreviewGain   = 51112
+	tDepthFormat        = 51177
+	tDepthNear          = 51178
+	tDepthFar           = 51179
+	tDepthUnits         = 51180
+	tDepthMeasureType   = 51181
+	tEnhanceParams      = 51182
 )
 
-// The Color name of the CFAPatern values.
-var cfaColors = []string{"R", "G", "B"}
+// maxCFARepeat is the largest CFARepeatPatternDim supported (6x6 for X-Trans).
+const maxCFARepeat = 8
+
+// The Color name of the CFAPatern and CFAPlaneColor values (TIFF/EP).
+var cfaColors = []string{"R", "G", "B", "C", "M", "Y", "W"}
 
 // Compression types (defined in various places in the spec and supplements).
 const (
@@ -129,12 +183,26 @@ const (
 	pCMYK        = 5
 	pYCbCr       = 6
 	pCIELab      = 8
+	pICCLab      = 9
+	pITULab      = 10
 
 	pColorFilterArray = 32803
 	pLogL             = 32844 // GrayScale - CIE Log2(L)
 	pLogLuv           = 32845 // Color - CIE Log2(L) (u',v')
 )
 
+// Values for the tFillOrder tag (page 32 of the spec).
+const (
+	foMSBFirst = 1 // Lower column values are stored in the higher-order bits of the byte (default).
+	foLSBFirst = 2 // Lower column values are stored in the lower-order bits of the byte.
+)
+
+// Values for the tPlanarConfiguration tag (page 38 of the spec).
+const (
+	pcChunky   = 1 // The samples of each pixel are stored contiguously (default).
+	pcSeparate = 2 // The samples are stored in separate planes.
+)
+
 // Values for the tPredictor tag (page 64-65 of the spec).
 const (
 	prNone          = 1
@@ -142,10 +210,26 @@ const (
 	prFloatingPoint = 3 // Floating point horizontal differencing, a third specification supplement from Adobe
 )
 
+// Values for the tSampleFormat tag (page 80 of the spec).
+const (
+	sfUnsignedInteger = 1
+	sfSignedInteger   = 2
+	sfIEEEFP          = 3
+	sfUndefined       = 4
+)
+
+// Values for the tExtraSamples tag (page 31 of the spec).
+const (
+	esUnspecified       = 0
+	esAssociatedAlpha   = 1
+	esUnassociatedAlpha = 2
+)
+
 // Value for the tNewSubFileType tag (cf. SubIFDs Trees)
 const (
 	sftPrimaryImage = 0
 	sftThumbnail    = 1
+	sftTransMask    = 4 // Transparency mask of another image of the file
 )
 
 // Values for the tResolutionUnit tag (page 18).
@@ -170,4 +254,33 @@ const (
 	mLogL
 	mLogLuv
 	mColorFilterArray
+	mLab
+	mTransMask
 )
+
+// colorSamples is the number of color samples per pixel expected for each mode,
+// extra samples excluded.
+var colorSamples = map[imageMode]uint{
+	mBilevel:          1,
+	mRGB:              3,
+	mLogL:             1,
+	mLogLuv:           3,
+	mColorFilterArray: 1,
+	mLab:              3,
+	mTransMask:        1,
+}
+
+// outputChannels is the number of float32 samples per pixel of the image decoded for each output mode:
+// hdr.RGB for the RGB modes, hdr.XYZ for the others. hdr has no alpha-bearing image yet,
+// the alpha of mRGBA and mNRGBA is not kept.
+var outputChannels = map[imageMode]int{
+	mBilevel:          3,
+	mRGB:              3,
+	mRGBA:             3,
+	mNRGBA:            3,
+	mLogL:             3,
+	mLogLuv:           3,
+	mColorFilterArray: 3,
+	mLab:              3,
+	mTransMask:        3,
+}
@@ -0,0 +1,69 @@
+package tiff
+
+import (
+	"image"
+	"math"
+
+	"github.com/mdouchement/hdr"
+)
+
+// cropRect returns the area of the image kept by the DefaultCrop and UserCrop options.
+// The DefaultCropOrigin and DefaultCropSize default to the whole image and the crops are clamped
+// to the image; an invalid DefaultUserCrop is ignored.
+func (d *decoder) cropRect() image.Rectangle {
+	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+
+	var x, y float64
+	if t := d.features[tDefaultCropOrigin]; len(t.val) == 2 {
+		x, y = t.asFloat(0), t.asFloat(1)
+	}
+	w, h := float64(d.config.Width)-x, float64(d.config.Height)-y
+	if t := d.features[tDefaultCropSize]; len(t.val) == 2 {
+		w, h = t.asFloat(0), t.asFloat(1)
+	}
+	r := image.Rect(
+		int(math.Round(x)), int(math.Round(y)),
+		int(math.Round(x+w)), int(math.Round(y+h)),
+	).Intersect(bounds)
+
+	if t := d.features[tDefaultUserCrop]; d.opts.UserCrop && len(t.val) == 4 && !r.Empty() {
+		// Top, left, bottom, right as fractions of the default crop
+		clamp := func(v float64) float64 {
+			return math.Max(0, math.Min(1, v))
+		}
+		top, left := clamp(t.asFloat(0)), clamp(t.asFloat(1))
+		bottom, right := clamp(t.asFloat(2)), clamp(t.asFloat(3))
+		if top < bottom && left < right {
+			dx, dy := float64(r.Dx()), float64(r.Dy())
+			r = image.Rect(
+				r.Min.X+int(math.Round(left*dx)), r.Min.Y+int(math.Round(top*dy)),
+				r.Min.X+int(math.Round(right*dx)), r.Min.Y+int(math.Round(bottom*dy)),
+			)
+		}
+	}
+	return r
+}
+
+// crop returns the part of m within r, its origin being moved to (0, 0).
+func (d *decoder) crop(m image.Image, r image.Rectangle) (image.Image, error) {
+	r = r.Intersect(m.Bounds())
+	if r == m.Bounds() {
+		return m, nil
+	}
+
+	cropped, err := d.newImage(r.Sub(r.Min))
+	if err != nil {
+		return nil, err
+	}
+	src, ok := m.(hdr.Image)
+	dst, ok2 := cropped.(hdr.ImageSet)
+	if !ok || !ok2 {
+		return nil, errDestinationType
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.Set(x-r.Min.X, y-r.Min.Y, src.HDRAt(x, y))
+		}
+	}
+	return cropped, nil
+}
@@ -0,0 +1,68 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeCrop(t *testing.T) {
+	const width, height = 6, 4
+
+	// The red channel holds the position of the pixel.
+	strip := make([]byte, width*height*12)
+	for i := 0; i < width*height; i++ {
+		binary.LittleEndian.PutUint32(strip[12*i:], math.Float32bits(float32(i)))
+	}
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, sfIEEEFP, sfIEEEFP, sfIEEEFP).
+		add(tDefaultCropOrigin, dtShort, 1, 1).
+		add(tDefaultCropSize, dtShort, 4, 2).
+		add(tDefaultUserCrop, dtRational, 0, 1, 1, 4, 1, 1, 3, 4). // Top, left, bottom, right
+		strips(strip)
+
+	decode := func(opts *DecodeOptions) image.Image {
+		m, err := DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+		assert.NoError(t, err)
+		return m
+	}
+	origin := func(m image.Image) float64 {
+		r, _, _, _ := m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+		return r
+	}
+
+	m := decode(nil)
+	assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+
+	m = decode(&DecodeOptions{DefaultCrop: true})
+	assert.Equal(t, image.Rect(0, 0, 4, 2), m.Bounds())
+	assert.Equal(t, float64(1*width+1), origin(m))
+
+	m = decode(&DecodeOptions{UserCrop: true})
+	assert.Equal(t, image.Rect(0, 0, 2, 2), m.Bounds())
+	assert.Equal(t, float64(1*width+2), origin(m))
+
+	m = decode(&DecodeOptions{UserCrop: true, Subsample: 2})
+	assert.Equal(t, image.Rect(0, 0, 1, 1), m.Bounds())
+	assert.Equal(t, float64(2*width+2), origin(m))
+
+	// Crops exceeding the image are clamped.
+	b.add(tDefaultCropSize, dtShort, 8, 8)
+	m = decode(&DecodeOptions{DefaultCrop: true})
+	assert.Equal(t, image.Rect(0, 0, 5, 3), m.Bounds())
+
+	// An empty user crop is ignored.
+	b.add(tDefaultUserCrop, dtRational, 1, 2, 1, 2, 1, 2, 1, 2)
+	m = decode(&DecodeOptions{UserCrop: true})
+	assert.Equal(t, image.Rect(0, 0, 5, 3), m.Bounds())
+}
@@ -6,40 +6,64 @@ import (
 	"math"
 
 	"github.com/mdouchement/hdr"
-	"github.com/mdouchement/hdr/hdrcolor"
 	"github.com/mdouchement/tiff/bayer"
 )
 
 func (d *decoder) decodeColorFilterArray(dst image.Image, xmin, ymin, xmax, ymax int) error {
-	// Apply horizontal predictor if necessary.
-	// In this case, p contains the color difference to the preceding pixel.
-	// See page 64-65 of the spec.
-	if d.firstVal(tPredictor) > prNone {
-		return UnsupportedError("predictor")
-	}
+	// The predictor, if any, has already been reversed by decompress.
 
 	rMaxX := minInt(xmax, dst.Bounds().Max.X)
 	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
 
 	// Described workflow -> https://rcsumner.net/raw_guide/RAWguide.pdf
-	p, err := bayer.GetPattern(d.features[tCFAPattern].val)
+	rows, cols, colors, err := d.cfaPattern()
 	if err != nil {
 		return err
 	}
+	depth := int(d.bpp)
+	if d.packed() {
+		depth = 16 // Unpacked by decompress, the WhiteLevel still depends on the real depth.
+	}
+
+	// d.buf holds the samples of the block or, set by readCFABlock, the ones of the region cfaBounds
+	// surrounding it, so that the interpolation crosses the block boundaries. The pattern stays
+	// anchored to the origin of the image.
+	if rMaxX <= xmin || rMaxY <= ymin {
+		return nil
+	}
+	src := image.Rect(xmin, ymin, xmax, ymax)
+	if !d.cfaBounds.Empty() {
+		src = d.cfaBounds
+	}
+	ctx := src.Intersect(image.Rect(0, 0, d.config.Width, d.config.Height))
+	buf := d.buf
+	if stride := src.Dx() * d.bytesPerPixel; ctx.Dx() < src.Dx() {
+		rowSize := ctx.Dx() * d.bytesPerPixel
+		buf = make([]byte, rowSize*ctx.Dy())
+		for y := 0; y < ctx.Dy(); y++ {
+			copy(buf[y*rowSize:(y+1)*rowSize], d.buf[y*stride:])
+		}
+	}
+	colors = shiftPattern(colors, rows, cols, ctx.Min.Y%rows, ctx.Min.X%cols)
+
 	opts := &bayer.Options{
 		ByteOrder: d.byteOrder,
-		Depth:     int(d.bpp),
-		Width:     rMaxX,
-		Height:    rMaxY,
-		Pattern:   p,
+		Depth:     depth,
+		Width:     ctx.Dx(),
+		Height:    ctx.Dy(),
+
+		Colors:     colors,
+		RepeatRows: rows,
+		RepeatCols: cols,
+
+		ClipHighlights: d.opts.ClipHighlights,
 	}
 	// Step 1 - Linearizing + Luminance ReScale used in Bayer.
-	if t, exists := d.features[tLinearizationTable]; exists {
-		fmt.Println("You may need to linearize the CFA:", t.val)
-	}
+	// The LinearizationTable, if any, is not applied, which is reported by newIDFDecoder.
 	if t, exists := d.features[tBlackLevel]; exists {
 		opts.BlackLevel = t.asFloat(0)
 	}
+	opts.BlackLevels = d.blackLevels
 	if t, exists := d.features[tWhiteLevel]; exists {
 		opts.WhiteLevel = t.asFloat(0)
 	} else {
@@ -47,75 +71,324 @@ func (d *decoder) decodeColorFilterArray(dst image.Image, xmin, ymin, xmax, ymax
 	}
 
 	// Step 2 - White Balancing
-	if t, exists := d.features[tAsShotNeutral]; exists {
-		// Invert the values and then rescale them all so that the green multiplier is 1.
-		opts.WhiteBalance = make([]float64, len(t.val))
-		for i := range t.val {
-			opts.WhiteBalance[i] = 1 / t.asFloat(i)
-		}
-		opts.WhiteBalance[0] /= opts.WhiteBalance[1]
-		opts.WhiteBalance[1] /= opts.WhiteBalance[1]
-		opts.WhiteBalance[2] /= opts.WhiteBalance[1]
-	} else {
-		opts.WhiteBalance = []float64{1, 1, 1}
+	if opts.WhiteBalance, err = d.whiteBalance(); err != nil {
+		return err
 	}
 
 	// Step 3 - Demosaicing
-	bayer := bayer.NewBilinear(d.buf, opts)
+	// The classic 2x2 Bayer patterns have dedicated interpolations.
+	var byr bayer.Bayer
+	if opts.Pattern, err = bayer.GetPattern(colors); err == nil && rows == 2 && cols == 2 {
+		if d.opts.Demosaicing == DemosaicingMalvar {
+			byr = bayer.NewMalvar(buf, opts)
+		} else {
+			byr = bayer.NewBilinear(buf, opts)
+		}
+	} else if byr, err = bayer.NewArbitrary(buf, opts); err != nil {
+		return UnsupportedError(err.Error())
+	}
 
 	// Step 4 - Color Space Correction
-	// camToXYZ := []float64{}
-	// if t, exists := d.features[tColorMatrix2]; exists {
-	// 	data := make([]float64, len(t.val))
-	// 	for i := range t.val {
-	// 		data[i] = t.asFloat(i)
-	// 	}
-	// 	xyzToCam := mat.NewDense(3, 3, data) // nbOfRows should be equal to len(d.features[tCFAPlaneColor].val)
-	// 	var im mat.Dense
-	// 	im.Inverse(xyzToCam)
-	// 	camToXYZ = append(camToXYZ, im.RawRowView(0)...)
-	// 	camToXYZ = append(camToXYZ, im.RawRowView(1)...)
-	// 	camToXYZ = append(camToXYZ, im.RawRowView(2)...)
-	// } else if t, exists := d.features[tColorMatrix1]; exists {
-	// 	data := make([]float64, len(t.val))
-	// 	for i := range t.val {
-	// 		data[i] = t.asFloat(i)
-	// 	}
-	// 	xyzToCam := mat.NewDense(3, 3, data) // nbOfRows should be equal to len(d.features[tCFAPlaneColor].val)
-	// 	var im mat.Dense
-	// 	im.Inverse(xyzToCam)
-	// 	camToXYZ = append(camToXYZ, im.RawRowView(0)...)
-	// 	camToXYZ = append(camToXYZ, im.RawRowView(1)...)
-	// 	camToXYZ = append(camToXYZ, im.RawRowView(2)...)
-	// } else {
-	// 	// sRBG->XYZ (D65)
-	// 	camToXYZ = []float64{
-	// 		0.4124564, 0.3575761, 0.1804375,
-	// 		0.2126729, 0.7151522, 0.0721750,
-	// 		0.0193339, 0.1191920, 0.9503041,
-	// 	}
-	// }
-	camToXYZ := []float64{
-		0.4124564, 0.3575761, 0.1804375,
-		0.2126729, 0.7151522, 0.0721750,
-		0.0193339, 0.1191920, 0.9503041,
+	// Unless a camera matrix is given, the camera values are assumed to be linear sRGB.
+	camToXYZ, white := sRGBToXYZ, D65
+	if d.opts.UseCameraToXYZ {
+		camToXYZ = d.opts.CameraToXYZ
+	} else if colorMatrix, wp, ok := d.correctionMatrix(); ok {
+		if camToXYZ, ok = cameraToXYZ(colorMatrix, opts.WhiteBalance); !ok {
+			return FormatError("singular ColorMatrix")
+		}
+		white = wp
 	}
 	// Step 5 - Brightness & Gamma correction TODO (or not because TMO handle it well)
 
-	//
-	m := dst.(*hdr.XYZ)
-	var r, g, b, X, Y, Z float64
-	for y := ymin; y < rMaxY; y++ {
-		for x := xmin; x < rMaxX; x++ {
-			r, g, b = bayer.At(x, y)
+	switch d.opts.CFAOutput {
+	case CFAOutputCameraRGB:
+		return d.writeCFARGB(dst, byr, ctx, identity, xmin, ymin, rMaxX, rMaxY)
+	case CFAOutputLinearSRGB:
+		if white != D65 {
+			camToXYZ = chromaticAdaptation(white, D65).mul(camToXYZ)
+		}
+		xyzToSRGB, _ := sRGBToXYZ.inverse()
+		return d.writeCFARGB(dst, byr, ctx, xyzToSRGB.mul(camToXYZ), xmin, ymin, rMaxX, rMaxY)
+	default:
+		if d.opts.OutputWhitePoint != white {
+			camToXYZ = chromaticAdaptation(white, d.opts.OutputWhitePoint).mul(camToXYZ)
+		}
+		m, ok := dst.(*hdr.XYZ)
+		if !ok {
+			return errDestinationType
+		}
+		d.writeCFA(m.Pix, m.PixOffset, byr, ctx, camToXYZ, xmin, ymin, rMaxX, rMaxY)
+	}
+
+	return nil
+}
+
+// writeCFARGB writes into dst the demosaiced camera values converted by camToRGB.
+func (d *decoder) writeCFARGB(dst image.Image, b bayer.Bayer, window image.Rectangle, camToRGB mat3, xmin, ymin, xmax, ymax int) error {
+	m, ok := dst.(*hdr.RGB)
+	if !ok {
+		return errDestinationType
+	}
+	d.writeCFA(m.Pix, m.PixOffset, b, window, camToRGB, xmin, ymin, xmax, ymax)
+	return nil
+}
+
+// writeCFA writes the demosaiced camera values converted by mat into pix, the 3 samples per pixel
+// of an hdr.RGB or hdr.XYZ whose pixel (x, y) begins at offset(x, y).
+// b demosaics the region window of the image, which contains the written one.
+// The rows are interpolated at once when b is a bayer.RowBayer.
+func (d *decoder) writeCFA(pix []float32, offset func(x, y int) int, b bayer.Bayer, window image.Rectangle, mat mat3, xmin, ymin, xmax, ymax int) {
+	var X, Y, Z float64
+	rows, ok := b.(bayer.RowBayer)
+	if !ok {
+		for y := ymin; y < ymax; y++ {
+			for x := xmin; x < xmax; x++ {
+				X, Y, Z = d.clamp(mat.apply(b.At(x-window.Min.X, y-window.Min.Y)))
+				i := offset(x, y)
+				pix[i], pix[i+1], pix[i+2] = float32(X), float32(Y), float32(Z)
+			}
+		}
+		return
+	}
 
-			X = r*camToXYZ[0] + g*camToXYZ[1] + b*camToXYZ[2]
-			Y = r*camToXYZ[3] + g*camToXYZ[4] + b*camToXYZ[5]
-			Z = r*camToXYZ[6] + g*camToXYZ[7] + b*camToXYZ[8]
+	rgb := make([]float64, 3*window.Dx())
+	for y := ymin; y < ymax; y++ {
+		rows.Row(y-window.Min.Y, rgb)
+		p := pix[offset(xmin, y):]
+		for i, j := 0, 3*(xmin-window.Min.X); j < 3*(xmax-window.Min.X); i, j = i+3, j+3 {
+			X, Y, Z = d.clamp(mat.apply(rgb[j], rgb[j+1], rgb[j+2]))
+			p[i], p[i+1], p[i+2] = float32(X), float32(Y), float32(Z)
+		}
+	}
+}
 
-			m.SetXYZ(x, y, hdrcolor.XYZ{X: X, Y: Y, Z: Z})
+// readCFABlock decodes the k-th strip or tile of the CFA l into dst. The block is demosaiced along with
+// the samples of its neighbours within the reach of the interpolation, so that no seam appears at the
+// block boundaries. The decompressed blocks are cached while the next blocks, in the order of
+// readImage, may need them.
+func (d *decoder) readCFABlock(dst image.Image, l *blockLayout, k int) error {
+	// The next blocks only need the blocks from the previous row of blocks onwards.
+	for j := range d.cfaBlocks {
+		if j < k-l.across-1 || j > k+l.across+1 {
+			delete(d.cfaBlocks, j)
 		}
 	}
 
-	return nil
+	r := l.bounds(k)
+	samples, err := d.cfaBlock(l, k, dst.Bounds())
+	if err != nil {
+		return err
+	}
+	d.buf = samples
+
+	margin := d.cfaMargin()
+	ctx := r.Inset(-margin).Intersect(image.Rect(0, 0, d.config.Width, d.config.Height))
+	if !ctx.In(r) {
+		// The block is demosaiced on its own when a neighbour cannot be decompressed.
+		if window, err := d.cfaWindow(l, ctx); err == nil {
+			d.buf, d.cfaBounds = window, ctx
+			defer func() {
+				d.cfaBounds = image.Rectangle{}
+			}()
+		}
+	}
+	return d.decode(dst, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+// cfaBlock returns the decompressed samples of the k-th block of the CFA l, which hold its pixels within bounds.
+func (d *decoder) cfaBlock(l *blockLayout, k int, bounds image.Rectangle) ([]byte, error) {
+	if buf, ok := d.cfaBlocks[k]; ok {
+		return buf, nil
+	}
+	if err := d.loadBlock(l, k, bounds); err != nil {
+		return nil, err
+	}
+	if d.cfaBlocks == nil {
+		d.cfaBlocks = map[int][]byte{}
+	}
+	d.cfaBlocks[k] = d.buf
+	return d.buf, nil
+}
+
+// cfaWindow returns the samples of the region r of the CFA l, row by row, gathered from the blocks it overlaps.
+func (d *decoder) cfaWindow(l *blockLayout, r image.Rectangle) ([]byte, error) {
+	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+	window := make([]byte, r.Dx()*r.Dy()*d.bytesPerPixel)
+	for j := r.Min.Y / l.height; j <= (r.Max.Y-1)/l.height; j++ {
+		for i := r.Min.X / l.width; i <= (r.Max.X-1)/l.width; i++ {
+			k := j*l.across + i
+			samples, err := d.cfaBlock(l, k, bounds)
+			if err != nil {
+				return nil, err
+			}
+
+			b := l.bounds(k)
+			o := b.Intersect(r)
+			n := o.Dx() * d.bytesPerPixel
+			for y := o.Min.Y; y < o.Max.Y; y++ {
+				src := ((y-b.Min.Y)*b.Dx() + o.Min.X - b.Min.X) * d.bytesPerPixel
+				dst := ((y-r.Min.Y)*r.Dx() + o.Min.X - r.Min.X) * d.bytesPerPixel
+				copy(window[dst:dst+n], samples[src:src+n])
+			}
+		}
+	}
+	return window, nil
+}
+
+// cfaMargin returns the distance up to which the demosaicing reads the neighbours of a pixel:
+// 2 for the 2x2 Bayer interpolations and the size of the pattern for bayer.NewArbitrary.
+func (d *decoder) cfaMargin() int {
+	rows, cols, _, err := d.cfaPattern()
+	if err != nil {
+		return maxCFARepeat
+	}
+	return maxInt(rows, cols)
+}
+
+// shiftPattern returns the colors of the rows x cols pattern starting at its row dy and column dx.
+func shiftPattern(colors []uint, rows, cols, dy, dx int) []uint {
+	shifted := make([]uint, len(colors))
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			shifted[r*cols+c] = colors[((r+dy)%rows)*cols+(c+dx)%cols]
+		}
+	}
+	return shifted
+}
+
+// cfaPattern returns the dimensions and the colors, row by row, of the CFAPattern.
+// The pattern is 2x2 when CFARepeatPatternDim is missing.
+func (d *decoder) cfaPattern() (rows, cols int, colors []uint, err error) {
+	rows, cols = 2, 2
+	if dim, ok := d.features[tCFARepeatPatternDim]; ok {
+		if len(dim.val) != 2 {
+			return 0, 0, nil, FormatError("CFARepeatPatternDim must contain rows and columns")
+		}
+		rows, cols = int(dim.val[0]), int(dim.val[1])
+	}
+	if rows < 1 || cols < 1 || rows > maxCFARepeat || cols > maxCFARepeat {
+		return 0, 0, nil, UnsupportedError(fmt.Sprintf("CFARepeatPatternDim %dx%d", rows, cols))
+	}
+
+	colors = uints(d.features[tCFAPattern].val)
+	if len(colors) != rows*cols {
+		return 0, 0, nil, FormatError("CFAPattern does not match CFARepeatPatternDim")
+	}
+
+	// The demosaicing and the color matrices only handle red, green and blue filters,
+	// the CYGM or RGBE sensors would be misdecoded.
+	planeColors := d.cfaPlaneColors()
+	for _, c := range planeColors {
+		if c > 2 {
+			return 0, 0, nil, UnsupportedError("non-RGB CFA plane color " + cfaColorName(c))
+		}
+	}
+	for _, c := range colors {
+		if c > 2 {
+			return 0, 0, nil, UnsupportedError("non-RGB CFA color " + cfaColorName(c))
+		}
+		if !containsUint(planeColors, c) {
+			return 0, 0, nil, FormatError("CFAPattern color " + cfaColorName(c) + " missing from CFAPlaneColor")
+		}
+	}
+	return rows, cols, colors, nil
+}
+
+// cfaPlaneColors returns the colors of the CFA planes, red, green and blue by default.
+func (d *decoder) cfaPlaneColors() []uint {
+	if t, exists := d.features[tCFAPlaneColor]; exists {
+		return uints(t.val)
+	}
+	return []uint{0, 1, 2}
+}
+
+// cfaColorName returns the name of the CFA color c, e.g. "C" for cyan.
+func cfaColorName(c uint) string {
+	if c < uint(len(cfaColors)) {
+		return cfaColors[c]
+	}
+	return fmt.Sprint(c)
+}
+
+// whiteBalance returns the R, G, B multipliers of the white balance and, when the CFA has
+// two green planes, the multiplier of the second one. They are 1 with the SkipWhiteBalance option.
+// The AsShotNeutral values of the CFA planes, or the ones of the AsShotWhiteXY chromaticity when absent,
+// are inverted and then rescaled so that the multiplier of the (first) green plane is 1.
+func (d *decoder) whiteBalance() ([]float64, error) {
+	wb := []float64{1, 1, 1}
+	if d.opts.SkipWhiteBalance {
+		return wb, nil
+	}
+	neutral, err := d.asShotNeutral()
+	if neutral == nil || err != nil {
+		return wb, err
+	}
+
+	planeColors := d.cfaPlaneColors()
+	if len(neutral) != len(planeColors) {
+		return nil, FormatError("AsShotNeutral does not match CFAPlaneColor")
+	}
+
+	green := -1
+	for i, c := range planeColors {
+		if c == 1 {
+			green = i
+			break
+		}
+	}
+	if green < 0 {
+		return nil, UnsupportedError("CFA without green plane")
+	}
+
+	for i, c := range planeColors {
+		m := neutral[green] / neutral[i] // (1 / neutral[i]) / (1 / neutral[green])
+		switch {
+		case c == 1 && i != green:
+			if len(wb) > 3 {
+				return nil, UnsupportedError("CFA with more than two green planes")
+			}
+			wb = append(wb, m)
+		case c <= 2:
+			wb[c] = m
+		default:
+			return nil, UnsupportedError(fmt.Sprintf("CFA plane color %d", c))
+		}
+	}
+	return wb, nil
+}
+
+// asShotNeutral returns the camera values of a neutral of the scene: the AsShotNeutral or, when absent,
+// the AsShotWhiteXY chromaticity converted by the ColorMatrix. It returns nil without white balance.
+func (d *decoder) asShotNeutral() ([]float64, error) {
+	if t, exists := d.features[tAsShotNeutral]; exists {
+		neutral := make([]float64, len(t.val))
+		for i := range neutral {
+			neutral[i] = t.asFloat(i)
+		}
+		return neutral, nil
+	}
+
+	t, exists := d.features[tAsShotWhiteXY]
+	if !exists {
+		return nil, nil
+	}
+	if len(t.val) != 2 {
+		return nil, FormatError("invalid AsShotWhiteXY")
+	}
+	x, y := t.asFloat(0), t.asFloat(1)
+	if x <= 0 || y <= 0 || x+y >= 1 {
+		return nil, FormatError("invalid AsShotWhiteXY")
+	}
+	colorMatrix, _, ok := d.colorMatrix()
+	if !ok {
+		// Without ColorMatrix, the chromaticity cannot be converted to camera values.
+		return nil, nil
+	}
+
+	r, g, b := colorMatrix.apply(x/y, 1, (1-x-y)/y)
+	if r <= 0 || g <= 0 || b <= 0 {
+		return nil, FormatError("AsShotWhiteXY outside of the camera gamut")
+	}
+	return []float64{r, g, b}, nil
 }
@@ -0,0 +1,700 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"math/bits"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/tiff/bayer"
+	"github.com/stretchr/testify/assert"
+)
+
+// pack packs the samples of each row on depth bits MSB first, rows beginning on byte boundaries.
+func pack(samples []uint16, width int, depth uint) []byte {
+	var dst []byte
+	for row := 0; row < len(samples); row += width {
+		var v uint32
+		var nbits uint
+		for _, s := range samples[row : row+width] {
+			v = v<<depth | uint32(s)
+			nbits += depth
+			for nbits >= 8 {
+				nbits -= 8
+				dst = append(dst, byte(v>>nbits))
+			}
+		}
+		if nbits > 0 {
+			dst = append(dst, byte(v<<(8-nbits)))
+		}
+	}
+	return dst
+}
+
+func TestDecodeCFA12BitsPacked(t *testing.T) {
+	const width, height = 3, 4
+
+	samples := make([]uint16, width*height)
+	strip16 := make([]byte, 2*len(samples))
+	for i := range samples {
+		samples[i] = uint16(300*i + 7)
+		binary.BigEndian.PutUint16(strip16[2*i:], samples[i])
+	}
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		add(tWhiteLevel, dtShort, 4095).
+		strips(strip16)
+	expected, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	packed := pack(samples, width, 12)
+	assert.Len(t, packed, height*5) // 36 bits per row
+
+	b.add(tBitsPerSample, dtShort, 12).strips(packed)
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	// Derived StripByteCounts
+	m2, err := Decode(bytes.NewReader(b.omit(tStripByteCounts).bytes()))
+	assert.NoError(t, err)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			assert.Equal(t, expected.(hdr.Image).HDRAt(x, y), m.(hdr.Image).HDRAt(x, y))
+			assert.Equal(t, expected.(hdr.Image).HDRAt(x, y), m2.(hdr.Image).HDRAt(x, y))
+		}
+	}
+}
+
+func TestDecodeCFA12BitsFillOrder(t *testing.T) {
+	const width, height = 3, 2
+
+	samples := make([]uint16, width*height)
+	for i := range samples {
+		samples[i] = uint16(600*i + 5)
+	}
+	packed := pack(samples, width, 12)
+	reversed := make([]byte, len(packed))
+	for i, b := range packed {
+		reversed[i] = bits.Reverse8(b)
+	}
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 12).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		strips(packed)
+	expected, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	b.add(tFillOrder, dtShort, foLSBFirst).strips(reversed)
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			assert.Equal(t, expected.(hdr.Image).HDRAt(x, y), m.(hdr.Image).HDRAt(x, y))
+		}
+	}
+
+	b.add(tFillOrder, dtShort, 3)
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.Error(t, err)
+}
+
+func TestWhiteBalance(t *testing.T) {
+	rational := func(vals ...uint) tag {
+		t := tag{id: tAsShotNeutral, datatype: dtRational}
+		for _, v := range vals {
+			t.val = append(t.val, uint64(1)<<32|uint64(v)) // v/1
+		}
+		return t
+	}
+
+	d := &decoder{idf: &idf{features: map[uint16]tag{}}}
+	wb, err := d.whiteBalance()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, 1, 1}, wb)
+
+	d.features[tAsShotNeutral] = rational(2, 4, 8)
+	wb, err = d.whiteBalance()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{2, 1, 0.5}, wb)
+
+	// RGGB with the two greens as distinct planes
+	d.features[tCFAPlaneColor] = tag{id: tCFAPlaneColor, datatype: dtByte, val: []uint64{1, 0, 2, 1}}
+	d.features[tAsShotNeutral] = rational(4, 2, 8, 5)
+	wb, err = d.whiteBalance()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{2, 1, 0.5, 0.8}, wb)
+
+	d.features[tAsShotNeutral] = rational(4, 2, 8)
+	_, err = d.whiteBalance()
+	assert.Error(t, err)
+
+	d.features[tCFAPlaneColor] = tag{id: tCFAPlaneColor, datatype: dtByte, val: []uint64{0, 2, 3}}
+	_, err = d.whiteBalance()
+	assert.Error(t, err)
+}
+
+func TestDecodeCFAAsShotWhiteXY(t *testing.T) {
+	// XYZ to camera matrix scaling X by 2 and Z by 1/2
+	b := cfaImage(4, 4).
+		add(tColorMatrix1, dtSRational, 2, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 2).
+		add(tCalibrationIlluminant1, dtShort, lsD65)
+
+	// The chromaticity (1/3, 1/4) is the XYZ (4/3, 1, 5/3), i.e. the camera neutral (8/3, 1, 5/6).
+	expected, err := Decode(bytes.NewReader(b.add(tAsShotNeutral, dtRational, 8, 3, 1, 1, 5, 6).bytes()))
+	assert.NoError(t, err)
+	m, err := Decode(bytes.NewReader(b.omit(tAsShotNeutral).add(tAsShotWhiteXY, dtRational, 1, 3, 1, 4).bytes()))
+	assert.NoError(t, err)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			X, Y, Z, _ := expected.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			X2, Y2, Z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.InDeltaSlice(t, []float64{X, Y, Z}, []float64{X2, Y2, Z2}, 1e-6, "pixel (%d,%d)", x, y)
+		}
+	}
+	noWhiteBalance, err := DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{SkipWhiteBalance: true})
+	assert.NoError(t, err)
+	assert.NotEqual(t, noWhiteBalance, m)
+
+	for _, xy := range [][]uint64{{1, 3}, {0, 1, 1, 4}, {2, 3, 1, 2}} {
+		_, err = Decode(bytes.NewReader(b.add(tAsShotWhiteXY, dtRational, xy...).bytes()))
+		assert.EqualError(t, err, "tiff: invalid format: invalid AsShotWhiteXY", "%v", xy)
+	}
+}
+
+func TestDecodeCFAPlaneColor(t *testing.T) {
+	// CYGM
+	_, err := Decode(bytes.NewReader(cfaImage(4, 4).
+		add(tCFAPattern, dtByte, 3, 5, 1, 4).
+		add(tCFAPlaneColor, dtByte, 3, 5, 1, 4).
+		bytes()))
+	assert.EqualError(t, err, "tiff: unsupported feature: non-RGB CFA plane color C")
+
+	// RGBE, with the emerald reported as cyan by the default CFAPlaneColor
+	_, err = Decode(bytes.NewReader(cfaImage(4, 4).add(tCFAPattern, dtByte, 0, 1, 3, 2).bytes()))
+	assert.EqualError(t, err, "tiff: unsupported feature: non-RGB CFA color C")
+
+	_, err = Decode(bytes.NewReader(cfaImage(4, 4).add(tCFAPlaneColor, dtByte, 0, 1, 1).bytes()))
+	assert.EqualError(t, err, "tiff: invalid format: CFAPattern color B missing from CFAPlaneColor")
+
+	md, err := ReadMetadata(bytes.NewReader(cfaImage(4, 4).add(tCFAPlaneColor, dtByte, 3, 5, 1, 4).bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, "[3 5 1 4] (CYGM)", valuename(md.idf.features[tCFAPlaneColor]))
+}
+
+func TestDecodeCFAFourChannelsWhiteBalance(t *testing.T) {
+	b := cfaImage(4, 4).
+		add(tAsShotNeutral, dtRational, 2, 1, 1, 1, 4, 1)
+	expected, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	// Same neutral for both greens
+	b.add(tCFAPlaneColor, dtByte, 0, 1, 2, 1).
+		add(tAsShotNeutral, dtRational, 2, 1, 1, 1, 4, 1, 1, 1)
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			assert.Equal(t, expected.(hdr.Image).HDRAt(x, y), m.(hdr.Image).HDRAt(x, y))
+		}
+	}
+
+	// The second green is balanced on its own
+	b.add(tAsShotNeutral, dtRational, 2, 1, 1, 1, 4, 1, 2, 1)
+	m, err = Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.NotEqual(t, expected.(hdr.Image).HDRAt(0, 1), m.(hdr.Image).HDRAt(0, 1)) // Green of a blue row
+}
+
+func TestDecodeCFA14Bits(t *testing.T) {
+	const width, height = 4, 4
+
+	samples := make([]uint16, width*height)
+	strip16 := make([]byte, 2*len(samples))
+	for i := range samples {
+		samples[i] = uint16(1000*i + 11)
+		binary.LittleEndian.PutUint16(strip16[2*i:], samples[i])
+	}
+
+	// The 14-bit samples aligned on 16 bits are flagged by the WhiteLevel.
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		add(tWhiteLevel, dtShort, 1<<14-1).
+		strips(strip16)
+	expected, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	// The default WhiteLevel is derived from the 14 bits.
+	b.omit(tWhiteLevel).add(tBitsPerSample, dtShort, 14)
+	m, err := Decode(bytes.NewReader(b.strips(pack(samples, width, 14)).bytes()))
+	assert.NoError(t, err)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			assert.Equal(t, expected.(hdr.Image).HDRAt(x, y), m.(hdr.Image).HDRAt(x, y))
+		}
+	}
+
+	// A BitsPerSample of 14 always means packed samples, whatever the length of the strip.
+	m, err = Decode(bytes.NewReader(b.strips(strip16).bytes()))
+	assert.NoError(t, err)
+	assert.NotEqual(t, expected.(hdr.Image).HDRAt(1, 0), m.(hdr.Image).HDRAt(1, 0))
+}
+
+func BenchmarkDecodeCFA12BitsPacked(b *testing.B) {
+	const width, height = 512, 512
+
+	samples := make([]uint16, width*height)
+	for i := range samples {
+		samples[i] = uint16(i*37) & 0xFFF
+	}
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 12).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		strips(pack(samples, width, 12)).
+		bytes()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeCFA(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDemosaicCFA measures the demosaicing and the color matrix conversion of a decompressed CFA block.
+func BenchmarkDemosaicCFA(b *testing.B) {
+	const width, height = 512, 512
+
+	strip := make([]byte, 2*width*height)
+	for i := 0; i < width*height; i++ {
+		binary.LittleEndian.PutUint16(strip[2*i:], uint16(i*37))
+	}
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		add(tColorMatrix1, dtSRational, 2, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 2).
+		add(tAsShotNeutral, dtRational, 1, 2, 1, 1, 5, 8).
+		strips(strip).
+		bytes()
+
+	for name, demosaicing := range map[string]Demosaicing{"malvar": DemosaicingMalvar, "bilinear": DemosaicingBilinear} {
+		b.Run(name, func(b *testing.B) {
+			d, err := newDecoder(bytes.NewReader(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+			d.opts.Demosaicing = demosaicing
+			d.buf = strip
+			dst := hdr.NewXYZ(image.Rect(0, 0, width, height))
+
+			b.SetBytes(int64(len(strip)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := d.decodeColorFilterArray(dst, 0, 0, width, height); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeCFAMaskedAreasBlackLevel(t *testing.T) {
+	const width, height = 6, 4
+
+	// The two left columns are optically black.
+	black := [4]byte{10, 20, 22, 30} // RGGB
+	strip := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < 2 {
+				strip[y*width+x] = black[(y%2)*2+x%2]
+			} else {
+				strip[y*width+x] = byte(40 + 10*x + 3*y)
+			}
+		}
+	}
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 8).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFARepeatPatternDim, dtShort, 2, 2).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		add(tBlackLevel, dtShort, 15).
+		add(tMaskedAreas, dtShort, 0, 0, height, 2). // Top, left, bottom, right
+		strips(strip)
+
+	d, err := newDecoder(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	l, err := d.layout()
+	assert.NoError(t, err)
+	levels, err := d.maskedAreasBlackLevels(l)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{10, 21, 30}, levels)
+
+	// The static BlackLevel is used by default.
+	static, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	masked, err := DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{MaskedAreasBlackLevel: true})
+	assert.NoError(t, err)
+	assert.NotEqual(t, static, masked)
+
+	// Uniform masked areas at the static black level give the same image.
+	for y := 0; y < height; y++ {
+		strip[y*width], strip[y*width+1] = 15, 15
+	}
+	static, err = Decode(bytes.NewReader(b.strips(strip).bytes()))
+	assert.NoError(t, err)
+	masked, err = DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{MaskedAreasBlackLevel: true})
+	assert.NoError(t, err)
+	assert.Equal(t, static, masked)
+
+	// Malformed rectangles
+	b.add(tMaskedAreas, dtShort, 0, 0, height)
+	_, err = DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{MaskedAreasBlackLevel: true})
+	assert.Error(t, err)
+}
+
+func TestDecodeCFAClipHighlights(t *testing.T) {
+	strip := make([]byte, 4*4)
+	for i := range strip {
+		strip[i] = 250 // Blown highlights
+	}
+	data := cfaImage(4, 4).
+		add(tWhiteLevel, dtShort, 200).
+		add(tAsShotNeutral, dtRational, 1, 2, 1, 1, 5, 8).
+		strips(strip).
+		bytes()
+
+	X, Y, Z := sRGBToXYZ.apply(1, 1, 1)
+
+	m, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	X2, Y2, Z2, _ := m.(hdr.Image).HDRAt(1, 1).HDRXYZA()
+	assert.NotEqual(t, []float64{X, Y, Z}, []float64{X2, Y2, Z2})
+
+	m, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{ClipHighlights: true})
+	assert.NoError(t, err)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			X2, Y2, Z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.InDeltaSlice(t, []float64{X, Y, Z}, []float64{X2, Y2, Z2}, 1e-6, "pixel (%d,%d)", x, y)
+		}
+	}
+}
+
+func TestDecodeCFAOutput(t *testing.T) {
+	data := cfaImage(4, 4).
+		add(tAsShotNeutral, dtRational, 1, 2, 1, 1, 5, 8).
+		bytes()
+	decode := func(opts *DecodeOptions) hdr.Image {
+		m, err := DecodeWithOptions(bytes.NewReader(data), opts)
+		assert.NoError(t, err)
+		return m.(hdr.Image)
+	}
+
+	xyz := decode(nil)
+	assert.IsType(t, &hdr.XYZ{}, xyz)
+	camera := decode(&DecodeOptions{CFAOutput: CFAOutputCameraRGB})
+	assert.IsType(t, &hdr.RGB{}, camera)
+	// The reference white of the XYZ values does not change the sRGB values.
+	srgb := decode(&DecodeOptions{CFAOutput: CFAOutputLinearSRGB, OutputWhitePoint: D50})
+	assert.IsType(t, &hdr.RGB{}, srgb)
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			// Without ColorMatrix, the camera values are assumed to be linear sRGB.
+			R, G, B, _ := camera.HDRAt(x, y).HDRRGBA()
+			R2, G2, B2, _ := srgb.HDRAt(x, y).HDRRGBA()
+			assert.InDeltaSlice(t, []float64{R, G, B}, []float64{R2, G2, B2}, 1e-6, "pixel (%d,%d)", x, y)
+
+			X, Y, Z := sRGBToXYZ.apply(R, G, B)
+			X2, Y2, Z2, _ := xyz.HDRAt(x, y).HDRXYZA()
+			assert.InDeltaSlice(t, []float64{X, Y, Z}, []float64{X2, Y2, Z2}, 1e-6, "pixel (%d,%d)", x, y)
+		}
+	}
+
+	for _, output := range []CFAOutput{-1, CFAOutputLinearSRGB + 1} {
+		_, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{CFAOutput: output})
+		assert.Equal(t, FormatError("unknown CFAOutput"), err)
+	}
+}
+
+func TestDecodeCFADemosaicing(t *testing.T) {
+	const width, height = 6, 5
+	b := cfaImage(width, height)
+	strip := b.blocks[0]
+	opts := &bayer.Options{
+		ByteOrder:    binary.LittleEndian,
+		Depth:        8,
+		Width:        width,
+		Height:       height,
+		Pattern:      bayer.RGGB,
+		WhiteLevel:   255,
+		WhiteBalance: []float64{1, 1, 1},
+	}
+
+	for demosaicing, byr := range map[Demosaicing]bayer.Bayer{
+		DemosaicingMalvar:   bayer.NewMalvar(strip, opts),
+		DemosaicingBilinear: bayer.NewBilinear(strip, opts),
+	} {
+		m, err := DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{CFAOutput: CFAOutputCameraRGB, Demosaicing: demosaicing})
+		assert.NoError(t, err)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				R, G, B := byr.At(x, y)
+				R2, G2, B2, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+				assert.InDeltaSlice(t, []float64{R, G, B}, []float64{R2, G2, B2}, 1e-6, "demosaicing %d, pixel (%d,%d)", demosaicing, x, y)
+			}
+		}
+	}
+}
+
+func TestDecodeCFASkipWhiteBalance(t *testing.T) {
+	opts := &DecodeOptions{CFAOutput: CFAOutputCameraRGB}
+	sensor, err := DecodeWithOptions(bytes.NewReader(cfaImage(4, 4).bytes()), opts)
+	assert.NoError(t, err)
+
+	b := cfaImage(4, 4).add(tAsShotNeutral, dtRational, 1, 2, 1, 1, 5, 8)
+	balanced, err := DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+	assert.NoError(t, err)
+	assert.NotEqual(t, sensor, balanced)
+
+	opts.SkipWhiteBalance = true
+	m, err := DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, sensor, m)
+}
+
+func TestDecodeCFARepeatPatternDim(t *testing.T) {
+	const width, height = 8, 4
+	colors := []uint64{
+		0, 1, 2, 1,
+		1, 2, 1, 0,
+	}
+	strip := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			strip[y*width+x] = [3]byte{200, 100, 50}[colors[(y%2)*4+x%4]]
+		}
+	}
+	b := cfaImage(width, height).
+		add(tCFARepeatPatternDim, dtShort, 2, 4).
+		add(tCFAPattern, dtByte, colors...).
+		strips(strip)
+
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	X, Y, Z := sRGBToXYZ.apply(200.0/255, 100.0/255, 50.0/255)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			X2, Y2, Z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.InDeltaSlice(t, []float64{X, Y, Z}, []float64{X2, Y2, Z2}, 1e-6, "pixel (%d,%d)", x, y)
+		}
+	}
+
+	// The pattern must match its dimensions.
+	_, err = Decode(bytes.NewReader(b.add(tCFARepeatPatternDim, dtShort, 2, 2).bytes()))
+	assert.Error(t, err)
+
+	b.add(tCFARepeatPatternDim, dtShort, 12, 12).add(tCFAPattern, dtByte, make([]uint64, 144)...)
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	var unsupported UnsupportedError
+	assert.True(t, errors.As(err, &unsupported))
+}
+
+func TestDecodeCFACameraToXYZ(t *testing.T) {
+	// The ColorMatrix of the file is ignored.
+	data := cfaImage(4, 4).
+		add(tAsShotNeutral, dtRational, 1, 2, 1, 1, 5, 8).
+		add(tColorMatrix1, dtSRational, 2, 1, 0, 1, 0, 1, 0, 1, 2, 1, 0, 1, 0, 1, 0, 1, 2, 1).
+		bytes()
+	camToXYZ := [9]float64{
+		0.5, 0.25, 0.25,
+		0, 1, 0,
+		0.125, 0, 2,
+	}
+
+	camera, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{CFAOutput: CFAOutputCameraRGB})
+	assert.NoError(t, err)
+	m, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{CameraToXYZ: camToXYZ, UseCameraToXYZ: true})
+	assert.NoError(t, err)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			// Applied on the white balanced values
+			R, G, B, _ := camera.(hdr.Image).HDRAt(x, y).HDRRGBA()
+			X, Y, Z := mat3(camToXYZ).apply(R, G, B)
+			X2, Y2, Z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.InDeltaSlice(t, []float64{X, Y, Z}, []float64{X2, Y2, Z2}, 1e-6, "pixel (%d,%d)", x, y)
+		}
+	}
+}
+
+func TestDecodeCFABlocks(t *testing.T) {
+	const width, height = 8, 8
+	value := func(x, y int) byte {
+		return [4]byte{200, 100, 100, 50}[(y%2)*2+x%2] // Uniform color
+	}
+	X, Y, Z := sRGBToXYZ.apply(200.0/255, 100.0/255, 50.0/255)
+	check := func(m image.Image, name string) {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				X2, Y2, Z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+				assert.InDeltaSlice(t, []float64{X, Y, Z}, []float64{X2, Y2, Z2}, 1e-6, "%s pixel (%d,%d)", name, x, y)
+			}
+		}
+	}
+
+	// Strips of 3 rows, the second one begins on an odd row of the pattern.
+	strips := make([][]byte, 3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			strips[y/3] = append(strips[y/3], value(x, y))
+		}
+	}
+	b := cfaImage(width, height).add(tRowsPerStrip, dtShort, 3).strips(strips...)
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	check(m, "strips")
+
+	// Tiles of 5x5 pixels, clipped to 3 pixels at the right and bottom edges.
+	var tiles [][]byte
+	for ty := 0; ty < height; ty += 5 {
+		for tx := 0; tx < width; tx += 5 {
+			tile := make([]byte, 0, 25)
+			for y := ty; y < ty+5; y++ {
+				for x := tx; x < tx+5; x++ {
+					tile = append(tile, value(x, y))
+				}
+			}
+			tiles = append(tiles, tile)
+		}
+	}
+	b = cfaImage(width, height).omit(tRowsPerStrip).add(tTileWidth, dtShort, 5).add(tTileLength, dtShort, 5).tiles(tiles...)
+	m, err = Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	check(m, "tiles")
+}
+
+func TestDecodeCFABlockBoundaries(t *testing.T) {
+	const width, height = 9, 8
+	b := cfaImage(width, height)
+	samples := b.blocks[0] // Not uniform, the interpolation differs from one pixel to the next.
+
+	split := func(bw, bh int) [][]byte {
+		var blocks [][]byte
+		for ty := 0; ty < height; ty += bh {
+			for tx := 0; tx < width; tx += bw {
+				block := make([]byte, 0, bw*bh)
+				for y := ty; y < ty+bh; y++ {
+					for x := tx; x < tx+bw; x++ {
+						if x < width && y < height {
+							block = append(block, samples[y*width+x])
+						} else {
+							block = append(block, 0) // Padding
+						}
+					}
+				}
+				blocks = append(blocks, block)
+			}
+		}
+		return blocks
+	}
+	strips := make([][]byte, 0, 3)
+	for y := 0; y < height; y += 3 {
+		strips = append(strips, samples[y*width:minInt(y+3, height)*width])
+	}
+
+	for name, pattern := range map[string][]uint64{"bayer": {0, 1, 1, 2}, "arbitrary": {0, 1, 2, 1}} {
+		for _, demosaicing := range []Demosaicing{DemosaicingBilinear, DemosaicingMalvar} {
+			opts := &DecodeOptions{Demosaicing: demosaicing}
+			whole := cfaImage(width, height).add(tCFAPattern, dtByte, pattern...)
+			expected, err := DecodeWithOptions(bytes.NewReader(whole.bytes()), opts)
+			assert.NoError(t, err)
+
+			// The pixels along the block boundaries are interpolated from the samples of both sides.
+			m, err := DecodeWithOptions(bytes.NewReader(cfaImage(width, height).
+				add(tCFAPattern, dtByte, pattern...).
+				add(tRowsPerStrip, dtShort, 3).
+				strips(strips...).
+				bytes()), opts)
+			assert.NoError(t, err, "%s %d strips", name, demosaicing)
+			assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+
+			tiled := cfaImage(width, height).
+				add(tCFAPattern, dtByte, pattern...).
+				omit(tRowsPerStrip).
+				add(tTileWidth, dtShort, 4).
+				add(tTileLength, dtShort, 3).
+				tiles(split(4, 3)...)
+			m, err = DecodeWithOptions(bytes.NewReader(tiled.bytes()), opts)
+			assert.NoError(t, err, "%s %d tiles", name, demosaicing)
+			assertEqualImages(t, expected.(hdr.Image), m.(hdr.Image))
+
+			// A single tile decoded on its own, with the default options, reads its neighbours as well.
+			if demosaicing != DemosaicingBilinear {
+				continue
+			}
+			tile, r, err := DecodeBlock(bytes.NewReader(tiled.bytes()), 0, 4)
+			assert.NoError(t, err)
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					assert.Equal(t, expected.(hdr.Image).HDRAt(x, y), tile.(hdr.Image).HDRAt(x, y), "%s pixel (%d,%d)", name, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeCFALinearizationTable(t *testing.T) {
+	b := cfaImage(4, 4).
+		add(tLinearizationTable, dtShort, 0, 2, 4, 8).
+		add(tRowsPerStrip, dtShort, 2).
+		strips(cfaImage(4, 2).blocks[0], cfaImage(4, 2).blocks[0])
+
+	// Reported once for the whole image.
+	var warnings []string
+	_, err := DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{
+		Warn: func(msg string) { warnings = append(warnings, msg) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"LinearizationTable not applied, the CFA samples may need to be linearized"}, warnings)
+}
@@ -0,0 +1,169 @@
+package tiff
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// JPEG markers
+var (
+	jpegSOI = []byte{0xff, 0xd8}
+	jpegEOI = []byte{0xff, 0xd9}
+)
+
+// parseJPEGTables reads the JPEGTables shared by the JPEG strips or tiles, if any.
+// The tables are kept without their SOI and EOI markers so that they can be spliced into
+// each abbreviated stream by jpegBlock.
+func (d *decoder) parseJPEGTables() error {
+	d.jpegTables = nil
+	t, ok := d.features[tJPEGTables]
+	if !ok {
+		return nil
+	}
+
+	tables := make([]byte, len(t.val))
+	for i, v := range t.val {
+		tables[i] = byte(v)
+	}
+	if len(tables) < 4 || !bytes.HasPrefix(tables, jpegSOI) || !bytes.HasSuffix(tables, jpegEOI) {
+		return FormatError("invalid JPEGTables")
+	}
+	d.jpegTables = tables[2 : len(tables)-2]
+	return nil
+}
+
+// jpegBlock decodes the JPEG strip or tile of n bytes at offset.
+// When the tables are shared, they are inserted after the SOI marker of the block.
+func (d *decoder) jpegBlock(offset, n int64) (image.Image, error) {
+	var r io.Reader = io.NewSectionReader(d.r, offset, n)
+	if d.jpegTables != nil {
+		soi := make([]byte, len(jpegSOI))
+		if _, err := io.ReadFull(r, soi); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(soi, jpegSOI) {
+			return nil, FormatError("JPEG block without SOI marker")
+		}
+		r = io.MultiReader(bytes.NewReader(soi), bytes.NewReader(d.jpegTables), r)
+	}
+	return jpeg.Decode(r)
+}
+
+// readJPEG decodes the JPEG strips or tiles of a width x height preview.
+func (d *decoder) readJPEG(width, height int) (image.Image, error) {
+	blockWidth, blockHeight := width, height
+	offsets := d.features[tStripOffsets].val
+	counts := d.features[tStripByteCounts].val
+	if _, ok := d.features[tTileWidth]; ok {
+		blockWidth = int(d.firstVal(tTileWidth))
+		blockHeight = int(d.firstVal(tTileLength))
+		offsets = d.features[tTileOffsets].val
+		counts = d.features[tTileByteCounts].val
+	} else if v := int(d.firstVal(tRowsPerStrip)); v != 0 && v < height {
+		blockHeight = v
+	}
+	if len(counts) == 0 && len(offsets) > 0 {
+		// Some writers omit the byte counts of the JPEG blocks, which are delimited by their EOI marker.
+		counts = make([]uint64, len(offsets))
+		for i, offset := range offsets {
+			n, err := d.jpegLength(int64(offset))
+			if err != nil {
+				return nil, err
+			}
+			counts[i] = uint64(n)
+		}
+	}
+	if len(offsets) == 0 || len(offsets) != len(counts) || blockWidth <= 0 || blockHeight <= 0 {
+		return nil, FormatError("inconsistent header")
+	}
+
+	if len(offsets) == 1 {
+		return d.jpegBlock(int64(offsets[0]), int64(counts[0]))
+	}
+
+	across := (width + blockWidth - 1) / blockWidth
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range offsets {
+		block, err := d.jpegBlock(int64(offsets[i]), int64(counts[i]))
+		if err != nil {
+			return nil, err
+		}
+		r := image.Rect(0, 0, blockWidth, blockHeight).Add(image.Pt(i%across*blockWidth, i/across*blockHeight))
+		draw.Draw(m, r, block, block.Bounds().Min, draw.Src)
+	}
+	return m, nil
+}
+
+// jpegLength returns the length of the JPEG stream at offset, EOI marker included.
+// The marker segments are skipped by their length, so that an EOI in their payload (e.g. the
+// thumbnail of an APP1 segment) is ignored, and the entropy-coded data are scanned for the
+// next marker, their 0xFF bytes being followed by a stuffed 0x00 or a restart marker.
+func (d *decoder) jpegLength(offset int64) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(d.r, offset, math.MaxInt64-offset))
+	var n int64
+	readByte := func() (byte, error) {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		n++
+		return b, err
+	}
+
+	soi := make([]byte, len(jpegSOI))
+	if _, err := io.ReadFull(r, soi); err != nil || !bytes.Equal(soi, jpegSOI) {
+		return 0, FormatError("JPEG block without SOI marker")
+	}
+	n += int64(len(soi))
+
+	entropyCoded := false
+	for {
+		b, err := readByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xff {
+			if entropyCoded {
+				continue
+			}
+			return 0, FormatError("invalid JPEG marker")
+		}
+
+		marker := b
+		for marker == 0xff { // Fill bytes
+			if marker, err = readByte(); err != nil {
+				return 0, err
+			}
+		}
+		switch {
+		case entropyCoded && (marker == 0x00 || 0xd0 <= marker && marker <= 0xd7):
+			continue // Stuffed byte or restart marker (RSTn)
+		case marker == jpegEOI[1]:
+			return n, nil
+		}
+
+		hi, err := readByte()
+		if err != nil {
+			return 0, err
+		}
+		lo, err := readByte()
+		if err != nil {
+			return 0, err
+		}
+		length := int(hi)<<8 | int(lo)
+		if length < 2 {
+			return 0, FormatError("invalid JPEG segment length")
+		}
+		discarded, err := r.Discard(length - 2)
+		n += int64(discarded)
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		entropyCoded = marker == 0xda // SOS, the entropy-coded data follow the header
+	}
+}
@@ -0,0 +1,79 @@
+package tiff
+
+import (
+	"image"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// decodeLab decodes CIELab and ICCLab images.
+// CIELab stores a* and b* as signed integers relative to D65 whereas ICCLab stores
+// them as unsigned integers offset by 128 (or 32768) relative to D50.
+func (d *decoder) decodeLab(dst image.Image, xmin, ymin, xmax, ymax int) error {
+	rMaxX := minInt(xmax, dst.Bounds().Max.X)
+	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
+	rowStride := (xmax - xmin) * d.bytesPerPixel // Stored width, clipped pixels included
+	var offset int
+
+	icc := d.firstVal(tPhotometricInterpretation) == pICCLab
+	white := D65
+	if icc {
+		white = D50
+	}
+	adapt := white != d.opts.OutputWhitePoint
+	adaptation := chromaticAdaptation(white, d.opts.OutputWhitePoint)
+
+	m, ok := dst.(*hdr.XYZ)
+	if !ok {
+		return errDestinationType
+	}
+	for y := ymin; y < rMaxY; y++ {
+		offset = (y - ymin) * rowStride
+		for x := xmin; x < rMaxX; x++ {
+			L, a, b := d.readLab(d.buf[offset:], icc)
+			X, Y, Z := labToXYZ(L, a, b, whitePoints[white])
+			if adapt {
+				X, Y, Z = adaptation.apply(X, Y, Z)
+			}
+			X, Y, Z = d.clamp(X, Y, Z)
+			m.SetXYZ(x, y, hdrcolor.XYZ{X: X, Y: Y, Z: Z})
+			offset += d.bytesPerPixel
+		}
+	}
+
+	return nil
+}
+
+// readLab reads the L*a*b* samples of the pixel at the beginning of p.
+func (d *decoder) readLab(p []byte, icc bool) (L, a, b float64) {
+	if d.bpp == 8 {
+		L = float64(p[0]) * 100 / 0xff
+		if icc {
+			return L, float64(p[1]) - 128, float64(p[2]) - 128
+		}
+		return L, float64(int8(p[1])), float64(int8(p[2]))
+	}
+
+	L = float64(d.byteOrder.Uint16(p[0:2])) * 100 / 0xffff
+	if icc {
+		return L, float64(d.byteOrder.Uint16(p[2:4]))/256 - 128, float64(d.byteOrder.Uint16(p[4:6]))/256 - 128
+	}
+	return L, float64(int16(d.byteOrder.Uint16(p[2:4]))) / 256, float64(int16(d.byteOrder.Uint16(p[4:6]))) / 256
+}
+
+// labToXYZ converts L*a*b* to XYZ relative to the given reference white.
+func labToXYZ(L, a, b float64, white [3]float64) (X, Y, Z float64) {
+	finv := func(t float64) float64 {
+		const delta = 6.0 / 29
+		if t > delta {
+			return t * t * t
+		}
+		return 3 * delta * delta * (t - 4.0/29)
+	}
+
+	fy := (L + 16) / 116
+	fx := fy + a/500
+	fz := fy - b/200
+	return white[0] * finv(fx), white[1] * finv(fy), white[2] * finv(fz)
+}
@@ -0,0 +1,61 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLab(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		photometric uint64
+		bpp         uint64
+		pixel       []uint // White, mid-gray
+	}{
+		{"CIELab 8-bit", pCIELab, 8, []uint{0xff, 0, 0, 0x80, 0, 0}},
+		{"CIELab 16-bit", pCIELab, 16, []uint{0xffff, 0, 0, 0x8000, 0, 0}},
+		{"ICCLab 8-bit", pICCLab, 8, []uint{0xff, 0x80, 0x80, 0x80, 0x80, 0x80}},
+		{"ICCLab 16-bit", pICCLab, 16, []uint{0xffff, 0x8000, 0x8000, 0x8000, 0x8000, 0x8000}},
+	} {
+		var strip []byte
+		for _, v := range tc.pixel {
+			if tc.bpp == 8 {
+				strip = append(strip, byte(v))
+			} else {
+				strip = append(strip, byte(v>>8), byte(v))
+			}
+		}
+
+		b := newTIFFBuilder(binary.BigEndian).
+			add(tImageWidth, dtShort, 2).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, tc.bpp, tc.bpp, tc.bpp).
+			add(tPhotometricInterpretation, dtShort, tc.photometric).
+			add(tSamplesPerPixel, dtShort, 3).
+			strips(strip)
+
+		m, err := Decode(bytes.NewReader(b.bytes()))
+		assert.NoError(t, err, tc.name)
+
+		// The white is expressed relative to the default D65 output white point.
+		X, Y, Z, _ := m.(hdr.Image).HDRAt(0, 0).HDRXYZA()
+		white := whitePoints[D65]
+		assert.InDelta(t, white[0], X, 1e-3, tc.name)
+		assert.InDelta(t, white[1], Y, 1e-3, tc.name)
+		assert.InDelta(t, white[2], Z, 1e-3, tc.name)
+
+		// L* = 50 is 18.4% of the white luminance.
+		_, Y, _, _ = m.(hdr.Image).HDRAt(1, 0).HDRXYZA()
+		assert.InDelta(t, 0.184, Y, 2e-3, tc.name)
+
+		// The default SampleFormat may be explicit.
+		b.add(tSampleFormat, dtShort, sfUnsignedInteger, sfUnsignedInteger, sfUnsignedInteger)
+		explicit, err := Decode(bytes.NewReader(b.bytes()))
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, m, explicit, tc.name)
+	}
+}
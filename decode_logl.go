@@ -1,6 +1,7 @@
 package tiff
 
 import (
+	"encoding/binary"
 	"image"
 
 	"github.com/mdouchement/hdr"
@@ -12,28 +13,51 @@ func (d *decoder) decodeLogL(dst image.Image, xmin, ymin, xmax, ymax int) error
 	// Apply horizontal predictor if necessary.
 	// In this case, p contains the color difference to the preceding pixel.
 	// See page 64-65 of the spec.
-	if d.firstVal(tPredictor) > prNone {
+	if d.predictor > prNone {
 		return UnsupportedError("predictor")
 	}
 
 	rMaxX := minInt(xmax, dst.Bounds().Max.X)
 	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
-	var offset uint
+	rowStride := (xmax - xmin) * d.bytesPerPixel // Stored width, clipped pixels included
+	// Only the first sample is the luminance, the ExtraSamples that follow (e.g. alpha) are skipped.
+	var offset int
 
 	stonits := d.features[tStonits].double(0)
 	if stonits == 0 {
 		stonits = 1
 	}
 
-	m := dst.(*hdr.XYZ)
+	// unRLE interleaves the bytestreams most significant byte first whereas
+	// uncompressed samples are stored in the file's byte order.
+	var byteOrder binary.ByteOrder = binary.BigEndian
+	if d.compression != cSGILogRLE {
+		byteOrder = d.byteOrder
+	}
+
+	m, ok := dst.(*hdr.XYZ)
+	if !ok {
+		return errDestinationType
+	}
 	for y := ymin; y < rMaxY; y++ {
+		offset = (y - ymin) * rowStride
 		for x := xmin; x < rMaxX; x++ {
-			SLe := format.BytesToUint16(d.buf[offset], d.buf[offset+1])
-			Y := format.SLeToY(SLe)
-			m.SetXYZ(x, y, hdrcolor.XYZ{X: Y * stonits, Y: Y * stonits, Z: Y * stonits})
-			offset += 2 // LogL is hold on 2 bytes (the luminance used in GrayScale)
+			SLe := byteOrder.Uint16(d.buf[offset : offset+2])
+			Y, _, _ := d.clamp(sleToY(SLe)*stonits, 0, 0)
+			m.SetXYZ(x, y, hdrcolor.XYZ{X: Y, Y: Y, Z: Y})
+			offset += d.bytesPerPixel
 		}
 	}
 
 	return nil
 }
+
+// sleToY converts the 16-bit SLe word to the luminance, like LogL16toY of libtiff:
+// a zero Le is black and the sign bit negates the luminance.
+// Luminances below 1 cd/m² have a positive sign and a Le below 64*256.
+func sleToY(sle uint16) float64 {
+	if sle&0x7fff == 0 {
+		return 0
+	}
+	return format.SLeToY(sle)
+}
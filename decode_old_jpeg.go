@@ -0,0 +1,56 @@
+package tiff
+
+import (
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// oldJPEG returns the complete JPEG stream (JFIF) referenced by the JPEGInterchangeFormat tag,
+// which is the common layout of the obsolete JPEG compression (cJPEGOld).
+// The fragmented layout, with the tables in JPEGQTables, JPEGDCTables, etc. is not supported.
+func (d *decoder) oldJPEG() (io.Reader, error) {
+	if _, ok := d.features[tJPEGInterchangeFormat]; !ok {
+		return nil, UnsupportedError("obsolete JPEG without JPEGInterchangeFormat")
+	}
+
+	offset := int64(d.firstVal(tJPEGInterchangeFormat))
+	n := int64(d.firstVal(tJPEGInterchangeFormatLength))
+	if n == 0 {
+		n = 1<<63 - 1 - offset // The stream ends with its EOI marker.
+	}
+	return io.NewSectionReader(d.r, offset, n), nil
+}
+
+// readOldJPEG decodes the obsolete JPEG image, its gamma encoded sRGB values are linearized.
+func (d *decoder) readOldJPEG() (image.Image, error) {
+	stream, err := d.oldJPEG()
+	if err != nil {
+		return nil, err
+	}
+	src, err := jpeg.Decode(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	if bounds.Dx() != d.config.Width || bounds.Dy() != d.config.Height {
+		return nil, FormatError("JPEG dimensions do not match the image")
+	}
+
+	m := hdr.NewRGB(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, _ := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			m.SetRGB(x, y, hdrcolor.RGB{
+				R: sRGBToLinear(float64(r) / 0xffff),
+				G: sRGBToLinear(float64(g) / 0xffff),
+				B: sRGBToLinear(float64(b) / 0xffff),
+			})
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,65 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+// oldJPEGBuilder returns an obsolete JPEG TIFF whose JPEGInterchangeFormat references a gray JFIF stream.
+func oldJPEGBuilder(t *testing.T, width, height int, gray uint8) *tiffBuilder {
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{R: gray, G: gray, B: gray, A: 0xff}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, src, &jpeg.Options{Quality: 100}))
+
+	return newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, uint64(width)).
+		add(tImageLength, dtShort, uint64(height)).
+		add(tBitsPerSample, dtShort, 8, 8, 8).
+		add(tCompression, dtShort, cJPEGOld).
+		add(tPhotometricInterpretation, dtShort, pYCbCr).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tJPEGProc, dtShort, 1).
+		add(tJPEGInterchangeFormat, dtLong, 8). // The stream is written right after the header.
+		add(tJPEGInterchangeFormatLength, dtLong, uint64(buf.Len())).
+		strips(buf.Bytes())
+}
+
+func TestDecodeOldJPEG(t *testing.T) {
+	b := oldJPEGBuilder(t, 16, 8, 128)
+
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 16, 8), m.Bounds())
+
+	expected := math.Pow((128.0/255+0.055)/1.055, 2.4)
+	r, g, bl, _ := m.(hdr.Image).HDRAt(5, 3).HDRRGBA()
+	assert.InDelta(t, expected, r, 0.005)
+	assert.InDelta(t, expected, g, 0.005)
+	assert.InDelta(t, expected, bl, 0.005)
+
+	// The fragmented layout is not supported.
+	_, err = Decode(bytes.NewReader(b.omit(tJPEGInterchangeFormat).bytes()))
+	assert.Error(t, err)
+}
+
+func TestThumbnailOldJPEG(t *testing.T) {
+	data := oldJPEGBuilder(t, 16, 8, 200).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		bytes()
+
+	m, err := Thumbnail(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 16, 8), m.Bounds())
+	r, _, _, _ := m.At(0, 0).RGBA()
+	assert.InDelta(t, 200, r>>8, 1)
+}
@@ -2,32 +2,120 @@ package tiff
 
 import (
 	"image"
+	"math"
 
 	"github.com/mdouchement/hdr"
-	"github.com/mdouchement/hdr/format"
 	"github.com/mdouchement/hdr/hdrcolor"
 )
 
 func (d *decoder) decodeRGB(dst image.Image, xmin, ymin, xmax, ymax int) error {
-	// Apply horizontal predictor if necessary.
-	// In this case, p contains the color difference to the preceding pixel.
-	// See page 64-65 of the spec.
-	if d.firstVal(tPredictor) > prNone {
-		return UnsupportedError("predictor")
-	}
+	// The predictor, if any, has already been reversed by decompress.
 
 	rMaxX := minInt(xmax, dst.Bounds().Max.X)
 	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
-	var offset uint
+	rowStride := (xmax - xmin) * d.bytesPerPixel // Stored width, clipped pixels included
+	// Only the first 3 samples are color samples, the ExtraSamples that follow are skipped.
+	var offset int
+
+	m, ok := dst.(*hdr.RGB)
+	if !ok {
+		return errDestinationType
+	}
+	if d.bpp == 16 || d.packed() || d.sampleFormat == sfUnsignedInteger || d.sampleFormat == sfSignedInteger {
+		return d.decodeRGBInteger(m, xmin, ymin, rMaxX, rMaxY, rowStride)
+	}
 
-	m := dst.(*hdr.RGB)
+	// The 32-bit floating point samples are copied as is into the float32 backing of hdr.RGB,
+	// without going through float64 colors.
 	for y := ymin; y < rMaxY; y++ {
+		offset = (y - ymin) * rowStride
 		for x := xmin; x < rMaxX; x++ {
-			R, G, B := format.FromBytes(d.byteOrder, d.buf[offset:offset+12])
-			m.SetRGB(x, y, hdrcolor.RGB{R: R, G: G, B: B})
-			offset += 12 // RGB is hold on 12 Bytes (4 Bytes per channel)
+			p := m.Pix[m.PixOffset(x, y):]
+			for c := 0; c < 3; c++ {
+				v := math.Float32frombits(d.byteOrder.Uint32(d.buf[offset+4*c:]))
+				if d.opts.ClampNegative && v < 0 {
+					v = 0
+				}
+				p[c] = v
+			}
+			offset += d.bytesPerPixel
+		}
+	}
+
+	return nil
+}
+
+// decodeRGBInteger decodes packed (expanded to 16 bits by decompress), 16 and 32-bit
+// (un)signed integer samples, scaled to [0, 1] according to the IntegerSampleRange option or to
+// MinSampleValue and MaxSampleValue (the full range of the data type when they are absent).
+func (d *decoder) decodeRGBInteger(m *hdr.RGB, xmin, ymin, xmax, ymax, rowStride int) error {
+	signed := d.sampleFormat == sfSignedInteger // Not packed, see newIDFDecoder
+	minValue, maxValue := 0.0, float64(math.MaxUint16)
+	switch {
+	case signed && d.bpp == 16:
+		minValue, maxValue = math.MinInt16, math.MaxInt16
+	case signed:
+		minValue, maxValue = math.MinInt32, math.MaxInt32
+	case d.bpp == 32:
+		maxValue = math.MaxUint32
+	case d.packed():
+		maxValue = math.Exp2(float64(d.bpp)) - 1
+	}
+
+	var lo, scale [3]float64
+	for c := range lo {
+		if d.bitsPerSample != nil {
+			maxValue = math.Exp2(float64(d.bitsPerSample[c])) - 1
+		}
+		lo[c] = sampleValue(d.features[tMinSampleValue], c, minValue)
+		hi := sampleValue(d.features[tMaxSampleValue], c, maxValue)
+		if r := d.opts.IntegerSampleRange; r != [2]float64{} {
+			lo[c], hi = r[0], r[1]
+		}
+		if hi <= lo[c] {
+			return FormatError("MaxSampleValue must be greater than MinSampleValue")
+		}
+		scale[c] = 1 / (hi - lo[c])
+	}
+
+	sample := func(p []byte) float64 {
+		switch {
+		case signed && d.bpp == 16:
+			return float64(int16(d.byteOrder.Uint16(p)))
+		case d.bpp == 16 || d.packed():
+			return float64(d.byteOrder.Uint16(p))
+		case signed:
+			return float64(int32(d.byteOrder.Uint32(p)))
+		default:
+			return float64(d.byteOrder.Uint32(p))
 		}
 	}
+	bytesPerSample := d.bytesPerPixel / int(d.spp)
 
+	var rgb [3]float64
+	for y := ymin; y < ymax; y++ {
+		offset := (y - ymin) * rowStride
+		for x := xmin; x < xmax; x++ {
+			for c := range rgb {
+				rgb[c] = (sample(d.buf[offset+bytesPerSample*c:]) - lo[c]) * scale[c]
+			}
+			R, G, B := d.clamp(rgb[0], rgb[1], rgb[2])
+			m.SetRGB(x, y, hdrcolor.RGB{R: R, G: G, B: B})
+			offset += d.bytesPerPixel
+		}
+	}
 	return nil
 }
+
+// sampleValue returns the value of the sample c of a per-sample tag such as MinSampleValue,
+// the first value applying to all the samples when a single one is given.
+func sampleValue(t tag, c int, defaultValue float64) float64 {
+	switch {
+	case len(t.val) == 0:
+		return defaultValue
+	case c < len(t.val):
+		return t.asFloat(c)
+	default:
+		return t.asFloat(0)
+	}
+}
@@ -0,0 +1,83 @@
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+// decodeThumbnail decodes the LDR preview described by idf.
+// Previews are either JPEG streams, stripped or tiled, or 8-bit RGB strips.
+func decodeThumbnail(idf *idf) (image.Image, error) {
+	d := &decoder{
+		idf:         idf,
+		mode:        mRGB,
+		bpp:         8,
+		spp:         1,
+		compression: idf.firstVal(tCompression),
+	}
+	if _, ok := d.features[tSamplesPerPixel]; ok {
+		d.spp = d.firstVal(tSamplesPerPixel)
+	}
+	d.bytesPerPixel = int(d.spp)
+
+	width := dimension(d.firstVal(tImageWidth))
+	height := dimension(d.firstVal(tImageLength))
+	if err := d.checkLimits(image.Rect(0, 0, width, height), nil); err != nil {
+		return nil, err
+	}
+
+	if d.compression == cJPEG {
+		if err := d.parseJPEGTables(); err != nil {
+			return nil, err
+		}
+		return d.readJPEG(width, height)
+	}
+
+	if _, ok := d.features[tTileWidth]; ok {
+		return nil, UnsupportedError("tiled thumbnail")
+	}
+
+	rowsPerStrip := height
+	if v := int(d.firstVal(tRowsPerStrip)); v != 0 && v < height {
+		rowsPerStrip = v
+	}
+	offsets := d.features[tStripOffsets].val
+	counts := d.features[tStripByteCounts].val
+	if len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, FormatError("inconsistent header")
+	}
+
+	if d.compression == cJPEGOld {
+		r, err := d.oldJPEG()
+		if err != nil {
+			return nil, err
+		}
+		return jpeg.Decode(r)
+	}
+
+	if d.firstVal(tPhotometricInterpretation) != pRGB || d.firstVal(tBitsPerSample) != 8 || d.spp < 3 {
+		return nil, UnsupportedError(fmt.Sprintf("thumbnail %v", d.features[tPhotometricInterpretation]))
+	}
+
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range offsets {
+		ymin := i * rowsPerStrip
+		ymax := minInt(ymin+rowsPerStrip, height)
+		if err := d.decompress(int64(offsets[i]), int64(counts[i]), width, ymax-ymin); err != nil {
+			return nil, err
+		}
+
+		for y := ymin; y < ymax; y++ {
+			for x := 0; x < width; x++ {
+				offset := ((y-ymin)*width + x) * d.bytesPerPixel
+				if offset+3 > len(d.buf) {
+					return nil, FormatError("not enough pixel data")
+				}
+				m.SetRGBA(x, y, color.RGBA{R: d.buf[offset], G: d.buf[offset+1], B: d.buf[offset+2], A: 0xff})
+			}
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,204 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbnailRGB(t *testing.T) {
+	strip := []byte{
+		10, 20, 30, 40, 50, 60,
+		70, 80, 90, 100, 110, 120,
+	}
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 2).
+		add(tBitsPerSample, dtShort, 8, 8, 8).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tRowsPerStrip, dtShort, 2).
+		strips(strip).
+		bytes()
+
+	m, err := Thumbnail(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 2, 2), m.Bounds())
+	assert.Equal(t, color.RGBA{R: 10, G: 20, B: 30, A: 0xff}, m.At(0, 0))
+	assert.Equal(t, color.RGBA{R: 100, G: 110, B: 120, A: 0xff}, m.At(1, 1))
+}
+
+func TestThumbnailLimits(t *testing.T) {
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtLong, 0xFFFFFFFF).
+		add(tImageLength, dtLong, 0xFFFFFFFF).
+		add(tBitsPerSample, dtShort, 8, 8, 8).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips([]byte{10, 20}).
+		bytes()
+
+	// Rejected before the allocation of the preview.
+	_, err := Thumbnail(bytes.NewReader(data))
+	assert.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+	_, err = LinearThumbnail(bytes.NewReader(data))
+	assert.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+}
+
+func TestThumbnailJPEG(t *testing.T) {
+	preview := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, preview, nil))
+
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 16).
+		add(tImageLength, dtShort, 8).
+		add(tBitsPerSample, dtShort, 8, 8, 8).
+		add(tCompression, dtShort, cJPEG).
+		add(tPhotometricInterpretation, dtShort, pYCbCr).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips(buf.Bytes()).
+		bytes()
+
+	m, err := Thumbnail(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 16, 8), m.Bounds())
+}
+
+func TestThumbnailNotFound(t *testing.T) {
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogL).
+		strips([]byte{0, 0}).
+		bytes()
+
+	_, err := Thumbnail(bytes.NewReader(data))
+	assert.Error(t, err)
+}
+
+// abbreviatedJPEG splits the JPEG stream p into its tables-only stream and its abbreviated image stream.
+func abbreviatedJPEG(p []byte) (tables, scan []byte) {
+	tables = append(tables, jpegSOI...)
+	scan = append(scan, jpegSOI...)
+	for i := 2; i < len(p); {
+		marker := p[i+1]
+		if marker == 0xda { // SOS, the entropy-coded data follow
+			scan = append(scan, p[i:]...)
+			break
+		}
+		n := 2 + int(binary.BigEndian.Uint16(p[i+2:]))
+		if marker == 0xdb || marker == 0xc4 { // DQT, DHT
+			tables = append(tables, p[i:i+n]...)
+		} else {
+			scan = append(scan, p[i:i+n]...)
+		}
+		i += n
+	}
+	return append(tables, jpegEOI...), scan
+}
+
+func TestThumbnailJPEGTables(t *testing.T) {
+	colors := []color.RGBA{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0xff}, {R: 0xff, G: 0xff, B: 0xff, A: 0xff}}
+	var tables []byte
+	tiles := make([][]byte, len(colors))
+	for i, c := range colors {
+		tile := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		draw.Draw(tile, tile.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		var buf bytes.Buffer
+		assert.NoError(t, jpeg.Encode(&buf, tile, &jpeg.Options{Quality: 100}))
+		tables, tiles[i] = abbreviatedJPEG(buf.Bytes())
+	}
+	table := make([]uint64, len(tables))
+	for i, v := range tables {
+		table[i] = uint64(v)
+	}
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 24).
+		add(tImageLength, dtShort, 24).
+		add(tBitsPerSample, dtShort, 8, 8, 8).
+		add(tCompression, dtShort, cJPEG).
+		add(tPhotometricInterpretation, dtShort, pYCbCr).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tTileWidth, dtShort, 16).
+		add(tTileLength, dtShort, 16).
+		add(tJPEGTables, dtUndefined, table...).
+		tiles(tiles...)
+
+	m, err := Thumbnail(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 24, 24), m.Bounds())
+	for i, p := range []image.Point{{0, 0}, {20, 0}, {0, 20}, {23, 23}} {
+		r, g, bl, _ := m.At(p.X, p.Y).RGBA()
+		assert.InDeltaSlice(t, []uint32{uint32(colors[i].R) * 0x101, uint32(colors[i].G) * 0x101, uint32(colors[i].B) * 0x101},
+			[]uint32{r, g, bl}, 0x400, "%v", p)
+	}
+
+	// The abbreviated streams cannot be decoded without the shared tables.
+	_, err = Thumbnail(bytes.NewReader(b.omit(tJPEGTables).bytes()))
+	assert.Error(t, err)
+}
+
+func TestThumbnailJPEGWithoutByteCounts(t *testing.T) {
+	colors := []color.RGBA{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0xff}, {R: 0xff, G: 0xff, B: 0xff, A: 0xff}}
+	tiles := make([][]byte, len(colors))
+	for i, c := range colors {
+		tile := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		draw.Draw(tile, tile.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		var buf bytes.Buffer
+		assert.NoError(t, jpeg.Encode(&buf, tile, &jpeg.Options{Quality: 100}))
+		// A COM segment holding an EOI marker, which does not end the stream
+		comment := []byte{0xff, 0xfe, 0x00, 0x04, 0xff, 0xd9}
+		tiles[i] = append(append(append([]byte(nil), jpegSOI...), comment...), buf.Bytes()[2:]...)
+	}
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 24).
+		add(tImageLength, dtShort, 24).
+		add(tBitsPerSample, dtShort, 8, 8, 8).
+		add(tCompression, dtShort, cJPEG).
+		add(tPhotometricInterpretation, dtShort, pYCbCr).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tTileWidth, dtShort, 16).
+		add(tTileLength, dtShort, 16).
+		omit(tTileByteCounts).
+		tiles(tiles...)
+
+	idf, err := newIDF(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	d := &decoder{idf: idf}
+	for i, offset := range d.features[tTileOffsets].val {
+		n, err := d.jpegLength(int64(offset))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(tiles[i])), n)
+	}
+
+	m, err := Thumbnail(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	for i, p := range []image.Point{{0, 0}, {20, 0}, {0, 20}, {23, 23}} {
+		r, g, bl, _ := m.At(p.X, p.Y).RGBA()
+		assert.InDeltaSlice(t, []uint32{uint32(colors[i].R) * 0x101, uint32(colors[i].G) * 0x101, uint32(colors[i].B) * 0x101},
+			[]uint32{r, g, bl}, 0x400, "%v", p)
+	}
+
+	// A truncated stream has no EOI marker.
+	tiles[3] = tiles[3][:len(tiles[3])-2]
+	_, err = Thumbnail(bytes.NewReader(b.tiles(tiles...).bytes()))
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package tiff
+
+import (
+	"image"
+	"io"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// decodeTransMask decodes a transparency mask as a grayscale image, 1 being opaque and 0 transparent.
+// The spec defines 1-bit masks, 8-bit masks are decoded too.
+func (d *decoder) decodeTransMask(dst image.Image, xmin, ymin, xmax, ymax int) error {
+	return d.decodeGray(dst, xmin, ymin, xmax, ymax)
+}
+
+// decodeBilevel decodes a bilevel image as a grayscale image, 1 being white and 0 black.
+func (d *decoder) decodeBilevel(dst image.Image, xmin, ymin, xmax, ymax int) error {
+	return d.decodeGray(dst, xmin, ymin, xmax, ymax)
+}
+
+// decodeGray decodes the samples of d.bpp bits, read by readBits, as gray XYZ colors
+// scaled to [0, 1] and inverted for a WhiteIsZero image.
+func (d *decoder) decodeGray(dst image.Image, xmin, ymin, xmax, ymax int) error {
+	rMaxX := minInt(xmax, dst.Bounds().Max.X)
+	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
+	rowSize := d.rowSize(xmax - xmin) // Stored width, clipped pixels included
+	maxValue := float64(uint(1)<<d.bpp - 1)
+
+	if rMaxX > xmin && rMaxY > ymin {
+		if needed := (rMaxY-ymin-1)*rowSize + d.rowSize(rMaxX-xmin); len(d.buf) < needed {
+			return FormatError("not enough pixel data")
+		}
+	}
+
+	m, ok := dst.(*hdr.XYZ)
+	if !ok {
+		return errDestinationType
+	}
+	for y := ymin; y < rMaxY; y++ {
+		d.off = (y - ymin) * rowSize
+		for x := xmin; x < rMaxX; x++ {
+			v := float64(d.readBits(d.bpp)) / maxValue
+			if d.whiteIsZero {
+				v = 1 - v
+			}
+			m.SetXYZ(x, y, hdrcolor.XYZ{X: v, Y: v, Z: v})
+		}
+		d.flushBits()
+	}
+
+	return nil
+}
+
+// TransparencyMask reads a TIFF image from r and returns its transparency mask as an alpha plane,
+// which is the first IFD with the TransMask PhotometricInterpretation (usually flagged as such by its NewSubFileType)
+// or the first bilevel IFD flagged as a transparency mask by its NewSubFileType.
+// The mask can be applied to the image with draw.DrawMask.
+func TransparencyMask(r io.Reader) (*image.Alpha, error) {
+	idf, err := newIDF(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+
+	for fi, features := range idf.tree {
+		switch p := features[tPhotometricInterpretation].firstVal(); {
+		case p == pTransMask:
+		case (p == pBlackIsZero || p == pWhiteIsZero) && features[tNewSubFileType].firstVal()&sftTransMask != 0:
+		default:
+			continue
+		}
+
+		d, err := newIDFDecoder(idf.sub(fi))
+		if err != nil {
+			return nil, err
+		}
+		m, err := d.readImage()
+		if err != nil {
+			return nil, err
+		}
+
+		mask, ok := m.(*hdr.XYZ)
+		if !ok {
+			return nil, errDestinationType
+		}
+		b := mask.Bounds()
+		alpha := image.NewAlpha(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				alpha.Pix[alpha.PixOffset(x, y)] = uint8(mask.XYZAt(x, y).Y*0xff + 0.5)
+			}
+		}
+		return alpha, nil
+	}
+	return nil, FormatError("transparency mask not found")
+}
@@ -0,0 +1,135 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeTransMask(t *testing.T) {
+	const width, height = 10, 2
+
+	mask := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftTransMask).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 1).
+		add(tPhotometricInterpretation, dtShort, pTransMask).
+		strips([]byte{0b10110000, 0b01000000, 0b00000001, 0b11000000}) // Rows begin on byte boundaries
+	expected := [][]uint8{
+		{1, 0, 1, 1, 0, 0, 0, 0, 0, 1},
+		{0, 0, 0, 0, 0, 0, 0, 1, 1, 1},
+	}
+
+	m, err := Decode(bytes.NewReader(mask.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			_, Y, _, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.Equal(t, float64(expected[y][x]), Y, "pixel (%d,%d)", x, y)
+		}
+	}
+
+	// The mask of an image
+	strip := make([]byte, width*height*2*3)
+	img := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16, 16, 16).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, sfUnsignedInteger, sfUnsignedInteger, sfUnsignedInteger).
+		strips(strip).
+		subIFDs(mask)
+
+	alpha, err := TransparencyMask(bytes.NewReader(img.bytes()))
+	assert.NoError(t, err)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			assert.Equal(t, 0xff*expected[y][x], alpha.AlphaAt(x, y).A, "pixel (%d,%d)", x, y)
+		}
+	}
+
+	// The default SampleFormat may be explicit.
+	mask.add(tSampleFormat, dtShort, sfUnsignedInteger)
+	explicit, err := TransparencyMask(bytes.NewReader(img.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, alpha, explicit)
+	mask.omit(tSampleFormat)
+
+	_, err = TransparencyMask(bytes.NewReader(mask.add(tPhotometricInterpretation, dtShort, pLogL).bytes()))
+	assert.Error(t, err)
+
+	// Truncated mask
+	_, err = Decode(bytes.NewReader(mask.add(tPhotometricInterpretation, dtShort, pTransMask).strips([]byte{0, 0, 0}).bytes()))
+	assert.Error(t, err)
+}
+
+func TestDecodeBilevel(t *testing.T) {
+	const width, height = 10, 2
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 1).
+		add(tCompression, dtShort, cNone).
+		strips([]byte{0b10110000, 0b01000000, 0b00000001, 0b11000000})
+	expected := [][]uint8{
+		{1, 0, 1, 1, 0, 0, 0, 0, 0, 1},
+		{0, 0, 0, 0, 0, 0, 0, 1, 1, 1},
+	}
+
+	for _, p := range []uint{pBlackIsZero, pWhiteIsZero} {
+		m, err := Decode(bytes.NewReader(b.add(tPhotometricInterpretation, dtShort, uint64(p)).bytes()))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		// The default SampleFormat may be explicit.
+		withFormat := *b
+		withFormat.entries = append([]testEntry(nil), b.entries...)
+		explicit, err := Decode(bytes.NewReader(withFormat.add(tSampleFormat, dtShort, sfUnsignedInteger).bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, m, explicit)
+
+		assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := float64(expected[y][x])
+				if p == pWhiteIsZero {
+					v = 1 - v
+				}
+				_, Y, _, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+				assert.Equal(t, v, Y, "photometric %d, pixel (%d,%d)", p, x, y)
+			}
+		}
+	}
+
+	// A bilevel mask of an image
+	mask := b.add(tPhotometricInterpretation, dtShort, pBlackIsZero).add(tNewSubFileType, dtLong, sftTransMask)
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogL).
+		strips(make([]byte, width*height*2)).
+		subIFDs(mask).
+		bytes()
+	alpha, err := TransparencyMask(bytes.NewReader(data))
+	if assert.NoError(t, err) {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				assert.Equal(t, 0xff*expected[y][x], alpha.AlphaAt(x, y).A, "pixel (%d,%d)", x, y)
+			}
+		}
+	}
+
+	// The other LDR images are still rejected.
+	_, err = Decode(bytes.NewReader(b.add(tBitsPerSample, dtShort, 8).bytes()))
+	assert.True(t, errors.Is(err, ErrUnsupportedPhotometric))
+}
@@ -2,10 +2,13 @@ package tiff
 
 import (
 	"compress/zlib"
+	"encoding/binary"
 	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/bits"
 
 	"github.com/mdouchement/hdr/hdrcolor"
 	"golang.org/x/image/tiff/lzw"
@@ -16,26 +19,53 @@ var Debug = false
 
 type decoder struct {
 	*idf
-	config image.Config
-	mode   imageMode
-	bpp    uint
+	config        image.Config
+	mode          imageMode
+	bpp           uint
+	bitsPerSample []uint // BitsPerSample of each sample when they differ (e.g. 5-6-5 RGB), nil otherwise
+	whiteIsZero   bool   // Bilevel image whose 0 samples are white
+	spp           uint   // SamplesPerPixel
+	bytesPerPixel int
+	compression   uint // Compression of all the strips or tiles, 0 when missing
+	predictor     uint
+	sampleFormat  uint   // SampleFormat of the first sample, 0 when missing
+	jpegTables    []byte // JPEGTables without their SOI and EOI markers, shared by the JPEG blocks
+	opts          DecodeOptions
+	// blackLevels are the R, G and B black levels measured in the MaskedAreas of a CFA.
+	blackLevels []float64
+	// cfaBounds is the region of the image whose samples d.buf holds when readCFABlock surrounds
+	// the decoded block of a CFA with the samples of its neighbours, empty otherwise.
+	cfaBounds image.Rectangle
+	// cfaBlocks caches the decompressed samples of the CFA blocks, by index, which the next blocks
+	// may need as context.
+	cfaBlocks map[int][]byte
+	// warnings are the inconsistencies of the file tolerated by the decoder, see DecodeOptions.Warn.
+	warnings []string
 
 	// decode decodes the raw data of an image.
 	// It reads from d.buf and writes the strip or tile into dst.
+	// The block covers the half-open ranges [xmin, xmax) and [ymin, ymax), which may
+	// exceed the bounds of dst for the last tiles; only in-bounds pixels are written
+	// but the rows in d.buf always hold (xmax - xmin) pixels.
 	decode func(dst image.Image, xmin, ymin, xmax, ymax int) error
 
-	buf   []byte
-	off   int    // Current offset in buf.
-	v     uint32 // Buffer value for reading with arbitrary bit depths.
-	nbits uint   // Remaining number of bits in v.
+	buf      []byte
+	off      int    // Current offset in buf.
+	v        uint64 // Buffer value for reading with arbitrary bit depths.
+	nbits    uint   // Remaining number of bits in v.
+	lsbFirst bool   // FillOrder of the bit-packed data.
 }
 
-func newDecoder(r io.Reader) (*decoder, error) {
-	idf, err := newIDF(newReaderAt(r))
+func newDecoder(r io.ReaderAt) (*decoder, error) {
+	idf, err := newIDF(r)
 	if err != nil {
 		return nil, err
 	}
+	return newIDFDecoder(idf)
+}
 
+// newIDFDecoder returns a decoder of the image described by the features of idf.
+func newIDFDecoder(idf *idf) (*decoder, error) {
 	if Debug {
 		fmt.Println(idf)
 	}
@@ -43,28 +73,52 @@ func newDecoder(r io.Reader) (*decoder, error) {
 	d := &decoder{
 		idf: idf,
 	}
+	if d.exifErr != nil {
+		d.warnings = append(d.warnings, fmt.Sprintf("EXIF IFD ignored: %v", d.exifErr))
+	}
+	// Read once as they are checked for each strip or tile.
+	d.compression = d.firstVal(tCompression)
+	d.predictor = d.firstVal(tPredictor)
 
-	d.config.Width = int(d.firstVal(tImageWidth))
-	d.config.Height = int(d.firstVal(tImageLength))
+	d.config.Width = dimension(d.firstVal(tImageWidth))
+	d.config.Height = dimension(d.firstVal(tImageLength))
 
 	if _, ok := d.features[tBitsPerSample]; !ok {
 		return nil, FormatError("BitsPerSample tag missing")
 	}
 	d.bpp = d.firstVal(tBitsPerSample)
+	for _, v := range d.features[tBitsPerSample].val {
+		if uint(v) != d.bpp {
+			d.bitsPerSample = uints(d.features[tBitsPerSample].val)
+			break
+		}
+	}
+
+	if d.compression == cJPEGOld {
+		// The obsolete JPEG is decoded as a whole by readOldJPEG, whatever the PhotometricInterpretation.
+		d.mode = mRGB
+		d.config.ColorModel = hdrcolor.RGBModel
+		return d, nil
+	}
 
 	// Determine the image mode.
-	switch d.firstVal(tPhotometricInterpretation) {
-	case pWhiteIsZero:
-		fallthrough
-	case pBlackIsZero:
-		fallthrough
+	switch p := d.firstVal(tPhotometricInterpretation); p {
+	case pWhiteIsZero, pBlackIsZero:
+		if d.bpp == 1 && d.firstVal(tSamplesPerPixel) <= 1 {
+			// The bilevel images, such as the masks of HDR composites, are decoded as grayscale.
+			d.mode = mBilevel
+			d.decode = d.decodeBilevel
+			d.config.ColorModel = hdrcolor.XYZModel
+			d.whiteIsZero = p == pWhiteIsZero
+			break
+		}
+		// All LDR modes are droped.
+		return nil, fmt.Errorf("%w, use Golang's lib for LDR images", ErrUnsupportedPhotometric)
 	case pPaletted:
 		fallthrough
-	case pTransMask:
-		fallthrough
 	case pCMYK:
 		// All LDR modes are droped.
-		return nil, UnsupportedError("color model, use Golang's lib for LDR images")
+		return nil, fmt.Errorf("%w, use Golang's lib for LDR images", ErrUnsupportedPhotometric)
 	case pRGB:
 		d.mode = mRGB
 		d.decode = d.decodeRGB
@@ -77,45 +131,228 @@ func newDecoder(r io.Reader) (*decoder, error) {
 		d.mode = mLogLuv
 		d.decode = d.decodeLogLuv
 		d.config.ColorModel = hdrcolor.XYZModel
+		if d.bpp == 16 && d.firstVal(tSamplesPerPixel) <= 1 && len(d.features[tExtraSamples].val) == 0 {
+			// Some tools write the luminance only images as LogLuv instead of LogL.
+			d.mode = mLogL
+			d.decode = d.decodeLogL
+			d.warnings = append(d.warnings, "LogLuv image with a single 16-bit sample decoded as LogL")
+		}
 	case pColorFilterArray:
 		d.mode = mColorFilterArray
 		d.decode = d.decodeColorFilterArray
 		d.config.ColorModel = hdrcolor.XYZModel
+		if _, ok := d.features[tLinearizationTable]; ok {
+			d.warnings = append(d.warnings, "LinearizationTable not applied, the CFA samples may need to be linearized")
+		}
+	case pTransMask:
+		d.mode = mTransMask
+		d.decode = d.decodeTransMask
+		d.config.ColorModel = hdrcolor.XYZModel
+	case pCIELab, pICCLab:
+		d.mode = mLab
+		d.decode = d.decodeLab
+		d.config.ColorModel = hdrcolor.XYZModel
+	default:
+		return nil, ErrUnsupportedPhotometric
+	}
+
+	d.sampleFormat = d.firstVal(tSampleFormat)
+	for _, v := range d.features[tSampleFormat].val {
+		if d.mode == mRGB && d.bpp == 32 && uint(v) != d.sampleFormat {
+			// Integer and floating point samples are read by different paths.
+			return nil, UnsupportedError("mixed sample formats")
+		}
+		if d.mode == mRGB && d.bpp == 32 && (v == sfUnsignedInteger || v == sfSignedInteger) {
+			continue // 32-bit integer RGB
+		}
+		if v == sfUnsignedInteger && !d.unsignedSamples() {
+			// tSampleFormat == 2 for LogLuv/LogL with bpp == 16
+			// tSampleFormat == 3 only when bpp == 32
+			return nil, UnsupportedError("sample format")
+		}
+		if v == sfIEEEFP && d.bpp == 16 {
+			return nil, UnsupportedError("16-bit floating point samples")
+		}
+		if v == sfSignedInteger && d.mode == mRGB && d.packed() {
+			return nil, UnsupportedError("signed packed samples")
+		}
+	}
+
+	switch d.firstVal(tFillOrder) {
+	case 0, foMSBFirst:
+	case foLSBFirst:
+		d.lsbFirst = true
 	default:
-		return nil, UnsupportedError("color model")
+		return nil, FormatError("invalid FillOrder")
+	}
+
+	// SamplesPerPixel defaults to 1 (p. 24 of the spec).
+	d.spp = 1
+	if _, ok := d.features[tSamplesPerPixel]; ok {
+		d.spp = d.firstVal(tSamplesPerPixel)
+	}
+	if d.spp != colorSamples[d.mode]+uint(len(d.features[tExtraSamples].val)) {
+		return nil, FormatError("SamplesPerPixel does not match PhotometricInterpretation")
+	}
+	if err := d.checkMixedBitsPerSample(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case d.mode == mLogLuv && d.compression == cSGILog24Packed:
+		// The three Luv samples are packed in 24 bits, without ExtraSamples.
+		d.bytesPerPixel = 3
+	case d.mode == mLogLuv:
+		// The three Luv samples are packed in 32 bits.
+		d.bytesPerPixel = 4 + int((d.spp-colorSamples[d.mode])*d.bpp/8)
+	case d.packed():
+		// The packed samples are expanded to 16 bits by decompress.
+		d.bytesPerPixel = int(d.spp) * 2
+	default:
+		d.bytesPerPixel = int(d.spp * d.bpp / 8)
+	}
+
+	if err := d.checkSGILog(); err != nil {
+		return nil, err
 	}
 
 	return d, nil
 }
 
-// readBits reads n bits from the internal buffer starting at the current offset.
+// checkSGILog checks that the SGILog compressions are paired with a matching PhotometricInterpretation,
+// the bytes per pixel of the bytestreams being given by the mode: 2 for LogL and 4 for LogLuv,
+// followed by the 2 bytes of each ExtraSample (e.g. an alpha).
+// The SGILog24 compression is only defined for LogLuv, stored as raw 24-bit pixels without ExtraSamples.
+func (d *decoder) checkSGILog() error {
+	switch d.compression {
+	case cSGILogRLE:
+		bytesPerPixel := 2 + 2*len(d.features[tExtraSamples].val)
+		if d.mode == mLogLuv {
+			bytesPerPixel += 2
+		}
+		if (d.mode == mLogL || d.mode == mLogLuv) && d.bytesPerPixel == bytesPerPixel {
+			return nil
+		}
+		return FormatError("SGILog RLE compression does not match the PhotometricInterpretation")
+	case cSGILog24Packed:
+		if d.mode != mLogLuv {
+			return FormatError("SGILog24 compression does not match the PhotometricInterpretation")
+		}
+		if len(d.features[tExtraSamples].val) > 0 {
+			return UnsupportedError("ExtraSamples with the SGILog24 compression")
+		}
+	}
+	return nil
+}
+
+// checkMixedBitsPerSample checks the samples of different depths, which are only supported for
+// the contiguous integer RGB samples of up to 16 bits, read bit by bit like the packed samples.
+func (d *decoder) checkMixedBitsPerSample() error {
+	if d.bitsPerSample == nil {
+		return nil
+	}
+	if uint(len(d.bitsPerSample)) != d.spp {
+		return FormatError("BitsPerSample does not match SamplesPerPixel")
+	}
+	for _, v := range d.bitsPerSample {
+		if v == 0 || v > 16 {
+			return UnsupportedError(fmt.Sprintf("%d-bit sample among samples of different depths", v))
+		}
+	}
+	switch {
+	case d.mode != mRGB:
+		return UnsupportedError("samples of different depths for a PhotometricInterpretation other than RGB")
+	case d.sampleFormat == sfIEEEFP || d.sampleFormat == sfSignedInteger:
+		return UnsupportedError("floating point or signed samples of different depths")
+	case d.firstVal(tPlanarConfiguration) == pcSeparate:
+		return UnsupportedError("separate planes of different depths")
+	}
+	return nil
+}
+
+// sampleDepth returns the BitsPerSample of the c-th sample of the pixels.
+func (d *decoder) sampleDepth(c int) uint {
+	if d.bitsPerSample != nil {
+		return d.bitsPerSample[c]
+	}
+	return d.bpp
+}
+
+// clamp returns the channels a, b and c, clamped to zero when the ClampNegative option is set.
+func (d *decoder) clamp(a, b, c float64) (float64, float64, float64) {
+	if !d.opts.ClampNegative {
+		return a, b, c
+	}
+	return math.Max(a, 0), math.Max(b, 0), math.Max(c, 0)
+}
+
+// unsignedSamples reports whether the samples of the image can be declared as unsigned integers,
+// the default SampleFormat: the packed, 16 and 32-bit RGB, the Lab, the transparency mask and the bilevel samples.
+func (d *decoder) unsignedSamples() bool {
+	switch d.mode {
+	case mRGB:
+		return d.bpp == 16 || d.packed()
+	case mLab, mTransMask, mBilevel:
+		return true
+	}
+	return false
+}
+
+// readBits reads n bits (up to 32) from the internal buffer starting at the current offset.
+// The bits of each byte are read according to the FillOrder.
 func (d *decoder) readBits(n uint) uint32 {
-	for d.nbits < n {
-		d.v <<= 8
-		d.v |= uint32(d.buf[d.off])
+	if d.nbits < n {
+		d.fillBits()
+		if d.nbits < n {
+			panic(InternalError("readBits: not enough data"))
+		}
+	}
+	d.nbits -= n
+	return uint32(d.v>>d.nbits) & (1<<n - 1)
+}
+
+// fillBits loads as many whole bytes as fit in the 64-bit buffer used by readBits,
+// eight bytes at once when available.
+func (d *decoder) fillBits() {
+	if d.off+8 <= len(d.buf) {
+		x := binary.BigEndian.Uint64(d.buf[d.off:])
+		if d.lsbFirst {
+			x = bits.ReverseBytes64(bits.Reverse64(x)) // Reverse the bits of each byte
+		}
+		k := (64 - d.nbits) / 8 // Number of whole bytes that fit
+		d.v = d.v<<(8*k) | x>>(64-8*k)
+		d.off += int(k)
+		d.nbits += 8 * k
+		return
+	}
+
+	for d.nbits <= 56 && d.off < len(d.buf) {
+		b := d.buf[d.off]
+		if d.lsbFirst {
+			b = bits.Reverse8(b)
+		}
+		d.v = d.v<<8 | uint64(b)
 		d.off++
 		d.nbits += 8
 	}
-	d.nbits -= n
-	rv := d.v >> d.nbits
-	d.v &^= rv << d.nbits
-	return rv
 }
 
 // flushBits discards the unread bits in the buffer used by readBits.
-// It is used at the end of a line.
+// It is used at the end of a line: the bits of the partially read byte are dropped
+// and the offset rewinds to the first byte not read yet.
 func (d *decoder) flushBits() {
+	d.off -= int(d.nbits / 8)
 	d.v = 0
 	d.nbits = 0
 }
 
 // decompress decompress a Strip.
 func (d *decoder) decompress(offset, n int64, blockWidth, blockHeight int) (err error) {
-	switch d.firstVal(tCompression) {
+	switch d.compression {
 	// According to the spec, Compression does not have a default value,
 	// but some tools interpret a missing Compression value as none so we do
 	// the same.
-	case cNone, 0:
+	case cNone, 0, cSGILog24Packed: // SGILog24 is the raw 24-bit pixels
 		if b, ok := d.r.(*buffer); ok {
 			d.buf, err = b.Slice(int(offset), int(n))
 		} else {
@@ -123,7 +360,12 @@ func (d *decoder) decompress(offset, n int64, blockWidth, blockHeight int) (err
 			_, err = d.r.ReadAt(d.buf, offset)
 		}
 	case cLZW:
-		r := lzw.NewReader(io.NewSectionReader(d.r, offset, n), lzw.MSB, 8)
+		// The LSB-first variant, written by the encoders predating TIFF 6.0, is flagged by the FillOrder.
+		order := lzw.MSB
+		if d.lsbFirst {
+			order = lzw.LSB
+		}
+		r := lzw.NewReader(io.NewSectionReader(d.r, offset, n), order, 8)
 		d.buf, err = ioutil.ReadAll(r)
 		r.Close()
 	case cDeflate, cDeflateOld:
@@ -137,9 +379,91 @@ func (d *decoder) decompress(offset, n int64, blockWidth, blockHeight int) (err
 	case cPackBits:
 		d.buf, err = unpackBits(io.NewSectionReader(d.r, offset, n))
 	case cSGILogRLE:
-		d.buf, err = unRLE(io.NewSectionReader(d.r, offset, n), d.mode, blockWidth, blockHeight)
+		d.buf, err = unRLE(io.NewSectionReader(d.r, offset, n), d.bytesPerPixel, blockWidth, blockHeight)
+	default:
+		err = fmt.Errorf("%w value %d", ErrUnsupportedCompression, d.compression)
+	}
+	if err != nil {
+		return
+	}
+
+	if d.packed() {
+		// The samples stored in 16-bit words are flagged by a BitsPerSample of 16 and a WhiteLevel instead.
+		d.unpack(blockWidth)
+	}
+
+	return d.unpredict(blockWidth)
+}
+
+// rowSize returns the number of bytes of a raw row of width pixels.
+// Rows of bit-packed samples begin on byte boundaries.
+func (d *decoder) rowSize(width int) int {
+	if d.bitsPerSample != nil {
+		var bitsPerPixel int
+		for _, v := range d.bitsPerSample {
+			bitsPerPixel += int(v)
+		}
+		return (width*bitsPerPixel + 7) / 8
+	}
+	if d.bpp%8 != 0 {
+		return (width*int(d.spp*d.bpp) + 7) / 8
+	}
+	return width * d.bytesPerPixel
+}
+
+// packed reports whether the samples are bit-packed according to their BitsPerSample,
+// these samples are expanded to 16 bits by decompress. The samples of different depths are always bit-packed.
+func (d *decoder) packed() bool {
+	return d.bpp == 10 || d.bpp == 12 || d.bpp == 14 || d.bitsPerSample != nil
+}
+
+// unpack expands the packed samples of d.buf to 16-bit samples in d.byteOrder.
+func (d *decoder) unpack(blockWidth int) {
+	rowSize := d.rowSize(blockWidth)
+	n := blockWidth * int(d.spp) // Number of samples per row
+	rows := len(d.buf) / rowSize
+
+	buf := make([]byte, rows*n*2)
+	for y := 0; y < rows; y++ {
+		d.off = y * rowSize
+		for i := 0; i < n; i++ {
+			d.byteOrder.PutUint16(buf[2*(y*n+i):], uint16(d.readBits(d.sampleDepth(i%int(d.spp)))))
+		}
+		d.flushBits()
+	}
+	d.buf = buf
+}
+
+// unpredict reverses the predictor applied on the decompressed strip or tile.
+// SGILog modes do not use predictors and are left to their decode function.
+func (d *decoder) unpredict(blockWidth int) error {
+	if d.mode != mRGB && d.mode != mColorFilterArray && d.mode != mLab {
+		return nil
+	}
+
+	if d.predictor == prNone || d.predictor == 0 {
+		return nil
+	}
+
+	if _, ok := d.r.(*buffer); ok && d.compression <= cNone {
+		// d.buf is a slice of the underlying buffer which must not be altered.
+		d.buf = append([]byte(nil), d.buf...)
+	}
+
+	if d.packed() {
+		// The differences are computed on the packed samples, not on their 16-bit expansion, like libtiff
+		// the predictors are not supported for these depths.
+		return UnsupportedError(fmt.Sprintf("predictor with %d-bit packed samples", d.bpp))
+	}
+
+	rowSize := blockWidth * d.bytesPerPixel
+	bytesPerSample := int(d.bpp / 8)
+	switch d.predictor {
+	case prHorizontal:
+		return decodeHorizontalPredictor(d.buf, d.byteOrder, rowSize, int(d.spp), bytesPerSample)
+	case prFloatingPoint:
+		return decodeFloatingPointPredictor(d.buf, d.byteOrder, rowSize, int(d.spp), bytesPerSample)
 	default:
-		err = UnsupportedError(fmt.Sprintf("compression value %d", d.firstVal(tCompression)))
+		return UnsupportedError(fmt.Sprintf("predictor value %d", d.predictor))
 	}
-	return
 }
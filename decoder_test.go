@@ -0,0 +1,1698 @@
+package tiff
+
+import (
+	"bytes"
+	"compress/lzw"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/bits"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/format"
+	"github.com/stretchr/testify/assert"
+)
+
+// f32 returns the values rounded to the float32 precision of the hdr images.
+func f32(v ...float64) []float64 {
+	for i := range v {
+		v[i] = float64(float32(v[i]))
+	}
+	return v
+}
+
+// logluvPixel returns a distinct LogLuv 32-bit pixel for the given coordinates.
+func logluvPixel(x, y int) []byte {
+	return []byte{0x40 + byte(y), 0x10 * byte(x+1), 0x50 + byte(x), 0x60 + byte(y)}
+}
+
+func TestDecodeLogLuvClippedTiles(t *testing.T) {
+	const width, height, tileSize = 3, 3, 2
+
+	var tiles [][]byte
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tile := make([]byte, 0, tileSize*tileSize*4)
+			for y := ty; y < ty+tileSize; y++ {
+				for x := tx; x < tx+tileSize; x++ {
+					if x < width && y < height {
+						tile = append(tile, logluvPixel(x, y)...)
+					} else {
+						tile = append(tile, 0, 0, 0, 0) // Padding
+					}
+				}
+			}
+			tiles = append(tiles, rle(tile, 4, tileSize, tileSize))
+		}
+	}
+
+	// The RLE bytestreams do not depend on the byte order of the file.
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, cSGILogRLE).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tTileWidth, dtShort, tileSize).
+			add(tTileLength, dtShort, tileSize).
+			tiles(tiles...).
+			bytes()
+
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				p := logluvPixel(x, y)
+				X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+				x2, y2, z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+				assert.Equal(t, f32(X, Y, Z), []float64{x2, y2, z2}, "%v pixel (%d,%d)", byteOrder, x, y)
+			}
+		}
+	}
+}
+
+func TestDecodeLogLuvUncompressed(t *testing.T) {
+	const width, height = 3, 2
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		strip := make([]byte, 0, width*height*4)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				p := logluvPixel(x, y)
+				strip = append(strip, make([]byte, 4)...)
+				byteOrder.PutUint32(strip[len(strip)-4:], binary.BigEndian.Uint32(p))
+			}
+		}
+
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, cNone).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			strips(strip).
+			bytes()
+
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				p := logluvPixel(x, y)
+				X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+				x2, y2, z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+				assert.Equal(t, f32(X, Y, Z), []float64{x2, y2, z2}, "%v pixel (%d,%d)", byteOrder, x, y)
+			}
+		}
+	}
+}
+
+func TestDecodeLogLuvStrips(t *testing.T) {
+	const width, height = 3, 7
+
+	for _, rowsPerStrip := range []int{1, 2, 3, height} {
+		var strips [][]byte
+		for sy := 0; sy < height; sy += rowsPerStrip {
+			rows := minInt(rowsPerStrip, height-sy) // The last strip is truncated.
+			strip := make([]byte, 0, width*rows*4)
+			for y := sy; y < sy+rows; y++ {
+				for x := 0; x < width; x++ {
+					strip = append(strip, logluvPixel(x, y)...)
+				}
+			}
+			strips = append(strips, rle(strip, 4, width, rows))
+		}
+
+		data := newTIFFBuilder(binary.BigEndian).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, cSGILogRLE).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tRowsPerStrip, dtShort, uint64(rowsPerStrip)).
+			strips(strips...).
+			bytes()
+
+		// Each strip is mapped to its rows, in the full and in the subsampled images.
+		for _, subsample := range []int{1, 2} {
+			m, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Subsample: subsample})
+			if !assert.NoError(t, err, "%d rows per strip", rowsPerStrip) {
+				continue
+			}
+			b := m.Bounds()
+			assert.Equal(t, image.Rect(0, 0, (width+subsample-1)/subsample, (height+subsample-1)/subsample), b)
+
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					p := logluvPixel(x*subsample, y*subsample)
+					X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+					x2, y2, z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+					assert.Equal(t, f32(X, Y, Z), []float64{x2, y2, z2}, "%d rows per strip, subsample %d, pixel (%d,%d)", rowsPerStrip, subsample, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestNewDecoderAt(t *testing.T) {
+	strip := make([]byte, 0, 2*4)
+	strip = append(strip, logluvPixel(0, 0)...)
+	strip = append(strip, logluvPixel(1, 0)...)
+
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips(strip).
+		bytes()
+
+	d, err := NewDecoderAt(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, d.Config().Width)
+	assert.Equal(t, 1, d.Config().Height)
+
+	m, err := d.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 2, 1), m.Bounds())
+
+	_, err = NewDecoderAt(bytes.NewReader(data), 4)
+	assert.Error(t, err)
+}
+
+func TestDecodeMissingStripByteCounts(t *testing.T) {
+	const width, height, rowsPerStrip = 2, 3, 2
+
+	var strips [][]byte
+	for y := 0; y < height; y += rowsPerStrip {
+		var strip []byte
+		for j := y; j < minInt(y+rowsPerStrip, height); j++ {
+			for x := 0; x < width; x++ {
+				strip = append(strip, logluvPixel(x, j)...)
+			}
+		}
+		strips = append(strips, strip)
+	}
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tRowsPerStrip, dtShort, rowsPerStrip).
+		strips(strips...).
+		omit(tStripByteCounts)
+
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := logluvPixel(x, y)
+			X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+			x2, y2, z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.Equal(t, f32(X, Y, Z), []float64{x2, y2, z2})
+		}
+	}
+
+	// Byte counts are mandatory for compressed data.
+	b.add(tCompression, dtShort, cDeflate)
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.Error(t, err)
+}
+
+func TestDecodeSingleStripSentinel(t *testing.T) {
+	const width, height = 2, 3
+
+	var strip []byte
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			strip = append(strip, logluvPixel(x, y)...)
+		}
+	}
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tRowsPerStrip, dtLong, math.MaxUint32).
+		strips(strip)
+
+	expected, err := Decode(bytes.NewReader(b.add(tRowsPerStrip, dtLong, height).bytes()))
+	assert.NoError(t, err)
+	b.add(tRowsPerStrip, dtLong, math.MaxUint32)
+
+	d, err := newDecoder(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	l, err := d.layout()
+	assert.NoError(t, err)
+	assert.Equal(t, height, l.height)
+	assert.Equal(t, image.Rect(0, 0, width, height), l.bounds(0))
+
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+
+	// Derived byte count of the single strip
+	m, err = Decode(bytes.NewReader(b.omit(tStripByteCounts).bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+}
+
+func TestDecodeRGBUnspecifiedExtraSample(t *testing.T) {
+	const width, height = 3, 2
+
+	strip := make([]byte, width*height*16)
+	for i := 0; i < width*height*4; i++ {
+		v := float32(i)
+		if i%4 == 3 {
+			v = -1 // Unspecified extra sample
+		}
+		binary.LittleEndian.PutUint32(strip[4*i:], math.Float32bits(v))
+	}
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 4).
+		add(tExtraSamples, dtShort, esUnspecified).
+		add(tSampleFormat, dtShort, 3, 3, 3, 3).
+		strips(strip).
+		bytes()
+
+	m, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := float64((y*width + x) * 4)
+			r, g, b, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+			assert.Equal(t, []float64{i, i + 1, i + 2}, []float64{r, g, b})
+		}
+	}
+
+	// Without ExtraSamples, SamplesPerPixel contradicts the photometric interpretation.
+	data = newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 4).
+		strips(strip).
+		bytes()
+	_, err = Decode(bytes.NewReader(data))
+	assert.Error(t, err)
+}
+
+func TestDecodeOutputMode(t *testing.T) {
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 32, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 4).
+		add(tSampleFormat, dtShort, 3, 3, 3, 3).
+		strips(make([]byte, 16))
+
+	for es, mode := range map[uint]imageMode{
+		esUnspecified:       mRGB,
+		esAssociatedAlpha:   mRGBA,
+		esUnassociatedAlpha: mNRGBA,
+	} {
+		d, err := newDecoder(bytes.NewReader(b.add(tExtraSamples, dtShort, uint64(es)).bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, mode, d.outputMode(), "%d", es)
+
+		// The alpha is not decoded yet.
+		m, err := Decode(bytes.NewReader(b.bytes()))
+		assert.NoError(t, err)
+		assert.IsType(t, &hdr.RGB{}, m)
+	}
+
+	d, err := newDecoder(bytes.NewReader(cfaImage(4, 4).bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, mColorFilterArray, d.outputMode())
+	d.opts.CFAOutput = CFAOutputCameraRGB
+	assert.Equal(t, mRGB, d.outputMode())
+}
+
+func TestDecodeN(t *testing.T) {
+	strip := append(logluvPixel(0, 0), logluvPixel(1, 0)...)
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips(strip).
+		bytes()
+
+	expected, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	r := bytes.NewReader(append(append([]byte{}, data...), "trailer"...))
+	m, n, err := DecodeN(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, len("trailer"), r.Len())
+
+	_, n, err = DecodeN(bytes.NewReader(data[:4]))
+	assert.Error(t, err)
+	assert.Equal(t, int64(4), n)
+}
+
+func TestDecodeLZWFillOrder(t *testing.T) {
+	// Large enough for the codes to widen up to 12 bits and to be reset by a Clear code.
+	const width, height = 64, 32
+
+	strip := make([]byte, width*height*12)
+	for i := 0; i < width*height*3; i++ {
+		binary.LittleEndian.PutUint32(strip[4*i:], math.Float32bits(float32(uint32(i)*2654435761%1000)/8))
+	}
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, 3, 3, 3).
+		strips(strip)
+
+	expected, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	for fillOrder, order := range map[uint]lzw.Order{foMSBFirst: lzw.MSB, foLSBFirst: lzw.LSB} {
+		compressed := lzwCompress(strip, order)
+		assert.Greater(t, len(compressed), 4096*12/8, "fill order %d", fillOrder) // More than 4096 codes
+
+		b.add(tCompression, dtShort, cLZW).
+			add(tFillOrder, dtShort, uint64(fillOrder)).
+			strips(compressed)
+		m, err := Decode(bytes.NewReader(b.bytes()))
+		assert.NoError(t, err, "fill order %d", fillOrder)
+		assert.Equal(t, expected, m, "fill order %d", fillOrder)
+	}
+}
+
+func TestDecodeTrailingData(t *testing.T) {
+	const width, height = 2, 3
+
+	var strip []byte
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			strip = append(strip, logluvPixel(x, y)...)
+		}
+	}
+	var deflated bytes.Buffer
+	w := zlib.NewWriter(&deflated)
+	_, err := w.Write(strip)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	for compression, block := range map[uint][]byte{cNone: strip, cDeflate: deflated.Bytes()} {
+		data := newTIFFBuilder(binary.BigEndian).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, uint64(compression)).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			strips(block).
+			bytes()
+		expected, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		// A proprietary footer follows the TIFF.
+		footer := bytes.Repeat([]byte{0xff, 0x00, 0xde, 0xad}, 64)
+		full := append(append([]byte{}, data...), footer...)
+
+		m, err := Decode(bytes.NewReader(full))
+		assert.NoError(t, err, "compression %d", compression)
+		assert.Equal(t, expected, m, "compression %d", compression)
+
+		// Buffered io.Reader
+		m, err = Decode(io.MultiReader(bytes.NewReader(full)))
+		assert.NoError(t, err, "compression %d", compression)
+		assert.Equal(t, expected, m, "compression %d", compression)
+
+		d, err := NewDecoderAt(bytes.NewReader(full), int64(len(full)))
+		assert.NoError(t, err)
+		m, err = d.Decode()
+		assert.NoError(t, err, "compression %d", compression)
+		assert.Equal(t, expected, m, "compression %d", compression)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 3).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips(make([]byte, 2*3*4))
+
+	// 12 bytes per decoded pixel and 4 per decompressed one
+	for _, opts := range []*DecodeOptions{nil, {MaxPixels: 6, MaxBytes: 6*12 + 6*4}, {MaxPixels: -1, MaxBytes: -1}} {
+		_, err := DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+		assert.NoError(t, err)
+	}
+	for _, opts := range []*DecodeOptions{{MaxPixels: 5}, {MaxBytes: 6*12 + 6*4 - 1}} {
+		_, err := DecodeWithOptions(bytes.NewReader(b.bytes()), opts)
+		assert.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+		var unsupported UnsupportedError
+		assert.True(t, errors.As(err, &unsupported), "%v", err)
+	}
+
+	// Huge declared dimensions are rejected before any allocation.
+	b.add(tImageWidth, dtLong, 1<<20).add(tImageLength, dtLong, 1<<20)
+	_, err := Decode(bytes.NewReader(b.bytes()))
+	assert.EqualError(t, err, "tiff: unsupported feature: image exceeding the decoding limits: 1099511627776 pixels")
+	_, err = DecodeAlpha(bytes.NewReader(b.add(tSamplesPerPixel, dtShort, 4).add(tExtraSamples, dtShort, esUnassociatedAlpha).bytes()))
+	assert.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+	_, err = DecodeCFA(bytes.NewReader(cfaImage(2, 2).add(tImageWidth, dtLong, 1<<20).add(tImageLength, dtLong, 1<<20).bytes()))
+	assert.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+
+	// The number of pixels of the largest dimensions does not wrap.
+	b.add(tImageWidth, dtLong, 0xFFFFFFFF).add(tImageLength, dtLong, 0xFFFFFFFF)
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+
+	// A small CFA declaring a huge tile, decompressed before the demosaicing of the in-bounds window.
+	data := cfaImage(2, 2).
+		add(tTileWidth, dtLong, 1<<16).
+		add(tTileLength, dtLong, 1<<16).
+		tiles([]byte{16, 32, 48, 64}).
+		bytes()
+	_, err = Decode(bytes.NewReader(data))
+	assert.EqualError(t, err, "tiff: unsupported feature: image exceeding the decoding limits: 4294967380 bytes")
+}
+
+func TestDecodeBestEffort(t *testing.T) {
+	const width, height = 2, 3
+
+	var strips [][]byte
+	for y := 0; y < height; y++ {
+		var strip []byte
+		for x := 0; x < width; x++ {
+			strip = append(strip, logluvPixel(x, y)...)
+		}
+		strips = append(strips, strip)
+	}
+	strips[1] = strips[1][:3] // Truncated strip
+
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tRowsPerStrip, dtShort, 1).
+		strips(strips...).
+		bytes()
+
+	m, err := Decode(bytes.NewReader(data))
+	assert.Error(t, err)
+	assert.Nil(t, m)
+
+	m, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{BestEffort: true})
+	assert.IsType(t, BlockErrors{}, err)
+	errs := err.(BlockErrors)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 1, errs[0].Index)
+	assert.Equal(t, image.Rect(0, 1, width, 2), errs[0].Bounds)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			X, Y, Z, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			if y == 1 {
+				assert.Equal(t, []float64{0, 0, 0}, []float64{X, Y, Z})
+				continue
+			}
+			p := logluvPixel(x, y)
+			X2, Y2, Z2 := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+			assert.Equal(t, f32(X2, Y2, Z2), []float64{X, Y, Z})
+		}
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	const width, height, tileSize = 3, 3, 2
+
+	var tiles [][]byte
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tile := make([]byte, 0, tileSize*tileSize*4)
+			for y := ty; y < ty+tileSize; y++ {
+				for x := tx; x < tx+tileSize; x++ {
+					tile = append(tile, logluvPixel(x, y)...)
+				}
+			}
+			tiles = append(tiles, tile)
+		}
+	}
+
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tTileWidth, dtShort, tileSize).
+		add(tTileLength, dtShort, tileSize).
+		tiles(tiles...).
+		bytes()
+
+	m, r, err := DecodeBlock(bytes.NewReader(data), 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(2, 2, 3, 3), r)
+	assert.Equal(t, r, m.Bounds())
+
+	p := logluvPixel(2, 2)
+	X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+	x2, y2, z2, _ := m.(hdr.Image).HDRAt(2, 2).HDRXYZA()
+	assert.Equal(t, f32(X, Y, Z), []float64{x2, y2, z2})
+
+	_, _, err = DecodeBlock(bytes.NewReader(data), 0, 4)
+	assert.Error(t, err)
+	_, _, err = DecodeBlock(bytes.NewReader(data), 1, 0)
+	assert.Error(t, err)
+}
+
+func TestDecodeRGB16SampleValueRange(t *testing.T) {
+	const width, height = 2, 1
+
+	samples := []uint16{0, 1000, 2000, 65535, 500, 1500}
+	strip := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.BigEndian.PutUint16(strip[2*i:], s)
+	}
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16, 16, 16).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, sfUnsignedInteger, sfUnsignedInteger, sfUnsignedInteger).
+		strips(strip)
+
+	// Full range
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	r, g, bl, _ := m.(hdr.Image).HDRAt(1, 0).HDRRGBA()
+	assert.InDeltaSlice(t, []float64{1, 500.0 / 65535, 1500.0 / 65535}, []float64{r, g, bl}, 1e-9)
+
+	// Per-sample range
+	b.add(tMinSampleValue, dtShort, 0, 500, 1000).
+		add(tMaxSampleValue, dtShort, 65535, 1500, 2000)
+	m, err = Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	r, g, bl, _ = m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+	assert.InDeltaSlice(t, []float64{0, 0.5, 1}, []float64{r, g, bl}, 1e-9)
+
+	// Single value applying to all the samples
+	b.add(tMinSampleValue, dtShort, 0).
+		add(tMaxSampleValue, dtShort, 2000)
+	m, err = Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	r, g, bl, _ = m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+	assert.InDeltaSlice(t, []float64{0, 0.5, 1}, []float64{r, g, bl}, 1e-9)
+
+	b.add(tMaxSampleValue, dtShort, 0)
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.Error(t, err)
+
+	// Integer samples are only handled for 16 and 32-bit RGB.
+	b.add(tBitsPerSample, dtShort, 8, 8, 8)
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.IsType(t, UnsupportedError(""), err)
+}
+
+func TestDecodeRGB32Integer(t *testing.T) {
+	for _, sampleFormat := range []uint64{sfUnsignedInteger, sfSignedInteger} {
+		samples := []uint32{0, 1 << 31, math.MaxUint32}
+		expected := []float64{0, float64(1<<31) / math.MaxUint32, 1}
+		if sampleFormat == sfSignedInteger {
+			samples = []uint32{1 << 31, 0, math.MaxInt32} // MinInt32, 0, MaxInt32
+			expected = []float64{0, float64(1<<31) / math.MaxUint32, 1}
+		}
+		strip := make([]byte, 4*len(samples))
+		for i, s := range samples {
+			binary.LittleEndian.PutUint32(strip[4*i:], s)
+		}
+
+		b := newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, 1).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 32, 32, 32).
+			add(tPhotometricInterpretation, dtShort, pRGB).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tSampleFormat, dtShort, sampleFormat, sampleFormat, sampleFormat).
+			strips(strip)
+
+		m, err := Decode(bytes.NewReader(b.bytes()))
+		assert.NoError(t, err)
+		r, g, bl, _ := m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+		assert.InDeltaSlice(t, expected, []float64{r, g, bl}, 1e-7, "sample format %d", sampleFormat)
+
+		// Configured range
+		m, err = DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{IntegerSampleRange: [2]float64{0, 1 << 30}})
+		assert.NoError(t, err)
+		_, g, _, _ = m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+		if sampleFormat == sfSignedInteger {
+			assert.Equal(t, 0.0, g)
+		} else {
+			assert.Equal(t, 2.0, g)
+		}
+
+		b.add(tSampleFormat, dtShort, sampleFormat, sfIEEEFP, sampleFormat)
+		_, err = Decode(bytes.NewReader(b.bytes()))
+		assert.Error(t, err)
+	}
+}
+
+func TestDecodeRGB16Signed(t *testing.T) {
+	samples := []int16{math.MinInt16, 0, math.MaxInt16, -1000} // RGBA
+	strip := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.BigEndian.PutUint16(strip[2*i:], uint16(s))
+	}
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 16, 16, 16, 16).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 4).
+		add(tExtraSamples, dtShort, esUnassociatedAlpha).
+		add(tSampleFormat, dtShort, sfSignedInteger, sfSignedInteger, sfSignedInteger, sfSignedInteger).
+		strips(strip)
+
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	r, g, bl, _ := m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+	assert.InDeltaSlice(t, []float64{0, 32768.0 / 65535, 1}, []float64{r, g, bl}, 1e-7)
+
+	a, err := DecodeAlpha(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, color.Alpha16{A: 32768 - 1000}, a.Alpha16At(0, 0))
+
+	// The signed packed samples are not sign-extended.
+	_, err = Decode(bytes.NewReader(b.add(tBitsPerSample, dtShort, 12, 12, 12, 12).bytes()))
+	assert.Equal(t, UnsupportedError("signed packed samples"), err)
+}
+
+func TestDecodeLogLExtraSample(t *testing.T) {
+	const width, height = 3, 2
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		strip := make([]byte, width*height*4)
+		for i := 0; i < width*height; i++ {
+			byteOrder.PutUint16(strip[4*i:], uint16(0x3f00+i*16)) // Luminance
+			byteOrder.PutUint16(strip[4*i+2:], 0xffff)            // Alpha
+		}
+
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16, 16).
+			add(tCompression, dtShort, cNone).
+			add(tPhotometricInterpretation, dtShort, pLogL).
+			add(tSamplesPerPixel, dtShort, 2).
+			add(tExtraSamples, dtShort, esUnassociatedAlpha).
+			strips(strip).
+			bytes()
+
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				Y := format.SLeToY(uint16(0x3f00 + (y*width+x)*16))
+				X2, Y2, Z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+				assert.Equal(t, f32(Y, Y, Y), []float64{X2, Y2, Z2}, "%v pixel (%d,%d)", byteOrder, x, y)
+			}
+		}
+	}
+}
+
+func TestDecodeSGILogPhotometric(t *testing.T) {
+	newBuilder := func(photometric uint, compression uint) *tiffBuilder {
+		return newTIFFBuilder(binary.BigEndian).
+			add(tImageWidth, dtShort, 1).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, uint64(compression)).
+			add(tPhotometricInterpretation, dtShort, uint64(photometric)).
+			add(tSamplesPerPixel, dtShort, 1).
+			strips(rle([]byte{0x3e, 0x00}, 2, 1, 1))
+	}
+
+	_, err := Decode(bytes.NewReader(newBuilder(pLogL, cSGILogRLE).bytes()))
+	assert.NoError(t, err)
+
+	// The ExtraSamples add 2 bytes per pixel.
+	b := newBuilder(pLogL, cSGILogRLE).
+		add(tBitsPerSample, dtShort, 16, 16).
+		add(tSamplesPerPixel, dtShort, 2).
+		add(tExtraSamples, dtShort, esUnassociatedAlpha).
+		strips(rle([]byte{0x3e, 0x00, 0xff, 0xff}, 4, 1, 1))
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	// A 32-bit LogL with an ExtraSample is not encoded in 4 bytes per pixel.
+	_, err = Decode(bytes.NewReader(b.add(tBitsPerSample, dtShort, 32, 32).bytes()))
+	assert.EqualError(t, err, "tiff: invalid format: SGILog RLE compression does not match the PhotometricInterpretation")
+
+	b = newBuilder(pRGB, cSGILogRLE).
+		add(tBitsPerSample, dtShort, 16, 16, 16).
+		add(tSamplesPerPixel, dtShort, 3)
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.EqualError(t, err, "tiff: invalid format: SGILog RLE compression does not match the PhotometricInterpretation")
+
+	_, err = Decode(bytes.NewReader(newBuilder(pLogL, cSGILog24Packed).bytes()))
+	assert.EqualError(t, err, "tiff: invalid format: SGILog24 compression does not match the PhotometricInterpretation")
+}
+
+func TestDecodeLogLuv24(t *testing.T) {
+	pixels := []struct {
+		p    uint32
+		Y    float64
+		u, v float64
+	}{
+		{768<<14 | 11926, math.Exp2(768.5/64 - 12), 0.1978, 0.4683},
+		{832<<14 | 14583, math.Exp2(832.5/64 - 12), 0.45, 0.52},
+		{704<<14 | 1420, math.Exp2(704.5/64 - 12), 0.17, 0.16},
+		{768<<14 | 0x3fff, math.Exp2(768.5/64 - 12), 0.210526316, 0.473684211}, // Out of the grid, neutral
+		{0<<14 | 11926, 0, 0, 0},                                               // Black
+	}
+	var strip []byte
+	for _, px := range pixels {
+		strip = append(strip, byte(px.p>>16), byte(px.p>>8), byte(px.p))
+	}
+
+	// The 24-bit words do not depend on the byte order of the file.
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		b := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, uint64(len(pixels))).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, cSGILog24Packed).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			strips(strip)
+
+		m, err := Decode(bytes.NewReader(b.bytes()))
+		assert.NoError(t, err)
+		for x, px := range pixels {
+			X, Y, Z, _ := m.(hdr.Image).HDRAt(x, 0).HDRXYZA()
+			assert.InDelta(t, px.Y, Y, 1e-6, "pixel %d", x)
+			if px.Y == 0 {
+				continue
+			}
+			// Within the grid cell of 0.0035
+			assert.InDelta(t, px.u, 4*X/(X+15*Y+3*Z), 0.0035, "pixel %d", x)
+			assert.InDelta(t, px.v, 9*Y/(X+15*Y+3*Z), 0.0035, "pixel %d", x)
+		}
+
+		b.add(tSamplesPerPixel, dtShort, 4).add(tExtraSamples, dtShort, esUnassociatedAlpha)
+		_, err = Decode(bytes.NewReader(b.bytes()))
+		assert.EqualError(t, err, "tiff: unsupported feature: ExtraSamples with the SGILog24 compression")
+	}
+}
+
+func TestDecodeSingleSampleLogLuv(t *testing.T) {
+	const width, height = 3, 2
+	strip := make([]byte, 0, width*height*2)
+	for i := 0; i < width*height; i++ {
+		strip = append(strip, 0x3f, byte(i*16))
+	}
+	newBuilder := func(photometric uint) *tiffBuilder {
+		return newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, cSGILogRLE).
+			add(tPhotometricInterpretation, dtShort, uint64(photometric)).
+			add(tSamplesPerPixel, dtShort, 1).
+			strips(rle(strip, 2, width, height))
+	}
+
+	expected, err := Decode(bytes.NewReader(newBuilder(pLogL).bytes()))
+	assert.NoError(t, err)
+
+	var warnings []string
+	m, err := DecodeWithOptions(bytes.NewReader(newBuilder(pLogLuv).bytes()), &DecodeOptions{
+		Warn: func(msg string) { warnings = append(warnings, msg) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+	assert.Equal(t, []string{"LogLuv image with a single 16-bit sample decoded as LogL"}, warnings)
+
+	_, err = DecodeWithOptions(bytes.NewReader(newBuilder(pLogLuv).bytes()), &DecodeOptions{Strict: true})
+	assert.EqualError(t, err, "tiff: invalid format: LogLuv image with a single 16-bit sample decoded as LogL")
+
+	// The well-formed files are not reported.
+	warnings = nil
+	_, err = DecodeWithOptions(bytes.NewReader(newBuilder(pLogL).bytes()), &DecodeOptions{
+		Warn: func(msg string) { warnings = append(warnings, msg) },
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestDecodeLogLuvSignBit(t *testing.T) {
+	const width, height = 3, 2
+	pixels := [][]byte{
+		{0x3f, 0x00, 0x50, 0x60}, // Below 1 cd/m²
+		{0x40, 0x80, 0x51, 0x61}, // Above 1 cd/m²
+		{0xbf, 0x00, 0x52, 0x62}, // Negative luminance
+		{0xc0, 0x80, 0x53, 0x63}, // Negative luminance
+		{0x00, 0x00, 0x54, 0x64}, // Zero Le
+		{0x80, 0x00, 0x55, 0x65}, // Zero Le
+	}
+	expected := [][]float64{2: {0, 0, 0}, 3: {0, 0, 0}, 4: {0, 0, 0}, 5: {0, 0, 0}} // Black
+
+	for i, p := range pixels[:2] {
+		X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+		assert.Less(t, 0.0, Y)
+		expected[i] = f32(X, Y, Z)
+	}
+	assert.Less(t, expected[0][1], 1.0)
+	assert.Less(t, 1.0, expected[1][1])
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var strip []byte
+		for _, p := range pixels {
+			strip = append(strip, p...)
+		}
+
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, cSGILogRLE).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			strips(rle(strip, 4, width, height)).
+			bytes()
+
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		for i := range pixels {
+			X, Y, Z, _ := m.(hdr.Image).HDRAt(i%width, i/width).HDRXYZA()
+			assert.Equal(t, expected[i], []float64{X, Y, Z}, "%v pixel %d", byteOrder, i)
+		}
+	}
+}
+
+func TestSLeToY(t *testing.T) {
+	assert.Equal(t, 0.0, sleToY(0x0000))
+	assert.Equal(t, 0.0, sleToY(0x8000))
+	assert.Equal(t, format.SLeToY(0x3f00), sleToY(0x3f00))
+	assert.Equal(t, -format.SLeToY(0x3f00), sleToY(0xbf00))
+	assert.Less(t, sleToY(0x3f00), 1.0)
+	assert.Less(t, 1.0, sleToY(0x4080))
+}
+
+func TestDecodeClampNegative(t *testing.T) {
+	rgb := []float32{-0.25, 0.5, -2}
+	strip := make([]byte, 4*len(rgb))
+	for i, v := range rgb {
+		binary.LittleEndian.PutUint32(strip[4*i:], math.Float32bits(v))
+	}
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, sfIEEEFP, sfIEEEFP, sfIEEEFP).
+		strips(strip).
+		bytes()
+
+	// Preserved by default
+	m, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	r, g, b, _ := m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+	assert.Equal(t, []float64{-0.25, 0.5, -2}, []float64{r, g, b})
+
+	m, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{ClampNegative: true})
+	assert.NoError(t, err)
+	r, g, b, _ = m.(hdr.Image).HDRAt(0, 0).HDRRGBA()
+	assert.Equal(t, []float64{0, 0.5, 0}, []float64{r, g, b})
+}
+
+func TestReadBits(t *testing.T) {
+	buf := make([]byte, 37)
+	for i := range buf {
+		buf[i] = byte(i*73 + 11)
+	}
+	widths := []uint{12, 14, 1, 7, 32, 3, 16, 12, 24, 8, 5, 31}
+
+	for _, lsbFirst := range []bool{false, true} {
+		// Reference reader, bit by bit
+		bit := func(i int) uint32 {
+			b := buf[i/8]
+			if lsbFirst {
+				return uint32(b>>(i%8)) & 1
+			}
+			return uint32(b>>(7-i%8)) & 1
+		}
+
+		d := &decoder{buf: buf, lsbFirst: lsbFirst}
+		pos := 0
+		for _, n := range widths {
+			var expected uint32
+			for i := 0; i < int(n); i++ {
+				expected = expected<<1 | bit(pos+i)
+			}
+			assert.Equal(t, expected, d.readBits(n), "lsbFirst=%v width %d at bit %d", lsbFirst, n, pos)
+			pos += int(n)
+		}
+
+		// The bits of the partially read byte are discarded.
+		d.flushBits()
+		pos = (pos + 7) / 8 * 8
+		assert.Equal(t, pos/8, d.off)
+		var expected uint32
+		for i := 0; i < 8; i++ {
+			expected = expected<<1 | bit(pos+i)
+		}
+		assert.Equal(t, expected, d.readBits(8))
+	}
+}
+
+func TestDecodeLogLTiles(t *testing.T) {
+	const width, height, tileSize = 20, 18, 16
+
+	sle := func(x, y int) uint16 { return uint16(0x3e00 + 8*x + 3*y) }
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var tiles [][]byte
+		for ty := 0; ty < height; ty += tileSize {
+			for tx := 0; tx < width; tx += tileSize {
+				tile := make([]byte, 0, tileSize*tileSize*2)
+				for y := ty; y < ty+tileSize; y++ {
+					for x := tx; x < tx+tileSize; x++ {
+						if x < width && y < height {
+							tile = append(tile, byte(sle(x, y)>>8), byte(sle(x, y)))
+						} else {
+							tile = append(tile, 0, 0) // Padding
+						}
+					}
+				}
+				// Each tile is encoded with tile-width scanlines, padding included.
+				tiles = append(tiles, rle(tile, 2, tileSize, tileSize))
+			}
+		}
+
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tCompression, dtShort, cSGILogRLE).
+			add(tPhotometricInterpretation, dtShort, pLogL).
+			add(tTileWidth, dtShort, tileSize).
+			add(tTileLength, dtShort, tileSize).
+			tiles(tiles...).
+			bytes()
+
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				_, Y, _, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+				assert.Equal(t, f32(format.SLeToY(sle(x, y)))[0], Y, "%v pixel (%d,%d)", byteOrder, x, y)
+			}
+		}
+
+		// Bottom right tile, clipped to the image
+		tile, r, err := DecodeBlock(bytes.NewReader(data), 0, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(16, 16, width, height), r)
+		_, Y, _, _ := tile.(hdr.Image).HDRAt(19, 17).HDRXYZA()
+		assert.Equal(t, f32(format.SLeToY(sle(19, 17)))[0], Y)
+	}
+}
+
+func TestDecodeSingleTileByteCount(t *testing.T) {
+	const width, height, tileSize = 5, 3, 2
+
+	var tiles [][]byte
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tile := make([]byte, 0, tileSize*tileSize*4)
+			for y := ty; y < ty+tileSize; y++ {
+				for x := tx; x < tx+tileSize; x++ {
+					tile = append(tile, logluvPixel(x, y)...)
+				}
+			}
+			tiles = append(tiles, tile)
+		}
+	}
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tTileWidth, dtShort, tileSize).
+		add(tTileLength, dtShort, tileSize).
+		tiles(tiles...)
+
+	expected, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+
+	b.add(tTileByteCounts, dtLong, tileSize*tileSize*4)
+	m, err := Decode(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+
+	// The counts of the compressed tiles are required.
+	_, err = Decode(bytes.NewReader(b.add(tCompression, dtShort, cPackBits).bytes()))
+	assert.Error(t, err)
+}
+
+func TestDecodeSubsample(t *testing.T) {
+	const width, height, s = 5, 5, 2
+
+	var strips [][]byte
+	for y := 0; y < height; y++ {
+		var strip []byte
+		for x := 0; x < width; x++ {
+			strip = append(strip, logluvPixel(x, y)...)
+		}
+		strips = append(strips, strip)
+	}
+	strips[1] = strips[1][:3] // Truncated strip without kept pixel
+
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tRowsPerStrip, dtShort, 1).
+		strips(strips...).
+		bytes()
+
+	m, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Subsample: s})
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 3, 3), m.Bounds())
+
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			p := logluvPixel(x*s, y*s)
+			X, Y, Z := format.LogLuvToXYZ(p[0], p[1], p[2], p[3])
+			x2, y2, z2, _ := m.(hdr.Image).HDRAt(x, y).HDRXYZA()
+			assert.Equal(t, f32(X, Y, Z), []float64{x2, y2, z2}, "pixel (%d,%d)", x, y)
+		}
+	}
+
+	// The truncated strip is decoded at full resolution.
+	_, err = Decode(bytes.NewReader(data))
+	assert.Error(t, err)
+}
+
+func TestDecodeSubsampleTiles(t *testing.T) {
+	const width, height, tileSize, s = 7, 6, 4, 3
+
+	var tiles [][]byte
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tile := make([]byte, 0, tileSize*tileSize*4)
+			for y := ty; y < ty+tileSize; y++ {
+				for x := tx; x < tx+tileSize; x++ {
+					tile = append(tile, logluvPixel(x, y)...)
+				}
+			}
+			tiles = append(tiles, tile)
+		}
+	}
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tTileWidth, dtShort, tileSize).
+		add(tTileLength, dtShort, tileSize).
+		tiles(tiles...).
+		bytes()
+
+	full, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	m, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Subsample: s})
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 3, 2), m.Bounds())
+
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			assert.Equal(t, full.(hdr.Image).HDRAt(x*s, y*s), m.(hdr.Image).HDRAt(x, y), "pixel (%d,%d)", x, y)
+		}
+	}
+}
+
+func TestDecodeSeparatePlanesTiles(t *testing.T) {
+	const width, height, tileSize = 3, 3, 2
+
+	sample := func(x, y, p int) float32 {
+		return float32(100*p + 10*y + x)
+	}
+
+	// The tiles of the red plane, then the green and the blue ones.
+	var tiles [][]byte
+	for p := 0; p < 3; p++ {
+		for ty := 0; ty < height; ty += tileSize {
+			for tx := 0; tx < width; tx += tileSize {
+				tile := make([]byte, tileSize*tileSize*4)
+				for y := 0; y < tileSize; y++ {
+					for x := 0; x < tileSize; x++ {
+						binary.BigEndian.PutUint32(tile[4*(y*tileSize+x):], math.Float32bits(sample(tx+x, ty+y, p)))
+					}
+				}
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, 3, 3, 3).
+		add(tPlanarConfiguration, dtShort, pcSeparate).
+		add(tTileWidth, dtShort, tileSize).
+		add(tTileLength, dtShort, tileSize)
+
+	m, err := Decode(bytes.NewReader(b.tiles(tiles...).bytes()))
+	assert.NoError(t, err)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+			assert.Equal(t, []float64{float64(sample(x, y, 0)), float64(sample(x, y, 1)), float64(sample(x, y, 2))}, []float64{r, g, b}, "pixel (%d,%d)", x, y)
+		}
+	}
+
+	// The tiles of the blue plane are missing.
+	_, err = Decode(bytes.NewReader(b.tiles(tiles[:8]...).bytes()))
+	assert.Equal(t, FormatError("inconsistent header"), err)
+}
+
+func TestDecodeSeparatePlanesStrips(t *testing.T) {
+	const width, height, rowsPerStrip = 3, 5, 2
+	sample := func(x, y, p int) float32 {
+		return float32(100*p + 10*y + x)
+	}
+
+	// StripsPerImage strips of the red plane, then the green and the blue ones, the last strip
+	// of each plane being truncated.
+	var strips [][]byte
+	for p := 0; p < 3; p++ {
+		for sy := 0; sy < height; sy += rowsPerStrip {
+			var strip []byte
+			for y := sy; y < minInt(sy+rowsPerStrip, height); y++ {
+				for x := 0; x < width; x++ {
+					strip = append(strip, make([]byte, 4)...)
+					binary.LittleEndian.PutUint32(strip[len(strip)-4:], math.Float32bits(sample(x, y, p)))
+				}
+			}
+			strips = append(strips, strip)
+		}
+	}
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, 3, 3, 3).
+		add(tPlanarConfiguration, dtShort, pcSeparate).
+		add(tRowsPerStrip, dtShort, rowsPerStrip).
+		strips(strips...)
+
+	for _, data := range [][]byte{b.bytes(), b.omit(tStripByteCounts).bytes()} {
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				r, g, b, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+				assert.Equal(t, []float64{float64(sample(x, y, 0)), float64(sample(x, y, 1)), float64(sample(x, y, 2))}, []float64{r, g, b}, "pixel (%d,%d)", x, y)
+			}
+		}
+	}
+
+	// The strips of the blue plane are missing.
+	_, err := Decode(bytes.NewReader(newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, 3, 3, 3).
+		add(tPlanarConfiguration, dtShort, pcSeparate).
+		add(tRowsPerStrip, dtShort, rowsPerStrip).
+		strips(strips[:6]...).
+		bytes()))
+	assert.Equal(t, FormatError("inconsistent header"), err)
+}
+
+func TestDecodeSentinelErrors(t *testing.T) {
+	_, err := Decode(bytes.NewReader([]byte("not a TIFF header")))
+	assert.True(t, errors.Is(err, ErrMalformedHeader))
+	_, err = Decode(bytes.NewReader([]byte("II+\x00\x04\x00\x00\x00")))
+	assert.True(t, errors.Is(err, ErrMalformedHeader))
+	var format FormatError
+	assert.True(t, errors.As(err, &format))
+	assert.EqualError(t, err, "tiff: invalid format: malformed header: BigTIFF offset bytesize")
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 8).
+		add(tPhotometricInterpretation, dtShort, pBlackIsZero).
+		strips([]byte{0})
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.True(t, errors.Is(err, ErrUnsupportedPhotometric))
+	var unsupported UnsupportedError
+	assert.True(t, errors.As(err, &unsupported))
+	assert.Contains(t, err.Error(), "LDR")
+
+	b.add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogL).
+		add(tCompression, dtShort, 42).
+		strips([]byte{0, 0})
+	_, err = Decode(bytes.NewReader(b.bytes()))
+	assert.True(t, errors.Is(err, ErrUnsupportedCompression))
+	assert.EqualError(t, err, "tiff: unsupported feature: compression value 42")
+
+	// The errors detailed without wrapping the sentinel are not matched by their message.
+	assert.False(t, errors.Is(UnsupportedError("compression value 42"), ErrUnsupportedCompression))
+	assert.False(t, errors.Is(FormatError("compression"), ErrUnsupportedCompression))
+}
+
+func TestDecodeRGB32Exact(t *testing.T) {
+	rgb := []float32{math.MaxFloat32, math.SmallestNonzeroFloat32, 1.0 / 3, -0.1, 65504.5, float32(math.Inf(1))}
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		strip := make([]byte, 4*len(rgb))
+		for i, v := range rgb {
+			byteOrder.PutUint32(strip[4*i:], math.Float32bits(v))
+		}
+
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, 2).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 32, 32, 32).
+			add(tPhotometricInterpretation, dtShort, pRGB).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tSampleFormat, dtShort, sfIEEEFP, sfIEEEFP, sfIEEEFP).
+			strips(strip).
+			bytes()
+
+		// The samples are stored as is in the float32 backing of the image.
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.Equal(t, rgb, m.(*hdr.RGB).Pix, "%v", byteOrder)
+	}
+}
+
+func TestDecodeLevel(t *testing.T) {
+	level := func(size int, subFileType uint) *tiffBuilder {
+		var strip []byte
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				strip = append(strip, logluvPixel(x, y)...)
+			}
+		}
+		return newTIFFBuilder(binary.LittleEndian).
+			add(tNewSubFileType, dtLong, uint64(subFileType)).
+			add(tImageWidth, dtShort, uint64(size)).
+			add(tImageLength, dtShort, uint64(size)).
+			add(tBitsPerSample, dtShort, 16).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			strips(strip)
+	}
+
+	mask := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail|sftTransMask).
+		add(tImageWidth, dtShort, 8).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 1).
+		add(tPhotometricInterpretation, dtShort, pTransMask).
+		strips([]byte{0xff})
+	data := level(4, sftPrimaryImage).
+		subIFDs(level(1, sftThumbnail), mask, level(2, sftThumbnail)).
+		bytes()
+
+	for i, size := range []int{4, 2, 1} {
+		m, err := DecodeLevel(bytes.NewReader(data), i)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, size, size), m.Bounds(), "level %d", i)
+	}
+
+	_, err := DecodeLevel(bytes.NewReader(data), 3)
+	assert.Error(t, err)
+	_, err = DecodeLevel(bytes.NewReader(data), -1)
+	assert.Error(t, err)
+}
+
+func TestDecodePerIFDStonits(t *testing.T) {
+	newIFD := func(stonits float64) *tiffBuilder {
+		return newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, 1).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 16).
+			add(tPhotometricInterpretation, dtShort, pLogL).
+			add(tStonits, dtDouble, math.Float64bits(stonits)).
+			strips([]byte{0x00, 0x3f})
+	}
+	data := newIFD(2).
+		subIFDs(
+			newIFD(4).add(tNewSubFileType, dtLong, sftThumbnail),
+			newIFD(8).add(tNewSubFileType, dtLong, sftThumbnail).omit(tStonits),
+		).
+		bytes()
+	luminance := func(m image.Image) float64 {
+		_, Y, _, _ := m.(hdr.Image).HDRAt(0, 0).HDRXYZA()
+		return Y
+	}
+
+	m, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	Y := luminance(m) / 2
+
+	// Each IFD is decoded with its own Stonits, the one of the main IFD being inherited when absent.
+	for ifd, stonits := range []float64{2, 4, 2} {
+		block, _, err := DecodeBlock(bytes.NewReader(data), ifd, 0)
+		assert.NoError(t, err)
+		assert.InDelta(t, stonits*Y, luminance(block), 1e-6, "IFD %d", ifd)
+	}
+	m, err = DecodeLevel(bytes.NewReader(data), 1)
+	assert.NoError(t, err)
+	assert.InDelta(t, 4*Y, luminance(m), 1e-6)
+}
+
+func TestDecodeWrappedDimensions(t *testing.T) {
+	const width, height = 1, 1<<16 + 1 // The height is stored as a wrapped SHORT
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height&0xFFFF).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogL).
+		strips(make([]byte, width*height*2))
+	_, err := Decode(bytes.NewReader(b.bytes()))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "wrapped")
+
+	// Too many strips, the extra ones are ignored with a warning.
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(make([]byte, width*2))
+	zw.Close()
+	data := b.
+		add(tCompression, dtShort, cDeflate).
+		add(tRowsPerStrip, dtLong, 1).
+		strips(deflated.Bytes(), []byte{0}).
+		bytes()
+	var warnings []string
+	m, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Warn: func(msg string) {
+		warnings = append(warnings, msg)
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, width, 1), m.Bounds())
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "wrapped")
+	_, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "wrapped")
+
+	// Stored as LONG
+	m, err = Decode(bytes.NewReader(b.
+		add(tImageLength, dtLong, height).
+		add(tCompression, dtShort, cNone).
+		add(tRowsPerStrip, dtLong, 1<<15).
+		strips(make([]byte, width*(1<<15)*2), make([]byte, width*(1<<15)*2), make([]byte, 2)).
+		bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+}
+
+func TestDecodeRGBPacked(t *testing.T) {
+	const height = 3
+
+	// The widths cover the rows ending on a byte boundary or padded by 2, 4 or 6 bits.
+	for _, depth := range []uint64{10, 12, 14} {
+		for width := 1; width <= 4; width++ {
+			samples := make([]uint16, width*height*3)
+			for i := range samples {
+				samples[i] = uint16((997*i + 13) % (1 << depth))
+			}
+			samples[0], samples[len(samples)-1] = 0, 1<<depth-1
+			packed := pack(samples, width*3, uint(depth))
+			reversed := make([]byte, len(packed))
+			for i, b := range packed {
+				reversed[i] = bits.Reverse8(b)
+			}
+
+			b := newTIFFBuilder(binary.LittleEndian).
+				add(tImageWidth, dtShort, uint64(width)).
+				add(tImageLength, dtShort, height).
+				add(tBitsPerSample, dtShort, depth, depth, depth).
+				add(tPhotometricInterpretation, dtShort, pRGB).
+				add(tSamplesPerPixel, dtShort, 3).
+				add(tRowsPerStrip, dtShort, 2).
+				strips(packed[:2*len(packed)/height], packed[2*len(packed)/height:])
+
+			for fillOrder, strip := range map[uint][]byte{foMSBFirst: packed, foLSBFirst: reversed} {
+				b.add(tFillOrder, dtShort, uint64(fillOrder)).
+					strips(strip[:2*len(strip)/height], strip[2*len(strip)/height:])
+				m, err := Decode(bytes.NewReader(b.bytes()))
+				if !assert.NoError(t, err, "%d bits, width %d, fill order %d", depth, width, fillOrder) {
+					continue
+				}
+
+				maxValue := float64(int(1)<<depth - 1)
+				for y := 0; y < height; y++ {
+					for x := 0; x < width; x++ {
+						i := 3 * (y*width + x)
+						expected := f32(float64(samples[i])/maxValue, float64(samples[i+1])/maxValue, float64(samples[i+2])/maxValue)
+						r, g, bl, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+						assert.Equal(t, expected, []float64{r, g, bl}, "%d bits, width %d, fill order %d, pixel (%d,%d)", depth, width, fillOrder, x, y)
+					}
+				}
+			}
+
+			// The predictors would apply to the 16-bit expansion of the samples.
+			_, err := Decode(bytes.NewReader(b.add(tPredictor, dtShort, prHorizontal).bytes()))
+			assert.Equal(t, UnsupportedError(fmt.Sprintf("predictor with %d-bit packed samples", depth)), err)
+		}
+	}
+}
+
+func TestDecodeDestinationType(t *testing.T) {
+	d := &decoder{idf: &idf{features: map[uint16]tag{}}}
+	for name, decode := range map[string]func(image.Image, int, int, int, int) error{
+		"RGB":       d.decodeRGB,
+		"LogL":      d.decodeLogL,
+		"LogLuv":    d.decodeLogLuv,
+		"Lab":       d.decodeLab,
+		"TransMask": d.decodeTransMask,
+	} {
+		err := decode(image.NewRGBA(image.Rect(0, 0, 1, 1)), 0, 0, 0, 0)
+		assert.Equal(t, errDestinationType, err, name)
+	}
+}
+
+func TestDecodeRGBMixedBitsPerSample(t *testing.T) {
+	const width, height = 3, 2
+
+	for _, depths := range [][]uint64{{5, 6, 5}, {10, 10, 10, 2}, {4, 4, 3}} {
+		// Each row is packed MSB-first and padded to a byte boundary.
+		samples := make([]uint16, width*height*len(depths))
+		var strip []byte
+		for y := 0; y < height; y++ {
+			var v uint64
+			var nbits uint64
+			for x := 0; x < width; x++ {
+				for c, depth := range depths {
+					i := (y*width+x)*len(depths) + c
+					samples[i] = uint16((97*i + 13) % (1 << depth))
+					v = v<<depth | uint64(samples[i])
+					nbits += depth
+					for nbits >= 8 {
+						nbits -= 8
+						strip = append(strip, byte(v>>nbits))
+					}
+				}
+			}
+			if nbits > 0 {
+				strip = append(strip, byte(v<<(8-nbits)))
+			}
+		}
+
+		b := newTIFFBuilder(binary.BigEndian).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, depths...).
+			add(tPhotometricInterpretation, dtShort, pRGB).
+			add(tSamplesPerPixel, dtShort, uint64(len(depths))).
+			strips(strip)
+		if len(depths) == 4 {
+			b.add(tExtraSamples, dtShort, 2) // Unassociated alpha
+		}
+		m, err := Decode(bytes.NewReader(b.bytes()))
+		if !assert.NoError(t, err, "%v", depths) {
+			continue
+		}
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := (y*width + x) * len(depths)
+				var expected [3]float64
+				for c := range expected {
+					expected[c] = float64(samples[i+c]) / float64(int(1)<<depths[c]-1)
+				}
+				r, g, bl, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+				assert.Equal(t, f32(expected[0], expected[1], expected[2]), []float64{r, g, bl}, "%v, pixel (%d,%d)", depths, x, y)
+			}
+		}
+
+		// The strip is shorter than the rows of the sum of the bit widths.
+		_, err = Decode(bytes.NewReader(b.strips(strip[:len(strip)-1]).bytes()))
+		assert.EqualError(t, err, "tiff: invalid format: not enough pixel data", "%v", depths)
+	}
+
+	for _, c := range []struct {
+		depths []uint64
+		err    string
+	}{
+		{[]uint64{5, 6}, "tiff: invalid format: BitsPerSample does not match SamplesPerPixel"},
+		{[]uint64{5, 6, 5, 1}, "tiff: invalid format: BitsPerSample does not match SamplesPerPixel"},
+		{[]uint64{16, 32, 16}, "tiff: unsupported feature: 32-bit sample among samples of different depths"},
+		{[]uint64{5, 0, 5}, "tiff: unsupported feature: 0-bit sample among samples of different depths"},
+	} {
+		data := newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, c.depths...).
+			add(tPhotometricInterpretation, dtShort, pRGB).
+			add(tSamplesPerPixel, dtShort, 3).
+			strips(make([]byte, 64)).
+			bytes()
+		_, err := Decode(bytes.NewReader(data))
+		assert.EqualError(t, err, c.err, "%v", c.depths)
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	const width, height = 21, 19
+	var buf bytes.Buffer
+	assert.NoError(t, Encode(&buf, testRGBImage(width, height), nil))
+
+	n, err := EstimateMemory(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(width*height*3*4), n)
+
+	// The estimate is the size of the pixels of the decoded image.
+	m, err := Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, n, int64(4*len(m.(*hdr.RGB).Pix)))
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtLong, 1<<20).
+		add(tImageLength, dtLong, 1<<20).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cSGILogRLE).
+		add(tPhotometricInterpretation, dtShort, pLogL).
+		add(tSamplesPerPixel, dtShort, 1).
+		strips(nil).
+		bytes()
+	n, err = EstimateMemory(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<40*3*4), n)
+
+	_, err = EstimateMemory(bytes.NewReader([]byte("II*\x00")))
+	assert.Error(t, err)
+}
+
+func TestDecodeSamplesPerPixelMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		photometric uint64
+		spp         uint64
+		extras      []uint64
+		ok          bool
+	}{
+		{pRGB, 3, nil, true},
+		{pRGB, 1, nil, false},
+		{pRGB, 4, nil, false},
+		{pRGB, 4, []uint64{esUnassociatedAlpha}, true},
+		{pLogLuv, 3, nil, true},
+		{pLogLuv, 4, nil, false},
+		{pLogL, 1, nil, true},
+		{pLogL, 2, nil, false},
+		{pLogL, 2, []uint64{esUnassociatedAlpha}, true},
+		{pColorFilterArray, 3, nil, false},
+	} {
+		bps := make([]uint64, tc.spp)
+		for i := range bps {
+			bps[i] = 16
+		}
+		bytesPerPixel := 2 * int(tc.spp)
+		if tc.photometric == pLogLuv {
+			bytesPerPixel = 4 // Packed Luv
+		}
+		b := newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, 2).
+			add(tImageLength, dtShort, 2).
+			add(tBitsPerSample, dtShort, bps...).
+			add(tPhotometricInterpretation, dtShort, tc.photometric).
+			add(tSamplesPerPixel, dtShort, tc.spp).
+			strips(make([]byte, 2*2*bytesPerPixel))
+		if len(tc.extras) > 0 {
+			b.add(tExtraSamples, dtShort, tc.extras...)
+		}
+		if tc.photometric == pLogL || tc.photometric == pLogLuv {
+			b.add(tCompression, dtShort, cSGILogRLE).
+				strips(rle(make([]byte, 2*2*bytesPerPixel), bytesPerPixel, 2, 2))
+		}
+
+		_, err := Decode(bytes.NewReader(b.bytes()))
+		if tc.ok {
+			assert.NoError(t, err, "%+v", tc)
+			continue
+		}
+		assert.Equal(t, FormatError("SamplesPerPixel does not match PhotometricInterpretation"), err, "%+v", tc)
+	}
+}
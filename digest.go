@@ -0,0 +1,169 @@
+package tiff
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+
+	"github.com/mdouchement/hdr"
+)
+
+// DecodeWithDigest reads a TIFF image from r and returns it along with the SHA-256 digest of its pixels.
+// The digest does not depend on the container (compression, strips or tiles, byte order, etc.) but only
+// on the decoded image: its color space (RGB or XYZ), its dimensions and its channel values, row by row,
+// as little-endian float32, the precision of the hdr images.
+func DecodeWithDigest(r io.Reader) (image.Image, [32]byte, error) {
+	m, err := Decode(r)
+	if err != nil {
+		return nil, [32]byte{}, err
+	}
+	sum, err := pixelDigest(m)
+	if err != nil {
+		return nil, [32]byte{}, err
+	}
+	return m, sum, nil
+}
+
+// pixelDigest returns the SHA-256 digest of the pixels of m as described by DecodeWithDigest.
+func pixelDigest(m image.Image) ([32]byte, error) {
+	var model string
+	var pix []float32
+	var pixOffset func(x, y int) int
+	switch m := m.(type) {
+	case *hdr.RGB:
+		model, pix, pixOffset = "RGB", m.Pix, m.PixOffset
+	case *hdr.XYZ:
+		model, pix, pixOffset = "XYZ", m.Pix, m.PixOffset
+	default:
+		return [32]byte{}, InternalError("digest of an image other than hdr.RGB or hdr.XYZ")
+	}
+
+	b := m.Bounds()
+	h := sha256.New()
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(b.Dx()))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(b.Dy()))
+	h.Write([]byte(model))
+	h.Write(header)
+
+	row := make([]byte, 4*3*b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := pixOffset(b.Min.X, y)
+		for j, v := range pix[i : i+3*b.Dx()] {
+			binary.LittleEndian.PutUint32(row[4*j:], math.Float32bits(v))
+		}
+		h.Write(row)
+	}
+
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// rawDigestTileSize is the size of the tiles whose digests are combined into the NewRawImageDigest.
+const rawDigestTileSize = 256
+
+// VerifyRawDigest reads a DNG image from r and checks the integrity of its raw Color Filter Array:
+// the MD5 digest of its samples, computed as defined by the DNG spec, is compared to the NewRawImageDigest
+// tag or, when absent, to the legacy RawImageDigest tag. It returns ErrRawDigestMismatch when they differ.
+func VerifyRawDigest(r io.Reader) error {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return err
+	}
+	if d.mode != mColorFilterArray {
+		return UnsupportedError("raw digest of an image other than a Color Filter Array")
+	}
+	if err = d.checkBitsPerSample(); err != nil {
+		return err
+	}
+
+	t, legacy := d.features[tNewRawImageDigest], false
+	if len(t.val) == 0 {
+		t, legacy = d.features[tRawImageDigest], true
+	}
+	if len(t.val) == 0 {
+		return FormatError("raw image digest not found")
+	}
+	if len(t.val) != md5.Size {
+		return FormatError("invalid raw image digest")
+	}
+
+	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+	l, err := d.layout()
+	if err != nil {
+		return err
+	}
+	if err = d.checkLimits(bounds, l); err != nil {
+		return err
+	}
+	samples := make([]uint16, d.config.Width*d.config.Height)
+	for k := 0; k < l.across*l.down; k++ {
+		err = d.readSamples(l, k, func(x, y int, v uint16) {
+			samples[y*d.config.Width+x] = v
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var sum [md5.Size]byte
+	if legacy {
+		sum = rawImageDigest(samples)
+	} else {
+		// The samples are digested as bytes when they fit in 8 bits, like the DNG SDK does: when they are
+		// stored on up to 8 bits or are the indexes of a linearization table of up to 256 entries.
+		sampleSize := 2
+		if t, ok := d.features[tLinearizationTable]; d.bpp <= 8 || (ok && len(t.val) <= 256) {
+			sampleSize = 1
+		}
+		sum = newRawImageDigest(samples, d.config.Width, d.config.Height, sampleSize)
+	}
+	for i, v := range t.val {
+		if byte(v) != sum[i] {
+			return ErrRawDigestMismatch
+		}
+	}
+	return nil
+}
+
+// rawImageDigest returns the RawImageDigest of the samples: the MD5 digest of the samples in row-scan order,
+// zero padded to 16 bits and little-endian.
+func rawImageDigest(samples []uint16) [md5.Size]byte {
+	p := make([]byte, 2*len(samples))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(p[2*i:], v)
+	}
+	return md5.Sum(p)
+}
+
+// newRawImageDigest returns the NewRawImageDigest of the width x height samples: the MD5 digest of the
+// MD5 digests of its 256x256 tiles, row by row, the samples of each tile being digested in row-scan order
+// on sampleSize bytes, little-endian.
+func newRawImageDigest(samples []uint16, width, height, sampleSize int) [md5.Size]byte {
+	h := md5.New()
+	var tile []byte
+	for ty := 0; ty < height; ty += rawDigestTileSize {
+		for tx := 0; tx < width; tx += rawDigestTileSize {
+			tile = tile[:0]
+			for y := ty; y < minInt(ty+rawDigestTileSize, height); y++ {
+				for _, v := range samples[y*width+tx : y*width+minInt(tx+rawDigestTileSize, width)] {
+					if sampleSize == 1 {
+						tile = append(tile, byte(v))
+					} else {
+						tile = append(tile, byte(v), byte(v>>8))
+					}
+				}
+			}
+			sum := md5.Sum(tile)
+			h.Write(sum[:])
+		}
+	}
+
+	var sum [md5.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,187 @@
+package tiff
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeWithDigest(t *testing.T) {
+	const width, height = 3, 2
+
+	var strip []byte
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			strip = append(strip, logluvPixel(x, y)...)
+		}
+	}
+	builder := func(byteOrder binary.ByteOrder) *tiffBuilder {
+		return newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 16).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3)
+	}
+
+	m, sum, err := DecodeWithDigest(bytes.NewReader(builder(binary.BigEndian).strips(strip).bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+
+	// Same pixels in another container, the RLE bytestreams are most significant byte first
+	_, sum2, err := DecodeWithDigest(bytes.NewReader(builder(binary.LittleEndian).
+		add(tCompression, dtShort, cSGILogRLE).
+		add(tRowsPerStrip, dtShort, 1).
+		strips(rle(strip[:width*4], 4, width, 1), rle(strip[width*4:], 4, width, 1)).
+		bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, sum, sum2)
+
+	// Other pixels
+	strip[0]++
+	_, sum3, err := DecodeWithDigest(bytes.NewReader(builder(binary.BigEndian).strips(strip).bytes()))
+	assert.NoError(t, err)
+	assert.NotEqual(t, sum, sum3)
+
+	_, _, err = DecodeWithDigest(bytes.NewReader(nil))
+	assert.Error(t, err)
+}
+
+func TestVerifyRawDigest(t *testing.T) {
+	const width, height = 260, 3 // Two tiles of the NewRawImageDigest across
+
+	strip := make([]byte, 2*width*height)
+	for i := 0; i < width*height; i++ {
+		binary.BigEndian.PutUint16(strip[2*i:], uint16(i*37))
+	}
+	// The digests are computed over the little-endian samples.
+	le := make([]byte, len(strip))
+	for i := 0; i < len(strip); i += 2 {
+		le[i], le[i+1] = strip[i+1], strip[i]
+	}
+	digest := func(sum [md5.Size]byte) []uint64 {
+		vals := make([]uint64, md5.Size)
+		for i, v := range sum {
+			vals[i] = uint64(v)
+		}
+		return vals
+	}
+	legacy := md5.Sum(le)
+	var tiles []byte
+	for _, tile := range [][2]int{{0, 256}, {256, width}} {
+		var p []byte
+		for y := 0; y < height; y++ {
+			p = append(p, le[2*(y*width+tile[0]):2*(y*width+tile[1])]...)
+		}
+		sum := md5.Sum(p)
+		tiles = append(tiles, sum[:]...)
+	}
+	tiled := md5.Sum(tiles)
+
+	b := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		strips(strip)
+
+	err := VerifyRawDigest(bytes.NewReader(b.bytes()))
+	assert.EqualError(t, err, "tiff: invalid format: raw image digest not found")
+
+	assert.NoError(t, VerifyRawDigest(bytes.NewReader(b.add(tRawImageDigest, dtByte, digest(legacy)...).bytes())))
+	// NewRawImageDigest prevails.
+	b.add(tNewRawImageDigest, dtByte, digest(tiled)...)
+	assert.NoError(t, VerifyRawDigest(bytes.NewReader(b.bytes())))
+	b.add(tNewRawImageDigest, dtByte, digest(legacy)...)
+	assert.True(t, errors.Is(VerifyRawDigest(bytes.NewReader(b.bytes())), ErrRawDigestMismatch))
+
+	// Tampered sample
+	tampered := append([]byte(nil), strip...)
+	tampered[len(tampered)-1]++
+	b.add(tNewRawImageDigest, dtByte, digest(tiled)...).strips(tampered)
+	assert.True(t, errors.Is(VerifyRawDigest(bytes.NewReader(b.bytes())), ErrRawDigestMismatch))
+	b.omit(tNewRawImageDigest)
+	assert.True(t, errors.Is(VerifyRawDigest(bytes.NewReader(b.bytes())), ErrRawDigestMismatch))
+
+	// The 16-bit indexes of a small linearization table are digested as bytes.
+	small := make([]byte, width*height)
+	wide := make([]byte, 2*width*height)
+	for i := range small {
+		small[i] = byte(i % 4)
+		wide[2*i] = small[i]
+	}
+	b = newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cNone).
+		add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+		add(tSamplesPerPixel, dtShort, 1).
+		add(tCFAPattern, dtByte, 0, 1, 1, 2).
+		add(tLinearizationTable, dtShort, 0, 100, 1000, 10000).
+		strips(wide)
+	tiles = tiles[:0]
+	for _, tile := range [][2]int{{0, 256}, {256, width}} {
+		var p []byte
+		for y := 0; y < height; y++ {
+			p = append(p, small[y*width+tile[0]:y*width+tile[1]]...)
+		}
+		sum := md5.Sum(p)
+		tiles = append(tiles, sum[:]...)
+	}
+	assert.NoError(t, VerifyRawDigest(bytes.NewReader(b.add(tNewRawImageDigest, dtByte, digest(md5.Sum(tiles))...).bytes())))
+}
+
+func TestVerifyRawDigestFixtures(t *testing.T) {
+	// 2x2 tiles of the NewRawImageDigest, digests computed apart following the DNG SDK
+	// (dng_find_new_raw_image_digest_task).
+	const width, height = 300, 260
+
+	for _, tc := range []struct {
+		depth  uint64
+		sample func(x, y int) uint16
+		digest string
+	}{
+		{8, func(x, y int) uint16 { return uint16((x*3 + y*5) % 256) }, "2c030212673cbc45867905420a39b02f"},
+		{16, func(x, y int) uint16 { return uint16(x*37 + y*101) }, "435d0b864cc5e9472bd44e94108ad46e"},
+	} {
+		var strip []byte
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if v := tc.sample(x, y); tc.depth == 8 {
+					strip = append(strip, byte(v))
+				} else {
+					strip = append(strip, byte(v>>8), byte(v)) // Big-endian file
+				}
+			}
+		}
+		sum, err := hex.DecodeString(tc.digest)
+		assert.NoError(t, err)
+		digest := make([]uint64, len(sum))
+		for i, v := range sum {
+			digest[i] = uint64(v)
+		}
+
+		data := newTIFFBuilder(binary.BigEndian).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, tc.depth).
+			add(tCompression, dtShort, cNone).
+			add(tPhotometricInterpretation, dtShort, pColorFilterArray).
+			add(tSamplesPerPixel, dtShort, 1).
+			add(tCFAPattern, dtByte, 0, 1, 1, 2).
+			add(tNewRawImageDigest, dtByte, digest...).
+			strips(strip).
+			bytes()
+		assert.NoError(t, VerifyRawDigest(bytes.NewReader(data)), "%d bits", tc.depth)
+	}
+}
@@ -0,0 +1,379 @@
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/format"
+)
+
+// stripSize is the targeted size of a strip in bytes when RowsPerStrip is not set.
+const stripSize = 8 * 1024
+
+type encoder struct {
+	byteOrder binary.ByteOrder
+	opt       Options
+	bounds    image.Rectangle
+
+	// tags contains the tags specific to the image mode.
+	tags []ifdEntry
+	// bytesPerPixel is the number of bytes written by writePixel.
+	bytesPerPixel   int
+	samplesPerPixel int
+	// writePixel writes the pixel at (x, y) into p in the encoder's byte order.
+	writePixel func(p []byte, x, y int)
+	// packedDepth, if not zero, is the depth on which the 16-bit samples written by writePixel are bit-packed.
+	packedDepth int
+
+	tiled                    bool
+	blockWidth, blockHeight  int
+	blocksAcross, blocksDown int
+}
+
+// An ifdEntry is a tag to be written in the IFD.
+type ifdEntry struct {
+	tag      uint16
+	datatype uint16
+	data     []uint64 // Same layout as tag.val
+}
+
+func newEncoder(m hdr.Image, opt *Options) (*encoder, error) {
+	e := &encoder{
+		byteOrder: binary.LittleEndian,
+		bounds:    m.Bounds(),
+	}
+	if opt != nil {
+		e.opt = *opt
+	}
+	if e.opt.Predictor < PredictorNone || e.opt.Predictor > PredictorFloatingPoint {
+		return nil, FormatError("unknown predictor")
+	}
+
+	setup := e.rgb
+	if e.opt.LogLuv {
+		setup = e.logLuv
+	}
+	if err := setup(m); err != nil {
+		return nil, err
+	}
+
+	if err := e.layout(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// rgb sets up the encoding of m as 32-bit floating point RGB.
+func (e *encoder) rgb(m hdr.Image) error {
+	e.samplesPerPixel = 3
+	e.bytesPerPixel = 12
+	e.writePixel = func(p []byte, x, y int) {
+		r, g, b, _ := m.HDRAt(x, y).HDRRGBA()
+		e.byteOrder.PutUint32(p[0:4], math.Float32bits(float32(r)))
+		e.byteOrder.PutUint32(p[4:8], math.Float32bits(float32(g)))
+		e.byteOrder.PutUint32(p[8:12], math.Float32bits(float32(b)))
+	}
+	e.tags = []ifdEntry{
+		{tBitsPerSample, dtShort, []uint64{32, 32, 32}},
+		{tPhotometricInterpretation, dtShort, []uint64{pRGB}},
+		{tSamplesPerPixel, dtShort, []uint64{3}},
+		{tSampleFormat, dtShort, []uint64{sfIEEEFP, sfIEEEFP, sfIEEEFP}},
+	}
+	return nil
+}
+
+// logLuv sets up the encoding of m as 32-bit LogLuv, SGILog RLE compressed.
+// The luminances are divided by the Stonits option, which is written as the Stonits tag
+// so that the decoder recovers them.
+func (e *encoder) logLuv(m hdr.Image) error {
+	if e.opt.Deflate || e.opt.Predictor != PredictorNone {
+		return FormatError("LogLuv images are only SGILog RLE compressed, without predictor")
+	}
+	stonits := e.opt.Stonits
+	switch {
+	case stonits < 0 || math.IsNaN(stonits) || math.IsInf(stonits, 0):
+		return FormatError("invalid Stonits")
+	case stonits == 0:
+		stonits = 1
+	default:
+		e.tags = append(e.tags, ifdEntry{tStonits, dtDouble, []uint64{math.Float64bits(stonits)}})
+	}
+
+	e.samplesPerPixel = 3
+	e.bytesPerPixel = 4
+	e.writePixel = func(p []byte, x, y int) {
+		X, Y, Z, _ := m.HDRAt(x, y).HDRXYZA()
+		copy(p, xyzToLogLuv(X/stonits, Y/stonits, Z/stonits))
+	}
+	e.tags = append(e.tags,
+		ifdEntry{tBitsPerSample, dtShort, []uint64{16, 16, 16}},
+		ifdEntry{tPhotometricInterpretation, dtShort, []uint64{pLogLuv}},
+		ifdEntry{tSamplesPerPixel, dtShort, []uint64{3}},
+	)
+	return nil
+}
+
+// xyzToLogLuv returns the 32-bit LogLuv pixel of the color, most significant byte first.
+// The luminances beyond the LogLuv range are clamped, the negative ones being black.
+func xyzToLogLuv(X, Y, Z float64) []byte {
+	const minY, maxY = 0x1p-64, 0x1.fffp63 // Le of 0 and 0x7fff
+	if !(Y >= minY) {
+		return make([]byte, 4) // NaN included
+	}
+	if Y > maxY {
+		X, Y, Z = X*maxY/Y, maxY, Z*maxY/Y
+	}
+	return format.XYZToLogLuv(X, Y, Z)
+}
+
+// layout computes the dimensions of the strips or tiles.
+func (e *encoder) layout() error {
+	width, height := e.bounds.Dx(), e.bounds.Dy()
+
+	switch {
+	case e.opt.TileWidth < 0 || e.opt.TileLength < 0 || e.opt.RowsPerStrip < 0:
+		return FormatError("negative strip or tile dimensions")
+	case (e.opt.TileWidth == 0) != (e.opt.TileLength == 0):
+		return FormatError("both TileWidth and TileLength must be set")
+	case e.opt.TileWidth%16 != 0 || e.opt.TileLength%16 != 0:
+		return FormatError("TileWidth and TileLength must be multiples of 16")
+	}
+
+	if e.opt.TileWidth > 0 {
+		e.tiled = true
+		e.blockWidth = e.opt.TileWidth
+		e.blockHeight = e.opt.TileLength
+		e.blocksAcross = (width + e.blockWidth - 1) / e.blockWidth
+		e.blocksDown = (height + e.blockHeight - 1) / e.blockHeight
+		return nil
+	}
+
+	e.blockWidth = width
+	e.blockHeight = e.opt.RowsPerStrip
+	if e.blockHeight == 0 {
+		e.blockHeight = stripSize / maxInt(width*e.bytesPerPixel, 1)
+	}
+	e.blockHeight = maxInt(minInt(e.blockHeight, height), 1)
+	e.blocksAcross = 1
+	e.blocksDown = (height + e.blockHeight - 1) / e.blockHeight
+	return nil
+}
+
+func (e *encoder) encode(w io.Writer) error {
+	var blocks [][]byte
+	for j := 0; j < e.blocksDown; j++ {
+		for i := 0; i < e.blocksAcross; i++ {
+			block, err := e.encodeBlock(i*e.blockWidth, j*e.blockHeight)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+	}
+
+	offsets := make([]uint64, len(blocks))
+	counts := make([]uint64, len(blocks))
+	offset := 8 // Header
+	for i, block := range blocks {
+		offsets[i] = uint64(offset)
+		counts[i] = uint64(len(block))
+		offset += len(block)
+	}
+	padding := offset % 2 // The IFD begins on a word boundary.
+	offset += padding
+	if err := checkOffset(offset); err != nil {
+		return err
+	}
+
+	entries := append([]ifdEntry{
+		{tImageWidth, dtLong, []uint64{uint64(e.bounds.Dx())}},
+		{tImageLength, dtLong, []uint64{uint64(e.bounds.Dy())}},
+		{tCompression, dtShort, []uint64{uint64(e.compression())}},
+		{tPlanarConfiguration, dtShort, []uint64{pcChunky}},
+	}, e.tags...)
+	switch e.opt.Predictor {
+	case PredictorHorizontal:
+		entries = append(entries, ifdEntry{tPredictor, dtShort, []uint64{prHorizontal}})
+	case PredictorFloatingPoint:
+		entries = append(entries, ifdEntry{tPredictor, dtShort, []uint64{prFloatingPoint}})
+	}
+	if e.tiled {
+		entries = append(entries,
+			ifdEntry{tTileWidth, dtLong, []uint64{uint64(e.blockWidth)}},
+			ifdEntry{tTileLength, dtLong, []uint64{uint64(e.blockHeight)}},
+			ifdEntry{tTileOffsets, dtLong, offsets},
+			ifdEntry{tTileByteCounts, dtLong, counts},
+		)
+	} else {
+		entries = append(entries,
+			ifdEntry{tRowsPerStrip, dtLong, []uint64{uint64(e.blockHeight)}},
+			ifdEntry{tStripOffsets, dtLong, offsets},
+			ifdEntry{tStripByteCounts, dtLong, counts},
+		)
+	}
+
+	// Header
+	header := []byte(leHeader + "\x00\x00\x00\x00")
+	e.byteOrder.PutUint32(header[4:8], uint32(offset))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(make([]byte, padding)); err != nil {
+		return err
+	}
+
+	return e.writeIFD(w, offset, entries)
+}
+
+// encodeBlock returns the compressed strip or tile starting at (xmin, ymin).
+// Tiles are padded with zeros whereas the last strip is truncated.
+func (e *encoder) encodeBlock(xmin, ymin int) ([]byte, error) {
+	width := e.blockWidth
+	height := e.blockHeight
+	if !e.tiled {
+		height = minInt(height, e.bounds.Dy()-ymin)
+	}
+
+	rowSize := width * e.bytesPerPixel
+	p := make([]byte, rowSize*height)
+	for y := 0; y < height && ymin+y < e.bounds.Dy(); y++ {
+		for x := 0; x < width && xmin+x < e.bounds.Dx(); x++ {
+			e.writePixel(p[y*rowSize+x*e.bytesPerPixel:], e.bounds.Min.X+xmin+x, e.bounds.Min.Y+ymin+y)
+		}
+	}
+
+	if e.opt.LogLuv {
+		return encodeRLE(p, e.bytesPerPixel, width, height), nil
+	}
+	if e.packedDepth != 0 {
+		p = packSamples(p, e.byteOrder, width*e.samplesPerPixel, e.packedDepth)
+	}
+
+	bytesPerSample := e.bytesPerPixel / e.samplesPerPixel
+	switch e.opt.Predictor {
+	case PredictorHorizontal:
+		if err := encodeHorizontalPredictor(p, e.byteOrder, rowSize, e.samplesPerPixel, bytesPerSample); err != nil {
+			return nil, err
+		}
+	case PredictorFloatingPoint:
+		if err := encodeFloatingPointPredictor(p, e.byteOrder, rowSize, e.samplesPerPixel, bytesPerSample); err != nil {
+			return nil, err
+		}
+	}
+
+	if !e.opt.Deflate {
+		return p, nil
+	}
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *encoder) compression() uint {
+	if e.opt.LogLuv {
+		return cSGILogRLE
+	}
+	if e.opt.Deflate {
+		return cDeflate
+	}
+	return cNone
+}
+
+// writeIFD writes the IFD located at offset, followed by the values that do not fit in the entries.
+func (e *encoder) writeIFD(w io.Writer, offset int, entries []ifdEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	ifd := make([]byte, 2+ifdLen*len(entries)+4) // Number of entries, entries and next IFD offset
+	var extra []byte
+	extraOffset := offset + len(ifd)
+
+	e.byteOrder.PutUint16(ifd[0:2], uint16(len(entries)))
+	for i, entry := range entries {
+		p := ifd[2+i*ifdLen : 2+(i+1)*ifdLen]
+		raw := entry.bytes(e.byteOrder)
+
+		count := len(entry.data)
+		if entry.datatype == dtASCII || entry.datatype == dtUndefined {
+			count = len(raw)
+		}
+
+		e.byteOrder.PutUint16(p[0:2], entry.tag)
+		e.byteOrder.PutUint16(p[2:4], entry.datatype)
+		e.byteOrder.PutUint32(p[4:8], uint32(count))
+		if len(raw) <= 4 {
+			copy(p[8:12], raw)
+			continue
+		}
+
+		if err := checkOffset(extraOffset + len(extra)); err != nil {
+			return err
+		}
+		e.byteOrder.PutUint32(p[8:12], uint32(extraOffset+len(extra)))
+		extra = append(extra, raw...)
+		if len(extra)%2 != 0 {
+			extra = append(extra, 0) // Values begin on word boundaries.
+		}
+	}
+
+	if _, err := w.Write(ifd); err != nil {
+		return err
+	}
+	_, err := w.Write(extra)
+	return err
+}
+
+// checkOffset returns an error when offset does not fit in the 32-bit offsets of a classic TIFF,
+// the encoder does not write BigTIFF.
+func checkOffset(offset int) error {
+	if int64(offset) > math.MaxUint32 {
+		return UnsupportedError("offset beyond 4 GiB, BigTIFF encoding")
+	}
+	return nil
+}
+
+// bytes returns the raw value of the entry.
+func (entry ifdEntry) bytes(byteOrder binary.ByteOrder) []byte {
+	raw := make([]byte, 0, int(lengths[entry.datatype])*len(entry.data))
+	p := make([]byte, 8)
+	for _, v := range entry.data {
+		switch lengths[entry.datatype] {
+		case 1:
+			raw = append(raw, byte(v))
+		case 2:
+			byteOrder.PutUint16(p, uint16(v))
+			raw = append(raw, p[:2]...)
+		case 4:
+			byteOrder.PutUint32(p, uint32(v))
+			raw = append(raw, p[:4]...)
+		case 8:
+			if entry.datatype == dtRational || entry.datatype == dtSRational {
+				// Numerator in the low 32 bits, denominator in the high ones
+				byteOrder.PutUint32(p[0:4], uint32(v))
+				byteOrder.PutUint32(p[4:8], uint32(v>>32))
+			} else {
+				byteOrder.PutUint64(p, v)
+			}
+			raw = append(raw, p...)
+		}
+	}
+	return raw
+}
@@ -0,0 +1,23 @@
+package tiff
+
+import (
+	"image"
+
+	"golang.org/x/exp/mmap"
+)
+
+// DecodeFile reads the TIFF image stored at path and returns an image.Image decoded according to opts.
+// The file is memory-mapped so that its content is not copied into the heap.
+func DecodeFile(path string, opts *DecodeOptions) (image.Image, error) {
+	r, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	d, err := NewDecoderAt(r, int64(r.Len()))
+	if err != nil {
+		return nil, err
+	}
+	return d.DecodeWithOptions(opts)
+}
@@ -0,0 +1,34 @@
+package tiff
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeFile(t *testing.T) {
+	strip := append(logluvPixel(0, 0), logluvPixel(1, 0)...)
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips(strip).
+		bytes()
+
+	path := filepath.Join(t.TempDir(), "image.tiff")
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+
+	m, err := DecodeFile(path, nil)
+	assert.NoError(t, err)
+	assert.Implements(t, (*hdr.Image)(nil), m)
+	assert.Equal(t, 2, m.Bounds().Dx())
+
+	_, err = DecodeFile(filepath.Join(t.TempDir(), "missing.tiff"), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,51 @@
+package tiff
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// A TagHandler receives the raw value of a tag: its TIFF datatype (e.g. 7 for UNDEFINED) and its bytes
+// as stored in the IFD, in byteOrder, the byte order of that IFD. It is the one of the file given by its
+// header ("II" or "MM") unless the IFD is stored in its own byte order.
+type TagHandler func(datatype uint, byteOrder binary.ByteOrder, raw []byte)
+
+var (
+	tagHandlersMu sync.RWMutex
+	tagHandlers   = map[uint16]TagHandler{}
+)
+
+// RegisterTagHandler registers fn to be called with the value of each entry of the tag id found while
+// parsing the IFDs of an image (the main IFD, its EXIF IFD and its SubIFDs), whether or not the tag is
+// known by the decoder, e.g. to capture a MakerNote or a vendor tag.
+// A nil fn unregisters the handler of the tag.
+func RegisterTagHandler(id uint16, fn TagHandler) {
+	tagHandlersMu.Lock()
+	defer tagHandlersMu.Unlock()
+	if fn == nil {
+		delete(tagHandlers, id)
+		return
+	}
+	tagHandlers[id] = fn
+}
+
+// tagHandler returns the handler registered for the tag id, if any.
+func tagHandler(id uint16) TagHandler {
+	tagHandlersMu.RLock()
+	defer tagHandlersMu.RUnlock()
+	return tagHandlers[id]
+}
+
+// handleTag calls the handler registered for the tag of the IFD entry in p, if any.
+// An entry whose value cannot be read is not handed over, the parsing of the IFD goes on.
+func (d *idf) handleTag(p []byte) {
+	fn := tagHandler(d.byteOrder.Uint16(p[0:2]))
+	if fn == nil {
+		return
+	}
+	raw, datatype, _, err := d.ifdRaw(p)
+	if err != nil {
+		return
+	}
+	fn(uint(datatype), d.byteOrder, append([]byte(nil), raw...))
+}
@@ -0,0 +1,63 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterTagHandler(t *testing.T) {
+	const tMakerNote, tVendor, tBroken = 37500, 65000, 65001
+
+	var makerNote, vendor []byte
+	var datatype uint
+	var byteOrder binary.ByteOrder
+	broken := false
+	RegisterTagHandler(tMakerNote, func(dt uint, _ binary.ByteOrder, raw []byte) {
+		makerNote = raw
+		datatype = dt
+	})
+	RegisterTagHandler(tVendor, func(_ uint, bo binary.ByteOrder, raw []byte) {
+		vendor = raw
+		byteOrder = bo
+	})
+	RegisterTagHandler(tBroken, func(uint, binary.ByteOrder, []byte) { broken = true })
+	defer RegisterTagHandler(tMakerNote, nil)
+	defer RegisterTagHandler(tVendor, nil)
+	defer RegisterTagHandler(tBroken, nil)
+
+	data := cfaImage(2, 2).
+		add(tVendor, dtShort, 0x0102).
+		add(tBroken, 14, 1, 2). // Undefined data type
+		exifIFD(newTIFFBuilder(nil).add(tMakerNote, dtUndefined, 'N', 'i', 'k', 'o', 'n', 0)).
+		bytes()
+
+	_, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("Nikon\x00"), makerNote)
+	assert.Equal(t, uint(dtUndefined), datatype)
+	assert.Equal(t, []byte{0x02, 0x01}, vendor) // Little-endian file
+	assert.Equal(t, binary.LittleEndian, byteOrder)
+	assert.False(t, broken) // Unreadable entry skipped
+
+	// Big-endian IFD in a little-endian file
+	data = newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tVendor, dtShort, 0x0102).
+		strips([]byte{0}).
+		bytes()
+	d := &idf{r: bytes.NewReader(data), byteOrder: binary.LittleEndian}
+	assert.NoError(t, d.appendAndParseIDF(int64(binary.BigEndian.Uint32(data[4:8])), binary.BigEndian))
+	assert.Equal(t, []byte{0x01, 0x02}, vendor)
+	assert.Equal(t, binary.BigEndian, byteOrder)
+
+	// Unregistered
+	RegisterTagHandler(tVendor, nil)
+	vendor = nil
+	_, err = ReadMetadata(bytes.NewReader(cfaImage(2, 2).add(tVendor, dtShort, 0x0102).bytes()))
+	assert.NoError(t, err)
+	assert.Nil(t, vendor)
+}
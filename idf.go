@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 )
 
 //------------------------//
@@ -13,36 +15,69 @@ import (
 
 type idf struct {
 	r         io.ReaderAt
-	byteOrder binary.ByteOrder
+	byteOrder binary.ByteOrder // Byte order of the features, the file's one unless overridden
+	bigTIFF   bool             // 8-byte offsets and counts
 	format    int
 	features  map[uint16]tag
-	tree      []map[uint16]tag // IDF-Tree
+	tree      []map[uint16]tag   // IDF-Tree
+	orders    []binary.ByteOrder // Byte order of each IFD of the tree
+	exif      map[uint16]tag     // EXIF IFD of the main IDF, if any
+	// exifErr reports the EXIF IFD that could not be parsed, its tags are then ignored.
+	exifErr error
+	// entryErr reports the first IFD entry out of the ascending tag order required by the spec.
+	// Such files are decoded anyway unless the Strict option is set.
+	entryErr error
+	// scan restricts the parsed tags to the ones requested by ScanTags, along with the pointers to
+	// the SubIFDs and the EXIF IFD. All the known tags are parsed when nil.
+	scan map[uint16]bool
 }
 
-func newIDF(r io.ReaderAt) (d *idf, err error) {
-	d = &idf{
+func newIDF(r io.ReaderAt) (*idf, error) {
+	d := &idf{
 		r:        r,
 		format:   fTIFF,
 		features: make(map[uint16]tag),
 		tree:     make([]map[uint16]tag, 0),
 	}
+	if err := d.parse(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
 
+// parse parses the header and the IFD tree of the file.
+func (d *idf) parse() (err error) {
 	p := make([]byte, 8)
 	if _, err = d.r.ReadAt(p, 0); err != nil {
-		return nil, err
+		return err
 	}
 	switch string(p[0:4]) {
 	case leHeader:
 		d.byteOrder = binary.LittleEndian
 	case beHeader:
 		d.byteOrder = binary.BigEndian
+	case leBigHeader:
+		d.byteOrder = binary.LittleEndian
+		d.bigTIFF = true
+	case beBigHeader:
+		d.byteOrder = binary.BigEndian
+		d.bigTIFF = true
 	default:
-		return nil, FormatError("malformed header")
+		return ErrMalformedHeader
 	}
 
 	ifdOffset := int64(d.byteOrder.Uint32(p[4:8]))
-	if err = d.appendAndParseIDF(0, ifdOffset); err != nil { // Main IDF is at index 0.
-		return nil, err
+	if d.bigTIFF {
+		if d.byteOrder.Uint16(p[4:6]) != 8 || d.byteOrder.Uint16(p[6:8]) != 0 {
+			return fmt.Errorf("%w: BigTIFF offset bytesize", ErrMalformedHeader)
+		}
+		if _, err = d.r.ReadAt(p, 8); err != nil {
+			return err
+		}
+		ifdOffset = int64(d.byteOrder.Uint64(p))
+	}
+	if err = d.appendAndParseIDF(ifdOffset, d.byteOrder); err != nil { // Main IDF is at index 0.
+		return err
 	}
 
 	// Add main IDF data in features map.
@@ -50,6 +85,14 @@ func newIDF(r io.ReaderAt) (d *idf, err error) {
 		d.features[k] = v
 	}
 
+	if exifIFD, ok := d.features[tExifIFD]; ok {
+		// A broken EXIF IFD does not prevent the decoding of the image.
+		d.exif = make(map[uint16]tag)
+		if d.exifErr = d.parseIDF(d.exif, int64(exifIFD.firstVal()), d.byteOrder); d.exifErr != nil {
+			d.exif = nil
+		}
+	}
+
 	// Update file format
 	if _, ok := d.features[tDNGVersion]; ok {
 		d.format = fDNG
@@ -57,64 +100,207 @@ func newIDF(r io.ReaderAt) (d *idf, err error) {
 
 	if subIDFs, ok := d.features[tSubIFDs]; ok {
 		// Parse all SubIFD
-		for fi, offset := range subIDFs.val {
-			if err = d.appendAndParseIDF(fi+1, int64(offset)); err != nil {
-				return nil, err
+		for _, offset := range subIDFs.val {
+			if err = d.appendAndParseIDF(int64(offset), d.byteOrder); err != nil {
+				return err
 			}
 		}
 	}
 
 	if d.format == fDNG {
-		// Find `Primary image`, the highest-resolution and quality IFD.
-		for _, features := range d.tree {
-			feature, ok := features[tNewSubFileType]
-			if ok && feature.val[0] == sftPrimaryImage {
-				// Add/overwrite features with the primary image matadata.
-				for k, v := range features {
-					d.features[k] = v
-				}
-				break
+		fi := d.primaryImage()
+		d.byteOrder = d.orders[fi] // Byte order of the raster
+		// Add/overwrite features with the primary image matadata.
+		for k, v := range d.tree[fi] {
+			if len(v.val) == 0 {
+				// Keep the value inherited from the main IDF (e.g. calibration tags).
+				continue
 			}
+			d.features[k] = v
 		}
 	}
 
 	return
 }
 
+// calibrationTags are the tags inherited from the main IFD by the SubIFDs which lack them,
+// the calibration of the sensor or of the luminance being often stored once in the main IFD.
+var calibrationTags = []uint16{
+	tStonits,
+	tColorMatrix1,
+	tColorMatrix2,
+	tCameraCalibration1,
+	tCameraCalibration2,
+	tAsShotNeutral,
+	tAsShotWhiteXY,
+	tCalibrationIlluminant1,
+	tCalibrationIlluminant2,
+}
+
+// sub returns a copy of d whose features are the ones of the IFD at index fi of the tree.
+// Only the calibrationTags absent from the IFD are inherited from the main IFD: the image is decoded
+// with its own calibration when it has one (e.g. the Stonits of each exposure of a bracketed stack).
+func (d *idf) sub(fi int) *idf {
+	features := d.tree[fi]
+	if fi != 0 {
+		features = make(map[uint16]tag, len(d.tree[fi]))
+		for k, v := range d.tree[fi] {
+			features[k] = v
+		}
+		for _, k := range calibrationTags {
+			if v, ok := d.tree[0][k]; ok && len(features[k].val) == 0 {
+				features[k] = v
+			}
+		}
+	}
+
+	return &idf{
+		r:         d.r,
+		byteOrder: d.orders[fi],
+		bigTIFF:   d.bigTIFF,
+		format:    d.format,
+		features:  features,
+		tree:      d.tree,
+		orders:    d.orders,
+		exif:      d.exif,
+		exifErr:   d.exifErr,
+		entryErr:  d.entryErr,
+	}
+}
+
+// primaryImage returns the index in the tree of the `Primary image`, the highest-resolution and quality IFD.
+// When no IFD is flagged as such, the largest one, transparency masks excluded, is used.
+func (d *idf) primaryImage() int {
+	for fi, features := range d.tree {
+		feature, ok := features[tNewSubFileType]
+		if ok && feature.firstVal() == sftPrimaryImage {
+			return fi
+		}
+	}
+
+	primary := 0
+	var largest uint
+	for fi, features := range d.tree {
+		if features[tNewSubFileType].firstVal()&sftTransMask != 0 {
+			continue
+		}
+		if size := features[tImageWidth].firstVal() * features[tImageLength].firstVal(); size > largest {
+			primary, largest = fi, size
+		}
+	}
+	return primary
+}
+
+// reducedResolutions returns the indexes in the tree of the reduced-resolution IFDs,
+// transparency masks excluded, by descending dimensions.
+func (d *idf) reducedResolutions() []int {
+	var levels []int
+	for fi, features := range d.tree {
+		if t := features[tNewSubFileType].firstVal(); t&sftThumbnail != 0 && t&sftTransMask == 0 {
+			levels = append(levels, fi)
+		}
+	}
+
+	size := func(fi int) uint {
+		return d.tree[fi][tImageWidth].firstVal() * d.tree[fi][tImageLength].firstVal()
+	}
+	sort.SliceStable(levels, func(i, j int) bool {
+		return size(levels[i]) > size(levels[j])
+	})
+	return levels
+}
+
 // firstVal is a convenient accessor of tag#firstVal().
 func (d *idf) firstVal(tag uint16) uint {
 	return d.features[tag].firstVal()
 }
 
-func (d *idf) appendAndParseIDF(fi int, ifdOffset int64) error {
-	d.tree = append(d.tree, make(map[uint16]tag)) // Append to `fi` index
+// appendAndParseIDF parses the IFD located at ifdOffset, whose entries are in byteOrder,
+// and appends it to the tree.
+func (d *idf) appendAndParseIDF(ifdOffset int64, byteOrder binary.ByteOrder) error {
+	features := make(map[uint16]tag)
+	if err := d.parseIDF(features, ifdOffset, byteOrder); err != nil {
+		return err
+	}
+	d.tree = append(d.tree, features)
+	d.orders = append(d.orders, byteOrder)
+	return nil
+}
+
+// parseIDF parses the IFD located at ifdOffset, whose entries are in byteOrder, into features.
+// The byte order usually is the file's one but foreign data (e.g. a MakerNote) may have its own.
+func (d *idf) parseIDF(features map[uint16]tag, ifdOffset int64, byteOrder binary.ByteOrder) error {
+	file := d
+	if byteOrder != d.byteOrder {
+		d = &idf{r: d.r, byteOrder: byteOrder, bigTIFF: d.bigTIFF, scan: d.scan}
+	}
+
 	p := make([]byte, 8)
 
 	// The first two bytes contain the number of entries (12 bytes each).
-	if _, err := d.r.ReadAt(p[0:2], ifdOffset); err != nil {
+	// BigTIFF: the first eight bytes contain the number of entries (20 bytes each).
+	countLen, entryLen, offsetLen := 2, ifdLen, 4
+	if d.bigTIFF {
+		countLen, entryLen, offsetLen = 8, bigIFDLen, 8
+	}
+	if _, err := d.r.ReadAt(p[0:countLen], ifdOffset); err != nil {
 		return err
 	}
-	numItems := int(d.byteOrder.Uint16(p[0:2]))
+	var numItems int
+	if d.bigTIFF {
+		n := d.byteOrder.Uint64(p)
+		if n > 0xFFFF {
+			return FormatError("too many IFD entries")
+		}
+		numItems = int(n)
+	} else {
+		numItems = int(d.byteOrder.Uint16(p[0:2]))
+	}
 
 	// All IFD entries are read in one chunk.
-	p = make([]byte, ifdLen*numItems)
-	if _, err := d.r.ReadAt(p, ifdOffset+2); err != nil {
+	p = make([]byte, entryLen*numItems)
+	if _, err := d.r.ReadAt(p, ifdOffset+int64(countLen)); err != nil {
 		return err
 	}
 
-	for i := 0; i < len(p); i += ifdLen {
-		if err := d.parseIFD(fi, p[i:i+ifdLen]); err != nil {
+	// The entries must be sorted by ascending tag. When a tag is duplicated, its first entry is kept
+	// and the next ones are ignored, like libtiff does.
+	seen := make(map[uint16]bool, numItems)
+	var previous uint16
+	for i := 0; i < len(p); i += entryLen {
+		tid := d.byteOrder.Uint16(p[i : i+2])
+		if i > 0 && tid <= previous && file.entryErr == nil {
+			file.entryErr = FormatError(fmt.Sprintf("IFD entry %d out of order after %d", tid, previous))
+			if tid == previous {
+				file.entryErr = FormatError(fmt.Sprintf("duplicate IFD entry %d", tid))
+			}
+		}
+		previous = tid
+		if seen[tid] {
+			continue
+		}
+		seen[tid] = true
+
+		if err := d.parseIFD(features, p[i:i+entryLen]); err != nil {
 			return err
 		}
 	}
 
+	// The offset of the next IFD, which ends the IFD, is not followed but it is read anyway so that
+	// the whole IFD is consumed from a buffered io.Reader (see DecodeN). A missing offset is tolerated.
+	d.r.ReadAt(make([]byte, offsetLen), ifdOffset+int64(countLen+len(p)))
+
 	return nil
 }
 
 // parseIFD decides whether the the IFD entry in p is "interesting" and
 // stows away the data in the decoder.
-func (d *idf) parseIFD(fi int, p []byte) error {
+func (d *idf) parseIFD(features map[uint16]tag, p []byte) error {
 	tid := d.byteOrder.Uint16(p[0:2]) // TagID
+	d.handleTag(p)
+	if d.scan != nil && !d.scan[tid] && tid != tSubIFDs && tid != tExifIFD {
+		return nil // Not requested by ScanTags
+	}
 	switch tid {
 	case tBitsPerSample,
 		tExtraSamples,
@@ -127,11 +313,23 @@ func (d *idf) parseIFD(fi int, p []byte) error {
 		tStripByteCounts,
 		tSamplesPerPixel,
 		tRowsPerStrip,
+		tMinSampleValue,
+		tMaxSampleValue,
 		tTileWidth,
 		tTileLength,
 		tTileOffsets,
 		tTileByteCounts,
 		tPlanarConfiguration,
+		tFillOrder,
+		tSoftware,
+		tDateTime,
+		tHostComputer,
+		tExifIFD,
+		tDateTimeOriginal,
+		tJPEGProc,
+		tJPEGInterchangeFormat,
+		tJPEGInterchangeFormatLength,
+		tJPEGTables,
 		tImageLength,
 		tImageWidth,
 		tStonits,
@@ -139,11 +337,16 @@ func (d *idf) parseIFD(fi int, p []byte) error {
 		tCFAPattern,
 		tDNGVersion,
 		tDNGBackwardVersion,
+		tUniqueCameraModel,
 		tCFAPlaneColor,
 		tCFALayout,
 		tLinearizationTable,
+		tBlackLevelRepeatDim,
 		tBlackLevel,
 		tWhiteLevel,
+		tDefaultCropOrigin,
+		tDefaultCropSize,
+		tDefaultUserCrop,
 		tColorMatrix1,
 		tColorMatrix2,
 		tCameraCalibration1,
@@ -151,14 +354,27 @@ func (d *idf) parseIFD(fi int, p []byte) error {
 		tReductionMatrix1,
 		tReductionMatrix2,
 		tAsShotNeutral,
+		tAsShotWhiteXY,
 		tBaselineExposure,
 		tCalibrationIlluminant1,
-		tCalibrationIlluminant2:
+		tCalibrationIlluminant2,
+		tMaskedAreas,
+		tPreviewColorSpace,
+		tRawImageDigest,
+		tDefaultBlackRender,
+		tNewRawImageDigest,
+		tRawToPreviewGain,
+		tDepthFormat,
+		tDepthNear,
+		tDepthFar,
+		tDepthUnits,
+		tDepthMeasureType,
+		tEnhanceParams:
 		val, dt, err := d.ifdUint(p)
 		if err != nil {
 			return err
 		}
-		d.tree[fi][tid] = tag{
+		features[tid] = tag{
 			id:       tid,
 			datatype: dt,
 			val:      val,
@@ -169,61 +385,81 @@ func (d *idf) parseIFD(fi int, p []byte) error {
 		// the value is not 1 [= unsigned integer data], a Baseline
 		// TIFF reader that cannot handle the SampleFormat value
 		// must terminate the import process gracefully.
-		val, _, err := d.ifdUint(p)
+		// The values are checked by the decoder according to the image mode.
+		val, dt, err := d.ifdUint(p)
 		if err != nil {
 			return err
 		}
-		for _, v := range val {
-			if v == 1 {
-				// tSampleFormat == 2 for LogLuv/LogL with bpp == 16
-				// tSampleFormat == 3 only when bpp == 32
-				return UnsupportedError("sample format")
-			}
+		features[tid] = tag{
+			id:       tid,
+			datatype: dt,
+			val:      val,
+		}
+	default:
+		if !d.scan[tid] {
+			// fmt.Println(tid, "-", p)
+			return nil
+		}
+		// Tag unknown by the decoder, requested by ScanTags.
+		val, dt, err := d.ifdUint(p)
+		if err != nil {
+			return err
+		}
+		features[tid] = tag{
+			id:       tid,
+			datatype: dt,
+			val:      val,
 		}
-		// default:
-		// 	fmt.Println(tid, "-", p)
 	}
 	return nil
 }
 
-// ifdUint decodes the IFD entry in p, which must be of the Byte, Short
-// or Long type, and returns the decoded uint values and their datatype.
-func (d *idf) ifdUint(p []byte) (u []uint, dt uint, err error) {
-	var raw []byte
-	datatype := d.byteOrder.Uint16(p[2:4])
-	count := d.byteOrder.Uint32(p[4:8])
-	if datalen := lengths[datatype] * count; datalen > 4 {
-		// The IFD contains a pointer to the real value.
-		raw = make([]byte, datalen)
-		_, err = d.r.ReadAt(raw, int64(d.byteOrder.Uint32(p[8:12])))
-	} else {
-		raw = p[8 : 8+datalen]
-	}
+// ifdUint decodes the IFD entry in p and returns the decoded uint values and their datatype.
+// ASCII values are stored byte by byte, the signed integers sign-extended to 64 bits
+// and the floats as their IEEE 754 bits.
+func (d *idf) ifdUint(p []byte) (u []uint64, dt uint, err error) {
+	raw, datatype, count, err := d.ifdRaw(p)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	u = make([]uint, count)
+	u = make([]uint64, count)
 	switch datatype {
-	case dtByte:
-		for i := uint32(0); i < count; i++ {
-			u[i] = uint(raw[i])
+	case dtByte, dtASCII, dtUndefined:
+		for i := uint64(0); i < count; i++ {
+			u[i] = uint64(raw[i])
+		}
+	case dtSByte:
+		for i := uint64(0); i < count; i++ {
+			u[i] = uint64(int8(raw[i]))
 		}
 	case dtShort:
-		for i := uint32(0); i < count; i++ {
-			u[i] = uint(d.byteOrder.Uint16(raw[2*i : 2*(i+1)]))
+		for i := uint64(0); i < count; i++ {
+			u[i] = uint64(d.byteOrder.Uint16(raw[2*i : 2*(i+1)]))
+		}
+	case dtSShort:
+		for i := uint64(0); i < count; i++ {
+			u[i] = uint64(int16(d.byteOrder.Uint16(raw[2*i : 2*(i+1)])))
+		}
+	case dtLong, dtIFD, dtFloat:
+		for i := uint64(0); i < count; i++ {
+			u[i] = uint64(d.byteOrder.Uint32(raw[4*i : 4*(i+1)]))
 		}
-	case dtLong:
-		for i := uint32(0); i < count; i++ {
-			u[i] = uint(d.byteOrder.Uint32(raw[4*i : 4*(i+1)]))
+	case dtSLong:
+		for i := uint64(0); i < count; i++ {
+			u[i] = uint64(int32(d.byteOrder.Uint32(raw[4*i : 4*(i+1)])))
 		}
-	case dtRational:
-		fallthrough
-	case dtSRational:
-		fallthrough
-	case dtDouble:
-		for i := uint32(0); i < count; i++ {
-			u[i] = uint(d.byteOrder.Uint64(raw[8*i : 8*(i+1)]))
+	case dtRational, dtSRational:
+		// The numerator is kept in the low 32 bits and the denominator in the high ones,
+		// whatever the byte order of the file.
+		for i := uint64(0); i < count; i++ {
+			num := d.byteOrder.Uint32(raw[8*i : 8*i+4])
+			denom := d.byteOrder.Uint32(raw[8*i+4 : 8*(i+1)])
+			u[i] = uint64(denom)<<32 | uint64(num)
+		}
+	case dtDouble, dtLong8, dtSLong8, dtIFD8:
+		for i := uint64(0); i < count; i++ {
+			u[i] = d.byteOrder.Uint64(raw[8*i : 8*(i+1)])
 
 			// var v float64
 			// binary.Read(bytes.NewBuffer(raw[8*i:8*(i+1)]), d.byteOrder, &v)
@@ -235,6 +471,68 @@ func (d *idf) ifdUint(p []byte) (u []uint, dt uint, err error) {
 	return u, uint(datatype), nil
 }
 
+// ifdRaw returns the raw bytes of the value of the IFD entry in p, read from the file when they do not
+// fit in the entry, along with their datatype and their count.
+func (d *idf) ifdRaw(p []byte) (raw []byte, datatype uint16, count uint64, err error) {
+	datatype = d.byteOrder.Uint16(p[2:4])
+	if int(datatype) >= len(lengths) || lengths[datatype] == 0 {
+		// 0, 14 and 15 are not defined.
+		return nil, 0, 0, UnsupportedError("data type")
+	}
+
+	// The count is followed by the value, or a pointer to it, which is 4 bytes wide
+	// or 8 bytes wide in BigTIFF.
+	var value []byte
+	if d.bigTIFF {
+		count = d.byteOrder.Uint64(p[4:12])
+		value = p[12:20]
+	} else {
+		count = uint64(d.byteOrder.Uint32(p[4:8]))
+		value = p[8:12]
+	}
+	if count > math.MaxInt32 {
+		return nil, 0, 0, FormatError("tag count")
+	}
+
+	if datalen := uint64(lengths[datatype]) * count; datalen > uint64(len(value)) {
+		// The IFD contains a pointer to the real value.
+		offset := uint64(d.byteOrder.Uint32(value))
+		if d.bigTIFF {
+			offset = d.byteOrder.Uint64(value)
+		}
+		if raw, err = readChunks(d.r, int64(offset), datalen); err != nil {
+			return nil, 0, 0, err
+		}
+	} else {
+		raw = value[:datalen]
+	}
+	return raw, datatype, count, nil
+}
+
+// readChunks reads the n bytes of r at offset by chunks, so that the memory allocated for a corrupted count
+// is bounded by the size of the file.
+func readChunks(r io.ReaderAt, offset int64, n uint64) ([]byte, error) {
+	const chunkSize = 64 * 1024
+
+	var p []byte
+	for uint64(len(p)) < n {
+		m := chunkSize
+		if rest := n - uint64(len(p)); rest < chunkSize {
+			m = int(rest)
+		}
+		off := len(p)
+		p = append(p, make([]byte, m)...)
+		k, err := r.ReadAt(p[off:], offset+int64(off))
+		if k < m || (err != nil && err != io.EOF) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
 func (d *idf) String() string {
 	buf := bytes.NewBufferString("")
 	switch d.format {
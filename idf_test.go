@@ -0,0 +1,322 @@
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/big"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIDFPrimaryImageInheritance(t *testing.T) {
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		primary := newTIFFBuilder(byteOrder).
+			add(tNewSubFileType, dtLong, sftPrimaryImage).
+			add(tImageWidth, dtShort, 4).
+			add(tImageLength, dtShort, 2).
+			add(tStonits, dtDouble) // Defined without value
+
+		data := newTIFFBuilder(byteOrder).
+			add(tNewSubFileType, dtLong, sftThumbnail).
+			add(tImageWidth, dtShort, 1).
+			add(tImageLength, dtShort, 1).
+			add(tDNGVersion, dtByte, 1, 4, 0, 0).
+			add(tStonits, dtDouble, math.Float64bits(2.5)).
+			add(tBaselineExposure, dtSRational, 1, 2).
+			subIFDs(primary).
+			bytes()
+
+		d, err := newIDF(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.Equal(t, fDNG, d.format)
+
+		// Primary image values
+		assert.Equal(t, uint(sftPrimaryImage), d.firstVal(tNewSubFileType))
+		assert.Equal(t, uint(4), d.firstVal(tImageWidth))
+		assert.Equal(t, uint(2), d.firstVal(tImageLength))
+
+		// Inherited values
+		assert.Equal(t, 2.5, d.features[tStonits].double(0))
+		assert.Contains(t, d.features, uint16(tBaselineExposure))
+	}
+}
+
+func TestNewIDFPrimaryImageFallback(t *testing.T) {
+	full := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 4).
+		add(tImageLength, dtShort, 2)
+	preview := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 1)
+	mask := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftTransMask).
+		add(tImageWidth, dtShort, 8).
+		add(tImageLength, dtShort, 4)
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tDNGVersion, dtByte, 1, 4, 0, 0).
+		subIFDs(preview, full, mask).
+		bytes()
+
+	d, err := newIDF(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, d.primaryImage())
+	assert.Equal(t, uint(4), d.firstVal(tImageWidth))
+	assert.Equal(t, uint(2), d.firstVal(tImageLength))
+}
+
+func TestIDFByteOrderOverride(t *testing.T) {
+	strip := make([]byte, 3*2)
+	for i := 0; i < 3; i++ {
+		binary.BigEndian.PutUint16(strip[2*i:], uint16(0x3f00+i*64))
+	}
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, 3).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 16).
+		add(tPhotometricInterpretation, dtShort, pLogL).
+		strips(strip).
+		bytes()
+	offset := int64(binary.BigEndian.Uint32(data[4:8]))
+
+	// Little-endian file embedding a big-endian IFD
+	d := &idf{r: bytes.NewReader(data), byteOrder: binary.LittleEndian}
+	assert.NoError(t, d.appendAndParseIDF(offset, binary.BigEndian))
+	assert.Equal(t, uint(3), d.tree[0][tImageWidth].firstVal())
+	assert.Equal(t, binary.LittleEndian, d.byteOrder)
+
+	sub := d.sub(0)
+	assert.Equal(t, binary.BigEndian, sub.byteOrder)
+	dec, err := newIDFDecoder(sub)
+	assert.NoError(t, err)
+	m, err := dec.readImage()
+	assert.NoError(t, err)
+	expected, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m)
+
+	// The IFD cannot be read in the file's byte order.
+	assert.Error(t, d.appendAndParseIDF(offset, d.byteOrder))
+}
+
+func TestBigTIFF(t *testing.T) {
+	const width, height = 3, 2
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		raw := make([]byte, width*height*12)
+		for i := 0; i < width*height*3; i++ {
+			byteOrder.PutUint32(raw[4*i:], math.Float32bits(float32(i)/4))
+		}
+		var strip bytes.Buffer
+		zw := zlib.NewWriter(&strip)
+		zw.Write(raw)
+		zw.Close()
+
+		newBuilder := func() *tiffBuilder {
+			return newTIFFBuilder(byteOrder).
+				add(tImageWidth, dtLong, width).
+				add(tImageLength, dtLong, height).
+				add(tBitsPerSample, dtShort, 32, 32, 32). // Inline in BigTIFF only
+				add(tCompression, dtShort, cDeflate).
+				add(tPhotometricInterpretation, dtShort, pRGB).
+				add(tSamplesPerPixel, dtShort, 3).
+				add(tSampleFormat, dtShort, sfIEEEFP, sfIEEEFP, sfIEEEFP).
+				add(tStonits, dtDouble, math.Float64bits(2.5)). // Inline in BigTIFF only
+				add(tUniqueCameraModel, dtASCII, ascii("Camera model")...).
+				strips(strip.Bytes())
+		}
+
+		classic, err := Decode(bytes.NewReader(newBuilder().bytes()))
+		assert.NoError(t, err)
+
+		data := newBuilder().big().bytes()
+		d, err := newIDF(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.True(t, d.bigTIFF)
+		assert.Equal(t, []uint64{32, 32, 32}, d.features[tBitsPerSample].val)
+		assert.Equal(t, 2.5, d.features[tStonits].double(0))
+		assert.Equal(t, "Camera model", d.features[tUniqueCameraModel].ascii())
+		assert.Equal(t, uint(dtLong8), d.features[tStripOffsets].datatype)
+
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err, "%v", byteOrder)
+		assert.Equal(t, classic, m)
+
+		// The bytesize of the offsets must be 8.
+		byteOrder.PutUint16(data[4:6], 4)
+		_, err = newIDF(bytes.NewReader(data))
+		assert.Error(t, err)
+	}
+}
+
+func TestIDFEntryOrder(t *testing.T) {
+	newData := func() []byte {
+		return newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, 2).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 16).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tSoftware, dtASCII, ascii("first")...).
+			add(tHostComputer, dtASCII, ascii("second")...).
+			strips(append(logluvPixel(0, 0), logluvPixel(1, 0)...)).
+			bytes()
+	}
+	// entry returns the offset of the entry of the IFD0 holding the tag.
+	entry := func(data []byte, tid uint16) int {
+		ifd := int(binary.LittleEndian.Uint32(data[4:]))
+		for i := ifd + 2; ; i += ifdLen {
+			if binary.LittleEndian.Uint16(data[i:]) == tid {
+				return i
+			}
+		}
+	}
+
+	data := newData()
+	d, err := newDecoder(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, d.entryErr)
+
+	// Duplicated Software, the first entry is kept.
+	data = newData()
+	binary.LittleEndian.PutUint16(data[entry(data, tHostComputer):], tSoftware)
+	m, err := ReadMetadata(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", m.Software())
+	_, err = Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	_, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: true})
+	assert.EqualError(t, err, "tiff: invalid format: duplicate IFD entry 305")
+
+	// Swapped ImageWidth and ImageLength entries.
+	data = newData()
+	w, l := entry(data, tImageWidth), entry(data, tImageLength)
+	width := append([]byte(nil), data[w:w+ifdLen]...)
+	copy(data[w:], data[l:l+ifdLen])
+	copy(data[l:], width)
+	_, err = Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	_, err = DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{Strict: true})
+	assert.EqualError(t, err, "tiff: invalid format: IFD entry 256 out of order after 257")
+}
+
+func TestIDFEntryCount(t *testing.T) {
+	newData := func() ([]byte, int) {
+		data := newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, 2).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 16).
+			add(tPhotometricInterpretation, dtShort, pLogLuv).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tSoftware, dtASCII, ascii("software")...).
+			strips(append(logluvPixel(0, 0), logluvPixel(1, 0)...)).
+			bytes()
+		ifd := int(binary.LittleEndian.Uint32(data[4:]))
+		for i := ifd + 2; ; i += ifdLen {
+			if binary.LittleEndian.Uint16(data[i:]) == tSoftware {
+				return data, i
+			}
+		}
+	}
+
+	// The allocation for a count beyond the end of the file is bounded by the size of the file.
+	data, i := newData()
+	binary.LittleEndian.PutUint32(data[i+4:], math.MaxInt32)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := Decode(bytes.NewReader(data))
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+	_, err = Decode(iotest.HalfReader(bytes.NewReader(data))) // Not an io.ReaderAt
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// The undefined data types are rejected instead of being read as empty values.
+	for _, datatype := range []uint16{0, 14, 15, 19} {
+		data, i = newData()
+		binary.LittleEndian.PutUint16(data[i+2:], datatype)
+		_, err = Decode(bytes.NewReader(data))
+		assert.Equal(t, UnsupportedError("data type"), err, datatype)
+	}
+}
+
+func TestIDFSignedRationals(t *testing.T) {
+	// ColorMatrix1 of a Canon EOS 5D Mark II, its 9 SRationals (72 bytes) are stored out of the entry.
+	matrix := [][2]int32{
+		{4716, 10000}, {603, 10000}, {-830, 10000},
+		{-7798, 10000}, {15474, 10000}, {2480, 10000},
+		{-1496, 10000}, {1937, 10000}, {6651, 10000},
+	}
+	var val []uint64
+	for _, r := range matrix {
+		val = append(val, uint64(uint32(r[0])), uint64(uint32(r[1])))
+	}
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, 1).
+			add(tImageLength, dtShort, 1).
+			add(tColorMatrix1, dtSRational, val...).
+			add(tAsShotNeutral, dtRational, 1, 2, 3000000000, 4000000000, 5, 8).
+			bytes()
+
+		d, err := newIDF(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		cm := d.features[tColorMatrix1]
+		assert.Equal(t, uint(dtSRational), cm.datatype)
+		assert.Len(t, cm.val, 9)
+		for i, r := range matrix {
+			assert.Equal(t, big.NewRat(int64(r[0]), int64(r[1])), cm.sRational(i), "%v entry %d", byteOrder, i)
+			assert.Equal(t, float64(r[0])/float64(r[1]), cm.asFloat(i), "%v entry %d", byteOrder, i)
+		}
+
+		// The unsigned terms do not overflow.
+		neutral := d.features[tAsShotNeutral]
+		assert.Equal(t, big.NewRat(1, 2), neutral.rational(0), byteOrder)
+		assert.Equal(t, big.NewRat(3, 4), neutral.rational(1), byteOrder)
+		assert.Equal(t, 0.625, neutral.asFloat(2), byteOrder)
+	}
+}
+
+func TestIDFSubCalibration(t *testing.T) {
+	newIFD := func() *tiffBuilder {
+		return newTIFFBuilder(binary.LittleEndian).
+			add(tImageWidth, dtShort, 1).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 16).
+			add(tPhotometricInterpretation, dtShort, pLogL).
+			strips([]byte{0x00, 0x3f})
+	}
+	// The Stonits and the color matrix are only in the parent IFD.
+	data := newIFD().
+		add(tStonits, dtDouble, math.Float64bits(4)).
+		add(tColorMatrix1, dtSRational, 1, 2, 3, 4).
+		subIFDs(newIFD().add(tNewSubFileType, dtLong, sftThumbnail)).
+		bytes()
+
+	d, err := newIDF(bytes.NewReader(data))
+	assert.NoError(t, err)
+	sub := d.sub(1)
+	assert.Equal(t, 4.0, sub.features[tStonits].asFloat(0))
+	assert.Equal(t, d.tree[0][tColorMatrix1], sub.features[tColorMatrix1])
+	// The tree is left untouched.
+	_, ok := d.tree[1][tStonits]
+	assert.False(t, ok)
+
+	m, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	level, err := DecodeLevel(bytes.NewReader(data), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, m, level)
+}
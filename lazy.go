@@ -0,0 +1,133 @@
+package tiff
+
+import (
+	"container/list"
+	"image"
+	"image/color"
+	"io"
+	"sync"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// A LazyImage is an hdr.Image whose strips or tiles are decoded on pixel access, like DecodeBlock,
+// the most recently used blocks being cached. It suits the sparse sampling of images too large
+// to be decoded at once. It is safe for concurrent use, the blocks being decoded one at a time.
+type LazyImage struct {
+	mu        sync.Mutex
+	d         *decoder
+	l         *blockLayout
+	empty     hdr.Image // Zero pixels, returned out of bounds and in place of the faulty blocks
+	cacheSize int
+	cache     map[int]*list.Element // Cached blocks by index
+	lru       *list.List            // Cached blocks, the most recently used first
+	err       error
+}
+
+type lazyBlock struct {
+	k int
+	m hdr.Image
+}
+
+// NewLazyImage reads the header of the size bytes of r and returns the lazily decoded image.
+// Up to cacheSize decoded blocks, at least one, are kept in memory.
+func NewLazyImage(r io.ReaderAt, size int64, cacheSize int) (*LazyImage, error) {
+	d, err := newDecoder(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if d.compression == cJPEGOld {
+		return nil, UnsupportedError("lazy decoding of old-style JPEG")
+	}
+
+	l, err := d.layout()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkLimits(l.bounds(0), l); err != nil {
+		return nil, err
+	}
+	empty, err := d.newImage(image.Rectangle{})
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheSize < 1 {
+		cacheSize = 1
+	}
+	return &LazyImage{
+		d:         d,
+		l:         l,
+		empty:     empty.(hdr.Image),
+		cacheSize: cacheSize,
+		cache:     make(map[int]*list.Element, cacheSize),
+		lru:       list.New(),
+	}, nil
+}
+
+// ColorModel returns the Image's color model.
+func (m *LazyImage) ColorModel() color.Model {
+	return m.d.config.ColorModel
+}
+
+// Bounds returns the domain for which At can return non-zero color.
+func (m *LazyImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, m.d.config.Width, m.d.config.Height)
+}
+
+// Size returns the number of pixels.
+func (m *LazyImage) Size() int {
+	return m.d.config.Width * m.d.config.Height
+}
+
+// At returns the color of the pixel at (x, y).
+func (m *LazyImage) At(x, y int) color.Color {
+	return m.HDRAt(x, y)
+}
+
+// HDRAt returns the HDR color of the pixel at (x, y), decoding its strip or tile if it is not cached.
+// The pixels of the blocks that cannot be decoded are zero, see Err.
+func (m *LazyImage) HDRAt(x, y int) hdrcolor.Color {
+	if !(image.Point{x, y}.In(m.Bounds())) {
+		return m.empty.HDRAt(x, y)
+	}
+	return m.block(x/m.l.width+(y/m.l.height)*m.l.across).HDRAt(x, y)
+}
+
+// Err returns the error of the first block that could not be decoded, if any.
+func (m *LazyImage) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// block returns the k-th decoded block, from the cache when possible.
+func (m *LazyImage) block(k int) hdr.Image {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.cache[k]; ok {
+		m.lru.MoveToFront(e)
+		return e.Value.(*lazyBlock).m
+	}
+
+	b := &lazyBlock{k: k, m: m.empty}
+	dst, err := m.d.newImage(m.l.bounds(k).Intersect(m.Bounds()))
+	if err == nil {
+		err = m.d.readBlock(dst, m.l, k)
+	}
+	if err == nil {
+		b.m = dst.(hdr.Image)
+	} else if m.err == nil {
+		m.err = err
+	}
+
+	m.cache[k] = m.lru.PushFront(b)
+	if m.lru.Len() > m.cacheSize {
+		e := m.lru.Back()
+		m.lru.Remove(e)
+		delete(m.cache, e.Value.(*lazyBlock).k)
+	}
+	return b.m
+}
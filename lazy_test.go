@@ -0,0 +1,79 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"sync"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyImage(t *testing.T) {
+	const width, height, tileSize = 5, 3, 2
+
+	var tiles [][]byte
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tile := make([]byte, 0, tileSize*tileSize*4)
+			for y := ty; y < ty+tileSize; y++ {
+				for x := tx; x < tx+tileSize; x++ {
+					tile = append(tile, logluvPixel(x, y)...)
+				}
+			}
+			tiles = append(tiles, rle(tile, 4, tileSize, tileSize))
+		}
+	}
+
+	b := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cSGILogRLE).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tTileWidth, dtShort, tileSize).
+		add(tTileLength, dtShort, tileSize).
+		tiles(tiles...)
+	data := b.bytes()
+
+	expected, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	m, err := NewLazyImage(bytes.NewReader(data), int64(len(data)), 2)
+	assert.NoError(t, err)
+	assert.Implements(t, (*hdr.Image)(nil), m)
+	assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+	assert.Equal(t, expected.ColorModel(), m.ColorModel())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					assert.Equal(t, expected.(hdr.Image).HDRAt(x, y), m.HDRAt(x, y), "pixel (%d,%d)", x, y)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, m.Err())
+	assert.Equal(t, 2, m.lru.Len())
+	assert.Len(t, m.cache, 2)
+
+	// Out of bounds
+	assert.Equal(t, m.empty.HDRAt(0, 0), m.HDRAt(width, 0))
+
+	// The faulty blocks are zero.
+	tiles[1] = tiles[1][:1]
+	data = b.tiles(tiles...).bytes()
+	m, err = NewLazyImage(bytes.NewReader(data), int64(len(data)), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.(hdr.Image).HDRAt(0, 0), m.HDRAt(0, 0))
+	assert.Equal(t, m.empty.HDRAt(0, 0), m.HDRAt(2, 0))
+	assert.Error(t, m.Err())
+}
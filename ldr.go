@@ -0,0 +1,182 @@
+package tiff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+	"github.com/mdouchement/hdr/tmo"
+)
+
+// A ToneMapper returns the tone mapping operator used to convert m to a displayable image.
+type ToneMapper func(m hdr.Image) tmo.ToneMappingOperator
+
+// ldrToneMapping holds the settings of SetLDRToneMapping.
+type ldrToneMapping struct {
+	tm       ToneMapper
+	exposure float64
+}
+
+var (
+	ldrMu       sync.RWMutex
+	ldrSettings ldrToneMapping
+)
+
+// currentLDRToneMapping returns the settings of SetLDRToneMapping, read once per decoding
+// so that a concurrent call does not alter a decoding in progress.
+func currentLDRToneMapping() ldrToneMapping {
+	ldrMu.RLock()
+	defer ldrMu.RUnlock()
+	return ldrSettings
+}
+
+// SetLDRToneMapping sets the tone mapping operator and the exposure, in stops, applied by DecodeLDR.
+//
+// When tm is not nil, the decoder registered in the image package also returns tone mapped *image.RGBA,
+// so that image.Decode yields an image that can be drawn instead of an hdr.Image.
+// A nil tm restores the default behaviour: image.Decode returns an hdr.Image and DecodeLDR uses Reinhard05.
+// The image package selects a format by its magic number in registration order,
+// that is why the LDR decoding is not registered under its own format name.
+//
+// It is safe to call SetLDRToneMapping concurrently with decoding, the decodings in progress
+// keep the settings they started with.
+func SetLDRToneMapping(tm ToneMapper, exposure float64) {
+	ldrMu.Lock()
+	defer ldrMu.Unlock()
+	ldrSettings = ldrToneMapping{tm: tm, exposure: exposure}
+}
+
+// DecodeLDR reads a TIFF image from r and returns it tone mapped as an *image.RGBA.
+// The tone mapping is configured with SetLDRToneMapping.
+func DecodeLDR(r io.Reader) (*image.RGBA, error) {
+	return decodeLDR(r, currentLDRToneMapping())
+}
+
+func decodeLDR(r io.Reader, s ldrToneMapping) (*image.RGBA, error) {
+	m, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return toneMap(m.(hdr.Image), s), nil
+}
+
+// DecodeSRGB reads a TIFF image from r, decoded according to opts, and returns a display-referred 8-bit
+// sRGB rendition of it, e.g. to be encoded as a JPEG. It is lossy: the dynamic range is compressed and the
+// values are quantized, use Decode to process the scene-referred values.
+//
+// The colors are converted to linear sRGB, the CFA being decoded with CFAOutputLinearSRGB and the XYZ
+// values being relative to D65. They are then tone mapped by the operator set with SetLDRToneMapping,
+// which performs its own encoding, or by default, scaled by the exposure set with SetLDRToneMapping,
+// compressed by the global Reinhard curve v/(1+v) and gamma encoded with the sRGB transfer function.
+func DecodeSRGB(r io.Reader, opts *DecodeOptions) (*image.RGBA, error) {
+	var o DecodeOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.CFAOutput = CFAOutputLinearSRGB
+	s := currentLDRToneMapping()
+
+	m, err := DecodeWithOptions(r, &o)
+	if err != nil {
+		return nil, err
+	}
+	linear := linearSRGB(m.(hdr.Image))
+
+	if s.tm != nil {
+		return toneMap(linear, s), nil
+	}
+	if s.exposure != 0 {
+		linear = expose(linear, s.exposure)
+	}
+
+	encode := func(v float64) uint8 {
+		v = math.Max(v, 0)
+		return uint8(math.Round(255 * linearToSRGB(v/(1+v))))
+	}
+	b := linear.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, _ := linear.HDRAt(x, y).HDRRGBA()
+			dst.SetRGBA(x, y, color.RGBA{R: encode(r), G: encode(g), B: encode(b), A: 0xff})
+		}
+	}
+	return dst, nil
+}
+
+// linearSRGB returns m with its XYZ values, if any, converted to linear sRGB.
+func linearSRGB(m hdr.Image) hdr.Image {
+	xyz, ok := m.(*hdr.XYZ)
+	if !ok {
+		return m
+	}
+
+	xyzToSRGB, _ := sRGBToXYZ.inverse()
+	b := xyz.Bounds()
+	dst := hdr.NewRGB(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := xyz.XYZAt(x, y)
+			r, g, b := xyzToSRGB.apply(c.X, c.Y, c.Z)
+			dst.SetRGB(x, y, hdrcolor.RGB{R: r, G: g, B: b})
+		}
+	}
+	return dst
+}
+
+// toneMap converts m to an *image.RGBA according to the settings s of SetLDRToneMapping.
+func toneMap(m hdr.Image, s ldrToneMapping) *image.RGBA {
+	if s.exposure != 0 {
+		m = expose(m, s.exposure)
+	}
+
+	tm := s.tm
+	if tm == nil {
+		tm = func(m hdr.Image) tmo.ToneMappingOperator {
+			return tmo.NewDefaultReinhard05(m)
+		}
+	}
+	ldr := tm(m).Perform()
+
+	dst := image.NewRGBA(ldr.Bounds())
+	draw.Draw(dst, dst.Bounds(), ldr, ldr.Bounds().Min, draw.Src)
+	return dst
+}
+
+// expose returns a copy of m with its values scaled by 2^stops.
+func expose(m hdr.Image, stops float64) hdr.Image {
+	scale := math.Exp2(stops)
+	b := m.Bounds()
+	dst := hdr.NewRGB(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, _ := m.HDRAt(x, y).HDRRGBA()
+			dst.SetRGB(x, y, hdrcolor.RGB{R: r * scale, G: g * scale, B: b * scale})
+		}
+	}
+	return dst
+}
+
+//------------------------//
+// image package          //
+//------------------------//
+
+func registeredDecode(r io.Reader) (image.Image, error) {
+	if s := currentLDRToneMapping(); s.tm != nil {
+		return decodeLDR(r, s)
+	}
+	return Decode(r)
+}
+
+func registeredDecodeConfig(r io.Reader) (image.Config, error) {
+	c, err := DecodeConfig(r)
+	if err == nil && currentLDRToneMapping().tm != nil {
+		c.ColorModel = color.RGBAModel
+	}
+	return c, err
+}
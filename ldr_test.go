@@ -0,0 +1,107 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/tmo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLDR(t *testing.T) {
+	const width, height = 2, 2
+
+	strip := make([]byte, width*height*12)
+	for i := 0; i < width*height*3; i++ {
+		binary.LittleEndian.PutUint32(strip[4*i:], math.Float32bits(float32(i)/4))
+	}
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, 3, 3, 3).
+		strips(strip).
+		bytes()
+
+	m, err := DecodeLDR(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+
+	// Registered decoder
+	m2, name, err := image.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "tiff", name)
+	assert.Implements(t, (*hdr.Image)(nil), m2)
+
+	SetLDRToneMapping(func(m hdr.Image) tmo.ToneMappingOperator { return tmo.NewLinear(m) }, 1)
+	defer SetLDRToneMapping(nil, 0)
+
+	m2, _, err = image.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.IsType(t, &image.RGBA{}, m2)
+	c, _, err := image.DecodeConfig(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBAModel, c.ColorModel)
+}
+
+func TestSetLDRToneMappingConcurrently(t *testing.T) {
+	defer SetLDRToneMapping(nil, 0)
+	data := cfaImage(4, 4).bytes()
+	linear := func(m hdr.Image) tmo.ToneMappingOperator { return tmo.NewLinear(m) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			SetLDRToneMapping(linear, float64(i))
+		}(i)
+		go func() {
+			defer wg.Done()
+			m, _, err := image.Decode(bytes.NewReader(data))
+			assert.NoError(t, err)
+			assert.Equal(t, image.Rect(0, 0, 4, 4), m.Bounds())
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDecodeSRGB(t *testing.T) {
+	strip := make([]byte, 2*12)
+	for i, v := range []float32{0, 0.25, 1, 3, 0.0001, 1e6} {
+		binary.LittleEndian.PutUint32(strip[4*i:], math.Float32bits(v))
+	}
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, 3, 3, 3).
+		strips(strip).
+		bytes()
+
+	m, err := DecodeSRGB(bytes.NewReader(data), nil)
+	assert.NoError(t, err)
+	// 0.25 -> 0.2 -> 124, 1 -> 0.5 -> 188, 3 -> 0.75 -> 225
+	assert.Equal(t, color.RGBA{R: 0, G: 124, B: 188, A: 0xff}, m.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{R: 225, G: 0, B: 255, A: 0xff}, m.RGBAAt(1, 0))
+
+	// The XYZ values are converted to sRGB.
+	m2, err := DecodeSRGB(bytes.NewReader(cfaImage(4, 4).bytes()), &DecodeOptions{OutputWhitePoint: D50})
+	assert.NoError(t, err)
+	ref, err := Decode(bytes.NewReader(cfaImage(4, 4).bytes()))
+	assert.NoError(t, err)
+	X, Y, Z, _ := ref.(hdr.Image).HDRAt(1, 1).HDRXYZA()
+	xyzToSRGB, _ := sRGBToXYZ.inverse()
+	r, _, _ := xyzToSRGB.apply(X, Y, Z)
+	assert.Equal(t, uint8(math.Round(255*linearToSRGB(r/(1+r)))), m2.RGBAAt(1, 1).R)
+}
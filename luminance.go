@@ -0,0 +1,123 @@
+package tiff
+
+import (
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// A Luminance is an HDR image holding only the Y luminance of each pixel, in a third of the memory
+// of an hdr.RGB. Its pixels are gray XYZ colors whose X and Z equal Y, like the decoded LogL images.
+type Luminance struct {
+	// Pix holds the luminance of the pixels, row by row.
+	Pix []float32
+	// Stride is the Pix stride between vertically adjacent pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+}
+
+// NewLuminance returns a new Luminance image with the given bounds.
+func NewLuminance(r image.Rectangle) *Luminance {
+	return &Luminance{
+		Pix:    make([]float32, r.Dx()*r.Dy()),
+		Stride: r.Dx(),
+		Rect:   r,
+	}
+}
+
+// ColorModel returns the Image's color model.
+func (p *Luminance) ColorModel() color.Model {
+	return hdrcolor.XYZModel
+}
+
+// Bounds returns the domain for which At can return non-zero color.
+func (p *Luminance) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+// Size returns the number of pixels.
+func (p *Luminance) Size() int {
+	return p.Rect.Dx() * p.Rect.Dy()
+}
+
+// At returns the color of the pixel at (x, y).
+func (p *Luminance) At(x, y int) color.Color {
+	return p.HDRAt(x, y)
+}
+
+// HDRAt returns the HDR color of the pixel at (x, y).
+func (p *Luminance) HDRAt(x, y int) hdrcolor.Color {
+	Y := p.YAt(x, y)
+	return hdrcolor.XYZ{X: Y, Y: Y, Z: Y}
+}
+
+// YAt returns the luminance of the pixel at (x, y).
+func (p *Luminance) YAt(x, y int) float64 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return float64(p.Pix[p.PixOffset(x, y)])
+}
+
+// SetY sets the luminance of the pixel at (x, y).
+func (p *Luminance) SetY(x, y int, Y float64) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = float32(Y)
+}
+
+// PixOffset returns the index of the element of Pix that corresponds to the pixel at (x, y).
+func (p *Luminance) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// DecodeLuminance reads an RGB TIFF image from r and returns its luminance,
+// Y = 0.2126 R + 0.7152 G + 0.0722 B, e.g. for the histograms of an exposure analysis.
+// The strips or tiles are decoded one at a time so that the RGB image is never held in memory.
+func DecodeLuminance(r io.Reader) (*Luminance, error) {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	if d.mode != mRGB || d.compression == cJPEGOld {
+		return nil, UnsupportedError("luminance of an image other than RGB")
+	}
+
+	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+	l, err := d.layout()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkLimits(bounds, l); err != nil {
+		return nil, err
+	}
+
+	m := NewLuminance(bounds)
+	for k := 0; k < l.across*l.down; k++ {
+		block, err := d.newImage(l.bounds(k).Intersect(bounds))
+		if err != nil {
+			return nil, err
+		}
+		if err = d.readBlock(block, l, k); err != nil {
+			return nil, err
+		}
+
+		src, ok := block.(*hdr.RGB)
+		if !ok {
+			return nil, errDestinationType
+		}
+		b := src.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				R, G, B, _ := src.HDRAt(x, y).HDRRGBA()
+				m.SetY(x, y, 0.2126*R+0.7152*G+0.0722*B)
+			}
+		}
+	}
+	return m, nil
+}
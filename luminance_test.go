@@ -0,0 +1,42 @@
+package tiff
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLuminance(t *testing.T) {
+	const width, height = 21, 19
+	rgb := testRGBImage(width, height)
+
+	for _, opt := range []*Options{nil, {TileWidth: 16, TileLength: 16, Deflate: true}} {
+		var buf bytes.Buffer
+		assert.NoError(t, Encode(&buf, rgb, opt))
+
+		m, err := DecodeLuminance(&buf)
+		assert.NoError(t, err)
+		assert.Implements(t, (*hdr.Image)(nil), m)
+		assert.Equal(t, image.Rect(0, 0, width, height), m.Bounds())
+		assert.Len(t, m.Pix, width*height)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := rgb.RGBAt(x, y)
+				Y := 0.2126*c.R + 0.7152*c.G + 0.0722*c.B
+				assert.InDelta(t, Y, m.YAt(x, y), 1e-5*Y+1e-7, "pixel (%d,%d)", x, y)
+				assert.Equal(t, hdrcolor.XYZ{X: m.YAt(x, y), Y: m.YAt(x, y), Z: m.YAt(x, y)}, m.HDRAt(x, y))
+			}
+		}
+		assert.Equal(t, 0.0, m.YAt(width, 0))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, Encode(&buf, rgb, &Options{LogLuv: true}))
+	_, err := DecodeLuminance(&buf)
+	assert.EqualError(t, err, "tiff: unsupported feature: luminance of an image other than RGB")
+}
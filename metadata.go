@@ -0,0 +1,166 @@
+package tiff
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata gives a read-only access to the tags of a TIFF image.
+type Metadata struct {
+	idf *idf
+}
+
+// ReadMetadata reads the IFDs of the TIFF image from r without decoding the raster.
+func ReadMetadata(r io.Reader) (*Metadata, error) {
+	idf, err := newIDF(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	return &Metadata{idf: idf}, nil
+}
+
+// ScanTags reads from r the given tags, known by the decoder or not (e.g. the EXIF ISOSpeedRatings),
+// without reading the values of the other tags nor the raster, to quickly scan many files.
+// Each tag is looked up in the main IFD, then in its EXIF IFD and then in its SubIFDs, the first
+// entry found being returned. The tags not found are missing from the returned map.
+func ScanTags(r io.ReaderAt, tags ...uint16) (map[uint16]Tag, error) {
+	d := &idf{
+		r:        r,
+		format:   fTIFF,
+		features: make(map[uint16]tag),
+		tree:     make([]map[uint16]tag, 0),
+		scan:     make(map[uint16]bool, len(tags)),
+	}
+	for _, id := range tags {
+		d.scan[id] = true
+	}
+	if err := d.parse(); err != nil {
+		return nil, err
+	}
+
+	ifds := []map[uint16]tag{d.tree[0], d.exif}
+	ifds = append(ifds, d.tree[1:]...)
+	found := make(map[uint16]Tag, len(tags))
+	for _, id := range tags {
+		for _, features := range ifds {
+			if t, ok := features[id]; ok {
+				found[id] = Tag{t: t}
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// Metadata returns the metadata of the TIFF image.
+func (d *Decoder) Metadata() *Metadata {
+	return &Metadata{idf: d.d.idf}
+}
+
+// UniqueCameraModel returns the DNG UniqueCameraModel, the unique non-localized name of the camera model,
+// or an empty string if the tag does not exist.
+func (m *Metadata) UniqueCameraModel() string {
+	return m.idf.features[tUniqueCameraModel].ascii()
+}
+
+// Software returns the name and version of the software that produced the image,
+// or an empty string if the tag does not exist.
+func (m *Metadata) Software() string {
+	return m.idf.features[tSoftware].ascii()
+}
+
+// HostComputer returns the computer or operating system on which the image was produced,
+// or an empty string if the tag does not exist.
+func (m *Metadata) HostComputer() string {
+	return m.idf.features[tHostComputer].ascii()
+}
+
+// EnhanceParams returns the DNG 1.5 EnhanceParams, the description of the computational enhancement
+// (e.g. denoising or super-resolution) applied to the enhanced image stored along the raw data,
+// or an empty string if no IFD holds the tag.
+// The raw data of an enhanced DNG is the pre-enhancement data.
+func (m *Metadata) EnhanceParams() string {
+	for _, features := range m.idf.tree {
+		if t, ok := features[tEnhanceParams]; ok {
+			return t.ascii()
+		}
+	}
+	return ""
+}
+
+// IFDs returns the tags of each IFD of the image, sorted by ID: the main IFD followed by its SubIFDs.
+// Unlike the merged view used for decoding, it shows which IFD holds each tag.
+// Only the tags known by the decoder are parsed.
+func (m *Metadata) IFDs() [][]Tag {
+	ifds := make([][]Tag, len(m.idf.tree))
+	for i, features := range m.idf.tree {
+		tags := make([]Tag, 0, len(features))
+		for _, t := range features {
+			tags = append(tags, Tag{t: t})
+		}
+		sort.Slice(tags, func(i, j int) bool {
+			return tags[i].ID() < tags[j].ID()
+		})
+		ifds[i] = tags
+	}
+	return ifds
+}
+
+// DateTime returns the capture date of the image: the EXIF DateTimeOriginal or, when absent,
+// the DateTime of the main IFD. The dates carry no time zone, they are returned in UTC.
+// A zero Time is returned when no date is recorded, including the blank dates the spec allows
+// for unknown dates (e.g. "    :  :     :  :  ").
+func (m *Metadata) DateTime() (time.Time, error) {
+	t, ok := m.idf.exif[tDateTimeOriginal]
+	if !ok {
+		t = m.idf.features[tDateTime]
+	}
+	return parseDateTime(t.ascii())
+}
+
+// parseDateTime parses a "YYYY:MM:DD HH:MM:SS" date, the time being optional when left blank.
+func parseDateTime(s string) (time.Time, error) {
+	s = strings.TrimRight(s, " :") // Blank time
+	if strings.Trim(s, " :") == "" {
+		return time.Time{}, nil // Unknown date
+	}
+
+	if len(s) == len("2006:01:02") {
+		t, err := time.Parse("2006:01:02", s)
+		if err != nil {
+			return time.Time{}, FormatError("DateTime " + s)
+		}
+		return t, nil
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return time.Time{}, FormatError("DateTime " + s)
+	}
+	return t, nil
+}
+
+// MarshalJSON implements json.Marshaler.
+// The tags of the image and of its EXIF IFD are serialized as {"TagName": {"id": 256, "type": "SHORT", "value": [...]}}.
+// Rationals are serialized as "num/denom" strings, doubles as numbers and ASCII as strings.
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	type jsonTag struct {
+		ID    uint16      `json:"id"`
+		Type  string      `json:"type"`
+		Value interface{} `json:"value"`
+	}
+
+	tags := make(map[string]jsonTag, len(m.idf.features)+len(m.idf.exif))
+	for _, features := range []map[uint16]tag{m.idf.exif, m.idf.features} {
+		for id, t := range features {
+			tags[tagname(id)] = jsonTag{
+				ID:    id,
+				Type:  datatypename(t.datatype),
+				Value: t.jsonValue(),
+			}
+		}
+	}
+	return json.Marshal(tags) // Map keys are sorted by encoding/json.
+}
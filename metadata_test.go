@@ -0,0 +1,308 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ascii returns the values of an ASCII tag.
+func ascii(s string) []uint64 {
+	val := make([]uint64, 0, len(s)+1)
+	for i := 0; i < len(s); i++ {
+		val = append(val, uint64(s[i]))
+	}
+	return append(val, 0) // NUL
+}
+
+func TestMetadataUniqueCameraModel(t *testing.T) {
+	data := cfaImage(2, 2).
+		add(tUniqueCameraModel, dtASCII, ascii("Canon EOS 5D")...).
+		bytes()
+
+	m, err := ReadMetadata(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "Canon EOS 5D", m.UniqueCameraModel())
+
+	m, err = ReadMetadata(bytes.NewReader(cfaImage(2, 2).bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, "", m.UniqueCameraModel())
+}
+
+func TestMetadataProvenance(t *testing.T) {
+	data := cfaImage(2, 2).
+		add(tSoftware, dtASCII, ascii("LibTIFF, Version 4.5.0")...).
+		add(tHostComputer, dtASCII, ascii("x86_64-pc-linux-gnu")...).
+		bytes()
+
+	m, err := ReadMetadata(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "LibTIFF, Version 4.5.0", m.Software())
+	assert.Equal(t, "x86_64-pc-linux-gnu", m.HostComputer())
+
+	m, err = ReadMetadata(bytes.NewReader(cfaImage(2, 2).bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, "", m.Software())
+	assert.Equal(t, "", m.HostComputer())
+}
+
+func TestMetadataMarshalJSON(t *testing.T) {
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtLong, 1).
+		add(tUniqueCameraModel, dtASCII, ascii("Camera")...).
+		add(tBaselineExposure, dtSRational, uint64(uint32(0xFFFFFFFF)), 2). // -1/2
+		add(tAsShotNeutral, dtRational, 1, 2, 4, 4, 3, 6).
+		add(tStonits, dtDouble, math.Float64bits(1.5)).
+		bytes()
+
+	m, err := ReadMetadata(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"ImageWidth": {"id": 256, "type": "SHORT", "value": [2]},
+		"ImageLength": {"id": 257, "type": "LONG", "value": [1]},
+		"UniqueCameraModel": {"id": 50708, "type": "ASCII", "value": "Camera"},
+		"BaselineExposure": {"id": 50730, "type": "SRATIONAL", "value": ["-1/2"]},
+		"AsShotNeutral": {"id": 50728, "type": "RATIONAL", "value": ["1/2", "4/4", "3/6"]},
+		"StoNits": {"id": 37439, "type": "DOUBLE", "value": [1.5]}
+	}`, string(b))
+
+	// Stable output
+	b2, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, b, b2)
+}
+
+func TestMetadataDateTime(t *testing.T) {
+	b := cfaImage(2, 2).add(tDateTime, dtASCII, ascii("2019:06:21 10:30:05")...)
+
+	m, err := ReadMetadata(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	dt, err := m.DateTime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 6, 21, 10, 30, 5, 0, time.UTC), dt)
+
+	// DateTimeOriginal of the EXIF IFD has precedence.
+	b.exifIFD(newTIFFBuilder(nil).add(tDateTimeOriginal, dtASCII, ascii("2019:06:20 08:00:00")...))
+	m, err = ReadMetadata(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	dt, err = m.DateTime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 6, 20, 8, 0, 0, 0, time.UTC), dt)
+
+	for s, expected := range map[string]time.Time{
+		"":                    {},
+		"    :  :     :  :  ": {},
+		"                   ": {},
+		"2019:06:20   :  :  ": time.Date(2019, 6, 20, 0, 0, 0, 0, time.UTC),
+	} {
+		b.exifIFD(newTIFFBuilder(nil).add(tDateTimeOriginal, dtASCII, ascii(s)...))
+		m, err = ReadMetadata(bytes.NewReader(b.bytes()))
+		assert.NoError(t, err)
+		dt, err = m.DateTime()
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, dt, s)
+	}
+
+	b.exifIFD(newTIFFBuilder(nil).add(tDateTimeOriginal, dtASCII, ascii("21/06/2019")...))
+	m, err = ReadMetadata(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	_, err = m.DateTime()
+	assert.Error(t, err)
+
+	// No date
+	m, err = ReadMetadata(bytes.NewReader(cfaImage(2, 2).bytes()))
+	assert.NoError(t, err)
+	dt, err = m.DateTime()
+	assert.NoError(t, err)
+	assert.True(t, dt.IsZero())
+}
+
+func TestMetadataEnhanceParams(t *testing.T) {
+	enhanced := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftPrimaryImage).
+		add(tImageWidth, dtShort, 4).
+		add(tImageLength, dtShort, 2).
+		add(tEnhanceParams, dtASCII, ascii("Fusion")...).
+		add(tDefaultBlackRender, dtLong, 1).
+		add(tRawToPreviewGain, dtDouble, math.Float64bits(1.5))
+
+	data := cfaImage(2, 2).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		subIFDs(enhanced).
+		bytes()
+
+	m, err := ReadMetadata(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "Fusion", m.EnhanceParams())
+
+	tags := m.IFDs()[1]
+	assert.Equal(t, "DefaultBlackRender", tags[3].Name())
+	assert.Equal(t, "None", valuename(tags[3].t))
+	assert.Equal(t, "RawToPreviewGain", tags[4].Name())
+	assert.Equal(t, []float64{1.5}, tags[4].Value())
+	assert.Equal(t, "EnhanceParams", tags[5].Name())
+
+	m, err = ReadMetadata(bytes.NewReader(cfaImage(2, 2).bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, "", m.EnhanceParams())
+}
+
+func TestMetadataIFDs(t *testing.T) {
+	primary := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftPrimaryImage).
+		add(tImageWidth, dtShort, 4).
+		add(tImageLength, dtShort, 2)
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tUniqueCameraModel, dtASCII, ascii("Camera")...).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageLength, dtShort, 1).
+		add(tImageWidth, dtShort, 1).
+		add(tDNGVersion, dtByte, 1, 4, 0, 0).
+		subIFDs(primary).
+		bytes()
+
+	m, err := ReadMetadata(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	ifds := m.IFDs()
+	assert.Len(t, ifds, 2)
+
+	var names []string
+	for _, tag := range ifds[0] {
+		names = append(names, tag.Name())
+	}
+	assert.Equal(t, []string{"NewSubFileType", "ImageWidth", "ImageLength", "SubIFDs", "DNG Version", "UniqueCameraModel"}, names)
+	assert.Equal(t, uint16(tUniqueCameraModel), ifds[0][5].ID())
+	assert.Equal(t, "ASCII", ifds[0][5].Type())
+	assert.Equal(t, "Camera", ifds[0][5].Value())
+
+	assert.Len(t, ifds[1], 3)
+	assert.Equal(t, "ImageWidth", ifds[1][1].Name())
+	assert.Equal(t, []uint64{4}, ifds[1][1].Value())
+	assert.Equal(t, []uint64{sftPrimaryImage}, ifds[1][0].Value())
+}
+
+// countingReaderAt counts the bytes read from r.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += n
+	return n, err
+}
+
+func TestScanTags(t *testing.T) {
+	const tISOSpeedRatings = 34855
+
+	raw := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftPrimaryImage).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 2).
+		add(tSoftware, dtASCII, ascii("sub")...).
+		add(tWhiteLevel, dtShort, 4095)
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tSoftware, dtASCII, ascii("main")...).
+		add(tLinearizationTable, dtShort, make([]uint64, 1000)...).
+		add(tDNGVersion, dtByte, 1, 4, 0, 0).
+		exifIFD(newTIFFBuilder(nil).add(tISOSpeedRatings, dtShort, 400)).
+		subIFDs(raw).
+		bytes()
+
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	tags, err := ScanTags(r, tSoftware, tISOSpeedRatings, tWhiteLevel, 40000)
+	assert.NoError(t, err)
+	assert.Len(t, tags, 3)
+	assert.Equal(t, "main", tags[tSoftware].Value())
+	assert.Equal(t, []uint64{400}, tags[tISOSpeedRatings].Value())
+	assert.Equal(t, []uint64{4095}, tags[tWhiteLevel].Value())
+
+	// The LinearizationTable is not read.
+	full := &countingReaderAt{r: bytes.NewReader(data)}
+	_, err = newIDF(full)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000*2, full.n-r.n)
+}
+
+func TestScanTagsSignedAndFloat(t *testing.T) {
+	// Private tags of each type
+	const tSByte, tSShort, tSLong, tFloat = 65000, 65001, 65002, 65003
+	signed := func(v int64) uint64 { return uint64(v) }
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, 1).
+			add(tImageLength, dtShort, 1).
+			add(tSByte, dtSByte, signed(-3), 4).
+			add(tSShort, dtSShort, signed(-200), 300).
+			add(tSLong, dtSLong, signed(-70000)).
+			add(tFloat, dtFloat, uint64(math.Float32bits(-1.5)), uint64(math.Float32bits(0.25))).
+			bytes()
+
+		tags, err := ScanTags(bytes.NewReader(data), tSByte, tSShort, tSLong, tFloat)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{-3, 4}, tags[tSByte].Value())
+		assert.Equal(t, []int64{-200, 300}, tags[tSShort].Value())
+		assert.Equal(t, []int64{-70000}, tags[tSLong].Value())
+		assert.Equal(t, []float64{-1.5, 0.25}, tags[tFloat].Value())
+		assert.Equal(t, "SSHORT", tags[tSShort].Type())
+		assert.Equal(t, -70000.0, tags[tSLong].t.asFloat(0))
+		assert.Equal(t, -1.5, tags[tFloat].t.asFloat(0))
+	}
+}
+
+func TestTagString(t *testing.T) {
+	width := Tag{t: tag{id: tImageWidth, datatype: dtShort, val: []uint64{256}}}
+	assert.Equal(t, "ImageWidth: 256", width.String())
+	assert.Equal(t, "ImageWidth: 256", fmt.Sprint(width))
+	assert.Equal(t, `tiff.Tag{ID: 256, Name: "ImageWidth", Type: "SHORT", Val: []uint64{0x100}}`, fmt.Sprintf("%#v", width))
+
+	unknown := Tag{t: tag{id: 40000, datatype: 99, val: []uint64{1, 2}}}
+	assert.Equal(t, "Unknown(40000): [1 2]", unknown.String())
+	assert.Equal(t, `tiff.Tag{ID: 40000, Name: "Unknown(40000)", Type: "Unknown(99)", Val: []uint64{0x1, 0x2}}`, fmt.Sprintf("%#v", unknown))
+
+	// Malformed values
+	assert.Equal(t, "DNG Version: [1 4]", Tag{t: tag{id: tDNGVersion, datatype: dtByte, val: []uint64{1, 4}}}.String())
+	assert.Equal(t, "StoNits: 0", Tag{t: tag{id: tStonits, datatype: dtDouble}}.String())
+}
+
+func TestMetadataBrokenExifIFD(t *testing.T) {
+	// The EXIF IFD is beyond the end of the file.
+	b := cfaImage(2, 2).
+		add(tDateTime, dtASCII, ascii("2019:06:21 10:30:05")...).
+		add(tExifIFD, dtLong, 1<<20)
+
+	m, err := ReadMetadata(bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	dt, err := m.DateTime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 6, 21, 10, 30, 5, 0, time.UTC), dt)
+
+	var warnings []string
+	_, err = DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{Warn: func(msg string) {
+		warnings = append(warnings, msg)
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 1)
+
+	_, err = DecodeWithOptions(bytes.NewReader(b.bytes()), &DecodeOptions{Strict: true})
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package tiff
+
+// A WhitePoint is the reference white of decoded XYZ values.
+type WhitePoint int
+
+// Supported white points.
+const (
+	// D65 is the reference white of sRGB (default).
+	D65 WhitePoint = iota
+	// D50 is the reference white of the DNG color math and of ICC profiles.
+	D50
+)
+
+// A CFAOutput is the color space of the images decoded from a Color Filter Array.
+type CFAOutput int
+
+// Supported CFA outputs.
+const (
+	// CFAOutputXYZ decodes an hdr.XYZ, whose reference white is the OutputWhitePoint (default).
+	CFAOutputXYZ CFAOutput = iota
+	// CFAOutputCameraRGB decodes an hdr.RGB holding the white balanced linear camera RGB,
+	// the ColorMatrix is not applied.
+	CFAOutputCameraRGB
+	// CFAOutputLinearSRGB decodes an hdr.RGB holding linear sRGB, the XYZ values being adapted to D65.
+	CFAOutputLinearSRGB
+)
+
+// A Demosaicing is the interpolation of the missing colors of a 2x2 Bayer CFA.
+type Demosaicing int
+
+// Supported demosaicings.
+const (
+	// DemosaicingBilinear is the bilinear interpolation (default), softer with zippering along the edges.
+	DemosaicingBilinear Demosaicing = iota
+	// DemosaicingMalvar is the gradient-corrected linear interpolation of Malvar, He and Cutler,
+	// sharper than the bilinear one for a similar cost.
+	DemosaicingMalvar
+)
+
+// Default decoding limits, see DecodeOptions.MaxPixels and DecodeOptions.MaxBytes.
+const (
+	DefaultMaxPixels = 1 << 28 // 268 megapixels
+	DefaultMaxBytes  = 4 << 30 // 4 GiB
+)
+
+// DecodeOptions are the decoding parameters.
+// The zero value decodes with the default behaviour.
+type DecodeOptions struct {
+	// OutputWhitePoint defines the reference white of the XYZ values decoded from a CFA.
+	// A Bradford chromatic adaptation is applied when it differs from D65.
+	OutputWhitePoint WhitePoint
+	// BestEffort continues the decoding when a strip or a tile cannot be decoded.
+	// The region of the faulty block is left zeroed and the partial image is returned
+	// along with a BlockErrors error.
+	BestEffort bool
+	// ClampNegative clamps to zero the negative channels, such as the out-of-gamut values produced by
+	// the color matrix of a CFA or the noise below the black level. They are preserved by default.
+	ClampNegative bool
+	// MaskedAreasBlackLevel measures the black level of each CFA color by averaging the optically
+	// black pixels listed by the DNG MaskedAreas tag, instead of using the static BlackLevel.
+	MaskedAreasBlackLevel bool
+	// Subsample decodes one pixel out of Subsample in both directions, e.g. 4 for a quick preview.
+	// The image is Subsample times smaller, rounded up, and the strips or tiles holding no kept
+	// pixel are skipped. Values below 2 decode the full resolution.
+	Subsample int
+	// ClipHighlights clips the CFA samples above the WhiteLevel and the white balanced colors to the
+	// level where the first color saturates, so that blown highlights are rendered neutral instead
+	// of magenta. The brightest highlights are lost, they are preserved by default.
+	ClipHighlights bool
+	// SkipWhiteBalance decodes the CFA without the AsShotNeutral white balance, e.g. along with
+	// CFAOutputCameraRGB to get the unmodified sensor response for calibration.
+	SkipWhiteBalance bool
+	// IntegerSampleRange overrides the range of the integer RGB samples, given by MinSampleValue and
+	// MaxSampleValue or by their data type, which is scaled to [0, 1].
+	// It is ignored when zero.
+	IntegerSampleRange [2]float64
+	// DefaultCrop crops the image to the DNG DefaultCropOrigin and DefaultCropSize, the area
+	// recommended for the final image, excluding the edges needed by demosaicing.
+	DefaultCrop bool
+	// UseColorMatrix converts the camera values of a CFA to XYZ with the ColorMatrix tags of the file,
+	// or with the registered CameraProfile overriding them. Otherwise the camera values are assumed to
+	// be linear sRGB, unless a CameraProfile is registered for the camera.
+	UseColorMatrix bool
+	// CameraToXYZ is the row-major matrix converting the white balanced camera values of a CFA to XYZ
+	// values relative to D65, used instead of the ColorMatrix of the file when UseCameraToXYZ is set.
+	CameraToXYZ [9]float64
+	// UseCameraToXYZ enables CameraToXYZ, e.g. to test a custom color profile.
+	UseCameraToXYZ bool
+	// CFAOutput defines the color space of the images decoded from a CFA.
+	CFAOutput CFAOutput
+	// Demosaicing defines the interpolation of the 2x2 Bayer CFA, the other CFA patterns being
+	// interpolated by bayer.NewArbitrary.
+	Demosaicing Demosaicing
+	// Strict fails the decoding of the files violating the spec in a way otherwise tolerated:
+	// the IFD entries not sorted by ascending tag or duplicated (the first entry of a tag being kept)
+	// and the inconsistencies reported to Warn.
+	Strict bool
+	// Warn, when not nil, is called with the description of each inconsistency of the file that the
+	// decoder reconciles, e.g. a single-sample LogLuv image decoded as LogL.
+	Warn func(msg string)
+	// MaxPixels limits the number of pixels of the decoded image, so that an untrusted file cannot
+	// declare huge dimensions to exhaust the memory. It is DefaultMaxPixels when zero and unlimited
+	// when negative.
+	MaxPixels int64
+	// MaxBytes limits the memory size of the decoded image along with the buffers of a strip or tile:
+	// its decompressed samples and, for a CFA, the samples of the neighbouring blocks read by the
+	// demosaicing and the ones it precomputes (8 bytes each).
+	// It is DefaultMaxBytes when zero and unlimited when negative.
+	MaxBytes int64
+	// UserCrop further crops the default crop to the DNG DefaultUserCrop, the crop chosen by the
+	// user in a raw editor. It implies DefaultCrop.
+	UserCrop bool
+}
+
+// validate returns an error when an option is out of its range.
+func (o *DecodeOptions) validate() error {
+	// An unknown white point has zero coordinates, which would give a NaN chromatic adaptation.
+	if _, ok := whitePoints[o.OutputWhitePoint]; !ok {
+		return FormatError("unknown OutputWhitePoint")
+	}
+	if o.CFAOutput < CFAOutputXYZ || o.CFAOutput > CFAOutputLinearSRGB {
+		return FormatError("unknown CFAOutput")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package tiff
+
+import "fmt"
+
+// A Photometric is the PhotometricInterpretation, the color space of the image data.
+type Photometric uint
+
+// Photometric interpretations.
+const (
+	PhotometricWhiteIsZero      Photometric = pWhiteIsZero
+	PhotometricBlackIsZero      Photometric = pBlackIsZero
+	PhotometricRGB              Photometric = pRGB
+	PhotometricPaletted         Photometric = pPaletted
+	PhotometricTransMask        Photometric = pTransMask
+	PhotometricCMYK             Photometric = pCMYK
+	PhotometricYCbCr            Photometric = pYCbCr
+	PhotometricCIELab           Photometric = pCIELab
+	PhotometricICCLab           Photometric = pICCLab
+	PhotometricITULab           Photometric = pITULab
+	PhotometricColorFilterArray Photometric = pColorFilterArray
+	PhotometricLogL             Photometric = pLogL
+	PhotometricLogLuv           Photometric = pLogLuv
+)
+
+var photometricNames = map[Photometric]string{
+	PhotometricWhiteIsZero:      "WhiteIsZero",
+	PhotometricBlackIsZero:      "BlackIsZero",
+	PhotometricRGB:              "RGB",
+	PhotometricPaletted:         "Paletted",
+	PhotometricTransMask:        "TransMask",
+	PhotometricCMYK:             "CMYK",
+	PhotometricYCbCr:            "YCbCr",
+	PhotometricCIELab:           "CIE-Lab",
+	PhotometricICCLab:           "ICC-Lab",
+	PhotometricITULab:           "ITU-Lab",
+	PhotometricColorFilterArray: "Color Filter Array",
+	PhotometricLogL:             "LogL (GrayScale)",
+	PhotometricLogLuv:           "SGI LogLuv (Color)",
+}
+
+// supportedPhotometrics lists the photometric interpretations handled by newIDFDecoder.
+var supportedPhotometrics = []Photometric{
+	PhotometricRGB,
+	PhotometricTransMask,
+	PhotometricCIELab,
+	PhotometricICCLab,
+	PhotometricColorFilterArray,
+	PhotometricLogL,
+	PhotometricLogLuv,
+}
+
+// SupportedPhotometrics returns the photometric interpretations that can be decoded.
+func SupportedPhotometrics() []Photometric {
+	return append([]Photometric(nil), supportedPhotometrics...)
+}
+
+// IsSupported reports whether the images with the photometric interpretation p can be decoded.
+func (p Photometric) IsSupported() bool {
+	for _, s := range supportedPhotometrics {
+		if p == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Photometric) String() string {
+	if name, ok := photometricNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Photometric(%d)", uint(p))
+}
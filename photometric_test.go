@@ -0,0 +1,25 @@
+package tiff
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhotometricIsSupported(t *testing.T) {
+	for p := range photometricNames {
+		_, err := newIDFDecoder(&idf{
+			features: map[uint16]tag{
+				tBitsPerSample:             {id: tBitsPerSample, datatype: dtShort, val: []uint64{16}},
+				tPhotometricInterpretation: {id: tPhotometricInterpretation, datatype: dtShort, val: []uint64{uint64(p)}},
+			},
+		})
+		assert.Equal(t, !errors.Is(err, ErrUnsupportedPhotometric), p.IsSupported(), "%v", p)
+	}
+
+	assert.Equal(t, "RGB", PhotometricRGB.String())
+	assert.Equal(t, "Photometric(42)", Photometric(42).String())
+	assert.False(t, Photometric(42).IsSupported())
+	assert.Contains(t, SupportedPhotometrics(), PhotometricLogLuv)
+}
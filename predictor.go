@@ -0,0 +1,141 @@
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The predictors are applied row by row, before compression when encoding and
+// after decompression when decoding (page 64-65 of the spec and the Adobe
+// Photoshop TIFF Technical Note 3 for the floating point predictor).
+//
+// p holds rows of rowSize bytes, samples are stored in byteOrder.
+
+// decodeHorizontalPredictor reverses the horizontal differencing of p in place.
+func decodeHorizontalPredictor(p []byte, byteOrder binary.ByteOrder, rowSize, samplesPerPixel, bytesPerSample int) error {
+	if err := checkPredictor(rowSize, samplesPerPixel*bytesPerSample); err != nil {
+		return err
+	}
+
+	stride := samplesPerPixel * bytesPerSample
+	for row := 0; row+rowSize <= len(p); row += rowSize {
+		line := p[row : row+rowSize]
+		for i := stride; i+bytesPerSample <= rowSize; i += bytesPerSample {
+			switch bytesPerSample {
+			case 1:
+				line[i] += line[i-stride]
+			case 2:
+				byteOrder.PutUint16(line[i:], byteOrder.Uint16(line[i:])+byteOrder.Uint16(line[i-stride:]))
+			case 4:
+				byteOrder.PutUint32(line[i:], byteOrder.Uint32(line[i:])+byteOrder.Uint32(line[i-stride:]))
+			case 8:
+				byteOrder.PutUint64(line[i:], byteOrder.Uint64(line[i:])+byteOrder.Uint64(line[i-stride:]))
+			default:
+				return UnsupportedError(fmt.Sprintf("horizontal predictor with %d bits per sample", 8*bytesPerSample))
+			}
+		}
+	}
+	return nil
+}
+
+// encodeHorizontalPredictor applies the horizontal differencing to p in place.
+func encodeHorizontalPredictor(p []byte, byteOrder binary.ByteOrder, rowSize, samplesPerPixel, bytesPerSample int) error {
+	if err := checkPredictor(rowSize, samplesPerPixel*bytesPerSample); err != nil {
+		return err
+	}
+
+	stride := samplesPerPixel * bytesPerSample
+	for row := 0; row+rowSize <= len(p); row += rowSize {
+		line := p[row : row+rowSize]
+		// Backward so that each difference is computed with the original preceding sample.
+		for i := rowSize - bytesPerSample; i >= stride; i -= bytesPerSample {
+			switch bytesPerSample {
+			case 1:
+				line[i] -= line[i-stride]
+			case 2:
+				byteOrder.PutUint16(line[i:], byteOrder.Uint16(line[i:])-byteOrder.Uint16(line[i-stride:]))
+			case 4:
+				byteOrder.PutUint32(line[i:], byteOrder.Uint32(line[i:])-byteOrder.Uint32(line[i-stride:]))
+			case 8:
+				byteOrder.PutUint64(line[i:], byteOrder.Uint64(line[i:])-byteOrder.Uint64(line[i-stride:]))
+			default:
+				return UnsupportedError(fmt.Sprintf("horizontal predictor with %d bits per sample", 8*bytesPerSample))
+			}
+		}
+	}
+	return nil
+}
+
+// decodeFloatingPointPredictor reverses the floating point predictor of p in place.
+// Each row is stored as byte planes, most significant bytes first, and the bytes are
+// differenced across the whole row.
+func decodeFloatingPointPredictor(p []byte, byteOrder binary.ByteOrder, rowSize, samplesPerPixel, bytesPerSample int) error {
+	if err := checkFloatingPointPredictor(rowSize, samplesPerPixel, bytesPerSample); err != nil {
+		return err
+	}
+
+	tmp := make([]byte, rowSize)
+	n := rowSize / bytesPerSample // Number of samples per row
+	for row := 0; row+rowSize <= len(p); row += rowSize {
+		line := p[row : row+rowSize]
+		for i := samplesPerPixel; i < rowSize; i++ {
+			line[i] += line[i-samplesPerPixel]
+		}
+
+		copy(tmp, line)
+		for i := 0; i < n; i++ {
+			for b := 0; b < bytesPerSample; b++ {
+				plane := b // Most significant byte first
+				if byteOrder == binary.LittleEndian {
+					plane = bytesPerSample - b - 1
+				}
+				line[bytesPerSample*i+b] = tmp[plane*n+i]
+			}
+		}
+	}
+	return nil
+}
+
+// encodeFloatingPointPredictor applies the floating point predictor to p in place.
+func encodeFloatingPointPredictor(p []byte, byteOrder binary.ByteOrder, rowSize, samplesPerPixel, bytesPerSample int) error {
+	if err := checkFloatingPointPredictor(rowSize, samplesPerPixel, bytesPerSample); err != nil {
+		return err
+	}
+
+	tmp := make([]byte, rowSize)
+	n := rowSize / bytesPerSample // Number of samples per row
+	for row := 0; row+rowSize <= len(p); row += rowSize {
+		line := p[row : row+rowSize]
+		copy(tmp, line)
+		for i := 0; i < n; i++ {
+			for b := 0; b < bytesPerSample; b++ {
+				plane := b // Most significant byte first
+				if byteOrder == binary.LittleEndian {
+					plane = bytesPerSample - b - 1
+				}
+				line[plane*n+i] = tmp[bytesPerSample*i+b]
+			}
+		}
+
+		for i := rowSize - 1; i >= samplesPerPixel; i-- {
+			line[i] -= line[i-samplesPerPixel]
+		}
+	}
+	return nil
+}
+
+func checkPredictor(rowSize, bytesPerPixel int) error {
+	if bytesPerPixel <= 0 || rowSize <= 0 || rowSize%bytesPerPixel != 0 {
+		return FormatError("invalid row size for predictor")
+	}
+	return nil
+}
+
+func checkFloatingPointPredictor(rowSize, samplesPerPixel, bytesPerSample int) error {
+	switch bytesPerSample {
+	case 2, 4, 8:
+	default:
+		return UnsupportedError(fmt.Sprintf("floating point predictor with %d bits per sample", 8*bytesPerSample))
+	}
+	return checkPredictor(rowSize, samplesPerPixel*bytesPerSample)
+}
@@ -0,0 +1,74 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPredictorRoundTrip(t *testing.T) {
+	const width, height, samplesPerPixel = 5, 3, 3
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, bytesPerSample := range []int{1, 2, 4, 8} {
+			rowSize := width * samplesPerPixel * bytesPerSample
+			src := make([]byte, rowSize*height)
+			rand.New(rand.NewSource(int64(bytesPerSample))).Read(src)
+
+			p := append([]byte(nil), src...)
+			assert.NoError(t, encodeHorizontalPredictor(p, byteOrder, rowSize, samplesPerPixel, bytesPerSample))
+			assert.NoError(t, decodeHorizontalPredictor(p, byteOrder, rowSize, samplesPerPixel, bytesPerSample))
+			assert.Equal(t, src, p, "horizontal %v %d", byteOrder, bytesPerSample)
+
+			if bytesPerSample == 1 {
+				assert.Error(t, encodeFloatingPointPredictor(p, byteOrder, rowSize, samplesPerPixel, bytesPerSample))
+				continue
+			}
+
+			p = append([]byte(nil), src...)
+			assert.NoError(t, encodeFloatingPointPredictor(p, byteOrder, rowSize, samplesPerPixel, bytesPerSample))
+			assert.NoError(t, decodeFloatingPointPredictor(p, byteOrder, rowSize, samplesPerPixel, bytesPerSample))
+			assert.Equal(t, src, p, "floating point %v %d", byteOrder, bytesPerSample)
+		}
+	}
+}
+
+func TestDecodeRGBFloatingPointPredictor(t *testing.T) {
+	const width, height = 4, 2
+
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		strip := make([]byte, width*height*12)
+		for i := 0; i < width*height*3; i++ {
+			byteOrder.PutUint32(strip[4*i:], math.Float32bits(float32(i)*1.5))
+		}
+		assert.NoError(t, encodeFloatingPointPredictor(strip, byteOrder, width*12, 3, 4))
+
+		data := newTIFFBuilder(byteOrder).
+			add(tImageWidth, dtShort, width).
+			add(tImageLength, dtShort, height).
+			add(tBitsPerSample, dtShort, 32, 32, 32).
+			add(tCompression, dtShort, cNone).
+			add(tPhotometricInterpretation, dtShort, pRGB).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tPredictor, dtShort, prFloatingPoint).
+			add(tSampleFormat, dtShort, 3, 3, 3).
+			strips(strip).
+			bytes()
+
+		m, err := Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := float64((y*width + x) * 3)
+				r, g, b, _ := m.(hdr.Image).HDRAt(x, y).HDRRGBA()
+				assert.Equal(t, []float64{i * 1.5, (i + 1) * 1.5, (i + 2) * 1.5}, []float64{r, g, b})
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// A PreviewColorSpace is the color space of a DNG preview, as declared by its PreviewColorSpace tag.
+type PreviewColorSpace uint
+
+// Preview color spaces.
+const (
+	PreviewColorSpaceUnknown     PreviewColorSpace = 0
+	PreviewColorSpaceGrayGamma22 PreviewColorSpace = 1
+	PreviewColorSpaceSRGB        PreviewColorSpace = 2
+	PreviewColorSpaceAdobeRGB    PreviewColorSpace = 3
+	PreviewColorSpaceProPhotoRGB PreviewColorSpace = 4
+)
+
+var previewColorSpaceNames = map[PreviewColorSpace]string{
+	PreviewColorSpaceUnknown:     "Unknown",
+	PreviewColorSpaceGrayGamma22: "Gray Gamma 2.2",
+	PreviewColorSpaceSRGB:        "sRGB",
+	PreviewColorSpaceAdobeRGB:    "Adobe RGB",
+	PreviewColorSpaceProPhotoRGB: "ProPhoto RGB",
+}
+
+func (cs PreviewColorSpace) String() string {
+	if name, ok := previewColorSpaceNames[cs]; ok {
+		return name
+	}
+	return fmt.Sprintf("PreviewColorSpace(%d)", uint(cs))
+}
+
+// linear returns the linear value of the value v, in the range [0, 1], encoded with the transfer
+// function of the color space. Unknown color spaces are assumed to be sRGB.
+func (cs PreviewColorSpace) linear(v float64) float64 {
+	switch cs {
+	case PreviewColorSpaceGrayGamma22:
+		return math.Pow(v, 2.2)
+	case PreviewColorSpaceAdobeRGB:
+		return math.Pow(v, 563.0/256)
+	case PreviewColorSpaceProPhotoRGB:
+		if v < 16.0/512 {
+			return v / 16
+		}
+		return math.Pow(v, 1.8)
+	default:
+		return sRGBToLinear(v)
+	}
+}
+
+// previewColorSpace returns the PreviewColorSpace of the IFD at index fi of the tree,
+// the one of the main IFD being inherited.
+func (d *idf) previewColorSpace(fi int) PreviewColorSpace {
+	if t, ok := d.tree[fi][tPreviewColorSpace]; ok {
+		return PreviewColorSpace(t.firstVal())
+	}
+	return PreviewColorSpace(d.tree[0][tPreviewColorSpace].firstVal())
+}
+
+// thumbnail returns the index in the tree of the IFD classified as thumbnail/preview image.
+func (d *idf) thumbnail() (int, error) {
+	for fi, features := range d.tree {
+		if features[tNewSubFileType].firstVal() == sftThumbnail {
+			return fi, nil
+		}
+	}
+	return 0, FormatError("thumbnail not found")
+}
+
+// PreviewColorSpace returns the color space of the thumbnail/preview image returned by Thumbnail.
+func (m *Metadata) PreviewColorSpace() (PreviewColorSpace, error) {
+	fi, err := m.idf.thumbnail()
+	if err != nil {
+		return PreviewColorSpaceUnknown, err
+	}
+	return m.idf.previewColorSpace(fi), nil
+}
+
+// LinearThumbnail reads a TIFF image from r and returns its thumbnail/preview image as an HDR image.
+// The values are linearized according to the transfer function of the PreviewColorSpace of the preview,
+// but the primaries are left unchanged (e.g. Adobe RGB previews are returned in linear Adobe RGB).
+func LinearThumbnail(r io.Reader) (*hdr.RGB, error) {
+	idf, err := newIDF(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := idf.thumbnail()
+	if err != nil {
+		return nil, err
+	}
+	src, err := decodeThumbnail(idf.sub(fi))
+	if err != nil {
+		return nil, err
+	}
+
+	cs := idf.previewColorSpace(fi)
+	bounds := src.Bounds()
+	m := hdr.NewRGB(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, _ := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			m.SetRGB(x, y, hdrcolor.RGB{
+				R: cs.linear(float64(r) / 0xffff),
+				G: cs.linear(float64(g) / 0xffff),
+				B: cs.linear(float64(b) / 0xffff),
+			})
+		}
+	}
+	return m, nil
+}
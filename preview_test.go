@@ -0,0 +1,82 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinearThumbnail(t *testing.T) {
+	newBuilder := func(cs PreviewColorSpace) *tiffBuilder {
+		return newTIFFBuilder(binary.LittleEndian).
+			add(tNewSubFileType, dtLong, sftThumbnail).
+			add(tImageWidth, dtShort, 2).
+			add(tImageLength, dtShort, 1).
+			add(tBitsPerSample, dtShort, 8, 8, 8).
+			add(tPhotometricInterpretation, dtShort, pRGB).
+			add(tSamplesPerPixel, dtShort, 3).
+			add(tDNGVersion, dtByte, 1, 4, 0, 0).
+			add(tPreviewColorSpace, dtLong, uint64(cs)).
+			strips([]byte{0, 0, 0, 255, 128, 4})
+	}
+
+	for cs, expected := range map[PreviewColorSpace][3]float64{
+		PreviewColorSpaceUnknown:     {1, sRGBToLinear(128.0 / 255), sRGBToLinear(4.0 / 255)},
+		PreviewColorSpaceGrayGamma22: {1, math.Pow(128.0/255, 2.2), math.Pow(4.0/255, 2.2)},
+		PreviewColorSpaceSRGB:        {1, sRGBToLinear(128.0 / 255), sRGBToLinear(4.0 / 255)},
+		PreviewColorSpaceAdobeRGB:    {1, math.Pow(128.0/255, 563.0/256), math.Pow(4.0/255, 563.0/256)},
+		PreviewColorSpaceProPhotoRGB: {1, math.Pow(128.0/255, 1.8), 4.0 / 255 / 16},
+	} {
+		data := newBuilder(cs).bytes()
+
+		md, err := ReadMetadata(bytes.NewReader(data))
+		assert.NoError(t, err)
+		actual, err := md.PreviewColorSpace()
+		assert.NoError(t, err)
+		assert.Equal(t, cs, actual)
+
+		m, err := LinearThumbnail(bytes.NewReader(data))
+		assert.NoError(t, err)
+		r, g, b, _ := m.HDRAt(0, 0).HDRRGBA()
+		assert.Equal(t, []float64{0, 0, 0}, []float64{r, g, b}, "%v", cs)
+		r, g, b, _ = m.HDRAt(1, 0).HDRRGBA()
+		assert.InDeltaSlice(t, expected[:], []float64{r, g, b}, 1e-6, "%v", cs)
+	}
+
+	assert.Equal(t, "Adobe RGB", PreviewColorSpaceAdobeRGB.String())
+	assert.Equal(t, "PreviewColorSpace(9)", PreviewColorSpace(9).String())
+}
+
+func TestPreviewColorSpaceInheritance(t *testing.T) {
+	preview := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftThumbnail).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 8, 8, 8).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips([]byte{255, 255, 255})
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tNewSubFileType, dtLong, sftPrimaryImage).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 2).
+		add(tDNGVersion, dtByte, 1, 4, 0, 0).
+		add(tPreviewColorSpace, dtLong, uint64(PreviewColorSpaceProPhotoRGB)).
+		subIFDs(preview).
+		bytes()
+
+	md, err := ReadMetadata(bytes.NewReader(data))
+	assert.NoError(t, err)
+	cs, err := md.PreviewColorSpace()
+	assert.NoError(t, err)
+	assert.Equal(t, PreviewColorSpaceProPhotoRGB, cs)
+
+	m, err := LinearThumbnail(bytes.NewReader(data))
+	assert.NoError(t, err)
+	r, g, b, _ := m.HDRAt(0, 0).HDRRGBA()
+	assert.Equal(t, []float64{1, 1, 1}, []float64{r, g, b})
+}
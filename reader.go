@@ -18,6 +18,7 @@ package tiff
 // https://rcsumner.net/raw_guide/RAWguide.pdf (processing workflow)
 
 import (
+	"fmt"
 	"image"
 	"io"
 
@@ -31,142 +32,714 @@ import (
 // DecodeConfig returns the color model and dimensions of a TIFF image without
 // decoding the entire image.
 func DecodeConfig(r io.Reader) (image.Config, error) {
-	d, err := newDecoder(r)
+	d, err := newDecoder(newReaderAt(r))
 	if err != nil {
 		return image.Config{}, err
 	}
 	return d.config, nil
 }
 
+// EstimateMemory returns the number of bytes of the pixels of the image decoded from r,
+// computed from its configuration without decoding the pixels, e.g. to reject or route the huge images
+// before decoding them.
+func EstimateMemory(r io.Reader) (int64, error) {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return 0, err
+	}
+	return d.imageBytes(image.Rect(0, 0, d.config.Width, d.config.Height)), nil
+}
+
 // Decode reads a DNG image from r and returns an image.Image.
 func Decode(r io.Reader) (m image.Image, err error) {
-	d, err := newDecoder(r)
+	d, err := newDecoder(newReaderAt(r))
 	if err != nil {
 		return
 	}
+	return d.readImage()
+}
+
+// DecodeN reads a TIFF image from r like Decode and also returns the number of bytes read from r,
+// the highest byte offset of the TIFF accessed by the decoding, so that the stream embedding the TIFF
+// can be parsed further. r is read sequentially up to that offset and never beyond.
+// Unreferenced trailing bytes of the TIFF, if any, are not counted.
+func DecodeN(r io.Reader) (image.Image, int64, error) {
+	b := &buffer{
+		r:   r,
+		buf: make([]byte, 0, 1024),
+	}
+	d, err := newDecoder(b)
+	if err != nil {
+		return nil, int64(len(b.buf)), err
+	}
+	m, err := d.readImage()
+	return m, int64(len(b.buf)), err
+}
 
+// DecodeWithOptions reads a TIFF image from r and returns an image.Image decoded according to opts.
+func DecodeWithOptions(r io.Reader, opts *DecodeOptions) (image.Image, error) {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		d.opts = *opts
+	}
+	return d.readImage()
+}
+
+// Thumbnail reads a TIFF image from r and returns its thumbnail/preview image,
+// which is the IFD classified as such by its NewSubFileType (e.g. the IFD0 of a DNG).
+// The preview is decoded without decoding the full resolution image.
+func Thumbnail(r io.Reader) (image.Image, error) {
+	idf, err := newIDF(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := idf.thumbnail()
+	if err != nil {
+		return nil, err
+	}
+	return decodeThumbnail(idf.sub(fi))
+}
+
+// DecodeLevel reads a TIFF image from r and decodes a level of its resolution pyramid without decoding
+// the other ones. Level 0 is the full resolution image, the next levels are the reduced-resolution
+// IFDs of the IFD tree (NewSubFileType bit 0 set, e.g. the DNG previews) by descending dimensions.
+// The 8-bit previews are decoded as LDR images like Thumbnail does.
+func DecodeLevel(r io.Reader, level int) (image.Image, error) {
+	idf, err := newIDF(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+
+	if level == 0 {
+		d, err := newIDFDecoder(idf)
+		if err != nil {
+			return nil, err
+		}
+		return d.readImage()
+	}
+
+	levels := idf.reducedResolutions()
+	if level < 0 || level > len(levels) {
+		return nil, FormatError("level not found")
+	}
+	features := idf.tree[levels[level-1]]
+	if features[tCompression].firstVal() == cJPEG ||
+		features[tPhotometricInterpretation].firstVal() == pRGB && features[tBitsPerSample].firstVal() == 8 {
+		return decodeThumbnail(idf.sub(levels[level-1]))
+	}
+	d, err := newIDFDecoder(idf.sub(levels[level-1]))
+	if err != nil {
+		return nil, err
+	}
+	return d.readImage()
+}
+
+// DecodeBlock reads a TIFF image from r and decodes only the strip or tile at blockIndex
+// of the image described by the IFD at ifdIndex (0 is the main IFD, followed by the SubIFDs).
+// It returns the decoded block and its position in the image, padding excluded.
+func DecodeBlock(r io.Reader, ifdIndex, blockIndex int) (image.Image, image.Rectangle, error) {
+	idf, err := newIDF(newReaderAt(r))
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	if ifdIndex < 0 || ifdIndex >= len(idf.tree) {
+		return nil, image.Rectangle{}, FormatError("IFD not found")
+	}
+
+	d, err := newIDFDecoder(idf.sub(ifdIndex))
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	l, err := d.layout()
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	if blockIndex < 0 || blockIndex >= l.across*l.down {
+		return nil, image.Rectangle{}, FormatError("block not found")
+	}
+
+	rect := l.bounds(blockIndex)
+	if err = d.checkLimits(rect, l); err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	m, err := d.newImage(rect.Intersect(image.Rect(0, 0, d.config.Width, d.config.Height)))
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	if err = d.readBlock(m, l, blockIndex); err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	return m, m.Bounds(), nil
+}
+
+// A Decoder decodes a TIFF image from an io.ReaderAt.
+type Decoder struct {
+	d *decoder
+}
+
+// NewDecoderAt returns a Decoder reading the size bytes of r.
+// Unlike Decode, the input is not buffered: the header and each strip or tile
+// are read on demand, so r can be an mmap'd file or a remote range reader.
+func NewDecoderAt(r io.ReaderAt, size int64) (*Decoder, error) {
+	d, err := newDecoder(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{d: d}, nil
+}
+
+// Config returns the color model and dimensions of the TIFF image.
+func (d *Decoder) Config() image.Config {
+	return d.d.config
+}
+
+// Compression returns the compression scheme of the TIFF image.
+// A missing Compression tag is reported as CompressionNone.
+func (d *Decoder) Compression() Compression {
+	if c := d.d.compression; c != 0 {
+		return Compression(c)
+	}
+	return CompressionNone
+}
+
+// Photometric returns the photometric interpretation of the TIFF image.
+func (d *Decoder) Photometric() Photometric {
+	return Photometric(d.d.firstVal(tPhotometricInterpretation))
+}
+
+// Decode decodes the TIFF image and returns an image.Image.
+func (d *Decoder) Decode() (image.Image, error) {
+	return d.DecodeWithOptions(nil)
+}
+
+// DecodeWithOptions decodes the TIFF image according to opts and returns an image.Image.
+func (d *Decoder) DecodeWithOptions(opts *DecodeOptions) (image.Image, error) {
+	d.d.opts = DecodeOptions{}
+	if opts != nil {
+		d.d.opts = *opts
+	}
+	return d.d.readImage()
+}
+
+// readImage decodes all the strips or tiles of the image.
+func (d *decoder) readImage() (m image.Image, err error) {
 	// fmt.Println("=================")
 	// fmt.Println(d.String())
 	// fmt.Println("=================")
 
-	// ==============================================================
-	blockPadding := false
-	blockWidth := d.config.Width
-	blockHeight := d.config.Height
-	blocksAcross := 1
-	blocksDown := 1
+	if err := d.opts.validate(); err != nil {
+		return nil, err
+	}
+	if d.opts.Strict && d.entryErr != nil {
+		return nil, d.entryErr
+	}
+	for _, w := range d.warnings {
+		if err = d.warn(w); err != nil {
+			return nil, err
+		}
+	}
+
+	s := d.opts.Subsample
+	if s < 1 {
+		s = 1
+	}
+	bounds := subsampledRect(image.Rect(0, 0, d.config.Width, d.config.Height), s)
+	// Checked before reading the layout, whose size also grows with the declared dimensions.
+	if err = d.checkLimits(bounds, nil); err != nil {
+		return nil, err
+	}
+
+	if d.compression == cJPEGOld {
+		return d.readOldJPEG()
+	}
+
+	l, err := d.layout()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkLimits(bounds, l); err != nil {
+		return nil, err
+	}
+	if n := l.across * l.down * l.planes; d.shortDimensions() && len(l.offsets) > n && len(l.counts) > n {
+		if err = d.warn("more strips or tiles than the image dimensions, ImageWidth or ImageLength may be wrapped"); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err = d.newImage(bounds)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		d.cfaBlocks = nil
+	}()
+
+	d.blackLevels = nil
+	if d.mode == mColorFilterArray && d.opts.MaskedAreasBlackLevel {
+		if d.blackLevels, err = d.maskedAreasBlackLevels(l); err != nil {
+			return nil, err
+		}
+	}
+
+	var scratch image.Image
+	if s > 1 {
+		// Decoding buffer of the subsampled blocks, large enough for any of them.
+		scratch, err = d.newImage(image.Rect(0, 0, minInt(l.width, d.config.Width), minInt(l.height, d.config.Height)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var errs BlockErrors
+	for k := 0; k < l.across*l.down; k++ {
+		if s > 1 {
+			err = d.readSubsampledBlock(m, scratch, l, k, s)
+		} else {
+			err = d.readBlock(m, l, k)
+		}
+		if err != nil {
+			if !d.opts.BestEffort {
+				return nil, err
+			}
+
+			r := subsampledRect(l.bounds(k), s).Intersect(m.Bounds())
+			zero(m, r)
+			errs = append(errs, &BlockError{Index: k, Bounds: r, Err: err})
+		}
+	}
+
+	if d.opts.DefaultCrop || d.opts.UserCrop {
+		if m, err = d.crop(m, subsampledRect(d.cropRect(), s)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(errs) > 0 {
+		return m, errs
+	}
+	return m, nil
+}
+
+// checkLimits reports an error when an image covering bounds exceeds the MaxPixels or MaxBytes options.
+// The bytes also count the buffers in which a strip or tile of l, if not nil, is decoded.
+func (d *decoder) checkLimits(bounds image.Rectangle, l *blockLayout) error {
+	maxPixels, maxBytes := d.opts.MaxPixels, d.opts.MaxBytes
+	if maxPixels == 0 {
+		maxPixels = DefaultMaxPixels
+	}
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	pixels := saturatedMul(int64(bounds.Dx()), int64(bounds.Dy()))
+	if maxPixels > 0 && pixels > maxPixels {
+		return fmt.Errorf("%w: %d pixels", ErrLimitExceeded, pixels)
+	}
+	n := d.imageBytes(bounds)
+	if l != nil {
+		n = saturatedAdd(n, d.blockBytes(l))
+	}
+	if maxBytes > 0 && n > maxBytes {
+		return fmt.Errorf("%w: %d bytes", ErrLimitExceeded, n)
+	}
+	return nil
+}
+
+// imageBytes returns the number of bytes of the pixels of the image newImage allocates for bounds.
+func (d *decoder) imageBytes(bounds image.Rectangle) int64 {
+	const sampleSize = 4 // float32
+	pixels := saturatedMul(int64(bounds.Dx()), int64(bounds.Dy()))
+	return saturatedMul(pixels, int64(outputChannels[d.outputMode()])*sampleSize)
+}
+
+// blockBytes returns the number of bytes of the buffers in which a strip or tile of l is decoded:
+// its decompressed samples, unpacked on 16 bits when packed. A CFA also keeps the samples of the
+// neighbouring blocks and demosaics the block along with its margins, gathered in a window whose
+// linearized samples are precomputed as float64.
+func (d *decoder) blockBytes(l *blockLayout) int64 {
+	pixels := saturatedMul(int64(l.width), int64(l.height))
+	n := saturatedMul(pixels, int64(d.bytesPerPixel))
+	if d.packed() {
+		n = saturatedAdd(n, saturatedMul(pixels, int64(d.spp)*2))
+	}
+	if d.mode == mColorFilterArray {
+		n = saturatedMul(n, int64(minInt(2*l.across+3, l.across*l.down)))
+		margin := d.cfaMargin()
+		window := saturatedMul(int64(minInt(l.width+2*margin, l.imageWidth)), int64(minInt(l.height+2*margin, l.imageHeight)))
+		n = saturatedAdd(n, saturatedMul(window, int64(d.bytesPerPixel+8)))
+	}
+	return n
+}
+
+// A blockLayout describes how the image is split into strips or tiles.
+type blockLayout struct {
+	imageWidth, imageHeight int
+	// padding is true for tiles, which are padded at the right and the bottom of the image,
+	// whereas the last strip is truncated.
+	padding         bool
+	width, height   int // Dimensions of a block
+	across, down    int // Number of blocks
+	offsets, counts []uint64
+	// planes is the number of sample planes: SamplesPerPixel when the samples are stored separately
+	// (PlanarConfiguration 2), the blocks of each plane following the ones of the previous plane.
+	planes int
+}
+
+// bounds returns the region covered by the k-th block, padding included.
+func (l *blockLayout) bounds(k int) image.Rectangle {
+	i, j := k%l.across, k/l.across
+
+	blkW := l.width
+	if !l.padding && i == l.across-1 && l.imageWidth%l.width != 0 {
+		blkW = l.imageWidth % l.width
+	}
+	blkH := l.height
+	if !l.padding && j == l.down-1 && l.imageHeight%l.height != 0 {
+		blkH = l.imageHeight % l.height
+	}
+
+	xmin := i * l.width
+	ymin := j * l.height
+	return image.Rect(xmin, ymin, xmin+blkW, ymin+blkH)
+}
+
+// layout returns the strips or tiles layout of the image.
+func (d *decoder) layout() (*blockLayout, error) {
+	l := &blockLayout{
+		imageWidth:  d.config.Width,
+		imageHeight: d.config.Height,
+		width:       d.config.Width,
+		height:      d.config.Height,
+		across:      1,
+		down:        1,
+		planes:      1,
+	}
+
+	if d.firstVal(tPlanarConfiguration) == pcSeparate && d.spp > 1 {
+		if d.mode == mLogLuv {
+			return nil, UnsupportedError("separate planes for LogLuv")
+		}
+		l.planes = int(d.spp)
+	}
 
 	if d.config.Width == 0 {
-		blocksAcross = 0
+		l.across = 0
 	}
 	if d.config.Height == 0 {
-		blocksDown = 0
+		l.down = 0
 	}
 
-	var blockOffsets, blockCounts []uint
-
 	if int(d.firstVal(tTileWidth)) != 0 {
-		blockPadding = true
+		l.padding = true
 
-		blockWidth = int(d.firstVal(tTileWidth))
-		blockHeight = int(d.firstVal(tTileLength))
+		l.width = int(d.firstVal(tTileWidth))
+		l.height = int(d.firstVal(tTileLength))
 
-		if blockWidth != 0 {
-			blocksAcross = (d.config.Width + blockWidth - 1) / blockWidth
+		if l.width != 0 {
+			l.across = (d.config.Width + l.width - 1) / l.width
 		}
-		if blockHeight != 0 {
-			blocksDown = (d.config.Height + blockHeight - 1) / blockHeight
+		if l.height != 0 {
+			l.down = (d.config.Height + l.height - 1) / l.height
 		}
 
-		blockCounts = d.features[tTileByteCounts].val
-		blockOffsets = d.features[tTileOffsets].val
+		l.counts = d.features[tTileByteCounts].val
+		l.offsets = d.features[tTileOffsets].val
+
+		if n := l.across * l.down * l.planes; len(l.counts) < n && d.compression <= cNone {
+			// Some writers store a single TileByteCounts for the uncompressed tiles, which all have
+			// the same size, the counts are derived from the geometry of the tiles.
+			size := uint64(l.height * d.rowSize(l.width) / l.planes)
+			l.counts = make([]uint64, n)
+			for k := range l.counts {
+				l.counts[k] = size
+			}
+		}
 
 	} else {
-		if int(d.firstVal(tRowsPerStrip)) != 0 {
-			blockHeight = int(d.firstVal(tRowsPerStrip))
+		if rows := d.firstVal(tRowsPerStrip); rows != 0 && rows < uint(d.config.Height) {
+			// RowsPerStrip larger than the image (e.g. 2^32-1) means a single strip.
+			l.height = int(rows)
 		}
 
-		if blockHeight != 0 {
-			blocksDown = (d.config.Height + blockHeight - 1) / blockHeight
+		if l.height != 0 {
+			l.down = (d.config.Height + l.height - 1) / l.height
 		}
 
-		blockOffsets = d.features[tStripOffsets].val
-		blockCounts = d.features[tStripByteCounts].val
+		l.offsets = d.features[tStripOffsets].val
+		l.counts = d.features[tStripByteCounts].val
+
+		if _, ok := d.features[tStripByteCounts]; !ok && d.compression <= cNone {
+			// Some minimal writers omit the StripByteCounts of uncompressed data,
+			// they are derived from the geometry of the strips, plane after plane.
+			l.counts = make([]uint64, l.down*l.planes)
+			for j := range l.counts {
+				rows := minInt(l.height, d.config.Height-j%l.down*l.height)
+				l.counts[j] = uint64(rows * d.rowSize(d.config.Width) / l.planes)
+			}
+		}
 	}
 
 	// Check if we have the right number of strips/tiles, offsets and counts.
-	if n := blocksAcross * blocksDown; len(blockOffsets) < n || len(blockCounts) < n {
+	if n := l.across * l.down * l.planes; len(l.offsets) < n || len(l.counts) < n {
 		return nil, FormatError("inconsistent header")
 	}
+	if err := d.checkDimensions(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// shortDimensions reports whether ImageWidth or ImageLength is stored as a SHORT, which wraps the dimensions
+// above 65535.
+func (d *decoder) shortDimensions() bool {
+	return d.features[tImageWidth].datatype == dtShort || d.features[tImageLength].datatype == dtShort
+}
+
+// checkDimensions reports an error when the strips or tiles hold more data than the dimensions of
+// the image can explain, which happens when a dimension above 65535 is stored, wrapped, as a SHORT.
+// Smaller excesses (e.g. padding) are tolerated, as well as the dimensions stored as LONG.
+// The strips or tiles in excess are only reported by readImage, they are ignored.
+func (d *decoder) checkDimensions(l *blockLayout) error {
+	widthShort := d.features[tImageWidth].datatype == dtShort
+	lengthShort := d.features[tImageLength].datatype == dtShort
+	if !widthShort && !lengthShort {
+		return nil
+	}
+
+	if d.compression > cNone || l.padding {
+		return nil // The size of the pixel data is unknown or does not depend on the dimensions.
+	}
+	var total uint64
+	for _, c := range l.counts {
+		total += uint64(c)
+	}
+	const wrap = 1 << 16
+	if widthShort && total >= uint64(d.rowSize(d.config.Width+wrap))*uint64(d.config.Height) ||
+		lengthShort && total >= uint64(d.rowSize(d.config.Width))*uint64(d.config.Height+wrap) {
+		return FormatError("pixel data exceeding the image dimensions, ImageWidth or ImageLength may be wrapped")
+	}
+	return nil
+}
+
+// warn reports the inconsistency msg of the file to the Warn option, it is an error in Strict mode.
+func (d *decoder) warn(msg string) error {
+	if d.opts.Strict {
+		return FormatError(msg)
+	}
+	if d.opts.Warn != nil {
+		d.opts.Warn(msg)
+	}
+	return nil
+}
+
+// newImage allocates the image, covering bounds, in which the raster is decoded.
+// Its type is given by outputMode.
+func (d *decoder) newImage(bounds image.Rectangle) (image.Image, error) {
+	if err := d.checkBitsPerSample(); err != nil {
+		return nil, err
+	}
+	if err := d.checkLimits(bounds, nil); err != nil {
+		return nil, err
+	}
 
-	// ==============================================================
+	switch d.outputMode() {
+	case mRGB:
+		return hdr.NewRGB(bounds), nil
+	case mRGBA, mNRGBA:
+		// hdr has no alpha-bearing image yet, the alpha sample is skipped like the other ExtraSamples.
+		return hdr.NewRGB(bounds), nil
+	default:
+		return hdr.NewXYZ(bounds), nil
+	}
+}
 
-	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+// outputMode returns the mode of the decoded image, chosen from the mode of the raster and from the
+// samples of its pixels: the RGB pixels whose ExtraSamples hold an alpha give an mRGBA image, or mNRGBA
+// for an unassociated alpha, and the CFA give an mRGB image unless decoded as XYZ.
+// The other modes are decoded as XYZ.
+func (d *decoder) outputMode() imageMode {
 	switch d.mode {
 	case mRGB:
-		if d.bpp == 32 {
-			m = hdr.NewRGB(bounds)
-		} else {
-			err = FormatError("Invalid BitsPerSample for RGB 32 bits floating-point format")
-			return
+		for _, es := range d.features[tExtraSamples].val {
+			switch es {
+			case esAssociatedAlpha:
+				return mRGBA
+			case esUnassociatedAlpha:
+				return mNRGBA
+			}
+		}
+	case mColorFilterArray:
+		if d.opts.CFAOutput != CFAOutputXYZ {
+			return mRGB
+		}
+	}
+	return d.mode
+}
+
+// checkBitsPerSample checks that the BitsPerSample is supported for the mode of the raster.
+func (d *decoder) checkBitsPerSample() error {
+	switch d.mode {
+	case mRGB:
+		if d.bpp == 32 || d.bpp == 16 || d.packed() {
+			return nil
 		}
+		return FormatError("Invalid BitsPerSample for RGB 32 bits floating-point or packed, 16 and 32 bits integer format")
 	case mLogL:
 		if d.bpp == 16 {
-			m = hdr.NewXYZ(bounds)
-		} else {
-			err = FormatError("Invalid BitsPerSample for LogL format")
-			return
+			return nil
 		}
+		return FormatError("Invalid BitsPerSample for LogL format")
 	case mLogLuv:
 		if d.bpp == 16 {
-			m = hdr.NewXYZ(bounds)
-		} else {
-			err = FormatError("Invalid BitsPerSample for LogLuv format")
-			return
+			return nil
 		}
+		return FormatError("Invalid BitsPerSample for LogLuv format")
 	case mColorFilterArray:
+		if d.bpp == 16 || d.packed() || d.bpp == 8 {
+			return nil
+		}
+		return FormatError("Invalid BitsPerSample for ColorFilterArray format")
+	case mLab:
 		if d.bpp == 16 || d.bpp == 8 {
-			m = hdr.NewXYZ(bounds)
-		} else {
-			err = FormatError("Invalid BitsPerSample for ColorFilterArray format")
-			return
+			return nil
+		}
+		return FormatError("Invalid BitsPerSample for CIELab format")
+	case mBilevel:
+		return nil
+	case mTransMask:
+		if d.bpp == 1 || d.bpp == 8 {
+			return nil
+		}
+		return FormatError("Invalid BitsPerSample for transparency mask")
+	}
+	return ErrUnsupportedPhotometric
+}
+
+// readBlock decompresses the k-th strip or tile of l and decodes it into dst.
+func (d *decoder) readBlock(dst image.Image, l *blockLayout, k int) error {
+	if d.mode == mColorFilterArray {
+		return d.readCFABlock(dst, l, k)
+	}
+
+	r := l.bounds(k)
+	if err := d.loadBlock(l, k, dst.Bounds()); err != nil {
+		return err
+	}
+	return d.decode(dst, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+// loadBlock decompresses the k-th strip or tile of l into d.buf and checks that it holds all the pixels
+// of the block within bounds.
+func (d *decoder) loadBlock(l *blockLayout, k int, bounds image.Rectangle) error {
+	r := l.bounds(k)
+	if err := d.decompressBlock(l, k); err != nil {
+		return err
+	}
+
+	if b := r.Intersect(bounds); !b.Empty() {
+		needed := ((b.Max.Y-r.Min.Y-1)*r.Dx() + b.Max.X - r.Min.X) * d.bytesPerPixel
+		if len(d.buf) < needed {
+			return FormatError("not enough pixel data")
 		}
 	}
+	return nil
+}
+
+// decompressBlock decompresses the k-th strip or tile of l into d.buf.
+// The samples stored in separate planes are interleaved as if they were contiguous.
+func (d *decoder) decompressBlock(l *blockLayout, k int) error {
+	r := l.bounds(k)
+	if l.planes == 1 {
+		return d.decompress(int64(l.offsets[k]), int64(l.counts[k]), r.Dx(), r.Dy())
+	}
 
-	// ==============================================================
+	// Each plane is decompressed as a single sample image.
+	spp, bytesPerPixel := d.spp, d.bytesPerPixel
+	defer func() {
+		d.spp, d.bytesPerPixel = spp, bytesPerPixel
+	}()
+	d.spp = 1
+	d.bytesPerPixel = bytesPerPixel / l.planes
 
-	for i := 0; i < blocksAcross; i++ {
-		blkW := blockWidth
-		if !blockPadding && i == blocksAcross-1 && d.config.Width%blockWidth != 0 {
-			blkW = d.config.Width % blockWidth
+	pixels := r.Dx() * r.Dy()
+	buf := make([]byte, pixels*bytesPerPixel)
+	n := l.across * l.down
+	for p := 0; p < l.planes; p++ {
+		i := p*n + k
+		if err := d.decompress(int64(l.offsets[i]), int64(l.counts[i]), r.Dx(), r.Dy()); err != nil {
+			return err
 		}
-		for j := 0; j < blocksDown; j++ {
-			blkH := blockHeight
-			if !blockPadding && j == blocksDown-1 && d.config.Height%blockHeight != 0 {
-				blkH = d.config.Height % blockHeight
-			}
-			offset := int64(blockOffsets[j*blocksAcross+i])
-			n := int64(blockCounts[j*blocksAcross+i])
 
-			if err = d.decompress(offset, n, blkW, blkH); err != nil {
-				return nil, err
-			}
+		pixels = minInt(pixels, len(d.buf)/d.bytesPerPixel) // Truncated plane
+		for j := 0; j < pixels; j++ {
+			copy(buf[j*bytesPerPixel+p*d.bytesPerPixel:], d.buf[j*d.bytesPerPixel:(j+1)*d.bytesPerPixel])
+		}
+	}
+	d.buf = buf[:pixels*bytesPerPixel]
+	return nil
+}
 
-			xmin := i * blockWidth
-			ymin := j * blockHeight
-			xmax := xmin + blkW
-			ymax := ymin + blkH
-			err = d.decode(m, xmin, ymin, xmax, ymax)
-			if err != nil {
-				return nil, err
-			}
+// readSubsampledBlock decodes the k-th block of l like readBlock and keeps one pixel out of s
+// in both directions, the pixel (x, y) of dst being the pixel (x*s, y*s) of the image.
+// The block is decoded into the pixels of scratch, which are reused for all the blocks.
+// The blocks without any kept pixel are not even decompressed.
+func (d *decoder) readSubsampledBlock(dst, scratch image.Image, l *blockLayout, k, s int) error {
+	r := l.bounds(k)
+	sr := subsampledRect(r, s).Intersect(dst.Bounds())
+	if sr.Empty() {
+		return nil
+	}
+
+	block := reslice(scratch, r.Intersect(image.Rect(0, 0, d.config.Width, d.config.Height)))
+	if block == nil {
+		return errDestinationType
+	}
+	if err := d.readBlock(block, l, k); err != nil {
+		return err
+	}
+
+	src := block.(hdr.Image)
+	m, ok := dst.(hdr.ImageSet)
+	if !ok {
+		return errDestinationType
+	}
+	for y := sr.Min.Y; y < sr.Max.Y; y++ {
+		for x := sr.Min.X; x < sr.Max.X; x++ {
+			m.Set(x, y, src.HDRAt(x*s, y*s))
 		}
 	}
+	return nil
+}
+
+// reslice returns an image of bounds r sharing the pixels of m, which must hold at least as many pixels,
+// or nil if m is not an image created by newImage.
+func reslice(m image.Image, r image.Rectangle) image.Image {
+	n := 3 * r.Dx() * r.Dy()
+	switch m := m.(type) {
+	case *hdr.RGB:
+		return &hdr.RGB{Pix: m.Pix[:n], Stride: 3 * r.Dx(), Rect: r}
+	case *hdr.XYZ:
+		return &hdr.XYZ{Pix: m.Pix[:n], Stride: 3 * r.Dx(), Rect: r}
+	}
+	return nil
+}
 
-	return
+// subsampledRect returns the region of the image subsampled by s covered by the pixels of r
+// whose coordinates are multiples of s.
+func subsampledRect(r image.Rectangle, s int) image.Rectangle {
+	ceil := func(v int) int {
+		return (v + s - 1) / s
+	}
+	return image.Rect(ceil(r.Min.X), ceil(r.Min.Y), ceil(r.Max.X), ceil(r.Max.Y))
 }
 
 func init() {
-	image.RegisterFormat("tiff", leHeader, Decode, DecodeConfig)
-	image.RegisterFormat("tiff", beHeader, Decode, DecodeConfig)
+	image.RegisterFormat("tiff", leHeader, registeredDecode, registeredDecodeConfig)
+	image.RegisterFormat("tiff", beHeader, registeredDecode, registeredDecodeConfig)
+	image.RegisterFormat("tiff", leBigHeader, registeredDecode, registeredDecodeConfig)
+	image.RegisterFormat("tiff", beBigHeader, registeredDecode, registeredDecodeConfig)
 }
@@ -0,0 +1,72 @@
+package tiff
+
+import (
+	"image"
+	"io"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+)
+
+// A ScanlineDecoder decodes a LogLuv or LogL image row by row without allocating the full image,
+// only the strip or the row of tiles holding the current row is kept in memory.
+type ScanlineDecoder struct {
+	d    *decoder
+	l    *blockLayout
+	band *hdr.XYZ // Decoded row of blocks
+	y    int      // Next row
+}
+
+// NewScanlineDecoder reads the header of the LogLuv or LogL image from r.
+func NewScanlineDecoder(r io.Reader) (*ScanlineDecoder, error) {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	if d.mode != mLogLuv && d.mode != mLogL {
+		return nil, UnsupportedError("scanlines of an image other than LogLuv or LogL")
+	}
+	if _, err = d.newImage(image.Rectangle{}); err != nil {
+		return nil, err
+	}
+
+	l, err := d.layout()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkLimits(image.Rect(0, 0, d.config.Width, l.height), l); err != nil { // A row of blocks
+		return nil, err
+	}
+	return &ScanlineDecoder{d: d, l: l}, nil
+}
+
+// Config returns the color model and dimensions of the image.
+func (s *ScanlineDecoder) Config() image.Config {
+	return s.d.config
+}
+
+// Next decodes and returns the next row of the image, from top to bottom.
+// It returns io.EOF after the last row.
+func (s *ScanlineDecoder) Next() ([]hdrcolor.XYZ, error) {
+	if s.y >= s.d.config.Height {
+		return nil, io.EOF
+	}
+
+	if s.band == nil || s.y >= s.band.Rect.Max.Y {
+		// Decode the strip or the row of tiles holding the row.
+		j := s.y / s.l.height
+		s.band = hdr.NewXYZ(image.Rect(0, j*s.l.height, s.d.config.Width, minInt((j+1)*s.l.height, s.d.config.Height)))
+		for i := 0; i < s.l.across; i++ {
+			if err := s.d.readBlock(s.band, s.l, j*s.l.across+i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	row := make([]hdrcolor.XYZ, s.d.config.Width)
+	for x := range row {
+		row[x] = s.band.XYZAt(x, s.y)
+	}
+	s.y++
+	return row, nil
+}
@@ -0,0 +1,117 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanlineDecoder(t *testing.T) {
+	const width, height, rowsPerStrip = 3, 5, 2
+
+	var strips [][]byte
+	for sy := 0; sy < height; sy += rowsPerStrip {
+		strip := make([]byte, 0, width*rowsPerStrip*4)
+		for y := sy; y < minInt(sy+rowsPerStrip, height); y++ {
+			for x := 0; x < width; x++ {
+				strip = append(strip, logluvPixel(x, y)...)
+			}
+		}
+		strips = append(strips, rle(strip, 4, width, len(strip)/(4*width)))
+	}
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cSGILogRLE).
+		add(tPhotometricInterpretation, dtShort, pLogLuv).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tRowsPerStrip, dtShort, rowsPerStrip).
+		strips(strips...).
+		bytes()
+
+	m, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	s, err := NewScanlineDecoder(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, width, s.Config().Width)
+	for y := 0; y < height; y++ {
+		row, err := s.Next()
+		assert.NoError(t, err)
+		assert.Len(t, row, width)
+		for x := range row {
+			assert.Equal(t, m.(*hdr.XYZ).XYZAt(x, y), row[x], "pixel (%d,%d)", x, y)
+		}
+	}
+	_, err = s.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestScanlineDecoderTiles(t *testing.T) {
+	const width, height, tileSize = 20, 18, 16
+
+	var tiles [][]byte
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tile := make([]byte, 0, tileSize*tileSize*2)
+			for y := ty; y < ty+tileSize; y++ {
+				for x := tx; x < tx+tileSize; x++ {
+					tile = append(tile, 0x3e, byte(8*x+3*y)) // Padding included
+				}
+			}
+			tiles = append(tiles, rle(tile, 2, tileSize, tileSize))
+		}
+	}
+
+	data := newTIFFBuilder(binary.BigEndian).
+		add(tImageWidth, dtShort, width).
+		add(tImageLength, dtShort, height).
+		add(tBitsPerSample, dtShort, 16).
+		add(tCompression, dtShort, cSGILogRLE).
+		add(tPhotometricInterpretation, dtShort, pLogL).
+		add(tTileWidth, dtShort, tileSize).
+		add(tTileLength, dtShort, tileSize).
+		tiles(tiles...).
+		bytes()
+
+	m, err := Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	s, err := NewScanlineDecoder(bytes.NewReader(data))
+	assert.NoError(t, err)
+	decoded := hdr.NewXYZ(image.Rect(0, 0, width, height))
+	for y := 0; ; y++ {
+		row, err := s.Next()
+		if err == io.EOF {
+			assert.Equal(t, height, y)
+			break
+		}
+		assert.NoError(t, err)
+		for x := range row {
+			decoded.SetXYZ(x, y, row[x])
+		}
+	}
+	assert.Equal(t, m, decoded)
+}
+
+func TestScanlineDecoderUnsupported(t *testing.T) {
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 1).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		add(tSampleFormat, dtShort, sfIEEEFP, sfIEEEFP, sfIEEEFP).
+		strips(make([]byte, 12)).
+		bytes()
+
+	_, err := NewScanlineDecoder(bytes.NewReader(data))
+	assert.Error(t, err)
+}
@@ -6,10 +6,49 @@ import (
 	"math/big"
 )
 
+// A Tag is a read-only IFD entry of a TIFF image.
+type Tag struct {
+	t tag
+}
+
+// ID returns the tag number, e.g. 256 for ImageWidth.
+func (t Tag) ID() uint16 {
+	return t.t.id
+}
+
+// Name returns the common name of the tag.
+func (t Tag) Name() string {
+	return t.t.Name()
+}
+
+// Type returns the name of the TIFF data type of the tag, e.g. "SHORT".
+func (t Tag) Type() string {
+	return datatypename(t.t.datatype)
+}
+
+// String returns the name and the formatted value of the tag, e.g. "ImageWidth: 256".
+func (t Tag) String() string {
+	return t.t.String()
+}
+
+// GoString returns the structure of the tag, raw values included, for the %#v verb.
+func (t Tag) GoString() string {
+	return fmt.Sprintf("tiff.Tag{ID: %d, Name: %q, Type: %q, Val: %#v}", t.t.id, t.Name(), t.Type(), t.t.val)
+}
+
+// Value returns the values of the tag: a string for ASCII, "num/denom" strings for rationals,
+// float64 for floats and doubles, int64 for signed integers and uint64 otherwise.
+func (t Tag) Value() interface{} {
+	return t.t.jsonValue()
+}
+
 type tag struct {
 	id       uint16
 	datatype uint
-	val      []uint
+	// val holds the values on 64 bits, whatever the architecture: a rational has its numerator
+	// in the low 32 bits and its denominator in the high ones, a float or a double its IEEE 754 bits
+	// and a signed integer its value sign-extended to 64 bits.
+	val []uint64
 }
 
 // firstVal returns the first uint of the features entry with the given tag,
@@ -18,31 +57,52 @@ func (t tag) firstVal() uint {
 	if len(t.val) == 0 {
 		return 0
 	}
-	return t.val[0]
+	return uint(t.val[0])
+}
+
+// ascii returns the string of the features entry with the given ASCII tag,
+// or an empty string if the tag does not exist.
+func (t tag) ascii() string {
+	b := make([]byte, 0, len(t.val))
+	for _, v := range t.val {
+		if v == 0 {
+			break // NUL terminated
+		}
+		b = append(b, byte(v))
+	}
+	return string(b)
 }
 
 // rational returns the first unsigned rational at index of the features entry with the given tag,
-// or 0 if the tag does not exist.
+// or 0 if the tag does not exist or its denominator is zero.
 func (t tag) rational(index int) *big.Rat {
 	if len(t.val) <= index {
-		return big.NewRat(0, 0)
+		return new(big.Rat)
 	}
-	u64 := uint64(t.val[index])
+	u64 := t.val[index]
 	num := int64(u64 & 0xFFFFFFFF)
 	denom := int64(u64 >> 32)
-	return big.NewRat(num, denom)
+	return newRat(num, denom)
 }
 
 // sRational returns the rational at index of the features entry with the given tag,
-// or 0 if the tag does not exist.
+// or 0 if the tag does not exist or its denominator is zero.
 func (t tag) sRational(index int) *big.Rat {
 	if len(t.val) <= index {
-		return big.NewRat(0, 0)
+		return new(big.Rat)
 	}
-	u64 := uint64(t.val[index])
+	u64 := t.val[index]
 	num := int32(u64 & 0xFFFFFFFF)
 	denom := int32(u64 >> 32)
-	return big.NewRat(int64(num), int64(denom))
+	return newRat(int64(num), int64(denom))
+}
+
+// newRat returns num/denom, or 0 for a zero denominator like libtiff does, instead of panicking.
+func newRat(num, denom int64) *big.Rat {
+	if denom == 0 {
+		return new(big.Rat)
+	}
+	return big.NewRat(num, denom)
 }
 
 // double returns the float64 at index of the features entry with the given tag,
@@ -51,7 +111,21 @@ func (t tag) double(index int) float64 {
 	if len(t.val) <= index {
 		return 0
 	}
-	return math.Float64frombits(uint64(t.val[index]))
+	return math.Float64frombits(t.val[index])
+}
+
+// float returns the float32 at index of the features entry with the given FLOAT tag,
+// or 0 if the tag does not exist.
+func (t tag) float(index int) float64 {
+	if len(t.val) <= index {
+		return 0
+	}
+	return float64(math.Float32frombits(uint32(t.val[index])))
+}
+
+// signed reports whether the tag holds signed integers.
+func (t tag) signed() bool {
+	return t.datatype == dtSByte || t.datatype == dtSShort || t.datatype == dtSLong || t.datatype == dtSLong8
 }
 
 // asFloat returns the converted float64 at index of the features entry with the given tag,
@@ -66,10 +140,15 @@ func (t tag) asFloat(index int) float64 {
 		return v
 	case dtDouble:
 		return t.double(index)
+	case dtFloat:
+		return t.float(index)
 	default:
 		if len(t.val) <= index {
 			return 0
 		}
+		if t.signed() {
+			return float64(int64(t.val[index]))
+		}
 		return float64(t.val[index])
 	}
 }
@@ -88,3 +167,42 @@ func (t tag) PrettyPrintedValue() string {
 func (t tag) String() string {
 	return fmt.Sprintf("%s: %s", t.Name(), t.PrettyPrintedValue())
 }
+
+// jsonValue returns the values of the tag as serialized in JSON.
+func (t tag) jsonValue() interface{} {
+	switch t.datatype {
+	case dtASCII:
+		return t.ascii()
+	case dtRational, dtSRational:
+		sl := make([]string, len(t.val))
+		for i, v := range t.val {
+			// Same layout as rational and sRational.
+			if t.datatype == dtRational {
+				sl[i] = fmt.Sprintf("%d/%d", uint32(v), uint32(v>>32))
+			} else {
+				sl[i] = fmt.Sprintf("%d/%d", int32(v), int32(v>>32))
+			}
+		}
+		return sl
+	case dtDouble, dtFloat:
+		sl := make([]float64, len(t.val))
+		for i := range t.val {
+			sl[i] = t.asFloat(i)
+		}
+		return sl
+	default:
+		if t.signed() {
+			return t.ints()
+		}
+		return t.val
+	}
+}
+
+// ints returns the values of the tag holding signed integers.
+func (t tag) ints() []int64 {
+	sl := make([]int64, len(t.val))
+	for i, v := range t.val {
+		sl[i] = int64(v)
+	}
+	return sl
+}
@@ -2,8 +2,13 @@ package tiff
 
 import (
 	"fmt"
+	"image"
 	"math"
 	"math/big"
+	"strings"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
 )
 
 // A FormatError reports that the input is not a valid TIFF image.
@@ -28,6 +33,83 @@ func (e InternalError) Error() string {
 	return fmt.Sprintf("tiff: internal error: %s", string(e))
 }
 
+// Sentinel errors of the decoder, they can be tested with errors.Is. The errors returned may wrap them
+// along with some details, errors.As still finding their FormatError or UnsupportedError.
+var (
+	// ErrMalformedHeader reports that the input does not begin with a TIFF or BigTIFF header.
+	ErrMalformedHeader = FormatError("malformed header")
+	// ErrUnsupportedCompression reports that the strips or tiles use an unimplemented compression scheme.
+	ErrUnsupportedCompression = UnsupportedError("compression")
+	// ErrUnsupportedPhotometric reports that the PhotometricInterpretation is not decoded by this package.
+	ErrUnsupportedPhotometric = UnsupportedError("color model")
+	// ErrLimitExceeded reports that the image exceeds the MaxPixels or MaxBytes decoding limits.
+	ErrLimitExceeded = UnsupportedError("image exceeding the decoding limits")
+	// ErrRawDigestMismatch reports that the raw samples of a DNG do not match its stored digest.
+	ErrRawDigestMismatch = FormatError("raw image digest mismatch")
+)
+
+// errDestinationType reports that the image allocated by newImage does not match the decode function,
+// which is a programming error.
+var errDestinationType = InternalError("unexpected destination image type")
+
+// A BlockError reports an error encountered while decoding a strip or a tile.
+type BlockError struct {
+	// Index is the index of the strip or tile.
+	Index int
+	// Bounds is the region of the image covered by the strip or tile.
+	Bounds image.Rectangle
+	// Err is the decoding error.
+	Err error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %d %v: %v", e.Index, e.Bounds, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// BlockErrors reports all the strips or tiles that could not be decoded
+// when decoding with the BestEffort option.
+type BlockErrors []*BlockError
+
+func (e BlockErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("tiff: %d corrupted blocks: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// containsUint reports whether v is in s.
+func containsUint(s []uint, v uint) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// uints returns the values of s, which fit in a uint such as the SHORT or LONG values of a tag.
+func uints(s []uint64) []uint {
+	u := make([]uint, len(s))
+	for i, v := range s {
+		u[i] = uint(v)
+	}
+	return u
+}
+
+// uint64s returns the values of s in the layout of tag.val.
+func uint64s(s []uint) []uint64 {
+	u := make([]uint64, len(s))
+	for i, v := range s {
+		u[i] = uint64(v)
+	}
+	return u
+}
+
 // minInt returns the smaller of x or y.
 func minInt(a, b int) int {
 	if a <= b {
@@ -36,12 +118,99 @@ func minInt(a, b int) int {
 	return b
 }
 
+// dimension converts the unsigned dimension v of a tag to an int, saturated to the largest int on the
+// 32-bit platforms, so that a huge dimension is not wrapped to a negative one.
+func dimension(v uint) int {
+	if uint64(v) > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(v)
+}
+
+// saturatedMul returns a*b for the non-negative a and b, or math.MaxInt64 when it overflows,
+// so that the huge dimensions declared by a file cannot wrap a size to a small or negative one.
+func saturatedMul(a, b int64) int64 {
+	if a != 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
+	}
+	return a * b
+}
+
+// saturatedAdd returns a+b for the non-negative a and b, or math.MaxInt64 when it overflows.
+func saturatedAdd(a, b int64) int64 {
+	if b > math.MaxInt64-a {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// maxInt returns the larger of x or y.
+func maxInt(a, b int) int {
+	if a >= b {
+		return a
+	}
+	return b
+}
+
+// zero sets to zero the pixels of m within r.
+func zero(m image.Image, r image.Rectangle) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			switch m := m.(type) {
+			case *hdr.RGB:
+				m.SetRGB(x, y, hdrcolor.RGB{})
+			case *hdr.XYZ:
+				m.SetXYZ(x, y, hdrcolor.XYZ{})
+			}
+		}
+	}
+}
+
+func datatypename(dt uint) string {
+	switch dt {
+	case dtByte:
+		return "BYTE"
+	case dtASCII:
+		return "ASCII"
+	case dtShort:
+		return "SHORT"
+	case dtLong:
+		return "LONG"
+	case dtRational:
+		return "RATIONAL"
+	case dtSByte:
+		return "SBYTE"
+	case dtUndefined:
+		return "UNDEFINED"
+	case dtSShort:
+		return "SSHORT"
+	case dtSLong:
+		return "SLONG"
+	case dtSRational:
+		return "SRATIONAL"
+	case dtFloat:
+		return "FLOAT"
+	case dtDouble:
+		return "DOUBLE"
+	case dtIFD:
+		return "IFD"
+	case dtLong8:
+		return "LONG8"
+	case dtSLong8:
+		return "SLONG8"
+	case dtIFD8:
+		return "IFD8"
+	default:
+		return fmt.Sprintf("Unknown(%d)", dt)
+	}
+}
+
 func tagname(t uint16) string {
 	switch t {
 	case tBitsPerSample:
 		return "BitsPerSample"
 	case tExtraSamples:
-		return "BitsPerSample"
+		return "ExtraSamples"
 	case tPhotometricInterpretation:
 		return "PhotometricInterpretation"
 	case tCompression:
@@ -60,6 +229,10 @@ func tagname(t uint16) string {
 		return "SamplesPerPixel"
 	case tRowsPerStrip:
 		return "RowsPerStrip"
+	case tMinSampleValue:
+		return "MinSampleValue"
+	case tMaxSampleValue:
+		return "MaxSampleValue"
 	case tTileWidth:
 		return "TileWidth"
 	case tTileLength:
@@ -68,8 +241,28 @@ func tagname(t uint16) string {
 		return "TileOffsets"
 	case tTileByteCounts:
 		return "TileByteCounts"
+	case tFillOrder:
+		return "FillOrder"
+	case tJPEGProc:
+		return "JPEGProc"
+	case tJPEGInterchangeFormat:
+		return "JPEGInterchangeFormat"
+	case tJPEGInterchangeFormatLength:
+		return "JPEGInterchangeFormatLength"
+	case tJPEGTables:
+		return "JPEGTables"
 	case tPlanarConfiguration:
 		return "PlanarConfiguration"
+	case tSoftware:
+		return "Software"
+	case tDateTime:
+		return "DateTime"
+	case tHostComputer:
+		return "HostComputer"
+	case tExifIFD:
+		return "ExifIFD"
+	case tDateTimeOriginal:
+		return "DateTimeOriginal"
 	case tImageLength:
 		return "ImageLength"
 	case tImageWidth:
@@ -90,10 +283,18 @@ func tagname(t uint16) string {
 		return "CFALayout"
 	case tLinearizationTable:
 		return "LinearizationTable"
+	case tBlackLevelRepeatDim:
+		return "BlackLevelRepeatDim"
 	case tBlackLevel:
 		return "BlackLevel"
 	case tWhiteLevel:
 		return "WhiteLevel"
+	case tDefaultCropOrigin:
+		return "DefaultCropOrigin"
+	case tDefaultCropSize:
+		return "DefaultCropSize"
+	case tDefaultUserCrop:
+		return "DefaultUserCrop"
 	case tColorMatrix1:
 		return "ColorMatrix1"
 	case tColorMatrix2:
@@ -108,12 +309,40 @@ func tagname(t uint16) string {
 		return "ReductionMatrix2"
 	case tAsShotNeutral:
 		return "AsShotNeutral"
+	case tAsShotWhiteXY:
+		return "AsShotWhiteXY"
 	case tBaselineExposure:
 		return "BaselineExposure"
+	case tUniqueCameraModel:
+		return "UniqueCameraModel"
 	case tCalibrationIlluminant1:
 		return "CalibrationIlluminant1"
 	case tCalibrationIlluminant2:
 		return "CalibrationIlluminant2"
+	case tMaskedAreas:
+		return "MaskedAreas"
+	case tPreviewColorSpace:
+		return "PreviewColorSpace"
+	case tRawImageDigest:
+		return "RawImageDigest"
+	case tDefaultBlackRender:
+		return "DefaultBlackRender"
+	case tNewRawImageDigest:
+		return "NewRawImageDigest"
+	case tRawToPreviewGain:
+		return "RawToPreviewGain"
+	case tDepthFormat:
+		return "DepthFormat"
+	case tDepthNear:
+		return "DepthNear"
+	case tDepthFar:
+		return "DepthFar"
+	case tDepthUnits:
+		return "DepthUnits"
+	case tDepthMeasureType:
+		return "DepthMeasureType"
+	case tEnhanceParams:
+		return "EnhanceParams"
 
 	default:
 		return fmt.Sprintf("Unknown(%d)", t)
@@ -133,67 +362,23 @@ func valuename(t tag) string {
 			v = t.firstVal()
 		}
 	case tPhotometricInterpretation:
-		switch t.firstVal() {
-		case pWhiteIsZero:
-			v = "WhiteIsZero"
-		case pBlackIsZero:
-			v = "BlackIsZero"
-		case pRGB:
-			v = "RGB"
-		case pPaletted:
-			v = "Paletted"
-		case pTransMask:
-			v = "TransMask"
-		case pCMYK:
-			v = "CMYK"
-		case pYCbCr:
-			v = "YCbCr"
-		case pCIELab:
-			v = "CIE-Lab"
-		case pColorFilterArray:
-			v = "Color Filter Array"
-		case pLogL:
-			v = "LogL (GrayScale)"
-		case pLogLuv:
-			v = "SGI LogLuv (Color)"
-		default:
+		if name, ok := photometricNames[Photometric(t.firstVal())]; ok {
+			v = name
+		} else {
 			v = t.firstVal()
 		}
 	case tCompression:
-		switch t.firstVal() {
-		case cNone:
-			v = "None"
-		case cCCITT:
-			v = "CCITT"
-		case cG3:
-			v = "Group 3 Fax"
-		case cG4:
-			v = "Group 4 Fax"
-		case cLZW:
-			v = "LZW"
-		case cJPEGOld:
-			v = "Old JPEG"
-		case cJPEG:
-			v = "JPEG"
-		case cDeflate:
-			v = "Deflate (zlib compression)"
-		case cPackBits:
-			v = "PackBits"
-		case cDeflateOld:
-			v = "Old Deflate"
-		case cSGILogRLE:
-			v = "SGI Log Luminance RLE"
-		case cSGILog24Packed:
-			v = "SGI Log 24-bits packed"
-		case cLossyJPEG:
-			v = "Lossy JPEG"
-		default:
+		if name, ok := compressionNames[Compression(t.firstVal())]; ok {
+			v = name
+		} else {
 			v = t.firstVal()
 		}
 	case tStripOffsets:
 		v = fmt.Sprintf("contains %d offset entries", len(t.val))
 	case tStripByteCounts:
 		v = fmt.Sprintf("contains %d byte-count entries", len(t.val))
+	case tJPEGTables:
+		v = fmt.Sprintf("contains %d bytes", len(t.val))
 	case tSamplesPerPixel:
 		fallthrough
 	case tRowsPerStrip:
@@ -206,22 +391,64 @@ func valuename(t tag) string {
 		fallthrough
 	case tImageWidth:
 		v = t.firstVal()
+	case tExtraSamples:
+		names := make([]string, len(t.val))
+		for i, es := range t.val {
+			switch es {
+			case esUnspecified:
+				names[i] = "Unspecified"
+			case esAssociatedAlpha:
+				names[i] = "Associated alpha"
+			case esUnassociatedAlpha:
+				names[i] = "Unassociated alpha"
+			default:
+				names[i] = fmt.Sprint(es)
+			}
+		}
+		v = names
+	case tFillOrder:
+		switch t.firstVal() {
+		case foMSBFirst:
+			v = "MSB first"
+		case foLSBFirst:
+			v = "LSB first"
+		default:
+			v = t.firstVal()
+		}
 	case tPlanarConfiguration:
 		switch t.firstVal() {
-		case 1:
+		case pcChunky:
 			v = "Contiguous (aka RGBRGBRGBRGB)"
-		case 2:
+		case pcSeparate:
 			v = "Separate (aka RRRRGGGGBBBB)"
 		}
 	case tStonits:
-		v = math.Float64frombits(uint64(t.val[0]))
+		v = t.double(0)
 	case tCFARepeatPatternDim:
+		if len(t.val) != 2 {
+			v = t.val
+			break
+		}
 		v = fmt.Sprintf("%d CFARepeatRows, %d CFARepeatCols", t.val[0], t.val[1])
-	case tCFAPattern:
-		v = fmt.Sprintf("%v (%s%s%s%s)", t.val, cfaColors[t.val[0]], cfaColors[t.val[1]], cfaColors[t.val[2]], cfaColors[t.val[3]])
+	case tCFAPattern, tCFAPlaneColor:
+		var colors strings.Builder
+		for _, c := range t.val {
+			if c < uint64(len(cfaColors)) {
+				colors.WriteString(cfaColors[c])
+			} else {
+				colors.WriteString("?")
+			}
+		}
+		v = fmt.Sprintf("%v (%s)", t.val, colors.String())
+	case tUniqueCameraModel, tSoftware, tHostComputer, tEnhanceParams:
+		v = t.ascii()
 	case tDNGVersion:
 		fallthrough
 	case tDNGBackwardVersion:
+		if len(t.val) != 4 {
+			v = t.val
+			break
+		}
 		v = fmt.Sprintf("%d.%d.%d.%d", t.val[0], t.val[1], t.val[2], t.val[3])
 	case tCFALayout:
 		switch t.firstVal() {
@@ -238,10 +465,19 @@ func valuename(t tag) string {
 		default:
 			v = t.firstVal()
 		}
-	case tCFAPlaneColor:
-		v = fmt.Sprintf("%v (%s%s%s)", t.val, cfaColors[t.val[0]], cfaColors[t.val[1]], cfaColors[t.val[2]])
 	case tBaselineExposure:
 		v = t.sRational(0)
+	case tPreviewColorSpace:
+		v = PreviewColorSpace(t.firstVal())
+	case tDefaultBlackRender:
+		switch t.firstVal() {
+		case 0:
+			v = "Auto"
+		case 1:
+			v = "None"
+		default:
+			v = t.firstVal()
+		}
 	default:
 		v = formatDatatype(t)
 	}
@@ -250,6 +486,8 @@ func valuename(t tag) string {
 
 func formatDatatype(t tag) interface{} {
 	switch t.datatype {
+	case dtASCII:
+		return t.ascii()
 	case dtRational:
 		sl := make([]*big.Rat, 0, len(t.val))
 		for i := range t.val {
@@ -262,13 +500,16 @@ func formatDatatype(t tag) interface{} {
 			sl = append(sl, t.sRational(i))
 		}
 		return sl
-	case dtDouble:
+	case dtDouble, dtFloat:
 		sl := make([]float64, 0, len(t.val))
 		for i := range t.val {
-			sl = append(sl, t.double(i))
+			sl = append(sl, t.asFloat(i))
 		}
 		return sl
 	default:
+		if t.signed() {
+			return t.ints()
+		}
 		return t.val
 	}
 }
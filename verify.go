@@ -0,0 +1,49 @@
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/mdouchement/hdr"
+)
+
+// Verify decodes the TIFF image read from r and runs internal consistency checks
+// without the need of a reference image: the decoded bounds must match the header
+// and all the pixels must be finite (no NaN or Inf from the color conversions).
+func Verify(r io.Reader) error {
+	d, err := newDecoder(newReaderAt(r))
+	if err != nil {
+		return err
+	}
+
+	m, err := d.readImage()
+	if err != nil {
+		return err
+	}
+
+	if bounds := image.Rect(0, 0, d.config.Width, d.config.Height); m.Bounds() != bounds {
+		return InternalError(fmt.Sprintf("decoded bounds %v instead of %v", m.Bounds(), bounds))
+	}
+
+	hm, ok := m.(hdr.Image)
+	if !ok {
+		return InternalError("decoded image is not an HDR image")
+	}
+
+	b := hm.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, _ := hm.HDRAt(x, y).HDRRGBA()
+			if !isFinite(r) || !isFinite(g) || !isFinite(b) {
+				return FormatError(fmt.Sprintf("non-finite pixel value at (%d, %d)", x, y))
+			}
+		}
+	}
+	return nil
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
@@ -0,0 +1,34 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, Encode(&buf, testRGBImage(8, 8), nil))
+	assert.NoError(t, Verify(&buf))
+
+	assert.NoError(t, Verify(bytes.NewReader(cfaImage(4, 4).bytes())))
+}
+
+func TestVerifyNaN(t *testing.T) {
+	strip := make([]byte, 2*12)
+	binary.LittleEndian.PutUint32(strip[16:], math.Float32bits(float32(math.NaN())))
+
+	data := newTIFFBuilder(binary.LittleEndian).
+		add(tImageWidth, dtShort, 2).
+		add(tImageLength, dtShort, 1).
+		add(tBitsPerSample, dtShort, 32, 32, 32).
+		add(tPhotometricInterpretation, dtShort, pRGB).
+		add(tSamplesPerPixel, dtShort, 3).
+		strips(strip).
+		bytes()
+
+	assert.Error(t, Verify(bytes.NewReader(data)))
+}
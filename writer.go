@@ -0,0 +1,59 @@
+package tiff
+
+import (
+	"io"
+
+	"github.com/mdouchement/hdr"
+)
+
+//------------------------//
+// Writer                 //
+//------------------------//
+
+// A Predictor is the differencing of the samples applied before the compression,
+// which improves the compression ratio.
+type Predictor int
+
+// Supported predictors.
+const (
+	// PredictorNone writes the samples as is (default).
+	PredictorNone Predictor = iota
+	// PredictorHorizontal writes the difference between each sample and the same sample
+	// of the preceding pixel (Predictor 2), which suits the integer samples.
+	PredictorHorizontal
+	// PredictorFloatingPoint writes each row as byte planes, differenced across the row
+	// (Predictor 3), which suits the floating point samples.
+	PredictorFloatingPoint
+)
+
+// Options are the encoding parameters.
+type Options struct {
+	// Deflate enables the Deflate (zlib) compression of the strips or tiles.
+	Deflate bool
+	// Predictor is applied to the samples before the compression.
+	Predictor Predictor
+	// RowsPerStrip defines the number of rows per strip.
+	// When zero, the strips are about 8KB each.
+	RowsPerStrip int
+	// TileWidth and TileLength define the dimensions of the tiles, they must be multiples of 16.
+	// When set, the image is stored as tiles instead of strips.
+	TileWidth  int
+	TileLength int
+	// LogLuv writes the image as 32-bit SGI LogLuv, SGILog RLE compressed, instead of
+	// 32-bit floating point RGB. It excludes Deflate and Predictor.
+	LogLuv bool
+	// Stonits is the absolute luminance, in candelas per square meter, of a LogLuv sample of 1.
+	// The luminances of the image are divided by it and it is written as the Stonits tag,
+	// which the decoder multiplies back. When zero, the luminances are written as is.
+	Stonits float64
+}
+
+// Encode writes the image m to w as a 32-bit floating point RGB TIFF, or LogLuv per the options.
+// If opt is nil, the image is written uncompressed with the default strip layout.
+func Encode(w io.Writer, m hdr.Image, opt *Options) error {
+	e, err := newEncoder(m, opt)
+	if err != nil {
+		return err
+	}
+	return e.encode(w)
+}
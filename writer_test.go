@@ -0,0 +1,167 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/mdouchement/hdr"
+	"github.com/mdouchement/hdr/hdrcolor"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRGBImage(width, height int) *hdr.RGB {
+	m := hdr.NewRGB(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.SetRGB(x, y, hdrcolor.RGB{R: float64(x) + 0.5, G: float64(y) * 2, B: float64(x*y) / 4})
+		}
+	}
+	return m
+}
+
+func TestEncodeLayout(t *testing.T) {
+	m := testRGBImage(21, 19)
+
+	for name, opt := range map[string]*Options{
+		"default":         nil,
+		"strips":          {RowsPerStrip: 4},
+		"single strip":    {RowsPerStrip: 1000},
+		"tiles":           {TileWidth: 16, TileLength: 16},
+		"deflate":         {Deflate: true, RowsPerStrip: 5},
+		"deflate + tiles": {Deflate: true, Predictor: PredictorFloatingPoint, TileWidth: 16, TileLength: 32},
+		"horizontal":      {Deflate: true, Predictor: PredictorHorizontal, RowsPerStrip: 5},
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, Encode(&buf, m, opt), name)
+
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err, name)
+		if opt != nil && opt.RowsPerStrip > 0 {
+			assert.Equal(t, uint(minInt(opt.RowsPerStrip, 19)), d.firstVal(tRowsPerStrip), name)
+		}
+		if opt != nil && opt.Predictor != PredictorNone {
+			assert.Equal(t, map[Predictor]uint{PredictorHorizontal: prHorizontal, PredictorFloatingPoint: prFloatingPoint}[opt.Predictor], d.firstVal(tPredictor), name)
+		}
+		if opt != nil && opt.TileWidth > 0 {
+			assert.Equal(t, uint(opt.TileWidth), d.firstVal(tTileWidth), name)
+			assert.Equal(t, uint(opt.TileLength), d.firstVal(tTileLength), name)
+		}
+
+		decoded, err := Decode(&buf)
+		assert.NoError(t, err, name)
+		assert.Equal(t, m, decoded, name)
+	}
+}
+
+func TestEncodeInvalidTiles(t *testing.T) {
+	m := testRGBImage(4, 4)
+
+	for _, opt := range []*Options{
+		{TileWidth: -16, TileLength: 16},
+		{TileWidth: 16},
+		{TileWidth: 16, TileLength: 10},
+		{RowsPerStrip: -1},
+	} {
+		assert.Error(t, Encode(new(bytes.Buffer), m, opt))
+	}
+}
+
+func TestEncodeUnknownPredictor(t *testing.T) {
+	m := testRGBImage(4, 4)
+	assert.Error(t, Encode(new(bytes.Buffer), m, &Options{Predictor: PredictorFloatingPoint + 1}))
+	assert.Error(t, Encode(new(bytes.Buffer), m, &Options{Predictor: -1}))
+}
+
+func TestEncodeOffsetBeyond4GiB(t *testing.T) {
+	assert.NoError(t, checkOffset(math.MaxInt32))
+	if strconv.IntSize == 32 {
+		t.Skip("offsets beyond 4 GiB do not fit in an int")
+	}
+
+	limit := int64(math.MaxUint32)
+	assert.NoError(t, checkOffset(int(limit)))
+	assert.Equal(t, UnsupportedError("offset beyond 4 GiB, BigTIFF encoding"), checkOffset(int(limit+1)))
+
+	// The values of the IFD entries that do not fit in the entry are written beyond the limit.
+	e := &encoder{byteOrder: binary.LittleEndian}
+	entries := []ifdEntry{{tBitsPerSample, dtShort, []uint64{32, 32, 32}}}
+	assert.NoError(t, e.writeIFD(ioutil.Discard, int(limit)-32, entries))
+	assert.Error(t, e.writeIFD(ioutil.Discard, int(limit)-8, entries))
+}
+
+func TestEncodeLogLuv(t *testing.T) {
+	const width, height = 20, 18
+	m := hdr.NewXYZ(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.SetXYZ(x, y, hdrcolor.XYZ{X: 95 + float64(x), Y: 100 + float64(y)*10, Z: 108}) // Runs along the rows
+		}
+	}
+	m.SetXYZ(0, 0, hdrcolor.XYZ{}) // Black
+
+	for _, opt := range []*Options{
+		{LogLuv: true},
+		{LogLuv: true, Stonits: 200},
+		{LogLuv: true, Stonits: 0.5, TileWidth: 16, TileLength: 16},
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, Encode(&buf, m, opt))
+
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, uint(cSGILogRLE), d.compression)
+		if opt.Stonits != 0 {
+			assert.Equal(t, uint(dtDouble), d.features[tStonits].datatype)
+			assert.Equal(t, opt.Stonits, d.features[tStonits].double(0))
+		} else {
+			_, ok := d.features[tStonits]
+			assert.False(t, ok)
+		}
+
+		decoded, err := Decode(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, m.Bounds(), decoded.Bounds())
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				X, Y, Z, _ := m.HDRAt(x, y).HDRXYZA()
+				dX, dY, dZ, _ := decoded.(hdr.Image).HDRAt(x, y).HDRXYZA()
+				if Y == 0 {
+					assert.Equal(t, 0.0, dY)
+					continue
+				}
+				// The luminance is quantized to 1/256 of a stop, the chromaticity to 1/410.
+				assert.InDelta(t, Y, dY, 0.003*Y, "pixel (%d,%d)", x, y)
+				assert.InDelta(t, X/Y, dX/dY, 0.02, "pixel (%d,%d)", x, y)
+				assert.InDelta(t, Z/Y, dZ/dY, 0.02, "pixel (%d,%d)", x, y)
+			}
+		}
+	}
+
+	for _, opt := range []*Options{
+		{LogLuv: true, Deflate: true},
+		{LogLuv: true, Predictor: PredictorHorizontal},
+		{LogLuv: true, Stonits: -1},
+	} {
+		assert.Error(t, Encode(new(bytes.Buffer), m, opt))
+	}
+}
+
+func TestEncodeRLE(t *testing.T) {
+	src := make([]byte, 2*300)
+	for i := range src {
+		if i > 400 {
+			src[i] = byte(i / 7)
+		}
+	}
+	dst := encodeRLE(src, 2, 300, 1)
+	assert.Greater(t, len(src), len(dst))
+
+	decoded, err := unRLE(bytes.NewReader(dst), 2, 300, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, src, decoded)
+}